@@ -0,0 +1,100 @@
+// This package deletes athletes on behalf of an operator, i.e., when an athlete
+// asks to be removed by email.
+//
+// Usage:
+//
+//	account delete <athlete ID>
+//	account resume
+//	account list [pending]
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/account"
+	"github.com/nmiodice/personal-strava-heatmap/internal/backend"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s delete <athlete ID> | resume | list [pending]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	config := backend.GetConfig(ctx)
+	deps, err := backend.GetDependencies(ctx, config)
+	if err != nil {
+		log.Fatalf("Error configuring application dependencies: %+v", err)
+	}
+	accounts := deps.Account
+
+	switch os.Args[1] {
+	case "delete":
+		if len(os.Args) != 3 {
+			usage()
+		}
+
+		athleteID, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			usage()
+		}
+		deletion, err := accounts.Delete(ctx, athleteID, account.DeletionSourceAdmin)
+		if err != nil {
+			log.Fatalf("Error deleting athlete, run '%s resume' to retry: %+v", os.Args[0], err)
+		}
+		fmt.Printf(
+			"deleted athlete %d: purged data of %d activities and %d tiles\n",
+			athleteID, deletion.ActivitiesPurged, deletion.TilesPurged)
+
+	case "resume":
+		resumed, err := accounts.ResumeDeletions(ctx)
+		if err != nil {
+			log.Fatalf("Error resuming deletions, finished %d: %+v", resumed, err)
+		}
+		fmt.Printf("finished %d deletions\n", resumed)
+
+	case "list":
+		pendingOnly := false
+		if len(os.Args) == 3 && os.Args[2] == "pending" {
+			pendingOnly = true
+		} else if len(os.Args) != 2 {
+			usage()
+		}
+
+		deletions, err := accounts.List(ctx, pendingOnly)
+		if err != nil {
+			log.Fatalf("Error listing deletions: %+v", err)
+		}
+		for _, d := range deletions {
+			lastError := ""
+			if d.LastError != nil {
+				lastError = *d.LastError
+			}
+			fmt.Printf(
+				"%d\t%s\t%s\trevoked %s\tdata deleted %s\tcompleted %s\t%d activities\t%d tiles\t%d failures\t%s\n",
+				d.AthleteID, d.Source, d.RequestedAt.Format(time.RFC3339),
+				formatTime(d.RevokedAt), formatTime(d.DataDeletedAt), formatTime(d.CompletedAt),
+				d.ActivitiesPurged, d.TilesPurged, d.Failures, lastError)
+		}
+
+	default:
+		usage()
+	}
+}
@@ -17,12 +17,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nmiodice/personal-strava-heatmap/internal/backend"
 	"github.com/nmiodice/personal-strava-heatmap/internal/background/athlete"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/cleanup"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/keys"
 	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
 )
 
@@ -30,32 +33,56 @@ const (
 	tokenRefreshLockID        = 1
 	activityListRefreshLockID = 2
 	activityDownloadLockID    = 3
+	storageReconcileLockID    = 4
+	sessionCleanupLockID      = 5
+	keyRotationLockID         = 6
+	accountDeletionLockID     = 7
+	takeoutCleanupLockID      = 8
 )
 
-func configureRouter(config *backend.Config, routes *backend.HttpRoutes) *gin.Engine {
+func configureRouter(config *backend.Config, deps *backend.Dependencies, routes *backend.HttpRoutes) *gin.Engine {
 	router := gin.Default()
 
 	router.LoadHTMLGlob(config.TemplatePath + "/*")
 
-	router.GET("/", routes.IndexRoute)
-	router.GET("/index.html", routes.IndexRoute)
-	router.GET("/map.html", routes.MapRoute)
-	router.GET("/logout", routes.LogoutRoute)
-	router.GET("/tokenexchange", routes.TokenExchange)
-	router.GET("/processingstate", routes.MapProcessingStateRoute)
+	// static files are served without looking up the session
+	site := router.Group("", routes.SessionMiddleware)
+	site.GET("/", routes.IndexRoute)
+	site.GET("/index.html", routes.IndexRoute)
+	site.POST("/logout", routes.LogoutRoute)
+	site.GET("/tokenexchange", routes.TokenExchange)
+	site.GET(backend.WebhookRoute, routes.WebhookValidationRoute)
+	site.POST(backend.WebhookRoute, routes.WebhookEventRoute)
+	site.GET(backend.TakeoutDownloadRoute+"/:link", routes.TakeoutDownloadRoute)
+
+	athlete := site.Group("", routes.RequireSession)
+	athlete.GET("/map.html", routes.MapRoute)
+	athlete.POST("/logout/everywhere", routes.LogoutEverywhereRoute)
+	athlete.POST("/account/delete", routes.DeleteAccountRoute)
+	athlete.POST("/takeout", routes.RequestTakeoutRoute)
+	athlete.GET("/takeout", routes.TakeoutStatusRoute)
+	athlete.GET("/processingstate", routes.MapProcessingStateRoute)
+	athlete.POST("/rebuild", routes.RebuildMapRoute)
+	athlete.GET("/visibility", routes.GetVisibilityRoute)
+	athlete.POST("/visibility", routes.SetVisibilityRoute)
+	athlete.GET("/ratelimit", routes.RateLimitRoute)
 
 	sharedMapRoute := "/sharedmap"
-	router.GET("/share", routes.ShareMapLinkRoute(sharedMapRoute))
-	router.GET(sharedMapRoute+"/:mapid", routes.SharedMapRoute)
+	athlete.GET("/share", routes.ShareMapLinkRoute(sharedMapRoute))
+	site.GET(sharedMapRoute+"/:mapid", routes.SharedMapRoute)
+	site.GET("/tiles/:mapid/:z/:x/:y", routes.TileRoute)
 
 	router.Use(routes.StaticFileServer("/static"))
+	if deps.TileFileRoot != "" {
+		router.Use(routes.TileFileServer(backend.FilesystemTileRoute))
+	}
 
 	return router
 }
 
 func runHTTPServerForever(config *backend.Config, deps *backend.Dependencies) {
 	routes := backend.GetRoutes(config, deps)
-	router := configureRouter(config, routes)
+	router := configureRouter(config, deps, routes)
 
 	router.Run(fmt.Sprintf(":%d", config.HttpServer.Port))
 }
@@ -74,11 +101,52 @@ func triggerBackgroundJobs(ctx context.Context, config *backend.Config, deps *ba
 		deps.Map,
 		deps.State,
 		deps.MakeLockFunc(activityDownloadLockID)))
+
+	// remove tiles and activity data that are no longer referenced
+	processor.RunForever(ctx, cleanup.StorageReconcileConfig(
+		ctx,
+		deps.Strava,
+		deps.Map,
+		deps.MakeLockFunc(storageReconcileLockID)))
+
+	// forget expired sessions and login states
+	processor.RunForever(ctx, cleanup.SessionCleanupConfig(
+		ctx,
+		deps.Strava,
+		deps.Session,
+		deps.MakeLockFunc(sessionCleanupLockID)))
+
+	// encrypt tokens and activity data again after a key was rotated
+	processor.RunForever(ctx, keys.KeyRotationConfig(
+		ctx,
+		deps.Strava,
+		deps.MakeLockFunc(keyRotationLockID)))
+
+	// finish account deletions that failed part way through
+	processor.RunForever(ctx, cleanup.AccountDeletionConfig(
+		ctx,
+		deps.Account,
+		deps.MakeLockFunc(accountDeletionLockID)))
+
+	// remove data exports that expired
+	processor.RunForever(ctx, cleanup.TakeoutCleanupConfig(
+		ctx,
+		deps.Takeout,
+		deps.MakeLockFunc(takeoutCleanupLockID)))
 }
 
 func main() {
+	sandbox := flag.Bool("sandbox", false, "serve a fake Strava API with synthetic athletes and keep storage and queues local")
+	flag.Parse()
+
 	ctx := context.Background()
+	if *sandbox {
+		backend.UseSandbox()
+	}
 	config := backend.GetConfig(ctx)
+	if *sandbox {
+		backend.RunSandboxStrava(config)
+	}
 	deps, err := backend.GetDependencies(ctx, config)
 	if err != nil {
 		log.Fatalf("Error configuring application dependencies: %+v", err)
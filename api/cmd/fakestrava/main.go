@@ -0,0 +1,43 @@
+// This package serves a fake Strava API with synthetic athletes, so the
+// application can be developed and tested offline. Point STRAVA_API_URL and
+// STRAVA_AUTHORIZE_URL at it, or run the backend with --sandbox instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/fake"
+)
+
+func main() {
+	port := flag.Int("port", 8081, "port to serve the fake API on")
+	clientID := flag.String("client-id", "", "client ID that token requests must present; any is accepted if empty")
+	clientSecret := flag.String("client-secret", "", "client secret that token requests must present")
+	seed := flag.Int64("seed", 1, "seed used to generate athletes and activities")
+	athletes := flag.Int("athletes", 3, "number of athletes")
+	activities := flag.Int("activities", 40, "number of activities per athlete")
+	fifteenMinuteLimit := flag.Int("limit-15m", 600, "requests allowed per 15 minutes")
+	dailyLimit := flag.Int("limit-daily", 30000, "requests allowed per day")
+	readFifteenMinuteLimit := flag.Int("read-limit-15m", 300, "GET requests allowed per 15 minutes")
+	readDailyLimit := flag.Int("read-limit-daily", 15000, "GET requests allowed per day")
+	errorRate429 := flag.Float64("error-rate-429", 0, "fraction of API requests that fail with 429")
+	errorRate500 := flag.Float64("error-rate-500", 0, "fraction of API requests that fail with 500")
+	flag.Parse()
+
+	server := fake.NewServer(fake.Config{
+		ClientID:               *clientID,
+		ClientSecret:           *clientSecret,
+		Seed:                   *seed,
+		Athletes:               *athletes,
+		Activities:             *activities,
+		FifteenMinuteLimit:     *fifteenMinuteLimit,
+		DailyLimit:             *dailyLimit,
+		ReadFifteenMinuteLimit: *readFifteenMinuteLimit,
+		ReadDailyLimit:         *readDailyLimit,
+		ErrorRate429:           *errorRate429,
+		ErrorRate500:           *errorRate500,
+	})
+	log.Fatal(server.ListenAndServe(fmt.Sprintf(":%d", *port)))
+}
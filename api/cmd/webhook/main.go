@@ -0,0 +1,108 @@
+// This package manages the Strava webhook subscription of the application.
+//
+// Usage:
+//
+//	webhook create <backend base URL>
+//	webhook list
+//	webhook delete <subscription ID>
+//	webhook record <subscription ID>
+//
+// Events are only accepted from subscriptions created here. Use record to
+// accept events of a subscription created before subscriptions were recorded.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/backend"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s create <backend base URL> | list | delete <subscription ID> | record <subscription ID>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	ctx := context.Background()
+	config := backend.GetConfig(ctx)
+	if config.Strava.WebhookVerifyToken == "" {
+		log.Fatal("STRAVA_WEBHOOK_VERIFY_TOKEN must be set")
+	}
+
+	deps, err := backend.GetDependencies(ctx, config)
+	if err != nil {
+		log.Fatalf("Error configuring application dependencies: %+v", err)
+	}
+	subscriptions := deps.Strava.Subscription
+
+	switch os.Args[1] {
+	case "create":
+		if len(os.Args) != 3 {
+			usage()
+		}
+
+		callbackURL := strings.TrimRight(os.Args[2], "/") + backend.WebhookRoute
+		subscription, err := subscriptions.Create(ctx, callbackURL)
+		if err != nil {
+			log.Fatalf("Error creating subscription: %+v", err)
+		}
+		fmt.Printf("created subscription %d for %s\n", subscription.ID, callbackURL)
+
+	case "list":
+		list, err := subscriptions.List(ctx)
+		if err != nil {
+			log.Fatalf("Error listing subscriptions: %+v", err)
+		}
+		for _, subscription := range list {
+			known, err := subscriptions.IsKnown(ctx, subscription.ID)
+			if err != nil {
+				log.Fatalf("Error listing subscriptions: %+v", err)
+			}
+			recorded := "not recorded, events are dropped"
+			if known {
+				recorded = "recorded"
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", subscription.ID, subscription.CallbackURL, subscription.CreatedAt, recorded)
+		}
+
+	case "delete":
+		if len(os.Args) != 3 {
+			usage()
+		}
+
+		id, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			usage()
+		}
+		if err := subscriptions.Delete(ctx, id); err != nil {
+			log.Fatalf("Error deleting subscription: %+v", err)
+		}
+		fmt.Printf("deleted subscription %d\n", id)
+
+	case "record":
+		if len(os.Args) != 3 {
+			usage()
+		}
+
+		id, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			usage()
+		}
+		if err := subscriptions.Record(ctx, id); err != nil {
+			log.Fatalf("Error recording subscription: %+v", err)
+		}
+		fmt.Printf("recorded subscription %d\n", id)
+
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,70 @@
+// This package renders map tiles for batches sent through the work queue.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/backend"
+	"github.com/nmiodice/personal-strava-heatmap/internal/concurrency"
+	"github.com/nmiodice/personal-strava-heatmap/internal/queue"
+)
+
+func processMessage(ctx context.Context, config *backend.Config, deps *backend.Dependencies, msg queue.Message) error {
+	// the queue dead letters the message if this attempt fails
+	lastAttempt := msg.Attempts >= config.Queue.MaxAttempts
+	err := deps.Map.ProcessTileBatchMessage(ctx, msg.ID, msg.Body, lastAttempt)
+	if err != nil {
+		log.Printf("failed to process message '%s' (attempt %d): %+v", msg.ID, msg.Attempts, err)
+		return deps.Queue.Fail(ctx, msg, err)
+	}
+
+	return deps.Queue.Complete(ctx, msg)
+}
+
+func runWorkerForever(ctx context.Context, config *backend.Config, deps *backend.Dependencies) {
+	sem := concurrency.NewSemaphore(config.Worker.Concurrency)
+
+	for {
+		msgs, err := deps.Queue.Dequeue(ctx, config.Worker.Concurrency)
+		if err != nil {
+			log.Printf("error receiving messages: %+v", err)
+		}
+
+		if len(msgs) == 0 {
+			time.Sleep(config.Worker.PollInterval)
+			continue
+		}
+
+		funcs := make([](func() error), len(msgs))
+		for i, msg := range msgs {
+			theMsg := msg
+			funcs[i] = func() error {
+				return processMessage(ctx, config, deps, theMsg)
+			}
+		}
+
+		if err := sem.WithRateLimit(funcs, false); err != nil {
+			log.Printf("error acknowledging messages: %+v", err)
+		}
+	}
+}
+
+func main() {
+	sandbox := flag.Bool("sandbox", false, "use the same local storage and queues as a sandboxed backend")
+	flag.Parse()
+
+	ctx := context.Background()
+	if *sandbox {
+		backend.UseSandbox()
+	}
+	config := backend.GetConfig(ctx)
+	deps, err := backend.GetDependencies(ctx, config)
+	if err != nil {
+		log.Fatalf("Error configuring application dependencies: %+v", err)
+	}
+
+	runWorkerForever(ctx, config, deps)
+}
@@ -0,0 +1,364 @@
+// Package account deletes the data of athletes who leave, either by asking to
+// or by deauthorizing the application on Strava
+package account
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/session"
+	"github.com/nmiodice/personal-strava-heatmap/internal/state"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+	"github.com/nmiodice/personal-strava-heatmap/internal/takeout"
+)
+
+// DeletionSource is what asked for a deletion
+type DeletionSource string
+
+const (
+	// the athlete, from the website
+	DeletionSourceAthlete DeletionSource = "athlete"
+	// Strava, after the athlete deauthorized the application
+	DeletionSourceWebhook DeletionSource = "webhook"
+	// an operator, from the command line
+	DeletionSourceAdmin DeletionSource = "admin"
+)
+
+// Deletion tracks the deletion of the data of an athlete. Each step records
+// when it finished, so a deletion that failed part way through resumes where
+// it stopped
+type Deletion struct {
+	ID        int
+	AthleteID int
+	// map of the athlete when the deletion was requested. Tiles are named after
+	// it, and it is forgotten along with the rest of their data
+	MapID       *string
+	Source      DeletionSource
+	RequestedAt time.Time
+	// when the application was deauthorized at Strava
+	RevokedAt *time.Time
+	// when the athlete was removed from the database
+	DataDeletedAt *time.Time
+	// when the stored activity data and tiles were removed
+	CompletedAt      *time.Time
+	ActivitiesPurged int
+	TilesPurged      int
+	// failed attempts, and the error of the last one
+	Failures  int
+	LastError *string
+}
+
+type AccountService struct {
+	db         *database.DB
+	stravaSvc  *strava.StravaService
+	mapSvc     *maps.MapService
+	sessionSvc *session.SessionService
+	stateSvc   state.StateService
+	takeoutSvc *takeout.TakeoutService
+}
+
+func NewAccountService(db *database.DB, stravaSvc *strava.StravaService, mapSvc *maps.MapService, sessionSvc *session.SessionService, stateSvc state.StateService, takeoutSvc *takeout.TakeoutService) *AccountService {
+	return &AccountService{
+		db:         db,
+		stravaSvc:  stravaSvc,
+		mapSvc:     mapSvc,
+		sessionSvc: sessionSvc,
+		stateSvc:   stateSvc,
+		takeoutSvc: takeoutSvc,
+	}
+}
+
+// Delete removes every trace of an athlete except the audit record of the
+// deletion. It can be called again for an athlete whose deletion is in
+// progress, which resumes it. If it fails, the deletion is recorded and
+// finished later by ResumeDeletions
+func (a AccountService) Delete(ctx context.Context, athleteID int, source DeletionSource) (*Deletion, error) {
+	deletion, err := a.request(ctx, athleteID, source)
+	if err != nil {
+		return nil, err
+	}
+	return deletion, a.resume(ctx, deletion)
+}
+
+// ResumeDeletions finishes deletions that failed part way through
+func (a AccountService) ResumeDeletions(ctx context.Context) (int, error) {
+	pending, err := a.List(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+
+	var errors *multierror.Error
+	resumed := 0
+	for _, deletion := range pending {
+		if err := a.resume(ctx, deletion); err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		resumed++
+	}
+	return resumed, errors.ErrorOrNil()
+}
+
+// List returns deletions, newest first. Only deletions in progress are
+// returned if pendingOnly is set
+func (a AccountService) List(ctx context.Context, pendingOnly bool) ([]*Deletion, error) {
+	deletions := []*Deletion{}
+	err := a.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, listDeletionsSQL, pendingOnly)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			deletion, err := scanDeletion(rows)
+			if err != nil {
+				return err
+			}
+			deletions = append(deletions, deletion)
+		}
+
+		return rows.Err()
+	})
+	return deletions, err
+}
+
+// request records a deletion, or returns the one in progress for the athlete
+func (a AccountService) request(ctx context.Context, athleteID int, source DeletionSource) (*Deletion, error) {
+	mapID, err := a.stravaSvc.Athlete.GetMapIDForAthlete(ctx, athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletion *Deletion
+	err = a.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, insertDeletionSQL, athleteID, mapID, string(source))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			log.Printf("deletion of athlete '%d' requested by %s", athleteID, source)
+		}
+
+		deletion, err = scanDeletion(tx.QueryRow(ctx, getPendingDeletionSQL, athleteID))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("recording deletion of athlete '%d': %w", athleteID, err)
+	}
+	return deletion, nil
+}
+
+// resume runs the steps of a deletion that have not finished yet. The tokens
+// of the athlete are revoked first, while they are still known. The database
+// is cleared next, which stops the athlete from being synced, and stored data
+// is purged last. Every step can be repeated
+func (a AccountService) resume(ctx context.Context, deletion *Deletion) error {
+	err := a.runSteps(ctx, deletion)
+	if err != nil {
+		if recordErr := a.recordFailure(ctx, deletion, err); recordErr != nil {
+			log.Printf("error recording failed deletion of athlete '%d': %+v", deletion.AthleteID, recordErr)
+		}
+		return fmt.Errorf("deleting athlete '%d': %w", deletion.AthleteID, err)
+	}
+	return nil
+}
+
+func (a AccountService) runSteps(ctx context.Context, deletion *Deletion) error {
+	// the athlete is logged out everywhere right away, even if the deletion
+	// does not finish yet
+	if deletion.DataDeletedAt == nil {
+		if _, err := a.sessionSvc.DeleteForAthlete(ctx, deletion.AthleteID); err != nil {
+			return err
+		}
+	}
+
+	if deletion.RevokedAt == nil {
+		// Strava already revoked the tokens of athletes who deauthorized
+		if deletion.Source != DeletionSourceWebhook {
+			if err := a.stravaSvc.Auth.RevokeTokensForAthlete(ctx, deletion.AthleteID); err != nil {
+				return err
+			}
+		}
+		if err := a.markStep(ctx, deletion.ID, markRevokedSQL); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		deletion.RevokedAt = &now
+	}
+
+	if deletion.DataDeletedAt == nil {
+		if err := a.deleteData(ctx, deletion); err != nil {
+			return err
+		}
+		if err := a.markStep(ctx, deletion.ID, markDataDeletedSQL); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		deletion.DataDeletedAt = &now
+	}
+
+	if deletion.CompletedAt == nil {
+		if err := a.purgeStorage(ctx, deletion); err != nil {
+			return err
+		}
+		err := a.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, markCompletedSQL, deletion.ID, deletion.ActivitiesPurged, deletion.TilesPurged)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		deletion.CompletedAt = &now
+		log.Printf(
+			"deleted athlete '%d': purged data of '%d' activities and '%d' tiles",
+			deletion.AthleteID, deletion.ActivitiesPurged, deletion.TilesPurged)
+	}
+
+	return nil
+}
+
+// deleteData forgets the athlete in the database. Their tokens go first, which
+// stops their activities from being synced
+func (a AccountService) deleteData(ctx context.Context, deletion *Deletion) error {
+	if err := a.stravaSvc.Auth.DeleteTokensForAthlete(ctx, deletion.AthleteID); err != nil {
+		return err
+	}
+	if deletion.MapID != nil {
+		if err := a.mapSvc.DeleteMap(ctx, *deletion.MapID); err != nil {
+			return err
+		}
+	}
+	if err := a.stravaSvc.Athlete.DeleteAthleteData(ctx, deletion.AthleteID); err != nil {
+		return err
+	}
+	return a.stateSvc.DeleteState(ctx, deletion.AthleteID)
+}
+
+// purgeStorage removes stored activity data, tiles and exports. Counts
+// accumulate over attempts
+func (a AccountService) purgeStorage(ctx context.Context, deletion *Deletion) error {
+	if _, err := a.takeoutSvc.DeleteForAthlete(ctx, deletion.AthleteID); err != nil {
+		return err
+	}
+
+	purged, err := a.stravaSvc.Athlete.DeleteActivityDataForAthlete(ctx, deletion.AthleteID)
+	deletion.ActivitiesPurged += purged
+	if err != nil {
+		return err
+	}
+
+	if deletion.MapID != nil {
+		purged, err := a.mapSvc.DeleteTilesForMap(ctx, *deletion.MapID)
+		deletion.TilesPurged += purged
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a AccountService) markStep(ctx context.Context, id int, query string) error {
+	return a.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, id)
+		return err
+	})
+}
+
+// recordFailure also records what was purged before the failure. The count of
+// failures is kept by the database, and read back into the deletion
+func (a AccountService) recordFailure(ctx context.Context, deletion *Deletion, failure error) error {
+	return a.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, recordFailureSQL, deletion.ID, failure.Error(), deletion.ActivitiesPurged, deletion.TilesPurged)
+		return row.Scan(&deletion.Failures)
+	})
+}
+
+func scanDeletion(row pgx.Row) (*Deletion, error) {
+	deletion := &Deletion{}
+	source := ""
+	err := row.Scan(
+		&deletion.ID, &deletion.AthleteID, &deletion.MapID, &source,
+		&deletion.RequestedAt, &deletion.RevokedAt, &deletion.DataDeletedAt, &deletion.CompletedAt,
+		&deletion.ActivitiesPurged, &deletion.TilesPurged, &deletion.Failures, &deletion.LastError)
+	deletion.Source = DeletionSource(source)
+	return deletion, err
+}
+
+var insertDeletionSQL = `
+INSERT INTO
+	AccountDeletion
+	(athlete_id, map_id, source)
+VALUES
+	($1, $2, $3)
+ON CONFLICT
+	(athlete_id) WHERE completed_at IS NULL
+	DO NOTHING
+`
+
+var deletionColumnsSQL = `
+	id, athlete_id, map_id::TEXT, source,
+	requested_at, revoked_at, data_deleted_at, completed_at,
+	activities_purged, tiles_purged, failures, last_error
+`
+
+var getPendingDeletionSQL = `
+SELECT` + deletionColumnsSQL + `FROM
+	AccountDeletion
+WHERE
+	athlete_id = $1 AND completed_at IS NULL
+`
+
+var listDeletionsSQL = `
+SELECT` + deletionColumnsSQL + `FROM
+	AccountDeletion
+WHERE
+	NOT $1 OR completed_at IS NULL
+ORDER BY
+	requested_at DESC
+`
+
+var markRevokedSQL = `
+UPDATE
+	AccountDeletion
+SET
+	revoked_at = NOW()
+WHERE
+	id = $1
+`
+
+var markDataDeletedSQL = `
+UPDATE
+	AccountDeletion
+SET
+	data_deleted_at = NOW()
+WHERE
+	id = $1
+`
+
+var markCompletedSQL = `
+UPDATE
+	AccountDeletion
+SET
+	completed_at = NOW(), activities_purged = $2, tiles_purged = $3, last_error = NULL
+WHERE
+	id = $1
+`
+
+var recordFailureSQL = `
+UPDATE
+	AccountDeletion
+SET
+	failures = failures + 1, last_error = $2, activities_purged = $3, tiles_purged = $4
+WHERE
+	id = $1
+RETURNING
+	failures
+`
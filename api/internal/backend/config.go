@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/sethvargo/go-envconfig"
@@ -17,10 +20,45 @@ type HttpClientConfig struct {
 	Timeout time.Duration `env:"HTTP_CLIENT_TIMEOUT_SECONDS,default=10s"`
 }
 
+// route that receives Strava webhook events. The callback URL of the webhook
+// subscription must point at it
+const WebhookRoute = "/webhook"
+
 type StravaAppConfig struct {
 	ClientID         string `env:"STRAVA_CLIENT_ID,required"`
 	ClientSecret     string `env:"STRAVA_CLIENT_SECRET,required"`
 	ConcurrencyLimit int    `env:"STRAVA_MAX_DOWNLOAD_WORKERS,default=4"`
+	// how often every activity of an athlete is listed, rather than only new ones
+	FullSyncInterval time.Duration `env:"STRAVA_FULL_SYNC_INTERVAL,default=168h"`
+	// echoed back by Strava when validating the webhook callback. Webhooks are
+	// disabled when empty
+	WebhookVerifyToken string `env:"STRAVA_WEBHOOK_VERIFY_TOKEN"`
+	// root of the Strava API, and the page athletes are sent to when logging in.
+	// Both point at the fake Strava API in sandbox mode
+	APIURL       string `env:"STRAVA_API_URL,default=https://www.strava.com/api/v3/"`
+	AuthorizeURL string `env:"STRAVA_AUTHORIZE_URL,default=https://www.strava.com/oauth/authorize"`
+	// signs the state of login requests. Must be the same on every instance
+	OAuthStateSecret string `env:"STRAVA_OAUTH_STATE_SECRET"`
+	// rate limits of the application, until Strava reports them in a response
+	RateLimit15Min     int `env:"STRAVA_RATE_LIMIT_15M,default=200"`
+	RateLimitDaily     int `env:"STRAVA_RATE_LIMIT_DAILY,default=2000"`
+	ReadRateLimit15Min int `env:"STRAVA_READ_RATE_LIMIT_15M,default=100"`
+	ReadRateLimitDaily int `env:"STRAVA_READ_RATE_LIMIT_DAILY,default=1000"`
+	// fraction of every rate limit window that background syncs leave for
+	// athletes who are waiting on their map
+	InteractiveReserve float64 `env:"STRAVA_INTERACTIVE_RESERVE,default=0.2"`
+}
+
+// OAuthRootURL is where the OAuth endpoints of Strava are served, i.e., the
+// page athletes log in on without its last path element
+func (sc StravaAppConfig) OAuthRootURL() string {
+	u, err := url.Parse(sc.AuthorizeURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	u.Path = path.Dir(u.Path) + "/"
+	u.RawQuery = ""
+	return u.String()
 }
 
 type DatabaseConfig struct {
@@ -32,19 +70,87 @@ type DatabaseConfig struct {
 	SSLMode string `env:"DB_SSLMODE,required"`
 }
 
+const (
+	StorageBackendAzure      = "azure"
+	StorageBackendFilesystem = "filesystem"
+	StorageBackendS3         = "s3"
+
+	// URL prefix used to serve tiles when they are stored on the local filesystem
+	FilesystemTileRoute = "/maptiles"
+)
+
 type StorageConfig struct {
+	Backend             string `env:"STORAGE_BACKEND,default=azure"`
 	ContainerName       string `env:"STORAGE_CONTAINER_NAME,required"`
-	AccountName         string `env:"STORAGE_ACCOUNT_NAME,required"`
-	AccountKey          string `env:"STORAGE_ACCOUNT_KEY,required"`
+	AccountName         string `env:"STORAGE_ACCOUNT_NAME"`
+	AccountKey          string `env:"STORAGE_ACCOUNT_KEY"`
+	FilesystemRoot      string `env:"STORAGE_FILESYSTEM_ROOT,default=./data"`
 	ConcurrencyLimit    int    `env:"STORAGE_MAX_WORKERS,default=16"`
 	UploadContainerName string `env:"UPLOAD_STORAGE_CONTAINER_NAME,required"`
+	S3                  S3Config
+}
+
+type S3Config struct {
+	Endpoint        string `env:"S3_ENDPOINT"`
+	PublicEndpoint  string `env:"S3_PUBLIC_ENDPOINT"`
+	Region          string `env:"S3_REGION,default=us-east-1"`
+	AccessKeyID     string `env:"S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY"`
+	UsePathStyle    bool   `env:"S3_USE_PATH_STYLE,default=false"`
 }
 
+// BucketURL is the URL that objects in a bucket can be publicly fetched from.
+// The public endpoint is used if configured because the API endpoint may only
+// be reachable from within the deployment (i.e., a docker network hostname)
+func (s3c S3Config) BucketURL(bucket string) string {
+	endpoint := s3c.PublicEndpoint
+	if endpoint == "" {
+		endpoint = s3c.Endpoint
+	}
+
+	if endpoint == "" {
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, s3c.Region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("%s/%s/", strings.TrimRight(endpoint, "/"), bucket)
+	}
+
+	if s3c.UsePathStyle {
+		u.Path = path.Join(u.Path, bucket) + "/"
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = strings.TrimRight(u.Path, "/") + "/"
+	}
+	return u.String()
+}
+
+// TileEndpoint is the URL prefix that map tiles can be fetched from
+func (sc StorageConfig) TileEndpoint() string {
+	switch sc.Backend {
+	case StorageBackendFilesystem:
+		return FilesystemTileRoute + "/"
+	case StorageBackendS3:
+		return sc.S3.BucketURL(sc.UploadContainerName)
+	default:
+		return fmt.Sprintf("https://%s.blob.core.windows.net/%s/", sc.AccountName, sc.UploadContainerName)
+	}
+}
+
+const (
+	QueueBackendAzure    = "azure"
+	QueueBackendPostgres = "postgres"
+)
+
 type QueueConfig struct {
-	QueueName   string `env:"STORAGE_QUEUE_NAME,required"`
-	AccountName string `env:"STORAGE_ACCOUNT_NAME,required"`
-	AccountKey  string `env:"STORAGE_ACCOUNT_KEY,required"`
-	BatchSize   int    `env:"QUEUE_BATCH_SIZE,default=250"`
+	Backend           string        `env:"QUEUE_BACKEND,default=azure"`
+	QueueName         string        `env:"STORAGE_QUEUE_NAME,default=job-queue"`
+	AccountName       string        `env:"STORAGE_ACCOUNT_NAME"`
+	AccountKey        string        `env:"STORAGE_ACCOUNT_KEY"`
+	BatchSize         int           `env:"QUEUE_BATCH_SIZE,default=250"`
+	VisibilityTimeout time.Duration `env:"QUEUE_VISIBILITY_TIMEOUT,default=10m"`
+	MaxAttempts       int           `env:"QUEUE_MAX_ATTEMPTS,default=5"`
 }
 
 func (dbc DatabaseConfig) ConnectionString() string {
@@ -60,9 +166,61 @@ func (dbc DatabaseConfig) ConnectionString() string {
 }
 
 type MapConfig struct {
-	MinTileZoom int    `env:"MIN_TILE_ZOOM,default=2"`
-	MaxTileZoom int    `env:"MAX_TILE_ZOOM,default=20"`
-	MapsAPIKey  string `env:"GOOGLE_MAPS_API_KEY,required"`
+	MinTileZoom int      `env:"MIN_TILE_ZOOM,default=2"`
+	MaxTileZoom int      `env:"MAX_TILE_ZOOM,default=20"`
+	MapsAPIKey  string   `env:"GOOGLE_MAPS_API_KEY,required"`
+	ColorRamp   string   `env:"MAP_COLOR_RAMP,default=hot"`
+	ColorScale  string   `env:"MAP_COLOR_SCALE,default=log"`
+	TileSizes   []int    `env:"MAP_TILE_SIZES,default=256"`
+	TileFormats []string `env:"MAP_TILE_FORMATS,default=png"`
+	// tiles at or above this zoom are rendered on demand. 0 disables this
+	LazyTileMinZoom int `env:"MAP_LAZY_TILE_MIN_ZOOM,default=0"`
+	// one of: direct, pyramid
+	RenderMode string `env:"MAP_RENDER_MODE,default=direct"`
+}
+
+// SessionConfig configures the login sessions of athletes
+type SessionConfig struct {
+	// sessions expire once they are not used for this long
+	TTL time.Duration `env:"SESSION_TTL,default=720h"`
+	// how often the expiry of a session in use is pushed back
+	RenewAfter time.Duration `env:"SESSION_RENEW_AFTER,default=24h"`
+	// lets browsers send the session cookie over plain HTTP. Only meant for
+	// running locally
+	InsecureCookie bool `env:"SESSION_INSECURE_COOKIE,default=false"`
+}
+
+// EncryptionConfig configures the keys that encrypt tokens and activity data.
+// Keys are 'id:base64 key' pairs of 32 byte keys, and the first key encrypts
+// new values. Nothing is encrypted if no keys are configured
+type EncryptionConfig struct {
+	// comma separated keys
+	Keys string `env:"ENCRYPTION_KEYS"`
+	// file with one key per line, read after ENCRYPTION_KEYS
+	KeyFile string `env:"ENCRYPTION_KEY_FILE"`
+}
+
+// TakeoutConfig configures the exports athletes download their data with
+type TakeoutConfig struct {
+	// how long an export can be downloaded after it is built
+	TTL time.Duration `env:"TAKEOUT_TTL,default=24h"`
+	// signs download links. Must be the same on every instance
+	LinkSecret string `env:"TAKEOUT_LINK_SECRET"`
+}
+
+// SandboxConfig configures the fake Strava API served in sandbox mode
+type SandboxConfig struct {
+	Port         int     `env:"SANDBOX_STRAVA_PORT,default=8081"`
+	Athletes     int     `env:"SANDBOX_ATHLETES,default=3"`
+	Activities   int     `env:"SANDBOX_ACTIVITIES,default=40"`
+	Seed         int64   `env:"SANDBOX_SEED,default=1"`
+	ErrorRate429 float64 `env:"SANDBOX_ERROR_RATE_429,default=0"`
+	ErrorRate500 float64 `env:"SANDBOX_ERROR_RATE_500,default=0"`
+}
+
+type WorkerConfig struct {
+	Concurrency  int           `env:"WORKER_CONCURRENCY,default=2"`
+	PollInterval time.Duration `env:"WORKER_POLL_INTERVAL,default=5s"`
 }
 
 type Config struct {
@@ -73,6 +231,11 @@ type Config struct {
 	Queue          QueueConfig
 	Strava         StravaAppConfig
 	Map            MapConfig
+	Worker         WorkerConfig
+	Session        SessionConfig
+	Encryption     EncryptionConfig
+	Takeout        TakeoutConfig
+	Sandbox        SandboxConfig
 	TemplatePath   string `env:"TEMPLATE_PATH,default=./templates"`
 	StaticFileRoot string `env:"STATIC_FILE_ROOT,default=./static"`
 }
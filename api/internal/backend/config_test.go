@@ -0,0 +1,30 @@
+package backend
+
+import "testing"
+
+func TestBucketURL(t *testing.T) {
+	cases := []struct {
+		name   string
+		config S3Config
+		want   string
+	}{
+		{"aws", S3Config{Region: "eu-west-1"}, "https://tiles.s3.eu-west-1.amazonaws.com/"},
+		{"virtual hosted", S3Config{Endpoint: "https://s3.example.com"}, "https://tiles.s3.example.com/"},
+		{"path style", S3Config{Endpoint: "http://minio:9000", UsePathStyle: true}, "http://minio:9000/tiles/"},
+		{"path style with a path", S3Config{Endpoint: "https://example.com/s3/", UsePathStyle: true}, "https://example.com/s3/tiles/"},
+		{
+			"public endpoint",
+			S3Config{Endpoint: "http://minio:9000", PublicEndpoint: "https://files.example.com", UsePathStyle: true},
+			"https://files.example.com/tiles/",
+		},
+		{"endpoint without a host", S3Config{Endpoint: "/s3/"}, "/s3/tiles/"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.config.BucketURL("tiles"); got != c.want {
+				t.Errorf("BucketURL() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
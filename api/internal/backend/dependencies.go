@@ -2,15 +2,20 @@ package backend
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/nmiodice/personal-strava-heatmap/internal/account"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/encryption"
 	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
 	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
 	"github.com/nmiodice/personal-strava-heatmap/internal/queue"
+	"github.com/nmiodice/personal-strava-heatmap/internal/session"
 	"github.com/nmiodice/personal-strava-heatmap/internal/state"
 	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+	"github.com/nmiodice/personal-strava-heatmap/internal/takeout"
 )
 
 type Dependencies struct {
@@ -18,6 +23,50 @@ type Dependencies struct {
 	Strava       *strava.StravaService
 	Map          *maps.MapService
 	State        state.StateService
+	Queue        queue.QueueConsumer
+	Session      *session.SessionService
+	Account      *account.AccountService
+	Takeout      *takeout.TakeoutService
+
+	// set when tiles are stored on the local filesystem and must be served by
+	// this process
+	TileFileRoot string
+}
+
+func newQueue(ctx context.Context, config QueueConfig, db *database.DB) (queue.Queue, error) {
+	switch config.Backend {
+	case QueueBackendAzure:
+		if config.AccountName == "" || config.AccountKey == "" {
+			return nil, fmt.Errorf("queue backend '%s' requires STORAGE_ACCOUNT_NAME and STORAGE_ACCOUNT_KEY", config.Backend)
+		}
+		return queue.NewAzureStorageQueue(ctx, config.QueueName, config.AccountName, config.AccountKey, config.VisibilityTimeout, config.MaxAttempts)
+	case QueueBackendPostgres:
+		return queue.NewPostgresQueue(db, config.QueueName, config.VisibilityTimeout, config.MaxAttempts), nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend '%s'", config.Backend)
+	}
+}
+
+func newBlobstore(ctx context.Context, config StorageConfig, containerName string) (storage.Blobstore, error) {
+	switch config.Backend {
+	case StorageBackendAzure:
+		if config.AccountName == "" || config.AccountKey == "" {
+			return nil, fmt.Errorf("storage backend '%s' requires STORAGE_ACCOUNT_NAME and STORAGE_ACCOUNT_KEY", config.Backend)
+		}
+		return storage.NewAzureBlobstore(ctx, containerName, config.AccountName, config.AccountKey)
+	case StorageBackendFilesystem:
+		return storage.NewFilesystemBlobstore(ctx, containerName, config.FilesystemRoot)
+	case StorageBackendS3:
+		return storage.NewS3Blobstore(ctx, containerName, storage.S3Options{
+			Endpoint:        config.S3.Endpoint,
+			Region:          config.S3.Region,
+			AccessKeyID:     config.S3.AccessKeyID,
+			SecretAccessKey: config.S3.SecretAccessKey,
+			UsePathStyle:    config.S3.UsePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", config.Backend)
+	}
 }
 
 func GetDependencies(ctx context.Context, config *Config) (*Dependencies, error) {
@@ -26,11 +75,20 @@ func GetDependencies(ctx context.Context, config *Config) (*Dependencies, error)
 		return nil, err
 	}
 
-	storageService, err := storage.NewAzureBlobstore(
-		ctx,
-		config.Storage.ContainerName,
-		config.Storage.AccountName,
-		config.Storage.AccountKey)
+	keyring, err := encryption.LoadKeyring(config.Encryption.Keys, config.Encryption.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// activity data is encrypted. Tiles are not, because they are served to
+	// anyone with the link to a map
+	activityStorageService, err := newBlobstore(ctx, config.Storage, config.Storage.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+	storageService := storage.NewEncryptedBlobstore(activityStorageService, keyring)
+
+	tileStorageService, err := newBlobstore(ctx, config.Storage, config.Storage.UploadContainerName)
 	if err != nil {
 		return nil, err
 	}
@@ -39,43 +97,93 @@ func GetDependencies(ctx context.Context, config *Config) (*Dependencies, error)
 		Timeout:      config.HttpClient.Timeout,
 		ClientID:     config.Strava.ClientID,
 		ClientSecret: config.Strava.ClientSecret,
-		DB:           db,
+		APIRootURL:   config.Strava.APIURL,
+		OAuthRootURL: config.Strava.OAuthRootURL(),
+		RateLimits: sdk.RateLimits{
+			FifteenMinute:     config.Strava.RateLimit15Min,
+			Daily:             config.Strava.RateLimitDaily,
+			ReadFifteenMinute: config.Strava.ReadRateLimit15Min,
+			ReadDaily:         config.Strava.ReadRateLimitDaily,
+		},
+		InteractiveReserve: config.Strava.InteractiveReserve,
+		DB:                 db,
 	})
-	athleteSvc := strava.NewAthleteService(stravaSDK, db, config.Strava.ConcurrencyLimit, storageService)
+	oauthSvc, err := strava.NewOAuthService(stravaSDK, db, config.Strava.OAuthStateSecret, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	athleteSvc := strava.NewAthleteService(stravaSDK, db, config.Strava.ConcurrencyLimit, config.Strava.FullSyncInterval, storageService, keyring)
 
 	stravaService := &strava.StravaService{
-		Auth:    strava.NewOAuthService(stravaSDK, db),
-		Athlete: athleteSvc,
+		Auth:         oauthSvc,
+		Athlete:      athleteSvc,
+		Subscription: strava.NewSubscriptionService(stravaSDK, db, config.Strava.WebhookVerifyToken),
+		RateLimit:    strava.NewRateLimitService(stravaSDK),
 	}
 
-	queueService, err := queue.NewAzureStorageQueue(
-		ctx,
-		config.Queue.QueueName,
-		config.Queue.AccountName,
-		config.Queue.AccountKey)
+	queueService, err := newQueue(ctx, config.Queue, db)
+	if err != nil {
+		return nil, err
+	}
 
+	tileStyle, err := maps.NewTileStyle(config.Map.ColorRamp, config.Map.ColorScale)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := maps.ValidateTileSizes(config.Map.TileSizes); err != nil {
+		return nil, err
+	}
+	if err := maps.ValidateTileFormats(config.Map.TileFormats); err != nil {
+		return nil, err
+	}
+	if err := maps.ValidateRenderMode(config.Map.RenderMode); err != nil {
+		return nil, err
+	}
+
 	mapSvc := maps.NewMapService(
 		stravaService,
 		storageService,
+		tileStorageService,
 		queueService,
 		db,
 		config.Map.MinTileZoom,
 		config.Map.MaxTileZoom,
 		config.Queue.BatchSize,
 		config.Storage.ConcurrencyLimit,
+		tileStyle,
+		config.Map.TileSizes,
+		config.Map.TileFormats,
+		config.Map.LazyTileMinZoom,
+		config.Map.RenderMode,
 	)
 
+	stateSvc := state.NewStateService(db)
+	sessionSvc := session.NewSessionService(db, config.Session.TTL, config.Session.RenewAfter)
+
+	// exports hold activity data, so they are kept in the encrypted activity
+	// storage
+	takeoutSvc, err := takeout.NewTakeoutService(db, stravaService, mapSvc, stateSvc, storageService, config.Takeout.TTL, config.Takeout.LinkSecret)
+	if err != nil {
+		return nil, err
+	}
+
 	deps := &Dependencies{
 		MakeLockFunc: func(id int) locks.Lock {
 			return locks.NewDistributedLock(db, id)
 		},
-		Strava: stravaService,
-		Map:    mapSvc,
-		State:  state.NewStateService(db),
+		Strava:  stravaService,
+		Map:     mapSvc,
+		State:   stateSvc,
+		Queue:   queueService,
+		Session: sessionSvc,
+		Account: account.NewAccountService(db, stravaService, mapSvc, sessionSvc, stateSvc, takeoutSvc),
+		Takeout: takeoutSvc,
+	}
+
+	if fsTileStorage, ok := tileStorageService.(*storage.FilesystemBlobstore); ok {
+		deps.TileFileRoot = fsTileStorage.Root()
 	}
 
 	return deps, nil
@@ -2,14 +2,20 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
 	"github.com/nmiodice/personal-strava-heatmap/internal/orchestrator"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
 )
 
@@ -19,11 +25,30 @@ const (
 	ResponseActivitiesSynced   = "ActivitiesSynced"
 	QueryParamCode             = "code"
 	QueryParamToken            = "token"
+	QueryParamState            = "state"
+	QueryParamScope            = "scope"
+	QueryParamOAuthError       = "error"
+	QueryParamReauthorize      = "reauthorize"
+	QueryParamDeleted          = "deleted"
 	ResponseStatus             = "status"
 	ResponseActivitiesIncluded = "activities"
 	ResponseActivitiesCount    = "activity_count"
 	ResponseTileBatchCount     = "tile_batch_count"
+	ResponseVisibilityPolicy   = "visibility_policy"
+	ResponseGrantedScopes      = "granted_scopes"
+	ResponseReauthorizeURL     = "reauthorize_url"
+	FormParamVisibilityPolicy  = "policy"
 	WebsiteName                = "Personal Heatmap"
+
+	// values of QueryParamReauthorize, which asks the athlete to log in again
+	// and grant a scope they declined or were not asked for
+	ReauthorizeActivity = "activity"
+	ReauthorizeReadAll  = "read_all"
+
+	// values of QueryParamDeleted, which reports the outcome of deleting an
+	// account
+	DeletedComplete = "complete"
+	DeletedPending  = "pending"
 )
 
 type HttpRoutes struct {
@@ -32,10 +57,27 @@ type HttpRoutes struct {
 	MapProcessingStateRoute gin.HandlerFunc
 	TokenExchange           gin.HandlerFunc
 	LogoutRoute             gin.HandlerFunc
+	LogoutEverywhereRoute   gin.HandlerFunc
+	DeleteAccountRoute      gin.HandlerFunc
+	RequestTakeoutRoute     gin.HandlerFunc
+	TakeoutStatusRoute      gin.HandlerFunc
+	TakeoutDownloadRoute    gin.HandlerFunc
 	SharedMapRoute          gin.HandlerFunc
+	TileRoute               gin.HandlerFunc
+	RebuildMapRoute         gin.HandlerFunc
+	GetVisibilityRoute      gin.HandlerFunc
+	SetVisibilityRoute      gin.HandlerFunc
+	RateLimitRoute          gin.HandlerFunc
+	WebhookValidationRoute  gin.HandlerFunc
+	WebhookEventRoute       gin.HandlerFunc
+
+	// resolves the session of every request, and stops requests without one
+	SessionMiddleware gin.HandlerFunc
+	RequireSession    gin.HandlerFunc
 
 	ShareMapLinkRoute func(string) gin.HandlerFunc
 	StaticFileServer  func(string) gin.HandlerFunc
+	TileFileServer    func(string) gin.HandlerFunc
 }
 
 func GetRoutes(config *Config, deps *Dependencies) *HttpRoutes {
@@ -45,24 +87,36 @@ func GetRoutes(config *Config, deps *Dependencies) *HttpRoutes {
 		MapRoute:                getMapRoute("map.html", config, deps),
 		ShareMapLinkRoute:       getShareMapLinkRoute(config, deps),
 		SharedMapRoute:          getSharedMapRoute("map.html", config, deps),
-		LogoutRoute:             getLogoutRoute(),
+		TileRoute:               getTileRoute(config, deps),
+		RebuildMapRoute:         getRebuildMapRoute(config, deps),
+		GetVisibilityRoute:      getGetVisibilityRoute(config, deps),
+		SetVisibilityRoute:      getSetVisibilityRoute(config, deps),
+		RateLimitRoute:          getRateLimitRoute(config, deps),
+		WebhookValidationRoute:  getWebhookValidationRoute(config, deps),
+		WebhookEventRoute:       getWebhookEventRoute(config, deps),
+		LogoutRoute:             getLogoutRoute(config, deps),
+		LogoutEverywhereRoute:   getLogoutEverywhereRoute(config, deps),
+		DeleteAccountRoute:      getDeleteAccountRoute(config, deps),
+		RequestTakeoutRoute:     getRequestTakeoutRoute(config, deps),
+		TakeoutStatusRoute:      getTakeoutStatusRoute(config, deps),
+		TakeoutDownloadRoute:    getTakeoutDownloadRoute(config, deps),
 		MapProcessingStateRoute: getMapProcessingStateRoute(config, deps),
+		SessionMiddleware:       getSessionMiddleware(config, deps),
+		RequireSession:          getRequireSessionMiddleware(),
 		StaticFileServer: func(urlPrefix string) gin.HandlerFunc {
 			return static.Serve(urlPrefix, static.LocalFile(config.StaticFileRoot, false))
 		},
+		TileFileServer: func(urlPrefix string) gin.HandlerFunc {
+			return static.Serve(urlPrefix, static.LocalFile(deps.TileFileRoot, false))
+		},
 	}
 }
 
 func getShareMapLinkRoute(config *Config, deps *Dependencies) func(string) gin.HandlerFunc {
 	return func(sharedMapRoute string) gin.HandlerFunc {
 		return func(c *gin.Context) {
-			token, err := c.Cookie("token")
-			if err != nil || token == "" {
-				c.Redirect(301, "/")
-				return
-			}
-
-			mapID, err := deps.Strava.Athlete.GetOrCreateMapID(c.Request.Context(), token)
+			athleteID, _ := athleteFromContext(c)
+			mapID, err := deps.Strava.Athlete.GetOrCreateMapIDForAthlete(c.Request.Context(), athleteID)
 			if err != nil {
 				c.JSON(500, gin.H{
 					ResponseError: err.Error(),
@@ -87,14 +141,9 @@ func getShareMapLinkRoute(config *Config, deps *Dependencies) func(string) gin.H
 
 func getMapProcessingStateRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie("token")
-		if err != nil || token == "" {
-			c.Redirect(301, "/")
-			return
-		}
-
 		ctx := c.Request.Context()
-		mapProcessingState, err := deps.Map.GetProcessingStateForAthlete(ctx, token)
+		athleteID, _ := athleteFromContext(c)
+		mapProcessingState, err := deps.Map.GetProcessingStateForAthlete(ctx, athleteID)
 		if err != nil {
 			c.JSON(500, gin.H{
 				ResponseError: err.Error(),
@@ -102,14 +151,6 @@ func getMapProcessingStateRoute(config *Config, deps *Dependencies) gin.HandlerF
 			return
 		}
 
-		athleteID, err := deps.Strava.Athlete.GetAthleteForAuthToken(ctx, token)
-		if err != nil {
-			c.JSON(401, gin.H{
-				ResponseError: err.Error(),
-			})
-			return
-		}
-
 		state, err := deps.State.GetState(ctx, athleteID)
 		if err != nil {
 			c.JSON(500, gin.H{
@@ -132,15 +173,226 @@ func getMapProcessingStateRoute(config *Config, deps *Dependencies) gin.HandlerF
 	}
 }
 
-func getMapRoute(templateFileName string, config *Config, deps *Dependencies) gin.HandlerFunc {
+// getRebuildMapRoute re-renders every tile of the map of the athlete, rather
+// than only the tiles touched by new activities
+func getRebuildMapRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie("token")
-		if err != nil || token == "" {
-			c.Redirect(301, "/")
+		athleteID, _ := athleteFromContext(c)
+
+		token, err := deps.Strava.Auth.GetAuthTokenForAthlete(c.Request.Context(), athleteID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		go func() {
+			orchestrator.UpdateAthleteMap(
+				deps.Strava,
+				deps.Map,
+				deps.State,
+				athleteID,
+				token,
+				orchestrator.UpdateOptions{FullRebuild: true},
+				sdk.WithPriority(context.Background(), sdk.PriorityInteractive))
+		}()
+
+		c.Status(http.StatusAccepted)
+	}
+}
+
+// getGetVisibilityRoute returns the policy that decides which activities of
+// the athlete are drawn on their map
+func getGetVisibilityRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+
+		policy, err := deps.Strava.Athlete.GetVisibilityPolicy(c.Request.Context(), athleteID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		response, err := visibilityResponse(c, deps, athleteID, policy)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		c.JSON(200, response)
+	}
+}
+
+// visibilityResponse describes the visibility policy of an athlete, along with
+// a link to grant the scope the policy needs if the athlete has not
+func visibilityResponse(c *gin.Context, deps *Dependencies, athleteID int, policy string) (gin.H, error) {
+	scopes, err := deps.Strava.Auth.GetScopesForAthlete(c.Request.Context(), athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := gin.H{
+		ResponseVisibilityPolicy: policy,
+		ResponseGrantedScopes:    scopes,
+	}
+	if policy == strava.VisibilityPolicyEverything && !scopes.CanReadPrivateActivities() {
+		response[ResponseReauthorizeURL] = "/?" + QueryParamReauthorize + "=" + ReauthorizeReadAll
+	}
+	return response, nil
+}
+
+// getSetVisibilityRoute changes the visibility policy of the athlete and
+// rebuilds their map if the policy changed
+func getSetVisibilityRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+
+		policy := c.PostForm(FormParamVisibilityPolicy)
+		if err := strava.ValidateVisibilityPolicy(policy); err != nil {
+			c.JSON(400, gin.H{
+				ResponseError: err.Error(),
+			})
 			return
 		}
 
-		mapID, err := deps.Strava.Athlete.GetOrCreateMapID(c.Request.Context(), token)
+		changed, err := deps.Strava.Athlete.SetVisibilityPolicy(c.Request.Context(), athleteID, policy)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		if changed {
+			log.Printf("visibility policy of athlete '%d' changed to '%s'", athleteID, policy)
+			token, err := deps.Strava.Auth.GetAuthTokenForAthlete(c.Request.Context(), athleteID)
+			if err != nil {
+				c.JSON(500, gin.H{
+					ResponseError: err.Error(),
+				})
+				return
+			}
+
+			go func() {
+				orchestrator.UpdateAthleteMap(
+					deps.Strava,
+					deps.Map,
+					deps.State,
+					athleteID,
+					token,
+					orchestrator.UpdateOptions{FullRebuild: true, SkipListing: true},
+					sdk.WithPriority(context.Background(), sdk.PriorityInteractive))
+			}()
+		}
+
+		response, err := visibilityResponse(c, deps, athleteID, policy)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, response)
+	}
+}
+
+// getRateLimitRoute reports how much of the Strava rate limits is used, and how
+// many requests were made for the athlete
+func getRateLimitRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+
+		c.JSON(200, deps.Strava.RateLimit.Usage(athleteID))
+	}
+}
+
+// getWebhookValidationRoute answers the challenge Strava sends when a webhook
+// subscription is created
+func getWebhookValidationRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		verifyToken := deps.Strava.Subscription.VerifyToken()
+		if verifyToken == "" || c.Query("hub.mode") != "subscribe" || c.Query("hub.verify_token") != verifyToken {
+			c.Status(http.StatusForbidden)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"hub.challenge": c.Query("hub.challenge"),
+		})
+	}
+}
+
+// getWebhookEventRoute receives webhook events. Strava expects a response
+// within two seconds, so events are processed in the background. Anyone can
+// post an event, so they are confirmed with Strava before anything is deleted
+func getWebhookEventRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if deps.Strava.Subscription.VerifyToken() == "" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		event := sdk.WebhookEvent{}
+		if err := c.BindJSON(&event); err != nil {
+			return
+		}
+
+		// events are not signed, so only those naming a subscription created by
+		// this application are trusted, and only as a hint of what to check
+		known, err := deps.Strava.Subscription.IsKnown(c.Request.Context(), event.SubscriptionID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		if !known {
+			log.Printf("dropping webhook event of unknown subscription '%d'", event.SubscriptionID)
+			c.Status(http.StatusForbidden)
+			return
+		}
+
+		go handleWebhookEvent(deps, event)
+
+		c.Status(http.StatusOK)
+	}
+}
+
+// handleWebhookEvent applies an event in the background. Strava does not send
+// an event again once it was acknowledged, so an event that was put off by a
+// rate limit is applied again once the window resets
+func handleWebhookEvent(deps *Dependencies, event sdk.WebhookEvent) {
+	err := orchestrator.HandleWebhookEvent(
+		deps.Strava,
+		deps.Map,
+		deps.State,
+		deps.Account,
+		event,
+		context.Background())
+	if err == nil {
+		return
+	}
+
+	if retryAt, ok := sdk.RetryTime(err); ok {
+		log.Printf("%s %s event for athlete '%d' was put off by Strava rate limits, will handle it again at %s", event.ObjectType, event.AspectType, event.OwnerID, retryAt.Format(time.RFC3339))
+		time.AfterFunc(time.Until(retryAt), func() {
+			handleWebhookEvent(deps, event)
+		})
+		return
+	}
+	log.Printf("error handling %s %s event for athlete '%d': %+v", event.ObjectType, event.AspectType, event.OwnerID, err)
+}
+
+func getMapRoute(templateFileName string, config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+		mapID, err := deps.Strava.Athlete.GetOrCreateMapIDForAthlete(c.Request.Context(), athleteID)
 		if err != nil {
 			c.JSON(500, gin.H{
 				ResponseError: err.Error(),
@@ -181,13 +433,74 @@ func getSharedMapRoute(templateFileName string, config *Config, deps *Dependenci
 	}
 }
 
+// matches the last path segment of a tile request, i.e., '123.png' or '123@2x.png'
+var tileFileRegex = regexp.MustCompile(`^(\d+)(?:@(\d)x)?\.(png|mvt)$`)
+
+func getTileRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		mapID := c.Param("mapid")
+
+		// maps are visible to their owner, or to anyone if they are shared
+		isOwner := false
+		if athleteID, ok := athleteFromContext(c); ok {
+			ownMapID, err := deps.Strava.Athlete.GetMapIDForAthlete(ctx, athleteID)
+			isOwner = err == nil && ownMapID != nil && *ownMapID == mapID
+		}
+		if !isOwner {
+			isShared, err := deps.Strava.Athlete.GetMapSharable(ctx, mapID)
+			if err != nil || !isShared {
+				c.Status(http.StatusNotFound)
+				return
+			}
+		}
+
+		z, errZ := strconv.Atoi(c.Param("z"))
+		x, errX := strconv.Atoi(c.Param("x"))
+		match := tileFileRegex.FindStringSubmatch(c.Param("y"))
+		if errZ != nil || errX != nil || match == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		y, _ := strconv.Atoi(match[1])
+		density := 1
+		if match[2] != "" {
+			density, _ = strconv.Atoi(match[2])
+		}
+		format := match[3]
+
+		tile, err := deps.Map.GetOrRenderTile(ctx, mapID, maps.Tile{X: x, Y: y, Z: z}, format, density*256)
+		if errors.Is(err, maps.ErrorTileOutOfRange) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		contentType := "image/png"
+		if format == maps.TileFormatMVT {
+			contentType = "application/vnd.mapbox-vector-tile"
+		}
+
+		c.Header("Cache-Control", "max-age=120")
+		c.Data(http.StatusOK, contentType, tile)
+	}
+}
+
 func sendMapResponse(c *gin.Context, mapID, templateFileName string, config *Config, templateOverrides gin.H) {
 	mapParams := gin.H{
-		"title":         WebsiteName,
-		"map_id":        mapID,
-		"sharable":      true,
-		"map_api_key":   config.Map.MapsAPIKey,
-		"tile_endpoint": fmt.Sprintf("https://%s.blob.core.windows.net/%s/", config.Storage.AccountName, config.Storage.UploadContainerName),
+		"title":          WebsiteName,
+		"map_id":         mapID,
+		"sharable":       true,
+		"map_api_key":    config.Map.MapsAPIKey,
+		"tile_endpoint":  config.Storage.TileEndpoint(),
+		"tile_densities": joinInts(maps.TileDensities(config.Map.TileSizes)),
+		"lazy_tile_zoom": config.Map.LazyTileMinZoom,
 	}
 	for k, v := range templateOverrides {
 		if _, ok := templateOverrides[k]; ok {
@@ -199,49 +512,147 @@ func sendMapResponse(c *gin.Context, mapID, templateFileName string, config *Con
 	c.HTML(http.StatusOK, templateFileName, mapParams)
 }
 
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// getIndexRoute shows the login page. Every page carries a new login state,
+// which is also kept in a cookie so that the login can only be completed by
+// the browser that started it
 func getIndexRoute(templateFileName string, config *Config, deps *Dependencies) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie("token")
-		if err == nil && token != "" {
+		reauthorize := c.Query(QueryParamReauthorize)
+		if _, ok := athleteFromContext(c); ok && reauthorize == "" {
 			c.Redirect(301, "/map.html")
 			return
 		}
 
+		scopes := strava.LoginScopes
+		approvalPrompt := "auto"
+		notice := ""
+		switch reauthorize {
+		case ReauthorizeActivity:
+			approvalPrompt = "force"
+			notice = "Your heatmap is drawn from your activities. Please log in again and allow access to your activity data."
+		case ReauthorizeReadAll:
+			scopes = strava.LoginScopesReadAll
+			approvalPrompt = "force"
+			notice = "To draw activities that only you can see, please log in again and allow access to your private activities."
+		}
+		switch c.Query(QueryParamDeleted) {
+		case DeletedComplete:
+			notice = "Your account was deleted. Your activity data and heatmap are gone, and this application no longer has access to your Strava account."
+		case DeletedPending:
+			notice = "Your account is being deleted. You were logged out, and your remaining data will be removed shortly."
+		}
+
+		state, err := deps.Strava.Auth.NewState()
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		setCookie(c, config, oauthStateCookie, state, int(strava.OAuthStateTTL.Seconds()))
+
 		// helps with login/logout
 		c.Header("Cache-Control", "no-cache")
 		c.HTML(http.StatusOK, "index.html", gin.H{
-			"title":            WebsiteName,
-			"strava_client_id": config.Strava.ClientID,
+			"title":                WebsiteName,
+			"strava_client_id":     config.Strava.ClientID,
+			"strava_authorize_url": config.Strava.AuthorizeURL,
+			"strava_scope":         scopes.String(),
+			"approval_prompt":      approvalPrompt,
+			"oauth_state":          state,
+			"notice":               notice,
 		})
 	}
 }
 
-func getLogoutRoute() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Header("Cache-Control", "no-cache")
-		c.SetCookie("token", "", -1, "", "", false, true)
-		c.Redirect(301, "/index.html")
-		return
+// checkOAuthState verifies that a login was started by this browser, from a
+// login page served by this application, and was not completed before
+func checkOAuthState(c *gin.Context, config *Config, deps *Dependencies) error {
+	expected, _ := c.Cookie(oauthStateCookie)
+	setCookie(c, config, oauthStateCookie, "", -1)
+
+	state := c.Query(QueryParamState)
+	if state == "" || state != expected {
+		return fmt.Errorf("%w: login was not started by this browser", strava.ErrorInvalidState)
 	}
+	return deps.Strava.Auth.ConsumeState(c.Request.Context(), state)
 }
 
 func getTokenExchangeRouteFunc(config *Config, deps *Dependencies) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		res, err := deps.Strava.Auth.ExchangeAuthToken(c.Request.Context(), &sdk.TokenExchangeCode{
+		if err := checkOAuthState(c, config, deps); err != nil {
+			c.JSON(400, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		// the athlete pressed cancel on the Strava page
+		if c.Query(QueryParamOAuthError) != "" {
+			c.Redirect(http.StatusFound, "/?"+QueryParamReauthorize+"="+ReauthorizeActivity)
+			return
+		}
+
+		scopes := strava.ParseScopes(c.Query(QueryParamScope))
+		res, scopesChanged, err := deps.Strava.Auth.ExchangeAuthToken(c.Request.Context(), &sdk.TokenExchangeCode{
 			Code: c.Query(QueryParamCode),
-		})
+		}, scopes)
+
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		// without access to activities there is nothing to draw, so the athlete is
+		// asked again rather than shown a map that never fills in
+		if !scopes.CanReadActivities() {
+			log.Printf("athlete '%d' logged in without granting activity access (granted '%s')", res.Athlete, scopes)
+			c.Redirect(http.StatusFound, "/?"+QueryParamReauthorize+"="+ReauthorizeActivity)
+			return
+		}
 
+		// activities that could not be read before are only found by listing
+		// every activity
+		if scopesChanged {
+			log.Printf("athlete '%d' granted '%s', listing every activity on the next sync", res.Athlete, scopes)
+			if err := deps.Strava.Athlete.RequestFullSync(c.Request.Context(), res.Athlete); err != nil {
+				c.JSON(500, gin.H{
+					ResponseError: err.Error(),
+				})
+				return
+			}
+		}
+
+		// a new session on every login keeps a session from being planted before
+		// the athlete logs in
+		s, err := deps.Session.Create(c.Request.Context(), res.Athlete)
 		if err != nil {
 			c.JSON(500, gin.H{
 				ResponseError: err.Error(),
 			})
 			return
 		}
+		if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+			if err := deps.Session.Delete(c.Request.Context(), token); err != nil {
+				log.Printf("error ending previous session of athlete '%d': %+v", res.Athlete, err)
+			}
+		}
 
-		c.SetCookie("token", res.AccessToken, 0, "", "", false, true)
+		setSessionCookie(c, config, s.Token, deps.Session)
 		c.Redirect(301, "/map.html/")
 
-		// kick off background job to update profile and rebuild map
+		// kick off background job to update profile and rebuild map. The athlete
+		// is waiting on it, so it goes ahead of scheduled syncs
 		go func() {
 			orchestrator.UpdateAthleteMap(
 				deps.Strava,
@@ -249,7 +660,8 @@ func getTokenExchangeRouteFunc(config *Config, deps *Dependencies) gin.HandlerFu
 				deps.State,
 				res.Athlete,
 				res.AccessToken,
-				context.Background())
+				orchestrator.UpdateOptions{},
+				sdk.WithPriority(context.Background(), sdk.PriorityInteractive))
 		}()
 	}
 }
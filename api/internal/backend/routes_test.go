@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+func webhookDeps(verifyToken string) *Dependencies {
+	return &Dependencies{
+		Strava: &strava.StravaService{
+			Subscription: strava.NewSubscriptionService(nil, nil, verifyToken),
+		},
+	}
+}
+
+func serve(handler gin.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Handle(method, "/webhook", handler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestWebhookValidationRoute(t *testing.T) {
+	cases := []struct {
+		name        string
+		verifyToken string
+		query       string
+		status      int
+	}{
+		{"valid", "secret", "?hub.mode=subscribe&hub.verify_token=secret&hub.challenge=15f7d1a91c1f40f8", http.StatusOK},
+		{"wrong token", "secret", "?hub.mode=subscribe&hub.verify_token=guess&hub.challenge=1", http.StatusForbidden},
+		{"wrong mode", "secret", "?hub.mode=unsubscribe&hub.verify_token=secret&hub.challenge=1", http.StatusForbidden},
+		{"no token", "secret", "?hub.mode=subscribe&hub.challenge=1", http.StatusForbidden},
+		// an empty token would otherwise match requests without one
+		{"webhooks disabled", "", "?hub.mode=subscribe&hub.verify_token=&hub.challenge=1", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := serve(getWebhookValidationRoute(nil, webhookDeps(c.verifyToken)), http.MethodGet, "/webhook"+c.query, "")
+			if w.Code != c.status {
+				t.Fatalf("status = %d, want %d", w.Code, c.status)
+			}
+			if c.status == http.StatusOK && w.Body.String() != `{"hub.challenge":"15f7d1a91c1f40f8"}` {
+				t.Errorf("body = %s, want the challenge echoed", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhookEventRouteRejects(t *testing.T) {
+	cases := []struct {
+		name        string
+		verifyToken string
+		body        string
+		status      int
+	}{
+		{"webhooks disabled", "", `{"object_type":"activity","subscription_id":1}`, http.StatusNotFound},
+		{"malformed event", "secret", `{"object_type":`, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := serve(getWebhookEventRoute(nil, webhookDeps(c.verifyToken)), http.MethodPost, "/webhook", c.body)
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/fake"
+)
+
+const (
+	sandboxClientID     = "sandbox"
+	sandboxClientSecret = "sandbox"
+)
+
+// UseSandbox points the application at a fake Strava API and keeps everything
+// else local. It must be called before GetConfig, and only fills in settings
+// that are empty
+func UseSandbox() {
+	port := 8081
+	if p, err := strconv.Atoi(os.Getenv("SANDBOX_STRAVA_PORT")); err == nil {
+		port = p
+	}
+
+	defaults := map[string]string{
+		"STRAVA_CLIENT_ID":              sandboxClientID,
+		"STRAVA_CLIENT_SECRET":          sandboxClientSecret,
+		"STRAVA_API_URL":                fmt.Sprintf("http://localhost:%d/api/v3/", port),
+		"STRAVA_AUTHORIZE_URL":          fmt.Sprintf("http://localhost:%d/oauth/authorize", port),
+		"STORAGE_BACKEND":               StorageBackendFilesystem,
+		"STORAGE_CONTAINER_NAME":        "activities",
+		"UPLOAD_STORAGE_CONTAINER_NAME": "tiles",
+		"QUEUE_BACKEND":                 QueueBackendPostgres,
+		"GOOGLE_MAPS_API_KEY":           "",
+		"SESSION_INSECURE_COOKIE":       "true",
+		"STRAVA_OAUTH_STATE_SECRET":     "sandbox",
+	}
+	for name, value := range defaults {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// RunSandboxStrava serves the fake Strava API in the background
+func RunSandboxStrava(config *Config) {
+	server := fake.NewServer(fake.Config{
+		ClientID:     config.Strava.ClientID,
+		ClientSecret: config.Strava.ClientSecret,
+		Seed:         config.Sandbox.Seed,
+		Athletes:     config.Sandbox.Athletes,
+		Activities:   config.Sandbox.Activities,
+		ErrorRate429: config.Sandbox.ErrorRate429,
+		ErrorRate500: config.Sandbox.ErrorRate500,
+	})
+
+	go func() {
+		log.Fatal(server.ListenAndServe(fmt.Sprintf(":%d", config.Sandbox.Port)))
+	}()
+}
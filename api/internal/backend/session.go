@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nmiodice/personal-strava-heatmap/internal/account"
+	"github.com/nmiodice/personal-strava-heatmap/internal/session"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+const (
+	SessionCookie = "session"
+	// held the Strava access token of the athlete before sessions were stored
+	// by the backend. It is cleared when seen
+	legacyTokenCookie = "token"
+	// holds the state of a login until Strava redirects back
+	oauthStateCookie = "oauth_state"
+	// key of the athlete ID in the gin context
+	contextKeyAthleteID = "athlete_id"
+)
+
+// getSessionMiddleware resolves the session cookie once per request. The
+// athlete is put in the context of the request, which also attributes Strava
+// requests made for it to the athlete
+func getSessionMiddleware(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := c.Cookie(legacyTokenCookie); err == nil {
+			setCookie(c, config, legacyTokenCookie, "", -1)
+		}
+
+		token, err := c.Cookie(SessionCookie)
+		if err != nil || token == "" {
+			c.Next()
+			return
+		}
+
+		s, renewed, err := deps.Session.Resolve(c.Request.Context(), token)
+		if errors.Is(err, session.ErrorInvalidSession) {
+			setCookie(c, config, SessionCookie, "", -1)
+			c.Next()
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		if renewed {
+			setSessionCookie(c, config, token, deps.Session)
+		}
+
+		c.Set(contextKeyAthleteID, s.AthleteID)
+		c.Request = c.Request.WithContext(sdk.WithAthlete(c.Request.Context(), s.AthleteID))
+		c.Next()
+	}
+}
+
+// getRequireSessionMiddleware sends visitors without a session to the login
+// page
+func getRequireSessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := athleteFromContext(c); !ok {
+			c.Redirect(301, "/")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// athleteFromContext returns the athlete of the session that made a request
+func athleteFromContext(c *gin.Context) (int, bool) {
+	athleteID, ok := c.Get(contextKeyAthleteID)
+	if !ok {
+		return 0, false
+	}
+	return athleteID.(int), true
+}
+
+func setSessionCookie(c *gin.Context, config *Config, token string, sessions *session.SessionService) {
+	setCookie(c, config, SessionCookie, token, int(sessions.TTL().Seconds()))
+}
+
+// setCookie sets an HTTP only cookie that is only sent by top level navigation
+// from other sites, i.e., the redirect back from Strava after logging in
+func setCookie(c *gin.Context, config *Config, name, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, "/", "", !config.Session.InsecureCookie, true)
+}
+
+// getLogoutRoute ends the current session. It only accepts POST requests, since
+// the session cookie is sent along with links from other sites
+func getLogoutRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+			if err := deps.Session.Delete(c.Request.Context(), token); err != nil {
+				c.JSON(500, gin.H{
+					ResponseError: err.Error(),
+				})
+				return
+			}
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		setCookie(c, config, SessionCookie, "", -1)
+		c.Redirect(http.StatusSeeOther, "/index.html")
+	}
+}
+
+// getLogoutEverywhereRoute ends every session of the athlete, i.e., after
+// logging in on a shared computer
+func getLogoutEverywhereRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+		deleted, err := deps.Session.DeleteForAthlete(c.Request.Context(), athleteID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		log.Printf("ended '%d' sessions of athlete '%d'", deleted, athleteID)
+		c.Header("Cache-Control", "no-cache")
+		setCookie(c, config, SessionCookie, "", -1)
+		c.Redirect(http.StatusSeeOther, "/index.html")
+	}
+}
+
+// getDeleteAccountRoute deletes the athlete along with their data, and logs
+// them out. A deletion that fails part way through is finished in the
+// background
+func getDeleteAccountRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+		deletion, err := deps.Account.Delete(c.Request.Context(), athleteID, account.DeletionSourceAthlete)
+		if deletion == nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		outcome := DeletedComplete
+		if err != nil {
+			log.Printf("deletion of athlete '%d' will be retried: %+v", athleteID, err)
+			outcome = DeletedPending
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		setCookie(c, config, SessionCookie, "", -1)
+		c.Redirect(http.StatusSeeOther, "/index.html?"+QueryParamDeleted+"="+outcome)
+	}
+}
@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nmiodice/personal-strava-heatmap/internal/takeout"
+)
+
+// route that serves exports. Links to it are signed, so it does not need a
+// session
+const TakeoutDownloadRoute = "/takeout/download"
+
+// reported as the status of an athlete who has no export
+const takeoutStatusNone = "none"
+
+type takeoutResponse struct {
+	Status      takeout.Status `json:"status"`
+	RequestedAt time.Time      `json:"requested_at"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	SizeBytes   int64          `json:"size_bytes,omitempty"`
+	DownloadURL string         `json:"download_url,omitempty"`
+	Error       *string        `json:"error,omitempty"`
+}
+
+func newTakeoutResponse(deps *Dependencies, export *takeout.Export) (*takeoutResponse, error) {
+	response := &takeoutResponse{
+		Status:      export.Status,
+		RequestedAt: export.RequestedAt,
+		ExpiresAt:   export.ExpiresAt,
+		SizeBytes:   export.SizeBytes,
+		Error:       export.Error,
+	}
+	if export.Status == takeout.StatusReady {
+		link, err := deps.Takeout.DownloadLink(export)
+		if err != nil {
+			return nil, err
+		}
+		response.DownloadURL = TakeoutDownloadRoute + "/" + link
+	}
+	return response, nil
+}
+
+// getRequestTakeoutRoute starts building an export of the data of the athlete,
+// unless one is being built already
+func getRequestTakeoutRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+
+		export, created, err := deps.Takeout.Request(c.Request.Context(), athleteID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		if created {
+			go func() {
+				if err := deps.Takeout.Build(context.Background(), export); err != nil {
+					log.Printf("error exporting data: %+v", err)
+				}
+			}()
+		}
+
+		response, err := newTakeoutResponse(deps, export)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusAccepted, response)
+	}
+}
+
+// getTakeoutStatusRoute reports the newest export of the athlete, and links to
+// it once it is ready
+func getTakeoutStatusRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		athleteID, _ := athleteFromContext(c)
+
+		export, err := deps.Takeout.Latest(c.Request.Context(), athleteID)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		if export == nil {
+			c.JSON(200, gin.H{
+				ResponseStatus: takeoutStatusNone,
+			})
+			return
+		}
+
+		response, err := newTakeoutResponse(deps, export)
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		c.JSON(200, response)
+	}
+}
+
+// getTakeoutDownloadRoute streams the archive behind a download link
+func getTakeoutDownloadRoute(config *Config, deps *Dependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		export, archive, err := deps.Takeout.Open(c.Request.Context(), c.Param("link"))
+		if errors.Is(err, takeout.ErrorExportNotFound) {
+			c.JSON(404, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{
+				ResponseError: err.Error(),
+			})
+			return
+		}
+		defer archive.Close()
+
+		filename := fmt.Sprintf("heatmap-%d-%s.zip", export.AthleteID, export.CompletedAt.Format("20060102"))
+		c.DataFromReader(200, export.SizeBytes, "application/zip", archive, map[string]string{
+			"Cache-Control":       "private, no-store",
+			"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s\"", filename),
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
 	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
 )
 
 func makeTokenRefreshFunc(ctx context.Context, stravaSvc *strava.StravaService, lock locks.Lock) processor.ProcessorFunc {
@@ -23,6 +24,11 @@ func makeTokenRefreshFunc(ctx context.Context, stravaSvc *strava.StravaService,
 		for id := range athleteTokens {
 			_, err := stravaSvc.Auth.RefreshAuthToken(ctx, id)
 			if err != nil {
+				// a refused refresh token will not work on the next attempt either.
+				// The athlete has to log in again
+				if !sdk.IsTransient(err) {
+					log.Printf("refresh token of athlete '%d' was refused: %+v", id, err)
+				}
 				errors = multierror.Append(errors, err)
 			}
 		}
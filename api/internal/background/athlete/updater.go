@@ -28,6 +28,7 @@ func makeAthleteUpdateFunc(ctx context.Context, stravaSvc *strava.StravaService,
 				stateService,
 				athleteID,
 				token.AccessToken,
+				orchestrator.UpdateOptions{},
 				context.Background())
 		}
 
@@ -0,0 +1,32 @@
+package cleanup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/account"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
+	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
+)
+
+func makeAccountDeletionFunc(ctx context.Context, accountSvc *account.AccountService) processor.ProcessorFunc {
+	return func() error {
+		resumed, err := accountSvc.ResumeDeletions(ctx)
+		if resumed > 0 {
+			log.Printf("finished '%d' account deletions", resumed)
+		}
+		return err
+	}
+}
+
+// AccountDeletionConfig finishes account deletions that failed part way
+// through, i.e., because storage was unavailable
+func AccountDeletionConfig(ctx context.Context, accountSvc *account.AccountService, lock locks.Lock) processor.ProcessorConfiguration {
+	return processor.ProcessorConfiguration{
+		Func:     makeAccountDeletionFunc(ctx, accountSvc),
+		WaitTime: time.Hour * 1,
+		Name:     "AccountDeletion",
+		Lock:     lock,
+	}
+}
@@ -0,0 +1,47 @@
+package cleanup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
+	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
+	"github.com/nmiodice/personal-strava-heatmap/internal/session"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+func makeSessionCleanupFunc(ctx context.Context, stravaSvc *strava.StravaService, sessionSvc *session.SessionService) processor.ProcessorFunc {
+	return func() error {
+		var errors *multierror.Error
+
+		if deleted, err := sessionSvc.DeleteExpired(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		} else {
+			log.Printf("deleted '%d' expired sessions", deleted)
+		}
+
+		if deleted, err := stravaSvc.Auth.DeleteExpiredStates(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		} else {
+			log.Printf("deleted '%d' expired login states", deleted)
+		}
+
+		if errors != nil {
+			return errors
+		}
+
+		return nil
+	}
+}
+
+// SessionCleanupConfig removes sessions and login states that expired
+func SessionCleanupConfig(ctx context.Context, stravaSvc *strava.StravaService, sessionSvc *session.SessionService, lock locks.Lock) processor.ProcessorConfiguration {
+	return processor.ProcessorConfiguration{
+		Func:     makeSessionCleanupFunc(ctx, stravaSvc, sessionSvc),
+		WaitTime: time.Hour * 1,
+		Name:     "SessionCleanup",
+		Lock:     lock,
+	}
+}
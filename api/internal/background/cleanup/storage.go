@@ -0,0 +1,43 @@
+package cleanup
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
+	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+func makeStorageReconcileFunc(ctx context.Context, stravaSvc *strava.StravaService, mapService *maps.MapService) processor.ProcessorFunc {
+	return func() error {
+		var errors *multierror.Error
+
+		if _, err := mapService.DeleteStaleTiles(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+
+		if _, err := stravaSvc.Athlete.DeleteOrphanedActivityData(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+
+		if errors != nil {
+			return errors
+		}
+
+		return nil
+	}
+}
+
+// StorageReconcileConfig removes tiles and activity data that are no longer
+// referenced by the database
+func StorageReconcileConfig(ctx context.Context, stravaSvc *strava.StravaService, mapService *maps.MapService, lock locks.Lock) processor.ProcessorConfiguration {
+	return processor.ProcessorConfiguration{
+		Func:     makeStorageReconcileFunc(ctx, stravaSvc, mapService),
+		WaitTime: time.Hour * 24,
+		Name:     "StorageReconcile",
+		Lock:     lock,
+	}
+}
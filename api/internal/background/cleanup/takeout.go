@@ -0,0 +1,32 @@
+package cleanup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
+	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
+	"github.com/nmiodice/personal-strava-heatmap/internal/takeout"
+)
+
+func makeTakeoutCleanupFunc(ctx context.Context, takeoutSvc *takeout.TakeoutService) processor.ProcessorFunc {
+	return func() error {
+		deleted, err := takeoutSvc.DeleteExpired(ctx)
+		if deleted > 0 {
+			log.Printf("deleted '%d' expired exports", deleted)
+		}
+		return err
+	}
+}
+
+// TakeoutCleanupConfig removes exports of athlete data once their download link
+// expired
+func TakeoutCleanupConfig(ctx context.Context, takeoutSvc *takeout.TakeoutService, lock locks.Lock) processor.ProcessorConfiguration {
+	return processor.ProcessorConfiguration{
+		Func:     makeTakeoutCleanupFunc(ctx, takeoutSvc),
+		WaitTime: time.Hour * 1,
+		Name:     "TakeoutCleanup",
+		Lock:     lock,
+	}
+}
@@ -0,0 +1,45 @@
+package keys
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nmiodice/personal-strava-heatmap/internal/background/processor"
+	"github.com/nmiodice/personal-strava-heatmap/internal/locks"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+func makeKeyRotationFunc(ctx context.Context, stravaSvc *strava.StravaService) processor.ProcessorFunc {
+	return func() error {
+		var errors *multierror.Error
+
+		if reencrypted, err := stravaSvc.Auth.ReencryptTokens(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		} else {
+			log.Printf("encrypted '%d' tokens with the primary key", reencrypted)
+		}
+
+		if _, err := stravaSvc.Athlete.ReencryptActivityData(ctx); err != nil {
+			errors = multierror.Append(errors, err)
+		}
+
+		if errors != nil {
+			return errors
+		}
+
+		return nil
+	}
+}
+
+// KeyRotationConfig encrypts tokens and activity data that are not encrypted
+// with the primary key, so that old keys can be removed once it ran
+func KeyRotationConfig(ctx context.Context, stravaSvc *strava.StravaService, lock locks.Lock) processor.ProcessorConfiguration {
+	return processor.ProcessorConfiguration{
+		Func:     makeKeyRotationFunc(ctx, stravaSvc),
+		WaitTime: time.Hour * 24,
+		Name:     "KeyRotation",
+		Lock:     lock,
+	}
+}
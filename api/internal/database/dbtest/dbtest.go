@@ -0,0 +1,95 @@
+// Package dbtest connects tests to a Postgres database, for code whose SQL
+// cannot be tested without one
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+)
+
+// URLEnv names the database that tests run against. Tests that need a database
+// are skipped when it is not set
+const URLEnv = "TEST_DATABASE_URL"
+
+// New connects to the test database with every migration applied to a schema
+// of its own, which is dropped when the test ends. Packages are tested in
+// parallel, so each one should pass a different schema
+func New(t *testing.T, schema string) *database.DB {
+	t.Helper()
+	url := os.Getenv(URLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", URLEnv)
+	}
+	ctx := context.Background()
+
+	admin, err := pgxpool.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// extensions are shared by the whole database, so they are kept in public
+	setup := fmt.Sprintf(`
+		CREATE EXTENSION IF NOT EXISTS "uuid-ossp" SCHEMA public;
+		DROP SCHEMA IF EXISTS %[1]s CASCADE;
+		CREATE SCHEMA %[1]s;
+	`, schema)
+	if _, err := admin.Exec(ctx, setup); err != nil {
+		t.Fatalf("creating schema %s: %v", schema, err)
+	}
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Close()
+		if admin, err := pgxpool.Connect(ctx, url); err == nil {
+			admin.Exec(ctx, fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schema))
+			admin.Close()
+		}
+	})
+
+	for _, migration := range migrations(t) {
+		sql, err := ioutil.ReadFile(migration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// statements without arguments are sent as they are, so a migration can
+		// hold more than one
+		if _, err := pool.Exec(ctx, string(sql)); err != nil {
+			t.Fatalf("applying %s: %v", filepath.Base(migration), err)
+		}
+	}
+
+	return &database.DB{Pool: pool}
+}
+
+// migrations lists the up migrations in the order they are applied
+func migrations(t *testing.T) []string {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("locating the migrations")
+	}
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(file), "..", "..", "..", "migrations", "*.up.sql"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("listing migrations: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
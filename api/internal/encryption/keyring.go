@@ -0,0 +1,309 @@
+// Package encryption protects tokens and activity data with envelope
+// encryption. Every value is encrypted with a fresh data key using AES-GCM, and
+// the data key is encrypted with a key from the keyring, whose ID is stored
+// alongside it. Values that are not encrypted are read as they are, so data
+// written before encryption was enabled stays readable
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// keys, and the data keys they encrypt, are AES-256 keys
+	keySize   = 32
+	nonceSize = 12
+	tagSize   = 16
+
+	// prefix of encrypted strings, which hold an envelope in base64
+	stringPrefix = "enc:v1:"
+)
+
+// magic starts every envelope. The layout is: magic, key ID length (1 byte),
+// key ID, nonce and encrypted data key, nonce and encrypted value
+var magic = []byte("HMENC1")
+
+var (
+	ErrorUnknownKey       = errors.New("value was encrypted with a key that is not in the keyring")
+	ErrorInvalidEnvelope  = errors.New("encrypted value is malformed")
+	ErrorInvalidKeyConfig = errors.New("invalid encryption key configuration")
+)
+
+// Key is a key encryption key
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring holds the keys that encrypt data keys. The first key encrypts new
+// values and every key decrypts, so a key is rotated by putting a new key
+// first and keeping the old one until every value was re-encrypted. An empty
+// keyring leaves values unencrypted
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func NewKeyring(keys []Key) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+	for i, key := range keys {
+		if key.ID == "" || len(key.ID) > 255 || strings.ContainsAny(key.ID, ":,") {
+			return nil, fmt.Errorf("%w: key ID '%s' must be 1 to 255 characters without ':' or ','", ErrorInvalidKeyConfig, key.ID)
+		}
+		if len(key.Secret) != keySize {
+			return nil, fmt.Errorf("%w: key '%s' must be %d bytes", ErrorInvalidKeyConfig, key.ID, keySize)
+		}
+		if _, ok := keyring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("%w: key '%s' is configured twice", ErrorInvalidKeyConfig, key.ID)
+		}
+
+		aead, err := newAEAD(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[key.ID] = aead
+		if i == 0 {
+			keyring.primary = key.ID
+		}
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads keys from a comma separated list of 'id:base64 key' pairs,
+// followed by the lines of a key file in the same format. Either may be empty
+func LoadKeyring(keys string, keyFile string) (*Keyring, error) {
+	parsed := []Key{}
+	for _, pair := range strings.Split(keys, ",") {
+		key, err := parseKey(pair)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			parsed = append(parsed, *key)
+		}
+	}
+
+	if keyFile != "" {
+		contents, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading key file: %+v", ErrorInvalidKeyConfig, err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			key, err := parseKey(line)
+			if err != nil {
+				return nil, err
+			}
+			if key != nil {
+				parsed = append(parsed, *key)
+			}
+		}
+	}
+
+	return NewKeyring(parsed)
+}
+
+// parseKey returns nil for blank input
+func parseKey(pair string) (*Key, error) {
+	pair = strings.TrimSpace(pair)
+	if pair == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(pair, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: expected 'id:base64 key'", ErrorInvalidKeyConfig)
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: key '%s' is not valid base64", ErrorInvalidKeyConfig, parts[0])
+	}
+	return &Key{ID: parts[0], Secret: secret}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Enabled reports whether new values are encrypted
+func (k *Keyring) Enabled() bool {
+	return k.primary != ""
+}
+
+// PrimaryKeyID is the ID of the key that encrypts new values. It is empty if
+// encryption is disabled
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primary
+}
+
+// Encrypt seals a value. The associated data, i.e., the name the value is
+// stored under, must be given again to decrypt it, which keeps encrypted values
+// from being swapped with each other
+func (k *Keyring) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	if !k.Enabled() {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, len(magic)+1+len(k.primary)+2*(nonceSize+tagSize)+keySize+len(plaintext))
+	envelope = append(envelope, magic...)
+	envelope = append(envelope, byte(len(k.primary)))
+	envelope = append(envelope, k.primary...)
+
+	envelope, err = seal(k.keys[k.primary], envelope, dataKey, []byte(k.primary))
+	if err != nil {
+		return nil, err
+	}
+	return seal(dataAEAD, envelope, plaintext, associatedData)
+}
+
+// seal appends a random nonce and the encrypted value to dst
+func seal(aead cipher.AEAD, dst, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, associatedData), nil
+}
+
+// Decrypt opens a value sealed by Encrypt or EncryptWriter. Values that are
+// not encrypted are returned as they are
+func (k *Keyring) Decrypt(data, associatedData []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if bytes.HasPrefix(data, streamMagic) {
+		r, err := k.DecryptReader(bytes.NewReader(data), associatedData)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	keyID, rest, err := splitEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	keyAEAD, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrorUnknownKey, keyID)
+	}
+
+	wrappedKeySize := nonceSize + keySize + tagSize
+	if len(rest) < wrappedKeySize+nonceSize+tagSize {
+		return nil, ErrorInvalidEnvelope
+	}
+	dataKey, err := keyAEAD.Open(nil, rest[:nonceSize], rest[nonceSize:wrappedKeySize], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInvalidEnvelope, err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := rest[wrappedKeySize:]
+	plaintext, err := dataAEAD.Open(nil, sealed[:nonceSize], sealed[nonceSize:], associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInvalidEnvelope, err)
+	}
+	return plaintext, nil
+}
+
+func splitEnvelope(data []byte) (string, []byte, error) {
+	rest := data[len(magic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return "", nil, ErrorInvalidEnvelope
+	}
+	keyIDSize := int(rest[0])
+	return string(rest[1 : 1+keyIDSize]), rest[1+keyIDSize:], nil
+}
+
+// IsEncrypted reports whether a value was sealed by Encrypt or EncryptWriter
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic) || bytes.HasPrefix(data, streamMagic)
+}
+
+// NeedsRotation reports whether a value is not encrypted with the primary key,
+// i.e., because it was written before the key was added
+func (k *Keyring) NeedsRotation(data []byte) bool {
+	if !IsEncrypted(data) {
+		return k.Enabled()
+	}
+	keyID, _, err := splitEnvelope(data)
+	return err == nil && keyID != k.primary
+}
+
+// EncryptString seals a value that is stored as text
+func (k *Keyring) EncryptString(plaintext, associatedData string) (string, error) {
+	if !k.Enabled() {
+		return plaintext, nil
+	}
+	envelope, err := k.Encrypt([]byte(plaintext), []byte(associatedData))
+	if err != nil {
+		return "", err
+	}
+	return stringPrefix + base64.StdEncoding.EncodeToString(envelope), nil
+}
+
+// DecryptString opens a value sealed by EncryptString. Values that are not
+// encrypted are returned as they are
+func (k *Keyring) DecryptString(value, associatedData string) (string, error) {
+	envelope, ok, err := decodeString(value)
+	if err != nil || !ok {
+		return value, err
+	}
+	plaintext, err := k.Decrypt(envelope, []byte(associatedData))
+	return string(plaintext), err
+}
+
+// StringNeedsRotation is NeedsRotation for values sealed by EncryptString
+func (k *Keyring) StringNeedsRotation(value string) bool {
+	envelope, ok, err := decodeString(value)
+	if err != nil {
+		return false
+	}
+	if !ok {
+		return k.Enabled()
+	}
+	return k.NeedsRotation(envelope)
+}
+
+func decodeString(value string) ([]byte, bool, error) {
+	if !strings.HasPrefix(value, stringPrefix) {
+		return nil, false, nil
+	}
+	envelope, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, stringPrefix))
+	if err != nil || !IsEncrypted(envelope) {
+		return nil, false, ErrorInvalidEnvelope
+	}
+	return envelope, true, nil
+}
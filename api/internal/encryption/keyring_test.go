@@ -0,0 +1,273 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T, id string) Key {
+	t.Helper()
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	return Key{ID: id, Secret: secret}
+}
+
+func newKeyring(t *testing.T, keys ...Key) *Keyring {
+	t.Helper()
+	keyring, err := NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestRoundTrip(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	ad := []byte("123/456.json")
+
+	cases := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"empty", []byte{}},
+		{"short", []byte("x")},
+		{"json", []byte(`[{"type":"latlng","data":[[47.1,-122.2]]}]`)},
+		{"large", bytes.Repeat([]byte("heatmap"), 100000)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sealed, err := keyring.Encrypt(c.plaintext, ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsEncrypted(sealed) {
+				t.Fatal("sealed value is not recognized as encrypted")
+			}
+			if len(c.plaintext) > 0 && bytes.Contains(sealed, c.plaintext) {
+				t.Fatal("sealed value contains the plaintext")
+			}
+
+			opened, err := keyring.Decrypt(sealed, ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, c.plaintext) {
+				t.Errorf("decrypted value differs from the plaintext")
+			}
+		})
+	}
+}
+
+func TestEncryptIsRandomized(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	first, _ := keyring.Encrypt([]byte("token"), nil)
+	second, _ := keyring.Encrypt([]byte("token"), nil)
+	if bytes.Equal(first, second) {
+		t.Error("encrypting the same value twice gave the same envelope")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, primaryKey := newKey(t, "2023"), newKey(t, "2024")
+	before := newKeyring(t, oldKey)
+	after := newKeyring(t, primaryKey, oldKey)
+
+	sealed, err := before.Encrypt([]byte("activity"), []byte("name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.NeedsRotation(sealed) {
+		t.Error("value sealed with the primary key needs rotation")
+	}
+	if !after.NeedsRotation(sealed) {
+		t.Error("value sealed with an old key does not need rotation")
+	}
+
+	// old keys still decrypt
+	opened, err := after.Decrypt(sealed, []byte("name"))
+	if err != nil || string(opened) != "activity" {
+		t.Fatalf("Decrypt() = %q, %v", opened, err)
+	}
+
+	resealed, err := after.Encrypt(opened, []byte("name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.NeedsRotation(resealed) {
+		t.Error("value sealed with the new primary key needs rotation")
+	}
+	if after.PrimaryKeyID() != "2024" {
+		t.Errorf("PrimaryKeyID() = %s, want 2024", after.PrimaryKeyID())
+	}
+
+	// once the old key is removed, only values sealed with the new key open
+	rotated := newKeyring(t, primaryKey)
+	if _, err := rotated.Decrypt(resealed, []byte("name")); err != nil {
+		t.Errorf("Decrypt() of rotated value = %v", err)
+	}
+	if _, err := rotated.Decrypt(sealed, []byte("name")); !errors.Is(err, ErrorUnknownKey) {
+		t.Errorf("Decrypt() with removed key = %v, want %v", err, ErrorUnknownKey)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	sealed, err := newKeyring(t, newKey(t, "a")).Encrypt([]byte("token"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key with the same ID but another secret cannot unwrap the data key
+	if _, err := newKeyring(t, newKey(t, "a")).Decrypt(sealed, nil); !errors.Is(err, ErrorInvalidEnvelope) {
+		t.Errorf("Decrypt() with another secret = %v, want %v", err, ErrorInvalidEnvelope)
+	}
+	if _, err := newKeyring(t, newKey(t, "b")).Decrypt(sealed, nil); !errors.Is(err, ErrorUnknownKey) {
+		t.Errorf("Decrypt() with another key ID = %v, want %v", err, ErrorUnknownKey)
+	}
+	if _, err := newKeyring(t).Decrypt(sealed, nil); !errors.Is(err, ErrorUnknownKey) {
+		t.Errorf("Decrypt() with an empty keyring = %v, want %v", err, ErrorUnknownKey)
+	}
+}
+
+func TestTamperedEnvelope(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	ad := []byte("1/2.json")
+	sealed, err := keyring.Encrypt([]byte("activity data"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	headerSize := len(magic) + 1 + len("a")
+
+	cases := []struct {
+		name     string
+		envelope []byte
+		ad       []byte
+	}{
+		{"wrapped key nonce", flip(headerSize), ad},
+		{"wrapped key", flip(headerSize + nonceSize), ad},
+		{"value nonce", flip(headerSize + nonceSize + keySize + tagSize), ad},
+		{"value", flip(len(sealed) - tagSize - 1), ad},
+		{"tag", flip(len(sealed) - 1), ad},
+		{"truncated", sealed[:len(sealed)-1], ad},
+		{"too short", sealed[:headerSize+nonceSize], ad},
+		{"key ID length", flip(len(magic)), ad},
+		{"associated data", sealed, []byte("1/3.json")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := keyring.Decrypt(c.envelope, c.ad)
+			if err == nil {
+				t.Fatal("tampered envelope was decrypted")
+			}
+			if !errors.Is(err, ErrorInvalidEnvelope) && !errors.Is(err, ErrorUnknownKey) {
+				t.Errorf("Decrypt() = %v, want an invalid envelope", err)
+			}
+		})
+	}
+}
+
+func TestPlaintextPassthrough(t *testing.T) {
+	disabled := newKeyring(t)
+	enabled := newKeyring(t, newKey(t, "a"))
+
+	if disabled.Enabled() {
+		t.Error("empty keyring is enabled")
+	}
+	sealed, err := disabled.Encrypt([]byte("plain"), nil)
+	if err != nil || string(sealed) != "plain" {
+		t.Errorf("Encrypt() without keys = %q, %v", sealed, err)
+	}
+	if disabled.NeedsRotation([]byte("plain")) {
+		t.Error("plaintext needs rotation without keys")
+	}
+
+	// values written before encryption was enabled are read as they are
+	for _, keyring := range []*Keyring{disabled, enabled} {
+		opened, err := keyring.Decrypt([]byte(`[{"type":"latlng"}]`), []byte("name"))
+		if err != nil || string(opened) != `[{"type":"latlng"}]` {
+			t.Errorf("Decrypt() of plaintext = %q, %v", opened, err)
+		}
+		token, err := keyring.DecryptString("abc123", "ad")
+		if err != nil || token != "abc123" {
+			t.Errorf("DecryptString() of plaintext = %q, %v", token, err)
+		}
+	}
+	if !enabled.NeedsRotation([]byte("plain")) || !enabled.StringNeedsRotation("abc123") {
+		t.Error("plaintext does not need rotation once keys are configured")
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	sealed, err := keyring.EncryptString("refresh-token", "athlete-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == "refresh-token" || keyring.StringNeedsRotation(sealed) {
+		t.Fatalf("EncryptString() = %q", sealed)
+	}
+
+	opened, err := keyring.DecryptString(sealed, "athlete-1")
+	if err != nil || opened != "refresh-token" {
+		t.Errorf("DecryptString() = %q, %v", opened, err)
+	}
+	if _, err := keyring.DecryptString(sealed, "athlete-2"); !errors.Is(err, ErrorInvalidEnvelope) {
+		t.Errorf("DecryptString() with other associated data = %v, want %v", err, ErrorInvalidEnvelope)
+	}
+	if _, err := keyring.DecryptString(stringPrefix+"not base64!", ""); !errors.Is(err, ErrorInvalidEnvelope) {
+		t.Errorf("DecryptString() of malformed value = %v, want %v", err, ErrorInvalidEnvelope)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	encode := func(key Key) string {
+		return key.ID + ":" + base64.StdEncoding.EncodeToString(key.Secret)
+	}
+	a, b, c := newKey(t, "a"), newKey(t, "b"), newKey(t, "c")
+
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte("# rotated keys\n"+encode(c)+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := LoadKeyring(encode(a)+", "+encode(b), keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.PrimaryKeyID() != "a" || len(keyring.keys) != 3 {
+		t.Errorf("loaded primary %s and %d keys", keyring.PrimaryKeyID(), len(keyring.keys))
+	}
+
+	invalid := []string{
+		"a",
+		"a:not base64!",
+		"a:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		encode(a) + "," + encode(Key{ID: "a", Secret: b.Secret}),
+		":" + base64.StdEncoding.EncodeToString(a.Secret),
+	}
+	for _, keys := range invalid {
+		if _, err := LoadKeyring(keys, ""); !errors.Is(err, ErrorInvalidKeyConfig) {
+			t.Errorf("LoadKeyring(%q) = %v, want %v", keys, err, ErrorInvalidKeyConfig)
+		}
+	}
+}
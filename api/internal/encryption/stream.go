@@ -0,0 +1,256 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// values streamed through EncryptWriter are sealed in chunks of this size, so
+// neither side holds more than a chunk in memory
+const chunkSize = 64 * 1024
+
+// streamMagic starts every streamed envelope. The layout is: magic, key ID
+// length (1 byte), key ID, nonce and encrypted data key, then the encrypted
+// chunks. The nonce of a chunk is its index and a flag that marks the last
+// chunk, so chunks cannot be reordered and the value cannot be truncated. The
+// data key is never reused, which makes these nonces safe
+var streamMagic = []byte("HMSTR1")
+
+// EncryptWriter seals a value as it is written to w, for values too large to
+// hold in memory. The value is complete once the writer is closed, which does
+// not close w. Values sealed this way are opened by Decrypt and DecryptReader
+func (k *Keyring) EncryptWriter(w io.Writer, associatedData []byte) (io.WriteCloser, error) {
+	if !k.Enabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(streamMagic)+1+len(k.primary)+nonceSize+keySize+tagSize)
+	header = append(header, streamMagic...)
+	header = append(header, byte(len(k.primary)))
+	header = append(header, k.primary...)
+	header, err = seal(k.keys[k.primary], header, dataKey, []byte(k.primary))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:              w,
+		aead:           dataAEAD,
+		associatedData: associatedData,
+		plaintext:      make([]byte, 0, chunkSize),
+		sealed:         make([]byte, 0, chunkSize+tagSize),
+	}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type encryptWriter struct {
+	w              io.Writer
+	aead           cipher.AEAD
+	associatedData []byte
+	// index of the next chunk
+	chunk uint32
+	// plaintext of the next chunk
+	plaintext []byte
+	sealed    []byte
+	closed    bool
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows it, since the
+		// last chunk is sealed differently
+		if len(e.plaintext) == chunkSize {
+			if err := e.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.plaintext[len(e.plaintext):chunkSize], p)
+		e.plaintext = e.plaintext[:len(e.plaintext)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.sealChunk(true)
+}
+
+func (e *encryptWriter) sealChunk(last bool) error {
+	if e.chunk == math.MaxUint32 {
+		return fmt.Errorf("value is too large to encrypt")
+	}
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.chunk, last), e.plaintext, e.associatedData)
+	if _, err := e.w.Write(e.sealed); err != nil {
+		return err
+	}
+	e.chunk++
+	e.plaintext = e.plaintext[:0]
+	return nil
+}
+
+func chunkNonce(chunk uint32, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint32(nonce[nonceSize-5:], chunk)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// DecryptReader opens a value as it is read from r. It reads values sealed by
+// EncryptWriter one chunk at a time, and values sealed by Encrypt at once.
+// Values that are not encrypted are read as they are
+func (k *Keyring) DecryptReader(r io.Reader, associatedData []byte) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	head, err := buffered.Peek(len(streamMagic))
+	if err == io.EOF || (err == nil && !bytes.Equal(head, streamMagic) && !bytes.Equal(head, magic)) {
+		return buffered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(head, magic) {
+		data, err := ioutil.ReadAll(buffered)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := k.Decrypt(data, associatedData)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(plaintext), nil
+	}
+
+	header := make([]byte, len(streamMagic)+1)
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return nil, ErrorInvalidEnvelope
+	}
+	keyID := make([]byte, header[len(header)-1])
+	if _, err := io.ReadFull(buffered, keyID); err != nil {
+		return nil, ErrorInvalidEnvelope
+	}
+	keyAEAD, ok := k.keys[string(keyID)]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrorUnknownKey, keyID)
+	}
+
+	wrappedKey := make([]byte, nonceSize+keySize+tagSize)
+	if _, err := io.ReadFull(buffered, wrappedKey); err != nil {
+		return nil, ErrorInvalidEnvelope
+	}
+	dataKey, err := keyAEAD.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInvalidEnvelope, err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:              buffered,
+		aead:           dataAEAD,
+		associatedData: associatedData,
+		// one byte more than a chunk, which tells whether another chunk
+		// follows
+		sealed: make([]byte, chunkSize+tagSize+1),
+	}, nil
+}
+
+type decryptReader struct {
+	r              io.Reader
+	aead           cipher.AEAD
+	associatedData []byte
+	// index of the next chunk
+	chunk uint32
+	last  bool
+	// plaintext of the current chunk that was not read yet
+	plaintext []byte
+	sealed    []byte
+	// bytes of the next chunk that were read along with the current one
+	carried int
+	err     error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.openChunk()
+	}
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+func (d *decryptReader) openChunk() error {
+	if d.last {
+		return io.EOF
+	}
+
+	n, err := io.ReadFull(d.r, d.sealed[d.carried:])
+	n += d.carried
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.last = true
+	default:
+		return err
+	}
+
+	size := n
+	if !d.last {
+		size = chunkSize + tagSize
+	}
+	plaintext, err := d.aead.Open(nil, chunkNonce(d.chunk, d.last), d.sealed[:size], d.associatedData)
+	if err != nil {
+		return fmt.Errorf("%w: %+v", ErrorInvalidEnvelope, err)
+	}
+	d.chunk++
+	d.plaintext = plaintext
+
+	if !d.last {
+		d.sealed[0] = d.sealed[size]
+		d.carried = 1
+	}
+	return nil
+}
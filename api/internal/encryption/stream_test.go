@@ -0,0 +1,168 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptStream(t *testing.T, keyring *Keyring, plaintext, ad []byte, writeSize int) []byte {
+	t.Helper()
+	sealed := &bytes.Buffer{}
+	w, err := keyring.EncryptWriter(sealed, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(plaintext) > 0 {
+		n := writeSize
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		if _, err := w.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func decryptStream(keyring *Keyring, sealed, ad []byte) ([]byte, error) {
+	r, err := keyring.DecryptReader(bytes.NewReader(sealed), ad)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	ad := []byte("takeout/1/export.zip")
+
+	cases := []struct {
+		name      string
+		size      int
+		writeSize int
+	}{
+		{"empty", 0, 1},
+		{"short", 10, 3},
+		{"under a chunk", chunkSize - 1, chunkSize},
+		{"one chunk", chunkSize, chunkSize},
+		{"over a chunk", chunkSize + 1, 1000},
+		{"several chunks", 3*chunkSize + 17, 4096},
+		{"single write", 2 * chunkSize, 2 * chunkSize},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plaintext := bytes.Repeat([]byte("heatmap!"), c.size/8+1)[:c.size]
+			sealed := encryptStream(t, keyring, plaintext, ad, c.writeSize)
+			if !IsEncrypted(sealed) {
+				t.Fatal("sealed value is not recognized as encrypted")
+			}
+			if c.size > 0 && bytes.Contains(sealed, plaintext) {
+				t.Fatal("sealed value contains the plaintext")
+			}
+
+			opened, err := decryptStream(keyring, sealed, ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("DecryptReader() read %d bytes, want %d", len(opened), len(plaintext))
+			}
+
+			// values that were streamed can also be read at once
+			opened, err = keyring.Decrypt(sealed, ad)
+			if err != nil || !bytes.Equal(opened, plaintext) {
+				t.Errorf("Decrypt() read %d bytes, %v", len(opened), err)
+			}
+		})
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	keyring := newKeyring(t, newKey(t, "a"))
+	ad := []byte("takeout/1/export.zip")
+	plaintext := bytes.Repeat([]byte("x"), 3*chunkSize)
+	sealed := encryptStream(t, keyring, plaintext, ad, chunkSize)
+
+	headerSize := len(streamMagic) + 1 + len("a") + nonceSize + keySize + tagSize
+	sealedChunk := chunkSize + tagSize
+	firstChunk := sealed[headerSize : headerSize+sealedChunk]
+	secondChunk := sealed[headerSize+sealedChunk : headerSize+2*sealedChunk]
+
+	flip := func(i int) []byte {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	cases := []struct {
+		name     string
+		envelope []byte
+		ad       []byte
+	}{
+		{"wrapped key", flip(headerSize - 1), ad},
+		{"first chunk", flip(headerSize), ad},
+		{"last chunk", flip(len(sealed) - 1), ad},
+		{"truncated at a chunk", sealed[:headerSize+2*sealedChunk], ad},
+		{"truncated in a chunk", sealed[:len(sealed)-1], ad},
+		{"reordered chunks", concat(sealed[:headerSize], secondChunk, firstChunk, sealed[headerSize+2*sealedChunk:]), ad},
+		{"appended chunk", concat(sealed, secondChunk), ad},
+		{"header only", sealed[:headerSize], ad},
+		{"associated data", sealed, []byte("takeout/2/export.zip")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decryptStream(keyring, c.envelope, c.ad)
+			if !errors.Is(err, ErrorInvalidEnvelope) {
+				t.Errorf("DecryptReader() = %v, want %v", err, ErrorInvalidEnvelope)
+			}
+		})
+	}
+
+	if _, err := decryptStream(newKeyring(t, newKey(t, "b")), sealed, ad); !errors.Is(err, ErrorUnknownKey) {
+		t.Errorf("DecryptReader() with another key ID = %v, want %v", err, ErrorUnknownKey)
+	}
+}
+
+func TestStreamPassthrough(t *testing.T) {
+	disabled := newKeyring(t)
+	enabled := newKeyring(t, newKey(t, "a"))
+	ad := []byte("name")
+
+	sealed := encryptStream(t, disabled, []byte("plain"), ad, 2)
+	if string(sealed) != "plain" {
+		t.Errorf("EncryptWriter() without keys wrote %q", sealed)
+	}
+
+	// plaintext, including values shorter than the magic, and values sealed
+	// at once are read as well
+	whole, err := enabled.Encrypt([]byte("sealed at once"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		stored []byte
+		want   string
+	}{
+		{[]byte{}, ""},
+		{[]byte("ab"), "ab"},
+		{[]byte(`[{"type":"latlng"}]`), `[{"type":"latlng"}]`},
+		{whole, "sealed at once"},
+	}
+	for _, c := range cases {
+		opened, err := decryptStream(enabled, c.stored, ad)
+		if err != nil || string(opened) != c.want {
+			t.Errorf("DecryptReader(%q) = %q, %v, want %q", c.stored, opened, err, c.want)
+		}
+	}
+}
@@ -1,16 +1,18 @@
 package maps
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
 	"math"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
 )
 
-type mapStruct struct {
-	Type string        `json:"type"`
-	Data []interface{} `json:"data"`
-}
+const (
+	earthRadiusMeters = 6371000
+	// consecutive points further apart than this are not joined, i.e., a GPS
+	// glitch or a recording that was paused while travelling. Such a segment
+	// would cross an unbounded number of tiles at high zoom levels
+	maxSegmentMeters = 10000
+)
 
 func project(lat, lon float64) (float64, float64) {
 	siny := math.Sin(lat * math.Pi / 180.0)
@@ -20,63 +22,123 @@ func project(lat, lon float64) (float64, float64) {
 	return x, y
 }
 
-func parseLatLonList(data []byte) [][]float64 {
-	results := [][]float64{}
+// projectLines projects coordinates into world coordinates and splits them into
+// the polylines that are drawn. Lines take the short way around the world, so
+// a line that crosses the antimeridian ends one polyline past one edge of the
+// map and starts the next one past the opposite edge. Points further apart
+// than maxSegmentMeters start a new polyline
+func projectLines(coords [][]float64) [][][2]float64 {
+	lines := [][][2]float64{}
+	line := [][2]float64{}
+
+	for i, coord := range coords {
+		x, y := project(coord[0], coord[1])
+		if len(line) > 0 && distanceMeters(coords[i-1], coord) > maxSegmentMeters {
+			lines = append(lines, line)
+			line = [][2]float64{}
+		}
+		if len(line) > 0 {
+			prev := line[len(line)-1]
+			if dx := x - prev[0]; math.Abs(dx) > tileSize/2 {
+				shift := -math.Copysign(tileSize, dx)
+				lines = append(lines, append(line, [2]float64{x + shift, y}))
+				line = [][2]float64{{prev[0] - shift, prev[1]}}
+			}
+		}
+		line = append(line, [2]float64{x, y})
+	}
 
-	dec := json.NewDecoder(bytes.NewReader(data))
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
 
-	// read open bracket
-	dec.Token()
+// distanceMeters is the great circle distance between two points
+func distanceMeters(a, b []float64) float64 {
+	lat1, lat2 := a[0]*math.Pi/180, b[0]*math.Pi/180
+	dLat, dLon := lat2-lat1, (b[1]-a[1])*math.Pi/180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
 
-	// while the array contains values
-	for dec.More() {
-		var res mapStruct
-		// decode an array value
-		err := dec.Decode(&res)
+// addLineTiles adds every tile at a zoom level that a polyline passes through
+func addLineTiles(line [][2]float64, z int, tiles types.Set) {
+	n := int(1) << z
+	scale := float64(n) / tileSize
+	add := func(x, y int) {
+		if x >= 0 && y >= 0 && x < n && y < n {
+			tiles.Add(Tile{x, y, z})
+		}
+	}
 
-		// skip non-conforming documents
-		if err != nil {
-			dec.Token()
+	for i, pt := range line {
+		if i == 0 {
+			add(int(math.Floor(pt[0]*scale)), int(math.Floor(pt[1]*scale)))
 			continue
 		}
 
-		// parse lat/lons
-		switch res.Type {
-		case "latlng":
-			for _, dataElem := range res.Data {
-				lat, lon, err := parseLatLon(dataElem)
-				if err != nil {
-					continue
-				}
-
-				results = append(results, []float64{lat, lon})
-			}
-		}
+		prev := line[i-1]
+		segmentTiles(prev[0]*scale, prev[1]*scale, pt[0]*scale, pt[1]*scale, add)
 	}
-
-	return results
 }
 
-func parseLatLon(dataElem interface{}) (float64, float64, error) {
-	asList, ok := dataElem.([]interface{})
-	if !ok {
-		return 0, 0, fmt.Errorf("unexpectedly did not find lat/lon list: %+v", dataElem)
+// segmentTiles walks the grid cells crossed by the segment from a to b using a
+// supercover traversal. A segment that passes exactly through a corner also
+// covers both cells that share the corner
+func segmentTiles(ax, ay, bx, by float64, add func(x, y int)) {
+	x, y := int(math.Floor(ax)), int(math.Floor(ay))
+	endX, endY := int(math.Floor(bx)), int(math.Floor(by))
+	add(x, y)
+
+	dx, dy := bx-ax, by-ay
+	stepX, tMaxX, tDeltaX := traversalAxis(ax, dx, x)
+	stepY, tMaxY, tDeltaY := traversalAxis(ay, dy, y)
+
+	// bounds the walk in case floating point error carries it past the end
+	remaining := abs(endX-x) + abs(endY-y)
+	for remaining > 0 && (x != endX || y != endY) {
+		switch {
+		case tMaxX < tMaxY:
+			x += stepX
+			tMaxX += tDeltaX
+			remaining--
+		case tMaxY < tMaxX:
+			y += stepY
+			tMaxY += tDeltaY
+			remaining--
+		default:
+			add(x+stepX, y)
+			add(x, y+stepY)
+			x += stepX
+			y += stepY
+			tMaxX += tDeltaX
+			tMaxY += tDeltaY
+			remaining -= 2
+		}
+		add(x, y)
 	}
+}
 
-	if len(asList) != 2 {
-		return 0, 0, fmt.Errorf("unexpectedly did not find correct number of lat/lon: %+v", asList)
+// traversalAxis returns the direction of a segment along one axis, the
+// fraction of the segment before it leaves the starting cell along that axis,
+// and the fraction it takes to cross a whole cell
+func traversalAxis(start, delta float64, cell int) (int, float64, float64) {
+	switch {
+	case delta > 0:
+		return 1, (float64(cell+1) - start) / delta, 1 / delta
+	case delta < 0:
+		return -1, (start - float64(cell)) / -delta, 1 / -delta
+	default:
+		return 0, math.Inf(1), math.Inf(1)
 	}
+}
 
-	lat, ok := asList[0].(float64)
-	if !ok {
-		return 0, 0, fmt.Errorf("lat was unexpectly not a float: %+v", asList[0])
+func abs(v int) int {
+	if v < 0 {
+		return -v
 	}
-	lon, ok := asList[1].(float64)
-	if !ok {
-		return 0, 0, fmt.Errorf("lon was unexpectly not a float: %+v", asList[0])
-	}
-
-	return lat, lon, nil
+	return v
 }
 
 // https://gis.stackexchange.com/questions/17278/calculate-lat-lon-bounds-for-individual-tile-generated-from-gdal2tiles
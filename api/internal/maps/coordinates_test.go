@@ -0,0 +1,226 @@
+package maps
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
+)
+
+const epsilon = 1e-9
+
+func TestProject(t *testing.T) {
+	cases := []struct {
+		name     string
+		lat, lon float64
+		x, y     float64
+	}{
+		{"origin", 0, 0, tileSize / 2, tileSize / 2},
+		{"west edge", 0, -180, 0, tileSize / 2},
+		{"east edge", 0, 180, tileSize, tileSize / 2},
+		{"north edge", 85.0511287798, 0, tileSize / 2, 0},
+		{"south edge", -85.0511287798, 0, tileSize / 2, tileSize},
+		// clamped, rather than projected to infinity
+		{"north pole", 90, 0, tileSize / 2, tileSize * (0.5 - math.Log(1.9999/0.0001)/(4*math.Pi))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			x, y := project(c.lat, c.lon)
+			if math.Abs(x-c.x) > 1e-6 || math.Abs(y-c.y) > 1e-6 {
+				t.Errorf("project(%v, %v) = (%v, %v), want (%v, %v)", c.lat, c.lon, x, y, c.x, c.y)
+			}
+		})
+	}
+}
+
+func TestProjectMatchesTileBounds(t *testing.T) {
+	cases := []Tile{
+		{0, 0, 0},
+		{1, 1, 1},
+		{654, 1583, 12},
+		{83749, 202621, 19},
+	}
+
+	for _, tile := range cases {
+		n := float64(int(1) << tile.Z)
+		x, y := project(tileToLat(tile.Y, tile.Z), tileToLon(tile.X, tile.Z))
+		if gotX, gotY := x*n/tileSize, y*n/tileSize; math.Abs(gotX-float64(tile.X)) > 1e-6 || math.Abs(gotY-float64(tile.Y)) > 1e-6 {
+			t.Errorf("top left corner of %+v projects to tile (%v, %v)", tile, gotX, gotY)
+		}
+	}
+}
+
+func TestTileToLatLon(t *testing.T) {
+	cases := []struct {
+		x, y, z  int
+		lat, lon float64
+	}{
+		{0, 0, 0, 85.0511287798, -180},
+		{1, 1, 1, 0, 0},
+		{2, 2, 1, -85.0511287798, 180},
+	}
+
+	for _, c := range cases {
+		lat, lon := tileToLat(c.y, c.z), tileToLon(c.x, c.z)
+		if math.Abs(lat-c.lat) > 1e-6 || math.Abs(lon-c.lon) > epsilon {
+			t.Errorf("tile (%d, %d, %d) starts at (%v, %v), want (%v, %v)", c.x, c.y, c.z, lat, lon, c.lat, c.lon)
+		}
+	}
+}
+
+func TestDistanceMeters(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"same point", []float64{47.6, -122.3}, []float64{47.6, -122.3}, 0},
+		{"degree of latitude", []float64{0, 0}, []float64{1, 0}, 111195},
+		{"degree of longitude at 60 degrees", []float64{60, 10}, []float64{60, 11}, 55597},
+		{"across the antimeridian", []float64{0, 179.99}, []float64{0, -179.99}, 2224},
+		{"antipodes", []float64{0, 0}, []float64{0, 180}, math.Pi * earthRadiusMeters},
+	}
+
+	for _, c := range cases {
+		if got := distanceMeters(c.a, c.b); math.Abs(got-c.want) > 1 {
+			t.Errorf("%s: distanceMeters() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProjectLines(t *testing.T) {
+	x := func(lon float64) float64 {
+		return tileSize * (0.5 + lon/360)
+	}
+	const y = tileSize / 2
+
+	cases := []struct {
+		name   string
+		coords [][]float64
+		want   [][][2]float64
+	}{
+		{"empty", [][]float64{}, [][][2]float64{}},
+		{"single point", [][]float64{{0, 10}}, [][][2]float64{{{x(10), y}}}},
+		{
+			"no split",
+			[][]float64{{0, 10}, {0, 10.05}, {0, 10.1}},
+			[][][2]float64{{{x(10), y}, {x(10.05), y}, {x(10.1), y}}},
+		},
+		{
+			// each polyline runs past the edge of the map, so both sides
+			// of the antimeridian are drawn
+			"east to west across the antimeridian",
+			[][]float64{{0, 179.99}, {0, -179.99}},
+			[][][2]float64{
+				{{x(179.99), y}, {x(-179.99) + tileSize, y}},
+				{{x(179.99) - tileSize, y}, {x(-179.99), y}},
+			},
+		},
+		{
+			"west to east across the antimeridian",
+			[][]float64{{0, -179.99}, {0, 179.99}},
+			[][][2]float64{
+				{{x(-179.99), y}, {x(179.99) - tileSize, y}},
+				{{x(-179.99) + tileSize, y}, {x(179.99), y}},
+			},
+		},
+		{
+			// the jump is not drawn, and does not cover the tiles between
+			"points too far apart",
+			[][]float64{{0, 10}, {0, 10.05}, {0, 20}, {0, 20.05}},
+			[][][2]float64{
+				{{x(10), y}, {x(10.05), y}},
+				{{x(20), y}, {x(20.05), y}},
+			},
+		},
+		{
+			"glitch to null island",
+			[][]float64{{0, 10}, {0, 0}, {0, 10.05}},
+			[][][2]float64{{{x(10), y}}, {{x(0), y}}, {{x(10.05), y}}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := projectLines(c.coords)
+			if len(got) != len(c.want) {
+				t.Fatalf("projectLines() = %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if len(got[i]) != len(c.want[i]) {
+					t.Fatalf("line %d = %v, want %v", i, got[i], c.want[i])
+				}
+				for j := range got[i] {
+					if math.Abs(got[i][j][0]-c.want[i][j][0]) > epsilon || math.Abs(got[i][j][1]-c.want[i][j][1]) > epsilon {
+						t.Errorf("line %d point %d = %v, want %v", i, j, got[i][j], c.want[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentTiles(t *testing.T) {
+	cases := []struct {
+		name           string
+		ax, ay, bx, by float64
+		want           [][2]int
+	}{
+		{"within a cell", 0.2, 0.2, 0.8, 0.9, [][2]int{{0, 0}}},
+		{"horizontal", 0.5, 0.5, 3.5, 0.5, [][2]int{{0, 0}, {1, 0}, {2, 0}, {3, 0}}},
+		{"backwards", 3.5, 0.5, 0.5, 0.5, [][2]int{{0, 0}, {1, 0}, {2, 0}, {3, 0}}},
+		{"vertical up", 1.5, 2.5, 1.5, 0.5, [][2]int{{1, 0}, {1, 1}, {1, 2}}},
+		{"shallow", 0.5, 0.5, 2.5, 1.5, [][2]int{{0, 0}, {1, 0}, {1, 1}, {2, 1}}},
+		// cells that only touch the segment at a corner are covered too
+		{"through corners", 0.5, 0.5, 2.5, 2.5, [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}, {2, 1}, {1, 2}, {2, 2}}},
+		{"negative cells", -0.5, 0.5, 0.5, 0.5, [][2]int{{-1, 0}, {0, 0}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := map[[2]int]bool{}
+			segmentTiles(c.ax, c.ay, c.bx, c.by, func(x, y int) {
+				got[[2]int{x, y}] = true
+			})
+
+			want := map[[2]int]bool{}
+			for _, cell := range c.want {
+				want[cell] = true
+			}
+			if len(got) != len(want) {
+				t.Fatalf("segmentTiles() covered %v, want %v", got, c.want)
+			}
+			for cell := range want {
+				if !got[cell] {
+					t.Errorf("segmentTiles() covered %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAddLineTiles(t *testing.T) {
+	// a line that runs past both edges of the map, as lines that cross the
+	// antimeridian do, only adds the tiles on the map
+	tiles := types.NewSet()
+	addLineTiles([][2]float64{{-10, 100}, {tileSize + 10, 100}}, 1, tiles)
+	for _, tile := range []Tile{{0, 0, 1}, {1, 0, 1}} {
+		if !tiles.Exists(tile) {
+			t.Errorf("tile %+v was not added", tile)
+		}
+	}
+	if tiles.Size() != 2 {
+		t.Errorf("added %d tiles, want 2", tiles.Size())
+	}
+
+	// the longest segment that is joined covers a bounded number of tiles,
+	// even at the highest zoom level
+	tiles = types.NewSet()
+	for _, line := range projectLines([][]float64{{47.6, -122.3}, {47.6, -122.3 + 0.13}}) {
+		addLineTiles(line, 19, tiles)
+	}
+	if tiles.Size() == 0 || tiles.Size() > 2000 {
+		t.Errorf("a %.0f meter segment covers %d tiles", distanceMeters([]float64{47.6, -122.3}, []float64{47.6, -122.3 + 0.13}), tiles.Size())
+	}
+}
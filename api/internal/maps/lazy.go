@@ -0,0 +1,152 @@
+package maps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
+)
+
+const (
+	// prefix of tiles that were rendered on demand, which are thrown away
+	// whenever the map is rebuilt
+	lazyTilePrefix = "lazy/"
+)
+
+var (
+	ErrorTileOutOfRange = errors.New("tile is not available for this map")
+)
+
+func lazyTileName(mapID string, t Tile, format string, sizePx int) string {
+	if format == TileFormatMVT {
+		return lazyTilePrefix + vectorTileName(mapID, t)
+	}
+	return lazyTilePrefix + tileName(mapID, t, sizePx)
+}
+
+// GetOrRenderTile returns a tile of a map, rendering it from the activities of
+// the athlete if it has not been requested since the map was last rebuilt
+func (ms MapService) GetOrRenderTile(ctx context.Context, mapID string, t Tile, format string, sizePx int) ([]byte, error) {
+	if err := ms.validateTileRequest(t, format, sizePx); err != nil {
+		return nil, err
+	}
+
+	name := lazyTileName(mapID, t, format, sizePx)
+	exists, err := ms.tileStorageSvc.ObjectExists(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	if exists {
+		return ms.tileStorageSvc.GetObjectBytes(ctx, name)
+	}
+
+	athleteID, err := ms.stravaSvc.Athlete.GetAthleteForMapID(ctx, mapID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	}
+
+	tracks, err := ms.loadTracks(ctx, athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	var bytes []byte
+	if format == TileFormatMVT {
+		bytes = renderVectorTile(tracks, t)
+	} else {
+		maxVisits, err := ms.db.getMaxVisits(ctx, mapID, t.Z)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+		}
+
+		bytes, err = encodePNG(renderTile(tracks, t, sizePx, ms.style, maxVisits))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+		}
+	}
+
+	// a failure to cache the tile should not fail the request
+	if err := ms.tileStorageSvc.CreateObject(ctx, name, bytes); err != nil {
+		log.Printf("error caching tile '%s': %+v", name, err)
+	}
+
+	return bytes, nil
+}
+
+// validateTileRequest only allows tiles that are rendered on demand, which are
+// those at or above the lazy zoom level. Every other tile is built with the map
+func (ms MapService) validateTileRequest(t Tile, format string, sizePx int) error {
+	if ms.lazyTileMinZoom <= 0 {
+		return ErrorTileOutOfRange
+	}
+	if t.Z < ms.lazyTileMinZoom || t.Z < ms.minTileZoom || t.Z > ms.maxTileZoom {
+		return ErrorTileOutOfRange
+	}
+
+	if t.X < 0 || t.Y < 0 || t.X >= 1<<t.Z || t.Y >= 1<<t.Z {
+		return ErrorTileOutOfRange
+	}
+
+	found := false
+	for _, f := range ms.tileFormats {
+		found = found || f == format
+	}
+	if !found {
+		return ErrorTileOutOfRange
+	}
+
+	if format == TileFormatMVT {
+		return nil
+	}
+
+	for _, size := range ms.tileSizes {
+		if size == sizePx {
+			return nil
+		}
+	}
+	return ErrorTileOutOfRange
+}
+
+// invalidateLazyTiles removes tiles that were rendered on demand for a map. If
+// affected is not nil, only tiles in it are removed
+func (ms MapService) invalidateLazyTiles(ctx context.Context, mapID string, affected *tileSet) error {
+	if ms.lazyTileMinZoom <= 0 {
+		return nil
+	}
+
+	names, err := ms.tileStorageSvc.ListObjects(ctx, lazyTilePrefix+mapID+"-")
+	if err != nil {
+		return err
+	}
+
+	stale := types.NewSet()
+	if affected != nil {
+		for k := range affected.tiles.ToMap() {
+			t := k.(Tile)
+			if t.Z < ms.lazyTileMinZoom {
+				continue
+			}
+
+			stale.Add(lazyTileName(mapID, t, TileFormatMVT, 0))
+			for _, size := range ms.tileSizes {
+				stale.Add(lazyTileName(mapID, t, TileFormatPNG, size))
+			}
+		}
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if affected != nil && !stale.Exists(name) {
+			continue
+		}
+		if err := ms.tileStorageSvc.DeleteObject(ctx, name); err != nil {
+			return err
+		}
+		deleted++
+	}
+
+	log.Printf("invalidated '%d' on demand tiles for map '%s'", deleted, mapID)
+	return nil
+}
@@ -0,0 +1,44 @@
+package maps
+
+import "testing"
+
+func TestValidateTileRequest(t *testing.T) {
+	lazy := MapService{
+		minTileZoom:     2,
+		maxTileZoom:     16,
+		lazyTileMinZoom: 13,
+		tileSizes:       []int{256, 512},
+		tileFormats:     []string{TileFormatPNG, TileFormatMVT},
+	}
+	disabled := lazy
+	disabled.lazyTileMinZoom = 0
+
+	cases := []struct {
+		name   string
+		ms     MapService
+		tile   Tile
+		format string
+		sizePx int
+		ok     bool
+	}{
+		{"lazy zoom", lazy, Tile{10, 20, 13}, TileFormatPNG, 256, true},
+		{"highest zoom", lazy, Tile{10, 20, 16}, TileFormatPNG, 512, true},
+		{"vector tile", lazy, Tile{10, 20, 14}, TileFormatMVT, 256, true},
+		// tiles below the lazy zoom level are built with the map
+		{"built with the map", lazy, Tile{1, 1, 12}, TileFormatPNG, 256, false},
+		{"below the minimum zoom", lazy, Tile{0, 0, 1}, TileFormatPNG, 256, false},
+		{"above the maximum zoom", lazy, Tile{0, 0, 17}, TileFormatPNG, 256, false},
+		{"lazy rendering disabled", disabled, Tile{10, 20, 13}, TileFormatPNG, 256, false},
+		{"lazy rendering disabled at a low zoom", disabled, Tile{1, 1, 2}, TileFormatPNG, 256, false},
+		{"outside the world", lazy, Tile{1 << 13, 0, 13}, TileFormatPNG, 256, false},
+		{"negative", lazy, Tile{-1, 0, 13}, TileFormatPNG, 256, false},
+		{"unknown size", lazy, Tile{10, 20, 13}, TileFormatPNG, 768, false},
+		{"unknown format", lazy, Tile{10, 20, 13}, "jpg", 256, false},
+	}
+
+	for _, c := range cases {
+		if err := c.ms.validateTileRequest(c.tile, c.format, c.sizePx); (err == nil) != c.ok {
+			t.Errorf("%s: validateTileRequest(%+v, %s, %d) = %v, want ok = %v", c.name, c.tile, c.format, c.sizePx, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package maps
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/concurrency"
+)
+
+// matches the names of tiles written by workers and by on demand rendering
+var tileNameRegex = regexp.MustCompile(`^(?:` + lazyTilePrefix + `)?([0-9a-f-]{36})-(\d+)-(\d+)-(\d+)(?:@\dx)?\.(?:png|mvt)$`)
+
+// parseTileName returns the map and tile that an uploaded tile belongs to. The
+// flag is false for objects that are not tiles
+func parseTileName(name string) (string, Tile, bool) {
+	match := tileNameRegex.FindStringSubmatch(name)
+	if match == nil {
+		return "", Tile{}, false
+	}
+
+	x, _ := strconv.Atoi(match[2])
+	y, _ := strconv.Atoi(match[3])
+	z, _ := strconv.Atoi(match[4])
+	return match[1], Tile{x, y, z}, true
+}
+
+// deleteTiles removes the uploaded tiles of a map in every configured size and
+// format. Tiles of sizes and formats that are no longer configured are left to
+// DeleteStaleTiles
+func (ms MapService) deleteTiles(ctx context.Context, mapID string, tiles []Tile) error {
+	funcs := []func() error{}
+	for _, t := range tiles {
+		names := []string{}
+		for _, format := range ms.tileFormats {
+			if format == TileFormatMVT {
+				names = append(names, vectorTileName(mapID, t))
+				continue
+			}
+			for _, size := range ms.tileSizes {
+				names = append(names, tileName(mapID, t, size))
+			}
+		}
+
+		for _, name := range names {
+			name := name
+			funcs = append(funcs, func() error {
+				return ms.tileStorageSvc.DeleteObject(ctx, name)
+			})
+		}
+	}
+
+	if err := concurrency.NewSemaphore(ms.storageConcurrencyLimit).WithRateLimit(funcs, true); err != nil {
+		return err
+	}
+	if len(tiles) > 0 {
+		log.Printf("deleted '%d' tiles that left map '%s'", len(tiles), mapID)
+	}
+	return nil
+}
+
+// DeleteStaleTiles removes uploaded tiles that are not in the manifest of their
+// map, along with every tile of a map that no longer exists. Maps without a
+// manifest have not been rebuilt since manifests were introduced and are left
+// alone, as are objects that are not tiles
+func (ms MapService) DeleteStaleTiles(ctx context.Context) (int, error) {
+	deleted := 0
+
+	// map IDs are UUIDs, so listing by their first character keeps the number
+	// of names held in memory at once manageable
+	for _, prefix := range []string{"", lazyTilePrefix} {
+		for _, c := range "0123456789abcdef" {
+			names, err := ms.tileStorageSvc.ListObjects(ctx, prefix+string(c))
+			if err != nil {
+				return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+			}
+
+			byMap := map[string][]string{}
+			tiles := map[string]Tile{}
+			for _, name := range names {
+				mapID, t, ok := parseTileName(name)
+				if !ok {
+					continue
+				}
+				byMap[mapID] = append(byMap[mapID], name)
+				tiles[name] = t
+			}
+
+			// the manifest is read after listing, so tiles of a rebuild that
+			// started in between are never mistaken for stale ones
+			for mapID, mapNames := range byMap {
+				exists, err := ms.db.mapExists(ctx, mapID)
+				if err != nil {
+					return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+				}
+
+				manifest, err := ms.db.getTileManifest(ctx, mapID)
+				if err != nil {
+					return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+				}
+				if exists && manifest.Size() == 0 {
+					continue
+				}
+
+				for _, name := range mapNames {
+					if manifest.Exists(tiles[name]) {
+						continue
+					}
+					if err := ms.tileStorageSvc.DeleteObject(ctx, name); err != nil {
+						return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+					}
+					deleted++
+				}
+			}
+		}
+	}
+
+	log.Printf("deleted '%d' stale tiles", deleted)
+	return deleted, nil
+}
+
+// DeleteTilesForMap removes every uploaded tile of a map, i.e., once it was
+// deleted
+func (ms MapService) DeleteTilesForMap(ctx context.Context, mapID string) (int, error) {
+	deleted := 0
+	for _, prefix := range []string{"", lazyTilePrefix} {
+		names, err := ms.tileStorageSvc.ListObjects(ctx, prefix+mapID)
+		if err != nil {
+			return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+		}
+
+		for _, name := range names {
+			if tileMapID, _, ok := parseTileName(name); !ok || tileMapID != mapID {
+				continue
+			}
+			if err := ms.tileStorageSvc.DeleteObject(ctx, name); err != nil {
+				return deleted, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+			}
+			deleted++
+		}
+	}
+
+	log.Printf("deleted '%d' tiles of map '%s'", deleted, mapID)
+	return deleted, nil
+}
@@ -2,10 +2,13 @@ package maps
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
 )
 
 const (
@@ -19,6 +22,10 @@ type mapDB struct {
 }
 
 func (mdb mapDB) setProcessingStateForIDs(ctx context.Context, mapID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
 	queryArgs := []interface{}{}
 	idx := 1
 	queryFormat := ""
@@ -41,12 +48,212 @@ func (mdb mapDB) setProcessingStateForIDs(ctx context.Context, mapID string, ids
 	return err
 }
 
+func (mdb mapDB) setProcessingStateForID(ctx context.Context, messageID string, pstate string) error {
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, updateProcessingStateForIDSQL, messageID, pstate)
+		return err
+	})
+}
+
+func (mdb mapDB) setMaxVisits(ctx context.Context, mapID string, maxVisits map[int]int) error {
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		for zoom, visits := range maxVisits {
+			if _, err := tx.Exec(ctx, upsertMaxVisitsSQL, mapID, zoom, visits); err != nil {
+				return fmt.Errorf("setting max visits for zoom %d: %w", zoom, err)
+			}
+		}
+		return nil
+	})
+}
+
+// getMaxVisits returns 0 if the zoom level has not been computed for the map
+func (mdb mapDB) getMaxVisits(ctx context.Context, mapID string, zoom int) (int, error) {
+	maxVisits := 0
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getMaxVisitsSQL, mapID, zoom)
+		if err := row.Scan(&maxVisits); err != nil && err != pgx.ErrNoRows {
+			return fmt.Errorf("fetching max visits: %w", err)
+		}
+		return nil
+	})
+	return maxVisits, err
+}
+
+// getMaxVisitsByZoom returns the stored max visits of every zoom level of a map
+func (mdb mapDB) getMaxVisitsByZoom(ctx context.Context, mapID string) (map[int]int, error) {
+	maxVisits := map[int]int{}
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, getMaxVisitsByZoomSQL, mapID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var zoom, visits int
+			if err := rows.Scan(&zoom, &visits); err != nil {
+				return err
+			}
+			maxVisits[zoom] = visits
+		}
+		return nil
+	})
+	return maxVisits, err
+}
+
+// getBuiltThrough returns the sync time of the newest activity drawn on a map,
+// or nil if the map has never been built
+func (mdb mapDB) getBuiltThrough(ctx context.Context, mapID string) (*time.Time, error) {
+	var builtThrough *time.Time
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getBuiltThroughSQL, mapID)
+		if err := row.Scan(&builtThrough); err != nil && err != pgx.ErrNoRows {
+			return fmt.Errorf("fetching map build time: %w", err)
+		}
+		return nil
+	})
+	return builtThrough, err
+}
+
+func (mdb mapDB) setBuiltThrough(ctx context.Context, mapID string, builtThrough time.Time) error {
+	// maps without any activities are built from scratch next time
+	if builtThrough.IsZero() {
+		return nil
+	}
+
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, setBuiltThroughSQL, mapID, builtThrough)
+		return err
+	})
+}
+
+// number of tiles written to the manifest per statement
+const manifestBatchSize = 10000
+
+// setTileManifest adds tiles to the manifest of a map, or replaces it. When it
+// is replaced, the tiles that were left out are returned
+func (mdb mapDB) setTileManifest(ctx context.Context, mapID string, tiles []Tile, replace bool) ([]Tile, error) {
+	removed := []Tile{}
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		removed = removed[:0]
+		if replace {
+			kept := types.NewSet()
+			for _, t := range tiles {
+				kept.Add(t)
+			}
+
+			rows, err := tx.Query(ctx, deleteTileManifestSQL, mapID)
+			if err != nil {
+				return fmt.Errorf("deleting tile manifest: %w", err)
+			}
+			for rows.Next() {
+				t := Tile{}
+				if err := rows.Scan(&t.Z, &t.X, &t.Y); err != nil {
+					rows.Close()
+					return fmt.Errorf("deleting tile manifest: %w", err)
+				}
+				if !kept.Exists(t) {
+					removed = append(removed, t)
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("deleting tile manifest: %w", err)
+			}
+		}
+
+		for start := 0; start < len(tiles); start += manifestBatchSize {
+			end := start + manifestBatchSize
+			if end > len(tiles) {
+				end = len(tiles)
+			}
+
+			xs, ys, zs := []int32{}, []int32{}, []int32{}
+			for _, t := range tiles[start:end] {
+				xs = append(xs, int32(t.X))
+				ys = append(ys, int32(t.Y))
+				zs = append(zs, int32(t.Z))
+			}
+
+			if _, err := tx.Exec(ctx, insertTileManifestSQL, mapID, zs, xs, ys); err != nil {
+				return fmt.Errorf("inserting tile manifest: %w", err)
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (mdb mapDB) getTileManifest(ctx context.Context, mapID string) (types.Set, error) {
+	tiles := types.NewSet()
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, getTileManifestSQL, mapID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			t := Tile{}
+			if err := rows.Scan(&t.Z, &t.X, &t.Y); err != nil {
+				return err
+			}
+			tiles.Add(t)
+		}
+		return rows.Err()
+	})
+	return tiles, err
+}
+
+// deleteMap forgets everything recorded about the tiles of a map
+func (mdb mapDB) deleteMap(ctx context.Context, mapID string) error {
+	return mdb.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		for _, query := range deleteMapSQL {
+			if _, err := tx.Exec(ctx, query, mapID); err != nil {
+				return fmt.Errorf("deleting map: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (mdb mapDB) mapExists(ctx context.Context, mapID string) (bool, error) {
+	exists := false
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, mapExistsSQL, mapID).Scan(&exists)
+	})
+	return exists, err
+}
+
 type ProcessingState struct {
 	Queued   int
 	Failed   int
 	Complete int
 }
 
+// getBuilds returns the builds of a map, newest first. Each build queued its
+// tile batches at once, so its batches share their creation time
+func (mdb mapDB) getBuilds(ctx context.Context, mapID string) ([]MapBuild, error) {
+	builds := []MapBuild{}
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, getBuildsSQL, mapID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			build := MapBuild{}
+			if err := rows.Scan(&build.StartedAt, &build.Queued, &build.Failed, &build.Complete); err != nil {
+				return fmt.Errorf("fetching map builds: %w", err)
+			}
+			builds = append(builds, build)
+		}
+		return rows.Err()
+	})
+	return builds, err
+}
+
 func (mdb mapDB) getProcessingStateForMap(ctx context.Context, mapID string) (*ProcessingState, error) {
 	var pstate ProcessingState
 
@@ -55,11 +262,129 @@ func (mdb mapDB) getProcessingStateForMap(ctx context.Context, mapID string) (*P
 		if err := row.Scan(&pstate.Queued, &pstate.Failed, &pstate.Complete); err != nil && err != pgx.ErrNoRows {
 			return fmt.Errorf("fetching processing states form ap: %w", err)
 		}
+
+		// zoom levels of a pyramid build that are waiting on the levels above them
+		pending := 0
+		if err := tx.QueryRow(ctx, getPendingPyramidBatchesSQL, mapID).Scan(&pending); err != nil {
+			return fmt.Errorf("fetching pending pyramid levels: %w", err)
+		}
+		pstate.Queued += pending
 		return nil
 	})
 	return &pstate, err
 }
 
+// setPyramidLevels replaces the zoom levels that are waiting to be enqueued for
+// a map. Each level is a list of tile batches
+func (mdb mapDB) setPyramidLevels(ctx context.Context, mapID string, levels map[int][]interface{}) error {
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, deletePyramidLevelsSQL, mapID); err != nil {
+			return fmt.Errorf("deleting pyramid levels: %w", err)
+		}
+
+		for zoom, batches := range levels {
+			data, err := json.Marshal(batches)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, insertPyramidLevelSQL, mapID, zoom, string(data)); err != nil {
+				return fmt.Errorf("inserting pyramid level %d: %w", zoom, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (mdb mapDB) hasPendingPyramidLevels(ctx context.Context, mapID string) (bool, error) {
+	pending := 0
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, getPendingPyramidBatchesSQL, mapID).Scan(&pending)
+	})
+	return pending > 0, err
+}
+
+// pyramidClaimID stands in for the messages of a pyramid level between the
+// level being claimed and its messages being enqueued, so the level below it
+// cannot be claimed in the meantime
+func pyramidClaimID(mapID string, zoom int) string {
+	return fmt.Sprintf("pyramid:%s:%d", mapID, zoom)
+}
+
+// claimNextPyramidLevel claims the highest zoom level of a map that has not
+// been enqueued, as long as no message of the current build is unfinished. It
+// returns nil batches if there is no such level. The caller enqueues the
+// batches once the claim is committed, so a failed commit cannot enqueue them
+// twice, and then calls recordPyramidLevel, or releasePyramidLevel if the
+// batches could not be enqueued
+func (mdb mapDB) claimNextPyramidLevel(ctx context.Context, mapID string) (int, []TileBatch, error) {
+	var zoom int
+	var batches []TileBatch
+	err := mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		batches = nil
+		var data []byte
+
+		// the row lock makes sure that only one worker claims each level
+		err := tx.QueryRow(ctx, selectNextPyramidLevelSQL, mapID).Scan(&zoom, &data)
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("fetching next pyramid level: %w", err)
+		}
+
+		unfinished := 0
+		if err := tx.QueryRow(ctx, countUnfinishedForLatestBuildSQL, mapID).Scan(&unfinished); err != nil {
+			return fmt.Errorf("counting unfinished messages: %w", err)
+		}
+		if unfinished > 0 {
+			return nil
+		}
+
+		claimed := []TileBatch{}
+		if err := json.Unmarshal(data, &claimed); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, markPyramidLevelEnqueuedSQL, mapID, zoom, true); err != nil {
+			return fmt.Errorf("marking pyramid level %d as enqueued: %w", zoom, err)
+		}
+		if _, err := tx.Exec(ctx, insertProcessingStateForLatestBuildSQL, mapID, processingQueued, []string{pyramidClaimID(mapID, zoom)}); err != nil {
+			return fmt.Errorf("inserting pyramid claim: %w", err)
+		}
+		batches = claimed
+		return nil
+	})
+	return zoom, batches, err
+}
+
+// recordPyramidLevel tracks the messages of a claimed level as part of the
+// current build, in place of the claim
+func (mdb mapDB) recordPyramidLevel(ctx context.Context, mapID string, zoom int, messageIDs []string) error {
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, insertProcessingStateForLatestBuildSQL, mapID, processingQueued, messageIDs); err != nil {
+			return fmt.Errorf("inserting processing states: %w", err)
+		}
+		if _, err := tx.Exec(ctx, deleteProcessingStateForIDSQL, pyramidClaimID(mapID, zoom)); err != nil {
+			return fmt.Errorf("deleting pyramid claim: %w", err)
+		}
+		return nil
+	})
+}
+
+// releasePyramidLevel gives up the claim of a level whose batches could not be
+// enqueued, so that advancePyramid can claim it again
+func (mdb mapDB) releasePyramidLevel(ctx context.Context, mapID string, zoom int) error {
+	return mdb.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, markPyramidLevelEnqueuedSQL, mapID, zoom, false); err != nil {
+			return fmt.Errorf("releasing pyramid level %d: %w", zoom, err)
+		}
+		if _, err := tx.Exec(ctx, deleteProcessingStateForIDSQL, pyramidClaimID(mapID, zoom)); err != nil {
+			return fmt.Errorf("deleting pyramid claim: %w", err)
+		}
+		return nil
+	})
+}
+
 // substitution is a series of escaped SQL values blocks
 var insertProcessingStateForIDsSQL = `
 INSERT INTO
@@ -69,7 +394,220 @@ VALUES
 	%s
 `
 
+var updateProcessingStateForIDSQL = `
+UPDATE
+	QueueProcessingState
+SET
+	pstate = $2
+WHERE
+	message_id = $1
+`
+
+var deleteProcessingStateForIDSQL = `
+DELETE FROM
+	QueueProcessingState
+WHERE
+	message_id = $1
+`
+
+var upsertMaxVisitsSQL = `
+INSERT INTO
+	MapZoomVisits
+	(map_id, zoom, max_visits)
+VALUES
+	($1, $2, $3)
+ON CONFLICT
+	(map_id, zoom)
+	DO UPDATE SET max_visits=EXCLUDED.max_visits, updated_at=NOW()
+`
+
+var getMaxVisitsSQL = `
+SELECT
+	max_visits
+FROM
+	MapZoomVisits
+WHERE
+	map_id = $1 AND zoom = $2
+`
+
+var getMaxVisitsByZoomSQL = `
+SELECT
+	zoom, max_visits
+FROM
+	MapZoomVisits
+WHERE
+	map_id = $1
+`
+
+var getBuiltThroughSQL = `
+SELECT
+	built_through
+FROM
+	AthleteMap
+WHERE
+	id = $1
+`
+
+var setBuiltThroughSQL = `
+UPDATE
+	AthleteMap
+SET
+	built_through = $2
+WHERE
+	id = $1
+`
+
+var deleteMapSQL = []string{`
+DELETE FROM
+	MapTile
+WHERE
+	map_id = $1
+`, `
+DELETE FROM
+	MapZoomVisits
+WHERE
+	map_id = $1
+`, `
+DELETE FROM
+	MapPyramidLevel
+WHERE
+	map_id = $1
+`, `
+DELETE FROM
+	QueueProcessingState
+WHERE
+	map_id = $1
+`}
+
+var mapExistsSQL = `
+SELECT EXISTS (
+	SELECT
+		id
+	FROM
+		AthleteMap
+	WHERE
+		id = $1
+)
+`
+
+var deleteTileManifestSQL = `
+DELETE FROM
+	MapTile
+WHERE
+	map_id = $1
+RETURNING
+	z, x, y
+`
+
+var insertTileManifestSQL = `
+INSERT INTO
+	MapTile
+	(map_id, z, x, y)
+SELECT
+	$1, UNNEST($2::INT[]), UNNEST($3::INT[]), UNNEST($4::INT[])
+ON CONFLICT
+	DO NOTHING
+`
+
+var getTileManifestSQL = `
+SELECT
+	z, x, y
+FROM
+	MapTile
+WHERE
+	map_id = $1
+`
+
+var deletePyramidLevelsSQL = `
+DELETE FROM
+	MapPyramidLevel
+WHERE
+	map_id = $1
+`
+
+var insertPyramidLevelSQL = `
+INSERT INTO
+	MapPyramidLevel
+	(map_id, zoom, batches)
+VALUES
+	($1, $2, $3::JSONB)
+`
+
+var selectNextPyramidLevelSQL = `
+SELECT
+	zoom, batches
+FROM
+	MapPyramidLevel
+WHERE
+	map_id = $1 AND NOT enqueued
+ORDER BY
+	zoom DESC
+LIMIT 1
+FOR UPDATE
+`
+
+var markPyramidLevelEnqueuedSQL = `
+UPDATE
+	MapPyramidLevel
+SET
+	enqueued = $3
+WHERE
+	map_id = $1 AND zoom = $2
+`
+
+var getPendingPyramidBatchesSQL = `
+SELECT
+	COALESCE(SUM(jsonb_array_length(batches)), 0)
+FROM
+	MapPyramidLevel
+WHERE
+	map_id = $1 AND NOT enqueued
+`
+
+// messages that are still being retried are QUEUED, so a level is only built
+// once every tile of the level above it was rendered or given up on
+var countUnfinishedForLatestBuildSQL = `
+SELECT
+	count(message_id)
+FROM
+	QueueProcessingState
+WHERE
+	map_id = $1
+	AND
+	pstate NOT IN ('` + processingComplete + `', '` + processingFailed + `')
+	AND
+	created_at = (SELECT MAX(created_at) FROM QueueProcessingState WHERE map_id = $1)
+`
+
+// messages share the creation time of the latest build so that progress is
+// reported across every zoom level of the build
+var insertProcessingStateForLatestBuildSQL = `
+INSERT INTO
+	QueueProcessingState
+	(map_id, message_id, pstate, created_at)
+SELECT
+	$1, message_id, $2::PSTATE, (SELECT MAX(created_at) FROM QueueProcessingState WHERE map_id = $1)
+FROM
+	UNNEST($3::VARCHAR[]) AS message_id
+`
+
 // group by each state, filtering on the latest insertion date
+var getBuildsSQL = `
+SELECT
+	created_at,
+	count(message_id) FILTER (WHERE pstate='` + processingQueued + `'),
+	count(message_id) FILTER (WHERE pstate='` + processingFailed + `'),
+	count(message_id) FILTER (WHERE pstate='` + processingComplete + `')
+FROM
+	QueueProcessingState
+WHERE
+	map_id = $1
+GROUP BY
+	created_at
+ORDER BY
+	created_at DESC
+`
+
 var getProcessingStateForMapSQL = `
 SELECT
 	count(message_id) FILTER (WHERE pstate='` + processingQueued + `')   AS "queued",
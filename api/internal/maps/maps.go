@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/nmiodice/personal-strava-heatmap/internal/batch"
 	"github.com/nmiodice/personal-strava-heatmap/internal/concurrency"
@@ -20,13 +22,20 @@ const (
 
 type MapService struct {
 	stravaSvc               *strava.StravaService
-	storageSvc              *storage.AzureBlobstore
+	storageSvc              storage.Blobstore
+	tileStorageSvc          storage.Blobstore
 	queueSvc                queue.QueueService
+	tracks                  *trackCache
 	db                      *mapDB
 	minTileZoom             int
 	maxTileZoom             int
 	queueBatchSize          int
 	storageConcurrencyLimit int
+	style                   TileStyle
+	tileSizes               []int
+	tileFormats             []string
+	lazyTileMinZoom         int
+	renderMode              string
 }
 
 type MapParam struct {
@@ -34,6 +43,9 @@ type MapParam struct {
 	TopLeft         []float64 `json:"tl"`
 	BottomRight     []float64 `json:"br"`
 	Tile            Tile      `json:"tile"`
+	// most activities passing through any tile at the same zoom level, which
+	// is used to normalize colors across the whole map
+	MaxVisits int `json:"max_visits,omitempty"`
 }
 
 type mapParams []MapParam
@@ -46,54 +58,100 @@ type Tile struct {
 
 type tileSet struct {
 	tiles types.Set
+	// number of activities passing through each tile
+	visits map[Tile]int
+}
+
+func newTileSet() tileSet {
+	return tileSet{types.NewSet(), map[Tile]int{}}
 }
 
 func (ts tileSet) Add(x, y, z int) {
 	ts.tiles.Add(Tile{x, y, z})
 }
 
+// AddActivity adds the tiles touched by a single activity
+func (ts tileSet) AddActivity(activityTiles types.Set) {
+	for k := range activityTiles.ToMap() {
+		t := k.(Tile)
+		ts.tiles.Add(t)
+		ts.visits[t]++
+	}
+}
+
+// MaxVisitsByZoom returns the most visited tile count for each zoom level
+func (ts tileSet) MaxVisitsByZoom() map[int]int {
+	maxVisits := map[int]int{}
+	for t, v := range ts.visits {
+		if v > maxVisits[t.Z] {
+			maxVisits[t.Z] = v
+		}
+	}
+	return maxVisits
+}
+
+// Tiles returns every tile in the set
+func (ts tileSet) Tiles() []Tile {
+	tiles := make([]Tile, 0, ts.tiles.Size())
+	for k := range ts.tiles.ToMap() {
+		tiles = append(tiles, k.(Tile))
+	}
+	return tiles
+}
+
 func (ts tileSet) Size() int {
 	return ts.tiles.Size()
 }
 
 func NewMapService(
 	stravaSvc *strava.StravaService,
-	storageSvc *storage.AzureBlobstore,
+	storageSvc storage.Blobstore,
+	tileStorageSvc storage.Blobstore,
 	queueSvc queue.QueueService,
 	db *database.DB,
 	minTileZoom int,
 	maxTileZoom int,
 	queueBatchSize int,
 	storageConcurrencyLimit int,
+	style TileStyle,
+	tileSizes []int,
+	tileFormats []string,
+	lazyTileMinZoom int,
+	renderMode string,
 ) *MapService {
 	return &MapService{
 		stravaSvc:               stravaSvc,
 		storageSvc:              storageSvc,
+		tileStorageSvc:          tileStorageSvc,
 		queueSvc:                queueSvc,
+		tracks:                  newTrackCache(),
 		db:                      &mapDB{db},
 		minTileZoom:             minTileZoom,
 		maxTileZoom:             maxTileZoom,
 		queueBatchSize:          queueBatchSize,
 		storageConcurrencyLimit: storageConcurrencyLimit,
+		style:                   style,
+		tileSizes:               tileSizes,
+		tileFormats:             tileFormats,
+		lazyTileMinZoom:         lazyTileMinZoom,
+		renderMode:              renderMode,
 	}
 }
 
+// AddToTileSet adds the tiles that the lines of an activity pass through, which
+// are the tiles that the activity is drawn on
 func (ms MapService) AddToTileSet(data []byte, minZoom, maxZoom int, tiles *tileSet) {
-	coords := parseLatLonList(data)
+	lines := projectLines(parseStreams(data).LatLons())
+	activityTiles := types.NewSet()
 	for z := minZoom; z <= maxZoom; z++ {
-		scale := float64(int(1) << z)
-		for _, coord := range coords {
-			x, y := project(coord[0], coord[1])
-			tiles.Add(
-				int(x*scale/tileSize),
-				int(y*scale/tileSize),
-				z,
-			)
+		for _, line := range lines {
+			addLineTiles(line, z, activityTiles)
 		}
 	}
+	tiles.AddActivity(activityTiles)
 }
 
-func (ms MapService) ComputeMapParams(tiles *tileSet) mapParams {
+func (ms MapService) ComputeMapParams(tiles *tileSet, maxVisits map[int]int) mapParams {
 	params := mapParams{}
 	tileMap := tiles.tiles.ToMap()
 	for k := range tileMap {
@@ -110,7 +168,8 @@ func (ms MapService) ComputeMapParams(tiles *tileSet) mapParams {
 				tileToLat(t.Y+1, t.Z),
 				tileToLon(t.X+1, t.Z),
 			},
-			Tile: t,
+			Tile:      t,
+			MaxVisits: maxVisits[t.Z],
 		})
 	}
 
@@ -123,22 +182,160 @@ var (
 	ErrorInternalError = errors.New("encountered issue with backend subsystem")
 )
 
+// RebuildMapForAthlete renders every tile of the map of an athlete
 func (ms MapService) RebuildMapForAthlete(ctx context.Context, token string) ([]string, []interface{}, error) {
-	if token == "" {
-		return nil, nil, ErrorMissingToken
+	athleteID, mapID, err := ms.getMapForToken(ctx, token)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	dataRefs, err := ms.stravaSvc.Athlete.GetActivityDataRefs(ctx, token)
+	refs, err := ms.stravaSvc.Athlete.GetActivityRefsForAthlete(ctx, athleteID)
 	if err != nil {
 		return nil, nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
 	}
 
+	tiles, err := ms.tileSetForActivities(ctx, refs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxVisits := tiles.MaxVisitsByZoom()
+	if err = ms.db.setMaxVisits(ctx, mapID, maxVisits); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	// tiles that are left out of the manifest may only show activities that
+	// were deleted or hidden since the last build, so they are deleted before
+	// any tile is rendered. Pyramid levels are then downsampled without them
+	removed, err := ms.db.setTileManifest(ctx, mapID, tiles.Tiles(), true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	if err = ms.deleteTiles(ctx, mapID, removed); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	if err = ms.invalidateLazyTiles(ctx, mapID, nil); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	messageBatches, err := ms.enqueueTiles(ctx, athleteID, mapID, ms.ComputeMapParams(&tiles, maxVisits))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ms.db.setBuiltThrough(ctx, mapID, latestSync(refs))
+	return dataRefs(refs), messageBatches, err
+}
+
+// UpdateMapForAthlete renders only the tiles touched by activities that were
+// synced since the map was last built. Maps that were never built are rebuilt
+func (ms MapService) UpdateMapForAthlete(ctx context.Context, token string) ([]string, []interface{}, error) {
+	athleteID, mapID, err := ms.getMapForToken(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builtThrough, err := ms.db.getBuiltThrough(ctx, mapID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	if builtThrough == nil {
+		return ms.RebuildMapForAthlete(ctx, token)
+	}
+
+	// replacing the pending levels of a pyramid build would leave holes in the
+	// map, so new activities are picked up once the build is done
+	building, err := ms.db.hasPendingPyramidLevels(ctx, mapID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	if building {
+		log.Printf("map '%s' is still being built, deferring update", mapID)
+		return nil, nil, nil
+	}
+
+	refs, err := ms.stravaSvc.Athlete.GetActivityRefsForAthlete(ctx, athleteID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	}
+
+	newRefs := []strava.ActivityRef{}
+	for _, ref := range refs {
+		if ref.SyncedAt.After(*builtThrough) {
+			newRefs = append(newRefs, ref)
+		}
+	}
+	if len(newRefs) == 0 {
+		return nil, nil, nil
+	}
+
+	tiles, err := ms.tileSetForActivities(ctx, newRefs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// visits only count the new activities, so they can raise the stored
+	// normalization but never lower it. Colors of untouched tiles are brought
+	// up to date by the next full rebuild
+	maxVisits, err := ms.db.getMaxVisitsByZoom(ctx, mapID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	for z, v := range tiles.MaxVisitsByZoom() {
+		if v > maxVisits[z] {
+			maxVisits[z] = v
+		}
+	}
+
+	if err = ms.db.setMaxVisits(ctx, mapID, maxVisits); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	if _, err = ms.db.setTileManifest(ctx, mapID, tiles.Tiles(), false); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	if err = ms.invalidateLazyTiles(ctx, mapID, &tiles); err != nil {
+		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	messageBatches, err := ms.enqueueTiles(ctx, athleteID, mapID, ms.ComputeMapParams(&tiles, maxVisits))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("updating '%d' tiles touched by '%d' new activities of map '%s'", tiles.Size(), len(newRefs), mapID)
+	err = ms.db.setBuiltThrough(ctx, mapID, latestSync(newRefs))
+	return dataRefs(newRefs), messageBatches, err
+}
+
+func (ms MapService) getMapForToken(ctx context.Context, token string) (int, string, error) {
+	if token == "" {
+		return 0, "", ErrorMissingToken
+	}
+
+	athleteID, err := ms.stravaSvc.Athlete.GetAthleteForAuthToken(ctx, token)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	}
+
+	mapID, err := ms.stravaSvc.Athlete.GetOrCreateMapID(ctx, token)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	}
+
+	return athleteID, mapID, nil
+}
+
+// tileSetForActivities downloads activities and collects the tiles they touch
+func (ms MapService) tileSetForActivities(ctx context.Context, refs []strava.ActivityRef) (tileSet, error) {
 	mapSem := concurrency.NewSemaphore(1)
-	tiles := tileSet{types.NewSet()}
+	tiles := newTileSet()
 
 	funcs := [](func() error){}
-	for _, ref := range dataRefs {
-		theRef := ref
+	for _, ref := range refs {
+		theRef := ref.DataRef
 		funcs = append(funcs, func() error {
 			bytes, err := ms.storageSvc.GetObjectBytes(ctx, theRef)
 			if err != nil {
@@ -153,45 +350,148 @@ func (ms MapService) RebuildMapForAthlete(ctx context.Context, token string) ([]
 		})
 	}
 
-	if err = concurrency.NewSemaphore(ms.storageConcurrencyLimit).WithRateLimit(funcs, true); err != nil {
-		return nil, nil, err
+	err := concurrency.NewSemaphore(ms.storageConcurrencyLimit).WithRateLimit(funcs, true)
+	return tiles, err
+}
+
+// enqueueTiles sends tiles to the rendering workers and tracks them as a new
+// build of the map
+func (ms MapService) enqueueTiles(ctx context.Context, athleteID int, mapID string, params mapParams) ([]interface{}, error) {
+	messages := []interface{}{}
+	for _, p := range params {
+		// tiles above the lazy zoom level are rendered when first requested
+		if ms.lazyTileMinZoom > 0 && p.Tile.Z >= ms.lazyTileMinZoom {
+			continue
+		}
+		messages = append(messages, p)
 	}
 
-	params := ms.ComputeMapParams(&tiles)
-	messages := make([]interface{}, len(params))
-	for idx, p := range params {
-		messages[idx] = p
+	// in pyramid mode only the highest zoom level is enqueued right away. Lower
+	// levels are enqueued by workers as the levels above them complete
+	pyramid := map[int][]interface{}{}
+	if ms.renderMode == RenderModePyramid {
+		leafZoom, levels := pyramidLevels(messages)
+		for z, level := range levels {
+			if z != leafZoom {
+				pyramid[z] = ms.toTileBatches(level, athleteID, mapID, true)
+			}
+		}
+		messages = levels[leafZoom]
 	}
 
-	athleteID, err := ms.stravaSvc.Athlete.GetAthleteForAuthToken(ctx, token)
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	if err := ms.db.setPyramidLevels(ctx, mapID, pyramid); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
 	}
 
-	mapID, err := ms.stravaSvc.Athlete.GetOrCreateMapID(ctx, token)
+	messageBatches := ms.toTileBatches(messages, athleteID, mapID, false)
+	messageIDs, err := ms.queueSvc.Enqueue(ctx, messageBatches...)
 	if err != nil {
-		return nil, nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	if err = ms.db.setProcessingStateForIDs(ctx, mapID, messageIDs); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	return messageBatches, nil
+}
+
+// latestSync is the sync time of the most recently downloaded activity
+func latestSync(refs []strava.ActivityRef) time.Time {
+	latest := time.Time{}
+	for _, ref := range refs {
+		if ref.SyncedAt.After(latest) {
+			latest = ref.SyncedAt
+		}
 	}
+	return latest
+}
+
+func dataRefs(refs []strava.ActivityRef) []string {
+	dataRefs := make([]string, len(refs))
+	for i, ref := range refs {
+		dataRefs[i] = ref.DataRef
+	}
+	return dataRefs
+}
 
-	messageBatches := batch.ToBatchesWithTransformer(messages, ms.queueBatchSize, func(batch []interface{}) interface{} {
-		return map[string]interface{}{
-			"coords":     batch,
-			"athlete_id": athleteID,
-			"map_id":     mapID,
+// toTileBatches groups tiles into queue messages
+func (ms MapService) toTileBatches(params []interface{}, athleteID int, mapID string, downsample bool) []interface{} {
+	return batch.ToBatchesWithTransformer(params, ms.queueBatchSize, func(batch []interface{}) interface{} {
+		coords := make([]MapParam, len(batch))
+		for i, p := range batch {
+			coords[i] = p.(MapParam)
+		}
+		return TileBatch{
+			Coords:     coords,
+			AthleteID:  athleteID,
+			MapID:      mapID,
+			Sizes:      ms.tileSizes,
+			Formats:    ms.tileFormats,
+			Downsample: downsample,
 		}
 	})
+}
 
-	messageIDs, err := ms.queueSvc.Enqueue(ctx, messageBatches...)
+// DeleteMap forgets the tiles of a map. Once the map itself is gone, its
+// uploaded tiles are removed by DeleteStaleTiles
+func (ms MapService) DeleteMap(ctx context.Context, mapID string) error {
+	if err := ms.db.deleteMap(ctx, mapID); err != nil {
+		return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	return nil
+}
+
+// MapBuild is a rebuild or update of a map, counted by the state of the tile
+// batches it queued
+type MapBuild struct {
+	StartedAt time.Time `json:"started_at"`
+	Queued    int       `json:"queued_batches"`
+	Failed    int       `json:"failed_batches"`
+	Complete  int       `json:"complete_batches"`
+}
+
+// BuildRecord describes a map and how it was built
+type BuildRecord struct {
+	MapID    string `json:"map_id"`
+	Sharable bool   `json:"sharable"`
+	// sync time of the newest activity drawn on the map
+	BuiltThrough    *time.Time  `json:"built_through"`
+	Tiles           int         `json:"tiles"`
+	MaxVisitsByZoom map[int]int `json:"max_visits_by_zoom"`
+	Builds          []MapBuild  `json:"builds"`
+}
+
+func (ms MapService) GetBuildRecord(ctx context.Context, mapID string) (*BuildRecord, error) {
+	record := &BuildRecord{MapID: mapID}
+
+	sharable, err := ms.stravaSvc.Athlete.GetMapSharable(ctx, mapID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
 	}
+	record.Sharable = sharable
 
-	err = ms.db.setProcessingStateForIDs(ctx, mapID, messageIDs)
-	return dataRefs, messageBatches, err
+	if record.BuiltThrough, err = ms.db.getBuiltThrough(ctx, mapID); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	manifest, err := ms.db.getTileManifest(ctx, mapID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	record.Tiles = manifest.Size()
+
+	if record.MaxVisitsByZoom, err = ms.db.getMaxVisitsByZoom(ctx, mapID); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+
+	if record.Builds, err = ms.db.getBuilds(ctx, mapID); err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorInternalError, err)
+	}
+	return record, nil
 }
 
-func (ms MapService) GetProcessingStateForAthlete(ctx context.Context, token string) (*ProcessingState, error) {
-	mapID, err := ms.stravaSvc.Athlete.GetOrCreateMapID(ctx, token)
+func (ms MapService) GetProcessingStateForAthlete(ctx context.Context, athleteID int) (*ProcessingState, error) {
+	mapID, err := ms.stravaSvc.Athlete.GetOrCreateMapIDForAthlete(ctx, athleteID)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,312 @@
+package maps
+
+import (
+	"math"
+	"time"
+)
+
+// Mapbox Vector Tile encoding, see https://github.com/mapbox/vector-tile-spec
+const (
+	mvtVersion = 2
+	mvtExtent  = 4096
+	// geometry outside of the tile, in tile units, that is kept so that lines
+	// do not end abruptly at tile borders
+	mvtBuffer = 64
+	// Douglas-Peucker tolerance, in tile units
+	mvtSimplifyTolerance = 2
+
+	mvtLayerName = "activities"
+
+	mvtGeomTypeLineString = 2
+	mvtCommandMoveTo      = 1
+	mvtCommandLineTo      = 2
+)
+
+// protobuf wire types
+const (
+	wireVarint          = 0
+	wireLengthDelimited = 2
+)
+
+// pbuf is a minimal protobuf writer, just enough to produce vector tiles
+type pbuf struct {
+	b []byte
+}
+
+func (p *pbuf) varint(v uint64) {
+	for v >= 0x80 {
+		p.b = append(p.b, byte(v)|0x80)
+		v >>= 7
+	}
+	p.b = append(p.b, byte(v))
+}
+
+func (p *pbuf) key(field int, wireType int) {
+	p.varint(uint64(field<<3 | wireType))
+}
+
+func (p *pbuf) uint(field int, v uint64) {
+	p.key(field, wireVarint)
+	p.varint(v)
+}
+
+func (p *pbuf) bytes(field int, b []byte) {
+	p.key(field, wireLengthDelimited)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *pbuf) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *pbuf) packed(field int, values []uint32) {
+	inner := pbuf{}
+	for _, v := range values {
+		inner.varint(uint64(v))
+	}
+	p.bytes(field, inner.b)
+}
+
+func zigzag(v int) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+// mvtLayer accumulates features along with their de-duplicated attributes
+type mvtLayer struct {
+	features [][]byte
+	keys     []string
+	keyIdx   map[string]int
+	values   [][]byte
+	valueIdx map[string]int
+}
+
+func newMVTLayer() *mvtLayer {
+	return &mvtLayer{keyIdx: map[string]int{}, valueIdx: map[string]int{}}
+}
+
+func (l *mvtLayer) key(k string) uint32 {
+	if i, ok := l.keyIdx[k]; ok {
+		return uint32(i)
+	}
+	l.keyIdx[k] = len(l.keys)
+	l.keys = append(l.keys, k)
+	return uint32(len(l.keys) - 1)
+}
+
+func (l *mvtLayer) value(encoded pbuf) uint32 {
+	k := string(encoded.b)
+	if i, ok := l.valueIdx[k]; ok {
+		return uint32(i)
+	}
+	l.valueIdx[k] = len(l.values)
+	l.values = append(l.values, encoded.b)
+	return uint32(len(l.values) - 1)
+}
+
+func (l *mvtLayer) stringValue(s string) uint32 {
+	v := pbuf{}
+	v.string(1, s)
+	return l.value(v)
+}
+
+func (l *mvtLayer) intValue(i int64) uint32 {
+	v := pbuf{}
+	v.uint(4, uint64(i))
+	return l.value(v)
+}
+
+// addLines adds a feature made up of one or more lines in tile coordinates
+func (l *mvtLayer) addLines(id uint64, lines [][][2]int, tags []uint32) {
+	geometry := []uint32{}
+	cursorX, cursorY := 0, 0
+	for _, line := range lines {
+		geometry = append(geometry, mvtCommandMoveTo|1<<3)
+		geometry = append(geometry, zigzag(line[0][0]-cursorX), zigzag(line[0][1]-cursorY))
+		cursorX, cursorY = line[0][0], line[0][1]
+
+		geometry = append(geometry, uint32(mvtCommandLineTo|(len(line)-1)<<3))
+		for _, pt := range line[1:] {
+			geometry = append(geometry, zigzag(pt[0]-cursorX), zigzag(pt[1]-cursorY))
+			cursorX, cursorY = pt[0], pt[1]
+		}
+	}
+
+	f := pbuf{}
+	f.uint(1, id)
+	f.packed(2, tags)
+	f.uint(3, mvtGeomTypeLineString)
+	f.packed(4, geometry)
+	l.features = append(l.features, f.b)
+}
+
+func (l *mvtLayer) encode(name string) []byte {
+	layer := pbuf{}
+	layer.uint(15, mvtVersion)
+	layer.string(1, name)
+	for _, f := range l.features {
+		layer.bytes(2, f)
+	}
+	for _, k := range l.keys {
+		layer.string(3, k)
+	}
+	for _, v := range l.values {
+		layer.bytes(4, v)
+	}
+	layer.uint(5, mvtExtent)
+
+	tile := pbuf{}
+	tile.bytes(3, layer.b)
+	return tile.b
+}
+
+// renderVectorTile encodes every track that passes through a tile as a
+// simplified line feature, tagged with the activity it came from
+func renderVectorTile(tracks []track, tile Tile) []byte {
+	layer := newMVTLayer()
+	scale := float64(int(1)<<tile.Z) * mvtExtent / tileSize
+	offsetX := float64(tile.X) * mvtExtent
+	offsetY := float64(tile.Y) * mvtExtent
+
+	for _, t := range tracks {
+		if !t.intersects(tile) {
+			continue
+		}
+
+		lines := [][][2]int{}
+		for _, l := range t.lines {
+			local := make([][2]float64, len(l.points))
+			for i, pt := range l.points {
+				local[i] = [2]float64{pt[0]*scale - offsetX, pt[1]*scale - offsetY}
+			}
+
+			for _, piece := range clipPolyline(local, -mvtBuffer, mvtExtent+mvtBuffer) {
+				line := toTileCoords(simplifyPolyline(piece, mvtSimplifyTolerance))
+				if len(line) >= 2 {
+					lines = append(lines, line)
+				}
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		tags := []uint32{
+			layer.key("activity_id"), layer.intValue(t.activityID),
+		}
+		if t.sportType != "" {
+			tags = append(tags, layer.key("sport_type"), layer.stringValue(t.sportType))
+		}
+		if !t.startDate.IsZero() {
+			tags = append(tags, layer.key("start_date"), layer.stringValue(t.startDate.UTC().Format(time.RFC3339)))
+		}
+
+		layer.addLines(uint64(t.activityID), lines, tags)
+	}
+
+	return layer.encode(mvtLayerName)
+}
+
+// clipPolyline splits a polyline into the pieces that fall within [lo, hi)
+func clipPolyline(points [][2]float64, lo, hi float64) [][][2]float64 {
+	pieces := [][][2]float64{}
+	current := [][2]float64{}
+	size := hi - lo
+
+	flush := func() {
+		if len(current) >= 2 {
+			pieces = append(pieces, current)
+		}
+		current = [][2]float64{}
+	}
+
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		ax, ay, bx, by, ok := clipSegment(a[0]-lo, a[1]-lo, b[0]-lo, b[1]-lo, size)
+		if !ok {
+			flush()
+			continue
+		}
+
+		start := [2]float64{ax + lo, ay + lo}
+		end := [2]float64{bx + lo, by + lo}
+		if len(current) == 0 || current[len(current)-1] != start {
+			flush()
+			current = append(current, start)
+		}
+		current = append(current, end)
+
+		// the segment left the clip area, so the line must be restarted
+		if end != b {
+			flush()
+		}
+	}
+	flush()
+
+	return pieces
+}
+
+// simplifyPolyline removes points using the Douglas-Peucker algorithm
+func simplifyPolyline(points [][2]float64, tolerance float64) [][2]float64 {
+	if len(points) < 3 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0] = true
+	keep[len(points)-1] = true
+
+	var simplify func(first, last int)
+	simplify = func(first, last int) {
+		maxDist := 0.0
+		index := -1
+		for i := first + 1; i < last; i++ {
+			d := segmentDistance(points[i], points[first], points[last])
+			if d > maxDist {
+				maxDist = d
+				index = i
+			}
+		}
+
+		if index != -1 && maxDist > tolerance {
+			keep[index] = true
+			simplify(first, index)
+			simplify(index, last)
+		}
+	}
+	simplify(0, len(points)-1)
+
+	result := [][2]float64{}
+	for i, pt := range points {
+		if keep[i] {
+			result = append(result, pt)
+		}
+	}
+	return result
+}
+
+// segmentDistance is the distance from p to the segment between a and b
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx := b[0] - a[0]
+	dy := b[1] - a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+// toTileCoords rounds points to integer tile coordinates, dropping repeats
+func toTileCoords(points [][2]float64) [][2]int {
+	result := [][2]int{}
+	for _, pt := range points {
+		rounded := [2]int{int(math.Round(pt[0])), int(math.Round(pt[1]))}
+		if len(result) > 0 && result[len(result)-1] == rounded {
+			continue
+		}
+		result = append(result, rounded)
+	}
+	return result
+}
@@ -0,0 +1,356 @@
+package maps
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pbField is a decoded protobuf field, either a varint or length delimited
+type pbField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodePB is a reference decoder for the protobuf wire format, which reads
+// the fields of a message in order
+func decodePB(t *testing.T, b []byte) []pbField {
+	t.Helper()
+	fields := []pbField{}
+	for len(b) > 0 {
+		key, n := decodeVarint(t, b)
+		b = b[n:]
+
+		f := pbField{num: int(key >> 3)}
+		switch key & 0x7 {
+		case wireVarint:
+			f.value, n = decodeVarint(t, b)
+			b = b[n:]
+		case wireLengthDelimited:
+			size, n := decodeVarint(t, b)
+			b = b[n:]
+			if uint64(len(b)) < size {
+				t.Fatalf("field %d is %d bytes, only %d left", f.num, size, len(b))
+			}
+			f.bytes = b[:size]
+			b = b[size:]
+		default:
+			t.Fatalf("field %d has unexpected wire type %d", f.num, key&0x7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodeVarint(t *testing.T, b []byte) (uint64, int) {
+	t.Helper()
+	v := uint64(0)
+	for i, c := range b {
+		if i == 10 {
+			break
+		}
+		v |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return v, i + 1
+		}
+	}
+	t.Fatalf("truncated varint % x", b)
+	return 0, 0
+}
+
+func decodePacked(t *testing.T, b []byte) []uint32 {
+	t.Helper()
+	values := []uint32{}
+	for len(b) > 0 {
+		v, n := decodeVarint(t, b)
+		values = append(values, uint32(v))
+		b = b[n:]
+	}
+	return values
+}
+
+func unzigzag(v uint32) int {
+	return int(int32(v>>1) ^ -int32(v&1))
+}
+
+// decodeGeometry turns the commands of a line feature back into absolute
+// tile coordinates
+func decodeGeometry(t *testing.T, geometry []uint32) [][][2]int {
+	t.Helper()
+	lines := [][][2]int{}
+	x, y := 0, 0
+	for i := 0; i < len(geometry); {
+		command, count := int(geometry[i]&0x7), int(geometry[i]>>3)
+		i++
+		if i+2*count > len(geometry) {
+			t.Fatalf("command %d with %d points overruns the geometry", command, count)
+		}
+
+		switch command {
+		case mvtCommandMoveTo:
+			lines = append(lines, [][2]int{})
+		case mvtCommandLineTo:
+			if len(lines) == 0 {
+				t.Fatal("LineTo before MoveTo")
+			}
+		default:
+			t.Fatalf("unexpected command %d", command)
+		}
+		for j := 0; j < count; j++ {
+			x += unzigzag(geometry[i])
+			y += unzigzag(geometry[i+1])
+			i += 2
+			lines[len(lines)-1] = append(lines[len(lines)-1], [2]int{x, y})
+		}
+	}
+	return lines
+}
+
+func TestZigzag(t *testing.T) {
+	cases := []struct {
+		in   int
+		want uint32
+	}{
+		{0, 0},
+		{-1, 1},
+		{1, 2},
+		{-2, 3},
+		{2, 4},
+		{mvtExtent, 8192},
+		{-mvtExtent, 8191},
+	}
+
+	for _, c := range cases {
+		if got := zigzag(c.in); got != c.want {
+			t.Errorf("zigzag(%d) = %d, want %d", c.in, got, c.want)
+		}
+		if got := unzigzag(c.want); got != c.in {
+			t.Errorf("unzigzag(%d) = %d, want %d", c.want, got, c.in)
+		}
+	}
+}
+
+func TestPbufEncoding(t *testing.T) {
+	cases := []struct {
+		name  string
+		write func(p *pbuf)
+		want  []byte
+	}{
+		{"varint zero", func(p *pbuf) { p.varint(0) }, []byte{0x00}},
+		{"varint one byte", func(p *pbuf) { p.varint(127) }, []byte{0x7f}},
+		{"varint two bytes", func(p *pbuf) { p.varint(300) }, []byte{0xac, 0x02}},
+		{"uint field", func(p *pbuf) { p.uint(5, mvtExtent) }, []byte{0x28, 0x80, 0x20}},
+		{"version field", func(p *pbuf) { p.uint(15, mvtVersion) }, []byte{0x78, 0x02}},
+		{"string field", func(p *pbuf) { p.string(1, "ab") }, []byte{0x0a, 0x02, 'a', 'b'}},
+		{"packed field", func(p *pbuf) { p.packed(4, []uint32{9, 300}) }, []byte{0x22, 0x03, 0x09, 0xac, 0x02}},
+		{"empty packed field", func(p *pbuf) { p.packed(2, nil) }, []byte{0x12, 0x00}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := pbuf{}
+			c.write(&p)
+			if !bytes.Equal(p.b, c.want) {
+				t.Errorf("wrote % x, want % x", p.b, c.want)
+			}
+		})
+	}
+}
+
+func TestAddLinesCommands(t *testing.T) {
+	layer := newMVTLayer()
+	lines := [][][2]int{
+		{{2, 3}, {5, 3}, {5, 10}},
+		{{1, 1}, {2, 2}},
+	}
+	layer.addLines(42, lines, []uint32{0, 0})
+
+	fields := decodePB(t, layer.features[0])
+	if len(fields) != 4 {
+		t.Fatalf("feature has %d fields, want 4", len(fields))
+	}
+	if fields[0].num != 1 || fields[0].value != 42 {
+		t.Errorf("id field = %+v, want 42", fields[0])
+	}
+	if fields[2].num != 3 || fields[2].value != mvtGeomTypeLineString {
+		t.Errorf("type field = %+v, want %d", fields[2], mvtGeomTypeLineString)
+	}
+
+	// commands are packed as id | count << 3, and the cursor carries over from
+	// one line to the next
+	want := []uint32{
+		9, 4, 6, // MoveTo(2, 3)
+		18, 6, 0, 0, 14, // LineTo(+3, 0), (0, +7)
+		9, 7, 17, // MoveTo(-4, -9)
+		10, 2, 2, // LineTo(+1, +1)
+	}
+	if geometry := decodePacked(t, fields[3].bytes); !reflect.DeepEqual(geometry, want) {
+		t.Errorf("geometry = %v, want %v", geometry, want)
+	}
+	if decoded := decodeGeometry(t, want); !reflect.DeepEqual(decoded, lines) {
+		t.Errorf("decoded geometry = %v, want %v", decoded, lines)
+	}
+}
+
+func TestClipPolyline(t *testing.T) {
+	cases := []struct {
+		name   string
+		points [][2]float64
+		want   [][][2]float64
+	}{
+		{
+			"inside",
+			[][2]float64{{10, 10}, {20, 20}, {30, 10}},
+			[][][2]float64{{{10, 10}, {20, 20}, {30, 10}}},
+		},
+		{
+			"outside",
+			[][2]float64{{-50, 10}, {-20, 90}},
+			[][][2]float64{},
+		},
+		{
+			"enters",
+			[][2]float64{{-50, 50}, {50, 50}},
+			[][][2]float64{{{0, 50}, {50, 50}}},
+		},
+		{
+			"leaves and comes back",
+			[][2]float64{{50, 50}, {150, 50}, {150, 60}, {50, 60}},
+			[][][2]float64{{{50, 50}, {100, 50}}, {{100, 60}, {50, 60}}},
+		},
+		{
+			"crosses",
+			[][2]float64{{50, -50}, {50, 150}},
+			[][][2]float64{{{50, 0}, {50, 100}}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := clipPolyline(c.points, 0, 100); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("clipPolyline() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// worldTrack makes a track out of points in world coordinates
+func worldTrack(activityID int64, sportType string, points ...[2]float64) track {
+	line := polyline{points: points, minX: points[0][0], minY: points[0][1], maxX: points[0][0], maxY: points[0][1]}
+	for _, pt := range points {
+		if pt[0] < line.minX {
+			line.minX = pt[0]
+		}
+		if pt[1] < line.minY {
+			line.minY = pt[1]
+		}
+		if pt[0] > line.maxX {
+			line.maxX = pt[0]
+		}
+		if pt[1] > line.maxY {
+			line.maxY = pt[1]
+		}
+	}
+	return track{
+		lines:      []polyline{line},
+		activityID: activityID,
+		sportType:  sportType,
+		startDate:  time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestRenderVectorTileRoundTrip(t *testing.T) {
+	// tile (1, 0, 1) covers world coordinates x in [128, 256), y in [0, 128),
+	// and a world unit is 32 tile units at zoom 1
+	tile := Tile{1, 0, 1}
+	tracks := []track{
+		worldTrack(1, "Ride", [2]float64{130, 10}, [2]float64{140, 10}, [2]float64{140, 20}),
+		// leaves the tile to the left, and is cut at the buffer
+		worldTrack(2, "Ride", [2]float64{150, 64}, [2]float64{100, 64}),
+		worldTrack(3, "Run", [2]float64{200, 100}, [2]float64{210, 110}),
+		// does not touch the tile
+		worldTrack(4, "Run", [2]float64{10, 10}, [2]float64{20, 20}),
+	}
+
+	fields := decodePB(t, renderVectorTile(tracks, tile))
+	if len(fields) != 1 || fields[0].num != 3 {
+		t.Fatalf("tile has fields %+v, want a single layer", fields)
+	}
+
+	var (
+		version, extent uint64
+		name            string
+		features        [][]byte
+		keys            []string
+		values          []string
+	)
+	for _, f := range decodePB(t, fields[0].bytes) {
+		switch f.num {
+		case 15:
+			version = f.value
+		case 1:
+			name = string(f.bytes)
+		case 2:
+			features = append(features, f.bytes)
+		case 3:
+			keys = append(keys, string(f.bytes))
+		case 5:
+			extent = f.value
+		case 4:
+			value := decodePB(t, f.bytes)
+			if len(value) != 1 {
+				t.Fatalf("value has %d fields", len(value))
+			}
+			switch value[0].num {
+			case 1:
+				values = append(values, string(value[0].bytes))
+			case 4:
+				values = append(values, fmt.Sprint(value[0].value))
+			default:
+				t.Fatalf("value has unexpected field %d", value[0].num)
+			}
+		default:
+			t.Fatalf("layer has unexpected field %d", f.num)
+		}
+	}
+
+	if version != mvtVersion || name != mvtLayerName || extent != mvtExtent {
+		t.Errorf("layer %q version %d extent %d, want %q version %d extent %d",
+			name, version, extent, mvtLayerName, mvtVersion, mvtExtent)
+	}
+	if want := []string{"activity_id", "sport_type", "start_date"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	// values are shared between the features that use them
+	if want := []string{"1", "Ride", "2024-03-01T10:00:00Z", "2", "3", "Run"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+
+	want := []struct {
+		id       uint64
+		tags     []uint32
+		geometry [][][2]int
+	}{
+		{1, []uint32{0, 0, 1, 1, 2, 2}, [][][2]int{{{64, 320}, {384, 320}, {384, 640}}}},
+		{2, []uint32{0, 3, 1, 1, 2, 2}, [][][2]int{{{704, 2048}, {-mvtBuffer, 2048}}}},
+		{3, []uint32{0, 4, 1, 5, 2, 2}, [][][2]int{{{2304, 3200}, {2624, 3520}}}},
+	}
+	if len(features) != len(want) {
+		t.Fatalf("tile has %d features, want %d", len(features), len(want))
+	}
+	for i, w := range want {
+		f := decodePB(t, features[i])
+		if f[0].value != w.id {
+			t.Errorf("feature %d has id %d, want %d", i, f[0].value, w.id)
+		}
+		if tags := decodePacked(t, f[1].bytes); !reflect.DeepEqual(tags, w.tags) {
+			t.Errorf("feature %d has tags %v, want %v", i, tags, w.tags)
+		}
+		if geometry := decodeGeometry(t, decodePacked(t, f[3].bytes)); !reflect.DeepEqual(geometry, w.geometry) {
+			t.Errorf("feature %d has geometry %v, want %v", i, geometry, w.geometry)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package maps
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+)
+
+const (
+	// every tile is rendered from activity coordinates
+	RenderModeDirect = "direct"
+	// only the highest precomputed zoom level is rendered from activity
+	// coordinates. Lower zoom levels are built from the images of their children
+	RenderModePyramid = "pyramid"
+)
+
+// ValidateRenderMode checks that a render mode is one that is supported
+func ValidateRenderMode(mode string) error {
+	if mode != RenderModeDirect && mode != RenderModePyramid {
+		return fmt.Errorf("unknown render mode '%s'", mode)
+	}
+	return nil
+}
+
+// children returns the four tiles at the next zoom level that cover a tile, in
+// the order top left, top right, bottom left, bottom right
+func (t Tile) children() []Tile {
+	return []Tile{
+		{2 * t.X, 2 * t.Y, t.Z + 1},
+		{2*t.X + 1, 2 * t.Y, t.Z + 1},
+		{2 * t.X, 2*t.Y + 1, t.Z + 1},
+		{2*t.X + 1, 2*t.Y + 1, t.Z + 1},
+	}
+}
+
+// downsampleTile builds a tile from the uploaded images of its four children.
+// Each pixel keeps the most opaque pixel of the 2x2 block beneath it, which
+// stops thin lines from fading away at lower zoom levels
+func (ms MapService) downsampleTile(ctx context.Context, mapID string, t Tile, sizePx int) (*image.NRGBA, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, sizePx, sizePx))
+	half := sizePx / 2
+
+	for i, child := range t.children() {
+		// children without any activities are never rendered
+		name := tileName(mapID, child, sizePx)
+		exists, err := ms.tileStorageSvc.ObjectExists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		data, err := ms.tileStorageSvc.GetObjectBytes(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		src, err := decodeNRGBA(data)
+		if err != nil {
+			return nil, fmt.Errorf("decoding tile '%s': %w", name, err)
+		}
+		if src.Rect.Dx() != sizePx || src.Rect.Dy() != sizePx {
+			return nil, fmt.Errorf("tile '%s' is %dx%d, expected %dx%d", name, src.Rect.Dx(), src.Rect.Dy(), sizePx, sizePx)
+		}
+
+		offsetX := (i % 2) * half
+		offsetY := (i / 2) * half
+		for y := 0; y < half; y++ {
+			for x := 0; x < half; x++ {
+				best := -1
+				for _, p := range []int{
+					src.PixOffset(2*x, 2*y),
+					src.PixOffset(2*x+1, 2*y),
+					src.PixOffset(2*x, 2*y+1),
+					src.PixOffset(2*x+1, 2*y+1),
+				} {
+					if best < 0 || src.Pix[p+3] > src.Pix[best+3] {
+						best = p
+					}
+				}
+
+				dst := img.PixOffset(offsetX+x, offsetY+y)
+				copy(img.Pix[dst:dst+4], src.Pix[best:best+4])
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func decodeNRGBA(data []byte) (*image.NRGBA, error) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if img, ok := src.(*image.NRGBA); ok && img.Rect.Min == (image.Point{}) {
+		return img, nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Rect, src, src.Bounds().Min, draw.Src)
+	return img, nil
+}
+
+// pyramidLevels splits tiles by zoom level. The highest zoom level is rendered
+// from activity coordinates and every other level is built from the one above it
+func pyramidLevels(params []interface{}) (int, map[int][]interface{}) {
+	leafZoom := -1
+	levels := map[int][]interface{}{}
+	for _, p := range params {
+		z := p.(MapParam).Tile.Z
+		levels[z] = append(levels[z], p)
+		if z > leafZoom {
+			leafZoom = z
+		}
+	}
+	return leafZoom, levels
+}
+
+// advancePyramid enqueues the next zoom level of a pyramid build once every
+// tile of the levels above it has been processed
+func (ms MapService) advancePyramid(ctx context.Context, mapID string) error {
+	zoom, batches, err := ms.db.claimNextPyramidLevel(ctx, mapID)
+	if err != nil || batches == nil {
+		return err
+	}
+
+	messages := make([]interface{}, len(batches))
+	for i, b := range batches {
+		messages[i] = b
+	}
+
+	log.Printf("enqueueing '%d' batches of zoom level '%d' for map '%s'", len(batches), zoom, mapID)
+	ids, err := ms.queueSvc.Enqueue(ctx, messages...)
+	if err != nil {
+		if releaseErr := ms.db.releasePyramidLevel(ctx, mapID, zoom); releaseErr != nil {
+			log.Printf("error releasing zoom level '%d' of map '%s': %+v", zoom, mapID, releaseErr)
+		}
+		return fmt.Errorf("enqueueing zoom level '%d' of map '%s': %w", zoom, mapID, err)
+	}
+	return ms.db.recordPyramidLevel(ctx, mapID, zoom, ids)
+}
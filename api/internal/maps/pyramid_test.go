@@ -0,0 +1,133 @@
+package maps
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
+)
+
+func TestDownsampleTile(t *testing.T) {
+	const sizePx = 4
+	red := color.NRGBA{R: 255, A: 255}
+	faint := color.NRGBA{G: 255, A: 10}
+	dim := color.NRGBA{B: 255, A: 120}
+
+	// child tiles are given as the pixels that are drawn on them
+	type pixels map[image.Point]color.NRGBA
+	cases := []struct {
+		name     string
+		children map[Tile]pixels
+		sizePx   int
+		want     pixels
+		err      bool
+	}{
+		{"no children", map[Tile]pixels{}, sizePx, pixels{}, false},
+		{
+			"top left",
+			map[Tile]pixels{{0, 0, 1}: {{1, 1}: red}},
+			sizePx,
+			pixels{{0, 0}: red},
+			false,
+		},
+		{
+			"bottom right",
+			map[Tile]pixels{{1, 1, 1}: {{2, 3}: red}},
+			sizePx,
+			pixels{{3, 3}: red},
+			false,
+		},
+		{
+			"most opaque pixel",
+			map[Tile]pixels{{1, 0, 1}: {{0, 0}: faint, {1, 0}: dim, {1, 1}: faint}},
+			sizePx,
+			pixels{{2, 0}: dim},
+			false,
+		},
+		{
+			"every child",
+			map[Tile]pixels{
+				{0, 0, 1}: {{0, 0}: red},
+				{1, 0, 1}: {{3, 0}: red},
+				{0, 1, 1}: {{0, 3}: red},
+				{1, 1, 1}: {{3, 3}: red},
+			},
+			sizePx,
+			pixels{{0, 0}: red, {3, 0}: red, {0, 3}: red, {3, 3}: red},
+			false,
+		},
+		{"child of another size", map[Tile]pixels{{0, 0, 1}: {}}, 2 * sizePx, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			store, err := storage.NewFilesystemBlobstore(ctx, "tiles", t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for child, drawn := range c.children {
+				img := image.NewNRGBA(image.Rect(0, 0, sizePx, sizePx))
+				for pt, px := range drawn {
+					img.SetNRGBA(pt.X, pt.Y, px)
+				}
+				data, err := encodePNG(img)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := store.CreateObject(ctx, tileName("map", child, c.sizePx), data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ms := MapService{tileStorageSvc: store}
+			img, err := ms.downsampleTile(ctx, "map", Tile{0, 0, 0}, c.sizePx)
+			if c.err {
+				if err == nil {
+					t.Error("downsampleTile() did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for y := 0; y < sizePx; y++ {
+				for x := 0; x < sizePx; x++ {
+					if got, want := img.NRGBAAt(x, y), c.want[image.Pt(x, y)]; got != want {
+						t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPyramidLevels(t *testing.T) {
+	params := []interface{}{
+		MapParam{Tile: Tile{4, 4, 3}},
+		MapParam{Tile: Tile{1, 1, 1}},
+		MapParam{Tile: Tile{5, 4, 3}},
+		MapParam{Tile: Tile{2, 2, 2}},
+	}
+
+	leafZoom, levels := pyramidLevels(params)
+	if leafZoom != 3 {
+		t.Errorf("leaf zoom = %d, want 3", leafZoom)
+	}
+	for zoom, n := range map[int]int{1: 1, 2: 1, 3: 2} {
+		if len(levels[zoom]) != n {
+			t.Errorf("zoom level %d has %d tiles, want %d", zoom, len(levels[zoom]), n)
+		}
+	}
+
+	// a tile covers the same area as its children
+	tile := Tile{3, 5, 4}
+	for _, child := range tile.children() {
+		if child.Z != tile.Z+1 || child.X/2 != tile.X || child.Y/2 != tile.Y {
+			t.Errorf("child %+v is not beneath %+v", child, tile)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package maps
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"time"
+)
+
+const (
+	// standard deviation, in pixels, of the blur applied to rendered lines
+	blurSigma = 0.8
+)
+
+// FC4C02, aka "strava orange"
+var stravaOrange = color.NRGBA{R: 252, G: 76, B: 2, A: 255}
+
+// track is a single activity projected into world coordinates
+type track struct {
+	lines []polyline
+
+	activityID int64
+	sportType  string
+	startDate  time.Time
+}
+
+// polyline is a continuous part of a track along with its bounding box
+type polyline struct {
+	points                 [][2]float64
+	minX, minY, maxX, maxY float64
+}
+
+func newTrack(coords [][]float64) track {
+	t := track{}
+	for _, points := range projectLines(coords) {
+		line := polyline{
+			points: points,
+			minX:   math.Inf(1),
+			minY:   math.Inf(1),
+			maxX:   math.Inf(-1),
+			maxY:   math.Inf(-1),
+		}
+
+		for _, pt := range points {
+			line.minX = math.Min(line.minX, pt[0])
+			line.minY = math.Min(line.minY, pt[1])
+			line.maxX = math.Max(line.maxX, pt[0])
+			line.maxY = math.Max(line.maxY, pt[1])
+		}
+		t.lines = append(t.lines, line)
+	}
+
+	return t
+}
+
+// intersects reports whether the bounding box of any line of the track
+// overlaps a tile
+func (t track) intersects(tile Tile) bool {
+	for _, line := range t.lines {
+		if line.intersects(tile) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l polyline) intersects(tile Tile) bool {
+	if len(l.points) == 0 {
+		return false
+	}
+
+	tileWorldSize := tileSize / float64(int(1)<<tile.Z)
+	left := float64(tile.X) * tileWorldSize
+	top := float64(tile.Y) * tileWorldSize
+
+	return l.maxX >= left && l.minX < left+tileWorldSize &&
+		l.maxY >= top && l.minY < top+tileWorldSize
+}
+
+// raster accumulates the number of distinct tracks that pass through each pixel
+type raster struct {
+	size   int
+	visits []int
+	// index (+1) of the last track that marked each pixel, so that a track
+	// which passes over the same pixel more than once is only counted once
+	stamp []int
+	track int
+}
+
+func newRaster(size int) *raster {
+	return &raster{
+		size:   size,
+		visits: make([]int, size*size),
+		stamp:  make([]int, size*size),
+	}
+}
+
+func (r *raster) startTrack() {
+	r.track++
+}
+
+func (r *raster) mark(x, y float64) {
+	ix := int(math.Floor(x))
+	iy := int(math.Floor(y))
+	if ix < 0 || iy < 0 || ix >= r.size || iy >= r.size {
+		return
+	}
+
+	i := iy*r.size + ix
+	if r.stamp[i] != r.track {
+		r.stamp[i] = r.track
+		r.visits[i]++
+	}
+}
+
+// renderTile draws every track that passes through a tile onto a square image.
+// Lines are dilated and blurred, and colored by how many tracks pass through
+// them relative to maxVisits. If maxVisits is not known it is taken from the
+// most visited pixel of the tile. Line width and blur grow with the tile size
+// so that high density tiles look the same, only sharper.
+func renderTile(tracks []track, tile Tile, tileSizePx int, style TileStyle, maxVisits int) *image.NRGBA {
+	density := tileSizePx / int(tileSize)
+	if density < 1 {
+		density = 1
+	}
+
+	r := newRaster(tileSizePx)
+	scale := float64(int(1)<<tile.Z) * float64(tileSizePx) / tileSize
+	offsetX := float64(tile.X * tileSizePx)
+	offsetY := float64(tile.Y * tileSizePx)
+
+	for _, t := range tracks {
+		if !t.intersects(tile) {
+			continue
+		}
+
+		r.startTrack()
+		for _, line := range t.lines {
+			if !line.intersects(tile) {
+				continue
+			}
+
+			for i, pt := range line.points {
+				ax := pt[0]*scale - offsetX
+				ay := pt[1]*scale - offsetY
+				if i == 0 {
+					r.mark(ax, ay)
+					continue
+				}
+
+				bx := line.points[i-1][0]*scale - offsetX
+				by := line.points[i-1][1]*scale - offsetY
+				drawSegment(r, ax, ay, bx, by)
+			}
+		}
+	}
+
+	if maxVisits <= 0 {
+		for _, v := range r.visits {
+			if v > maxVisits {
+				maxVisits = v
+			}
+		}
+	}
+
+	lineWidth := 2 * density
+	coverage, visits := dilate(r.visits, tileSizePx, lineWidth)
+	kernel := gaussianKernel(blurSigma * float64(density))
+	coverage = gaussianBlur(coverage, tileSizePx, kernel)
+	visits = gaussianBlur(visits, tileSizePx, kernel)
+
+	// the intensity at the center of a blurred line, which is treated as opaque
+	radius := len(kernel) / 2
+	linePeak := 0.0
+	for i := radius - lineWidth/2 + 1; i <= radius+lineWidth/2; i++ {
+		if i >= 0 && i < len(kernel) {
+			linePeak += kernel[i]
+		}
+	}
+
+	return colorize(coverage, visits, tileSizePx, linePeak, style, float64(maxVisits))
+}
+
+// drawSegment marks every pixel along the line from a to b, one sample per pixel
+func drawSegment(r *raster, ax, ay, bx, by float64) {
+	ax, ay, bx, by, ok := clipSegment(ax, ay, bx, by, float64(r.size))
+	if !ok {
+		return
+	}
+
+	steps := int(math.Ceil(math.Max(math.Abs(bx-ax), math.Abs(by-ay))))
+	if steps == 0 {
+		r.mark(ax, ay)
+		return
+	}
+
+	for i := 0; i <= steps; i++ {
+		frac := float64(i) / float64(steps)
+		r.mark(ax+(bx-ax)*frac, ay+(by-ay)*frac)
+	}
+}
+
+// clipSegment clips a line segment to the square [0, size) using the
+// Liang-Barsky algorithm. The returned flag is false if no part of the segment
+// is within the square.
+func clipSegment(ax, ay, bx, by, size float64) (float64, float64, float64, float64, bool) {
+	dx := bx - ax
+	dy := by - ay
+	t0, t1 := 0.0, 1.0
+
+	for _, edge := range [][2]float64{
+		{-dx, ax},
+		{dx, size - ax},
+		{-dy, ay},
+		{dy, size - ay},
+	} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return 0, 0, 0, 0, false
+			}
+			continue
+		}
+
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return 0, 0, 0, 0, false
+			}
+			t0 = math.Max(t0, r)
+		} else {
+			if r < t0 {
+				return 0, 0, 0, 0, false
+			}
+			t1 = math.Min(t1, r)
+		}
+	}
+
+	return ax + t0*dx, ay + t0*dy, ax + t1*dx, ay + t1*dy, true
+}
+
+// dilate grows each visited pixel into a width x width block centered on the
+// pixel (extending up and to the left for even widths). It returns the coverage
+// of the dilated image and the visit count of each pixel, taking the largest
+// count where blocks overlap.
+func dilate(visits []int, size int, width int) ([]float64, []float64) {
+	lo := -width / 2
+	hi := lo + width - 1
+
+	coverage := make([]float64, len(visits))
+	dilated := make([]float64, len(visits))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := float64(visits[y*size+x])
+			if v == 0 {
+				continue
+			}
+
+			for dy := lo; dy <= hi; dy++ {
+				for dx := lo; dx <= hi; dx++ {
+					if x+dx >= 0 && y+dy >= 0 && x+dx < size && y+dy < size {
+						i := (y+dy)*size + x + dx
+						coverage[i] = 1
+						dilated[i] = math.Max(dilated[i], v)
+					}
+				}
+			}
+		}
+	}
+	return coverage, dilated
+}
+
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(4*sigma + 0.5)
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := -radius; i <= radius; i++ {
+		kernel[i+radius] = math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		sum += kernel[i+radius]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// gaussianBlur applies a separable gaussian filter. Edges are handled by
+// reflecting the image, which mirrors the behavior of scipy's gaussian_filter
+func gaussianBlur(values []float64, size int, kernel []float64) []float64 {
+	radius := len(kernel) / 2
+	reflect := func(i int) int {
+		for i < 0 || i >= size {
+			if i < 0 {
+				i = -i - 1
+			} else {
+				i = 2*size - i - 1
+			}
+		}
+		return i
+	}
+
+	horizontal := make([]float64, len(values))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			acc := 0.0
+			for k := -radius; k <= radius; k++ {
+				acc += kernel[k+radius] * values[y*size+reflect(x+k)]
+			}
+			horizontal[y*size+x] = acc
+		}
+	}
+
+	blurred := make([]float64, len(values))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			acc := 0.0
+			for k := -radius; k <= radius; k++ {
+				acc += kernel[k+radius] * horizontal[reflect(y+k)*size+x]
+			}
+			blurred[y*size+x] = acc
+		}
+	}
+
+	return blurred
+}
+
+// colorize builds the tile image. Opacity follows the blurred line coverage,
+// while color follows the average visit count of the lines near each pixel.
+func colorize(coverage, visits []float64, size int, linePeak float64, style TileStyle, maxVisits float64) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+
+	for i, c := range coverage {
+		if c <= 0 {
+			continue
+		}
+
+		alpha := math.Min(c/linePeak, 1)
+		clr := style.color(visits[i]/c, maxVisits)
+		img.Pix[i*4+0] = clr.R
+		img.Pix[i*4+1] = clr.G
+		img.Pix[i*4+2] = clr.B
+		img.Pix[i*4+3] = uint8(float64(clr.A) * alpha)
+	}
+
+	return img
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package maps
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestRenderTileSize(t *testing.T) {
+	style, err := NewTileStyle(ColorRampHot, ColorScaleLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a line across the middle of the world, which crosses tile (0, 0, 0).
+	// Points are close enough together to be joined
+	coords := [][]float64{}
+	for lon := -90.0; lon <= 90; lon += 0.05 {
+		coords = append(coords, []float64{0, lon})
+	}
+	tracks := []track{newTrack(coords)}
+	tile := Tile{0, 0, 0}
+
+	cases := []struct {
+		name   string
+		sizePx int
+	}{
+		{"1x", 256},
+		{"2x", 512},
+		{"3x", 768},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			img := renderTile(tracks, tile, c.sizePx, style, 0)
+			if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != c.sizePx || h != c.sizePx {
+				t.Fatalf("rendered %dx%d, want %dx%d", w, h, c.sizePx, c.sizePx)
+			}
+
+			// the line is drawn at the same place at every density
+			if img.NRGBAAt(c.sizePx/2, c.sizePx/2).A == 0 {
+				t.Errorf("center of the line is transparent")
+			}
+			if img.NRGBAAt(c.sizePx/2, c.sizePx/4).A != 0 {
+				t.Errorf("pixel away from the line is drawn")
+			}
+
+			data, err := encodePNG(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := png.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != c.sizePx || cfg.Height != c.sizePx {
+				t.Errorf("encoded %dx%d, want %dx%d", cfg.Width, cfg.Height, c.sizePx, c.sizePx)
+			}
+		})
+	}
+}
+
+func TestTileName(t *testing.T) {
+	mapID := "0b5f7a5e-1c2d-4e3f-8a9b-0c1d2e3f4a5b"
+	tile := Tile{3, 5, 4}
+
+	cases := []struct {
+		sizePx int
+		want   string
+	}{
+		{256, mapID + "-3-5-4.png"},
+		{512, mapID + "-3-5-4@2x.png"},
+		{768, mapID + "-3-5-4@3x.png"},
+	}
+
+	for _, c := range cases {
+		name := tileName(mapID, tile, c.sizePx)
+		if name != c.want {
+			t.Errorf("tileName(%d) = %s, want %s", c.sizePx, name, c.want)
+		}
+		if gotMapID, gotTile, ok := parseTileName(name); !ok || gotMapID != mapID || gotTile != tile {
+			t.Errorf("parseTileName(%s) = %s, %+v, %v", name, gotMapID, gotTile, ok)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package maps
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+type streamStruct struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// trackPoint is a single recorded point of an activity. Only the location is
+// always set; use activityStreams.Has to check for the other values
+type trackPoint struct {
+	Lat, Lon float64
+	// seconds since the start of the activity
+	Time     int
+	Altitude float64
+	// meters per second
+	Velocity float64
+	// beats per minute
+	Heartrate int
+	Moving    bool
+}
+
+// activityStreams are the points of an activity, in the order they were
+// recorded. Activities downloaded before more streams were requested only hold
+// locations
+type activityStreams struct {
+	Points []trackPoint
+	has    map[string]bool
+}
+
+// Has reports whether every point holds the values of a stream
+func (as activityStreams) Has(streamType string) bool {
+	return as.has[streamType]
+}
+
+// LatLons returns the location of every point
+func (as activityStreams) LatLons() [][]float64 {
+	latLons := make([][]float64, len(as.Points))
+	for i, p := range as.Points {
+		latLons[i] = []float64{p.Lat, p.Lon}
+	}
+	return latLons
+}
+
+// TrackLatLons returns the location of every point of stored activity data
+func TrackLatLons(data []byte) [][]float64 {
+	return parseStreams(data).LatLons()
+}
+
+// parseStreams reads the stored streams of an activity. Points without a valid
+// location are dropped, and streams whose length does not match the locations
+// are ignored because their values cannot be aligned to a point
+func parseStreams(data []byte) activityStreams {
+	streams := map[string]json.RawMessage{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// read open bracket
+	dec.Token()
+
+	// while the array contains values
+	for dec.More() {
+		// decode an array value, stopping at invalid JSON
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			break
+		}
+
+		// skip non-conforming documents
+		var res streamStruct
+		if err := json.Unmarshal(raw, &res); err != nil {
+			continue
+		}
+		streams[res.Type] = res.Data
+	}
+
+	result := activityStreams{has: map[string]bool{}}
+
+	var latLngs []interface{}
+	if err := json.Unmarshal(streams[sdk.StreamLatLng], &latLngs); err != nil {
+		return result
+	}
+	result.has[sdk.StreamLatLng] = true
+
+	var times, heartrates []int
+	var altitudes, velocities []float64
+	var moving []bool
+	result.has[sdk.StreamTime] = decodeStream(streams, sdk.StreamTime, len(latLngs), &times)
+	result.has[sdk.StreamAltitude] = decodeStream(streams, sdk.StreamAltitude, len(latLngs), &altitudes)
+	result.has[sdk.StreamVelocitySmooth] = decodeStream(streams, sdk.StreamVelocitySmooth, len(latLngs), &velocities)
+	result.has[sdk.StreamHeartrate] = decodeStream(streams, sdk.StreamHeartrate, len(latLngs), &heartrates)
+	result.has[sdk.StreamMoving] = decodeStream(streams, sdk.StreamMoving, len(latLngs), &moving)
+
+	for i, dataElem := range latLngs {
+		lat, lon, err := parseLatLon(dataElem)
+		if err != nil {
+			continue
+		}
+
+		p := trackPoint{Lat: lat, Lon: lon}
+		if result.has[sdk.StreamTime] {
+			p.Time = times[i]
+		}
+		if result.has[sdk.StreamAltitude] {
+			p.Altitude = altitudes[i]
+		}
+		if result.has[sdk.StreamVelocitySmooth] {
+			p.Velocity = velocities[i]
+		}
+		if result.has[sdk.StreamHeartrate] {
+			p.Heartrate = heartrates[i]
+		}
+		if result.has[sdk.StreamMoving] {
+			p.Moving = moving[i]
+		}
+		result.Points = append(result.Points, p)
+	}
+
+	return result
+}
+
+// decodeStream decodes a stream into values, which must be a pointer to a
+// slice. It reports whether the stream exists and has one value per point
+func decodeStream(streams map[string]json.RawMessage, streamType string, points int, values interface{}) bool {
+	data, ok := streams[streamType]
+	if !ok {
+		return false
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) != points {
+		return false
+	}
+	return json.Unmarshal(data, values) == nil
+}
+
+func parseLatLon(dataElem interface{}) (float64, float64, error) {
+	asList, ok := dataElem.([]interface{})
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpectedly did not find lat/lon list: %+v", dataElem)
+	}
+
+	if len(asList) != 2 {
+		return 0, 0, fmt.Errorf("unexpectedly did not find correct number of lat/lon: %+v", asList)
+	}
+
+	lat, ok := asList[0].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("lat was unexpectly not a float: %+v", asList[0])
+	}
+	lon, ok := asList[1].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("lon was unexpectly not a float: %+v", asList[0])
+	}
+
+	return lat, lon, nil
+}
@@ -0,0 +1,98 @@
+package maps
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+func TestParseStreams(t *testing.T) {
+	latlng := `{"type":"latlng","data":[[37.1,-122.1],[37.2,-122.2],[37.3,-122.3]]}`
+
+	cases := []struct {
+		name   string
+		data   string
+		points []trackPoint
+		has    []string
+	}{
+		{
+			"locations only",
+			`[` + latlng + `]`,
+			[]trackPoint{{Lat: 37.1, Lon: -122.1}, {Lat: 37.2, Lon: -122.2}, {Lat: 37.3, Lon: -122.3}},
+			[]string{sdk.StreamLatLng},
+		},
+		{
+			"every stream",
+			`[` + latlng + `,
+				{"type":"time","data":[0,5,11]},
+				{"type":"altitude","data":[10.5,11,12.25]},
+				{"type":"velocity_smooth","data":[0,2.5,3]},
+				{"type":"heartrate","data":[90,120,140]},
+				{"type":"moving","data":[false,true,true]}]`,
+			[]trackPoint{
+				{Lat: 37.1, Lon: -122.1, Time: 0, Altitude: 10.5, Velocity: 0, Heartrate: 90, Moving: false},
+				{Lat: 37.2, Lon: -122.2, Time: 5, Altitude: 11, Velocity: 2.5, Heartrate: 120, Moving: true},
+				{Lat: 37.3, Lon: -122.3, Time: 11, Altitude: 12.25, Velocity: 3, Heartrate: 140, Moving: true},
+			},
+			[]string{sdk.StreamLatLng, sdk.StreamTime, sdk.StreamAltitude, sdk.StreamVelocitySmooth, sdk.StreamHeartrate, sdk.StreamMoving},
+		},
+		{
+			// values cannot be matched to points when a stream is shorter
+			"stream of another length",
+			`[` + latlng + `,{"type":"time","data":[0,5]},{"type":"heartrate","data":[90,120,140]}]`,
+			[]trackPoint{
+				{Lat: 37.1, Lon: -122.1, Heartrate: 90},
+				{Lat: 37.2, Lon: -122.2, Heartrate: 120},
+				{Lat: 37.3, Lon: -122.3, Heartrate: 140},
+			},
+			[]string{sdk.StreamLatLng, sdk.StreamHeartrate},
+		},
+		{
+			"stream of the wrong type",
+			`[` + latlng + `,{"type":"moving","data":[1,2,3]}]`,
+			[]trackPoint{{Lat: 37.1, Lon: -122.1}, {Lat: 37.2, Lon: -122.2}, {Lat: 37.3, Lon: -122.3}},
+			[]string{sdk.StreamLatLng},
+		},
+		{
+			// values stay aligned to the points that are kept
+			"invalid locations",
+			`[{"type":"latlng","data":[[37.1,-122.1],[37.2],"x",[37.4,-122.4]]},{"type":"time","data":[0,1,2,3]}]`,
+			[]trackPoint{{Lat: 37.1, Lon: -122.1, Time: 0}, {Lat: 37.4, Lon: -122.4, Time: 3}},
+			[]string{sdk.StreamLatLng, sdk.StreamTime},
+		},
+		{
+			"malformed stream",
+			`[{"type":"distance","data":{}},"x",` + latlng + `]`,
+			[]trackPoint{{Lat: 37.1, Lon: -122.1}, {Lat: 37.2, Lon: -122.2}, {Lat: 37.3, Lon: -122.3}},
+			[]string{sdk.StreamLatLng},
+		},
+		{"no locations", `[{"type":"time","data":[0,1]}]`, nil, nil},
+		{"empty", `[]`, nil, nil},
+		{"not json", `not json`, nil, nil},
+	}
+
+	allStreams := []string{sdk.StreamLatLng, sdk.StreamTime, sdk.StreamAltitude, sdk.StreamVelocitySmooth, sdk.StreamHeartrate, sdk.StreamMoving}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			streams := parseStreams([]byte(c.data))
+			if !reflect.DeepEqual(streams.Points, c.points) {
+				t.Errorf("points = %+v, want %+v", streams.Points, c.points)
+			}
+
+			has := []string(nil)
+			for _, s := range allStreams {
+				if streams.Has(s) {
+					has = append(has, s)
+				}
+			}
+			if !reflect.DeepEqual(has, c.has) {
+				t.Errorf("has streams %v, want %v", has, c.has)
+			}
+
+			if latLons := TrackLatLons([]byte(c.data)); len(latLons) != len(c.points) {
+				t.Errorf("TrackLatLons() has %d points, want %d", len(latLons), len(c.points))
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package maps
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+const (
+	ColorRampHot       = "hot"
+	ColorRampBlueRed   = "bluered"
+	ColorRampGrayscale = "grayscale"
+
+	ColorScaleLinear = "linear"
+	ColorScaleLog    = "log"
+)
+
+type colorStop struct {
+	at    float64
+	color color.NRGBA
+}
+
+// colorRamp maps a value in [0, 1] onto a color by interpolating between stops
+type colorRamp []colorStop
+
+var colorRamps = map[string]colorRamp{
+	// dark red for rarely visited roads, through strava orange, to white hot
+	ColorRampHot: {
+		{0, color.NRGBA{R: 173, G: 31, B: 7, A: 255}},
+		{0.4, stravaOrange},
+		{0.75, color.NRGBA{R: 255, G: 176, B: 37, A: 255}},
+		{1, color.NRGBA{R: 255, G: 255, B: 220, A: 255}},
+	},
+	ColorRampBlueRed: {
+		{0, color.NRGBA{R: 0, G: 80, B: 255, A: 255}},
+		{0.5, color.NRGBA{R: 170, G: 0, B: 170, A: 255}},
+		{1, color.NRGBA{R: 255, G: 0, B: 0, A: 255}},
+	},
+	ColorRampGrayscale: {
+		{0, color.NRGBA{R: 160, G: 160, B: 160, A: 255}},
+		{1, color.NRGBA{R: 0, G: 0, B: 0, A: 255}},
+	},
+}
+
+func (cr colorRamp) at(v float64) color.NRGBA {
+	if v <= cr[0].at {
+		return cr[0].color
+	}
+
+	for i := 1; i < len(cr); i++ {
+		if v > cr[i].at {
+			continue
+		}
+
+		lo, hi := cr[i-1], cr[i]
+		frac := (v - lo.at) / (hi.at - lo.at)
+		lerp := func(a, b uint8) uint8 {
+			return uint8(math.Round(float64(a) + (float64(b)-float64(a))*frac))
+		}
+		return color.NRGBA{
+			R: lerp(lo.color.R, hi.color.R),
+			G: lerp(lo.color.G, hi.color.G),
+			B: lerp(lo.color.B, hi.color.B),
+			A: lerp(lo.color.A, hi.color.A),
+		}
+	}
+
+	return cr[len(cr)-1].color
+}
+
+// TileStyle controls how visit counts are turned into tile colors
+type TileStyle struct {
+	ramp     colorRamp
+	logScale bool
+}
+
+func NewTileStyle(rampName, scaleName string) (TileStyle, error) {
+	ramp, ok := colorRamps[rampName]
+	if !ok {
+		return TileStyle{}, fmt.Errorf("unknown color ramp '%s'", rampName)
+	}
+
+	switch scaleName {
+	case ColorScaleLinear, ColorScaleLog:
+	default:
+		return TileStyle{}, fmt.Errorf("unknown color scale '%s'", scaleName)
+	}
+
+	return TileStyle{
+		ramp:     ramp,
+		logScale: scaleName == ColorScaleLog,
+	}, nil
+}
+
+// normalize maps a visit count onto [0, 1] given the most visits expected
+// anywhere on the map. A single visit always maps to 0.
+func (ts TileStyle) normalize(visits, maxVisits float64) float64 {
+	if maxVisits <= 1 || visits <= 1 {
+		return 0
+	}
+
+	var v float64
+	if ts.logScale {
+		v = math.Log(visits) / math.Log(maxVisits)
+	} else {
+		v = (visits - 1) / (maxVisits - 1)
+	}
+	return math.Min(v, 1)
+}
+
+func (ts TileStyle) color(visits, maxVisits float64) color.NRGBA {
+	return ts.ramp.at(ts.normalize(visits, maxVisits))
+}
@@ -0,0 +1,100 @@
+package maps
+
+import (
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestNewTileStyle(t *testing.T) {
+	cases := []struct {
+		ramp, scale string
+		ok          bool
+	}{
+		{ColorRampHot, ColorScaleLog, true},
+		{ColorRampBlueRed, ColorScaleLinear, true},
+		{ColorRampGrayscale, ColorScaleLog, true},
+		{"rainbow", ColorScaleLog, false},
+		{ColorRampHot, "sqrt", false},
+	}
+
+	for _, c := range cases {
+		_, err := NewTileStyle(c.ramp, c.scale)
+		if (err == nil) != c.ok {
+			t.Errorf("NewTileStyle(%q, %q) error = %v, want ok = %v", c.ramp, c.scale, err, c.ok)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	linear := TileStyle{logScale: false}
+	logScale := TileStyle{logScale: true}
+
+	cases := []struct {
+		name              string
+		style             TileStyle
+		visits, maxVisits float64
+		want              float64
+	}{
+		{"linear single visit", linear, 1, 10, 0},
+		{"linear half", linear, 5.5, 10, 0.5},
+		{"linear max", linear, 10, 10, 1},
+		{"linear over max", linear, 20, 10, 1},
+		{"linear unknown max", linear, 5, 1, 0},
+		{"log single visit", logScale, 1, 100, 0},
+		{"log half", logScale, 10, 100, 0.5},
+		{"log max", logScale, 100, 100, 1},
+		{"log over max", logScale, 1000, 100, 1},
+		{"no visits", logScale, 0, 100, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.style.normalize(c.visits, c.maxVisits); math.Abs(got-c.want) > epsilon {
+				t.Errorf("normalize(%v, %v) = %v, want %v", c.visits, c.maxVisits, got, c.want)
+			}
+		})
+	}
+}
+
+func TestColorRamp(t *testing.T) {
+	hot := colorRamps[ColorRampHot]
+	gray := colorRamps[ColorRampGrayscale]
+
+	cases := []struct {
+		name string
+		ramp colorRamp
+		v    float64
+		want color.NRGBA
+	}{
+		{"below first stop", hot, -1, hot[0].color},
+		{"first stop", hot, 0, hot[0].color},
+		{"inner stop", hot, 0.4, stravaOrange},
+		{"last stop", hot, 1, hot[len(hot)-1].color},
+		{"above last stop", hot, 2, hot[len(hot)-1].color},
+		{"halfway", gray, 0.5, color.NRGBA{R: 80, G: 80, B: 80, A: 255}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.ramp.at(c.v); got != c.want {
+				t.Errorf("at(%v) = %+v, want %+v", c.v, got, c.want)
+			}
+		})
+	}
+}
+
+func TestStyleColor(t *testing.T) {
+	style, err := NewTileStyle(ColorRampGrayscale, ColorScaleLinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ramp := colorRamps[ColorRampGrayscale]
+	if got := style.color(1, 10); got != ramp[0].color {
+		t.Errorf("least visited color = %+v, want %+v", got, ramp[0].color)
+	}
+	if got := style.color(10, 10); got != ramp[1].color {
+		t.Errorf("most visited color = %+v, want %+v", got, ramp[1].color)
+	}
+}
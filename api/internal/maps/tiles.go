@@ -0,0 +1,298 @@
+package maps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/concurrency"
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
+)
+
+const (
+	// number of athletes whose activity tracks are kept in memory by a worker
+	trackCacheAthletes = 4
+)
+
+// TileBatch is the message sent to tile rendering workers
+type TileBatch struct {
+	Coords    []MapParam `json:"coords"`
+	AthleteID int        `json:"athlete_id"`
+	MapID     string     `json:"map_id"`
+	// pixel sizes to render each tile at. Defaults to the standard tile size
+	Sizes []int `json:"sizes,omitempty"`
+	// tile formats to produce. Defaults to PNG
+	Formats []string `json:"formats,omitempty"`
+	// build raster tiles from the already rendered tiles of the next zoom level
+	// instead of from activity coordinates
+	Downsample bool `json:"downsample,omitempty"`
+}
+
+const (
+	TileFormatPNG = "png"
+	TileFormatMVT = "mvt"
+)
+
+// ValidateTileFormats checks that every format is one that can be rendered
+func ValidateTileFormats(formats []string) error {
+	if len(formats) == 0 {
+		return errors.New("at least one tile format is required")
+	}
+
+	for _, format := range formats {
+		if format != TileFormatPNG && format != TileFormatMVT {
+			return fmt.Errorf("unknown tile format '%s'", format)
+		}
+	}
+	return nil
+}
+
+// ValidateTileSizes checks that every size is the standard tile size scaled by
+// a power of two, which is what clients expect for high density displays
+func ValidateTileSizes(sizes []int) error {
+	if len(sizes) == 0 {
+		return errors.New("at least one tile size is required")
+	}
+
+	for _, size := range sizes {
+		density := size / int(tileSize)
+		if size%int(tileSize) != 0 || density&(density-1) != 0 {
+			return fmt.Errorf("tile size %d is not %d scaled by a power of two", size, int(tileSize))
+		}
+	}
+	return nil
+}
+
+// TileDensities converts tile sizes into device pixel ratios
+func TileDensities(sizes []int) []int {
+	densities := make([]int, len(sizes))
+	for i, size := range sizes {
+		densities[i] = size / int(tileSize)
+	}
+	return densities
+}
+
+// tileName is the name of the uploaded image for a tile of a map. Tiles larger
+// than the standard size get a density suffix, i.e., '@2x'
+func tileName(mapID string, t Tile, sizePx int) string {
+	suffix := ""
+	if density := sizePx / int(tileSize); density > 1 {
+		suffix = fmt.Sprintf("@%dx", density)
+	}
+	return fmt.Sprintf("%s-%d-%d-%d%s.png", mapID, t.X, t.Y, t.Z, suffix)
+}
+
+// vectorTileName is the name of the uploaded vector tile for a tile of a map
+func vectorTileName(mapID string, t Tile) string {
+	return fmt.Sprintf("%s-%d-%d-%d.mvt", mapID, t.X, t.Y, t.Z)
+}
+
+// trackCache holds parsed activity tracks so that consecutive batches for the
+// same athlete do not need to download every activity again
+type trackCache struct {
+	mu       sync.Mutex
+	athletes map[int]map[string]track
+	recent   []int
+}
+
+func newTrackCache() *trackCache {
+	return &trackCache{athletes: map[int]map[string]track{}}
+}
+
+// get returns the cached tracks for an athlete, limited to the refs requested
+func (tc *trackCache) get(athleteID int, refs []string) (map[string]track, []string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	cached := tc.athletes[athleteID]
+	found := map[string]track{}
+	missing := []string{}
+	for _, ref := range refs {
+		if t, ok := cached[ref]; ok {
+			found[ref] = t
+		} else {
+			missing = append(missing, ref)
+		}
+	}
+	return found, missing
+}
+
+func (tc *trackCache) put(athleteID int, tracks map[string]track) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.athletes[athleteID] = tracks
+	for i, id := range tc.recent {
+		if id == athleteID {
+			tc.recent = append(tc.recent[:i], tc.recent[i+1:]...)
+			break
+		}
+	}
+	tc.recent = append(tc.recent, athleteID)
+
+	for len(tc.recent) > trackCacheAthletes {
+		delete(tc.athletes, tc.recent[0])
+		tc.recent = tc.recent[1:]
+	}
+}
+
+func (ms MapService) loadTracks(ctx context.Context, athleteID int) ([]track, error) {
+	activityRefs, err := ms.stravaSvc.Athlete.GetActivityRefsForAthlete(ctx, athleteID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %+v", ErrorStravaAPI, err)
+	}
+
+	refs := make([]string, len(activityRefs))
+	for i, ref := range activityRefs {
+		refs[i] = ref.DataRef
+	}
+
+	tracks, missing := ms.tracks.get(athleteID, refs)
+	if len(missing) > 0 {
+		log.Printf("downloading '%d' of '%d' activities for athlete '%d'", len(missing), len(refs), athleteID)
+	}
+
+	tracksSem := concurrency.NewSemaphore(1)
+	funcs := [](func() error){}
+	for _, ref := range missing {
+		theRef := ref
+		funcs = append(funcs, func() error {
+			bytes, err := ms.storageSvc.GetObjectBytes(ctx, theRef)
+			if err != nil {
+				return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+			}
+
+			t := newTrack(parseStreams(bytes).LatLons())
+
+			tracksSem.Acquire(1)
+			defer tracksSem.Release(1)
+			tracks[theRef] = t
+			return nil
+		})
+	}
+
+	if err = concurrency.NewSemaphore(ms.storageConcurrencyLimit).WithRateLimit(funcs, true); err != nil {
+		return nil, err
+	}
+	ms.tracks.put(athleteID, tracks)
+
+	// metadata can change without the activity data changing, so it is not cached
+	result := make([]track, 0, len(activityRefs))
+	for _, ref := range activityRefs {
+		t := tracks[ref.DataRef]
+		t.activityID = ref.ActivityID
+		t.sportType = ref.SportType
+		t.startDate = ref.StartDate
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// RenderTileBatch renders and uploads every tile in a batch
+func (ms MapService) RenderTileBatch(ctx context.Context, batch TileBatch) error {
+	sizes := batch.Sizes
+	if len(sizes) == 0 {
+		sizes = []int{int(tileSize)}
+	}
+
+	formats := types.NewSet()
+	for _, format := range batch.Formats {
+		formats.Add(format)
+	}
+	if formats.Size() == 0 {
+		formats.Add(TileFormatPNG)
+	}
+
+	// downsampled raster tiles do not need any activity data
+	var tracks []track
+	if !batch.Downsample || formats.Exists(TileFormatMVT) {
+		var err error
+		if tracks, err = ms.loadTracks(ctx, batch.AthleteID); err != nil {
+			return err
+		}
+	}
+
+	funcs := [](func() error){}
+	for _, param := range batch.Coords {
+		theParam := param
+		if formats.Exists(TileFormatMVT) {
+			funcs = append(funcs, func() error {
+				bytes := renderVectorTile(tracks, theParam.Tile)
+				if err := ms.tileStorageSvc.CreateObject(ctx, vectorTileName(batch.MapID, theParam.Tile), bytes); err != nil {
+					return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+				}
+				return nil
+			})
+		}
+
+		if !formats.Exists(TileFormatPNG) {
+			continue
+		}
+
+		for _, size := range sizes {
+			theParam := param
+			theSize := size
+			funcs = append(funcs, func() error {
+				var img image.Image
+				if batch.Downsample {
+					downsampled, err := ms.downsampleTile(ctx, batch.MapID, theParam.Tile, theSize)
+					if err != nil {
+						return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+					}
+					img = downsampled
+				} else {
+					img = renderTile(tracks, theParam.Tile, theSize, ms.style, theParam.MaxVisits)
+				}
+
+				bytes, err := encodePNG(img)
+				if err != nil {
+					return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+				}
+
+				if err := ms.tileStorageSvc.CreateObject(ctx, tileName(batch.MapID, theParam.Tile, theSize), bytes); err != nil {
+					return fmt.Errorf("%w: %+v", ErrorInternalError, err)
+				}
+				return nil
+			})
+		}
+	}
+
+	return concurrency.NewSemaphore(ms.storageConcurrencyLimit).WithRateLimit(funcs, true)
+}
+
+// ProcessTileBatchMessage renders the tiles described by a queue message and
+// records the outcome in the processing state of the message. A message that
+// fails stays queued until its last attempt, since the queue retries it, so the
+// next zoom level of a pyramid build waits for it
+func (ms MapService) ProcessTileBatchMessage(ctx context.Context, messageID string, body []byte, lastAttempt bool) error {
+	batch := TileBatch{}
+	err := json.Unmarshal(body, &batch)
+	if err == nil {
+		log.Printf("rendering '%d' tiles for athlete '%d' (message '%s')", len(batch.Coords), batch.AthleteID, messageID)
+		err = ms.RenderTileBatch(ctx, batch)
+	}
+
+	pstate := processingComplete
+	if err != nil {
+		if !lastAttempt {
+			return err
+		}
+		pstate = processingFailed
+	}
+
+	if stateErr := ms.db.setProcessingStateForID(ctx, messageID, pstate); stateErr != nil {
+		log.Printf("error updating state of message '%s' to %s: %+v", messageID, pstate, stateErr)
+	}
+
+	if batch.MapID != "" {
+		if pyramidErr := ms.advancePyramid(ctx, batch.MapID); pyramidErr != nil {
+			log.Printf("error enqueueing next zoom level of map '%s': %+v", batch.MapID, pyramidErr)
+		}
+	}
+
+	return err
+}
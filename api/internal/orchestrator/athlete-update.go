@@ -2,14 +2,26 @@ package orchestrator
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
 	"github.com/nmiodice/personal-strava-heatmap/internal/state"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
 )
 
+// UpdateOptions changes how UpdateAthleteMap syncs activities and renders tiles
+type UpdateOptions struct {
+	// re-render every tile, rather than only the tiles touched by new activities
+	FullRebuild bool
+	// skip listing activities, i.e., when the caller already recorded the
+	// activities that changed
+	SkipListing bool
+}
+
 // UpdateAthleteMap update a map for an athlete, and track the progress.
 // This function processes optimistically and will continue in spite of errors
 func UpdateAthleteMap(
@@ -18,17 +30,37 @@ func UpdateAthleteMap(
 	stateSvc state.StateService,
 	athleteID int,
 	accessToken string,
+	options UpdateOptions,
 	ctx context.Context) error {
 
+	ctx = sdk.WithAthlete(ctx, athleteID)
 	var errors *multierror.Error
+	fullRebuild := options.FullRebuild
 
-	log.Printf("importing new activities for athlete '%d'", athleteID)
-	stateSvc.UpdateState(ctx, athleteID, state.ImportingActivities)
+	// every request to Strava would be refused, so the athlete is told to log in
+	// again instead
+	scopes, err := stravaSvc.Auth.GetScopesForAthlete(ctx, athleteID)
+	if err == nil && !scopes.CanReadActivities() {
+		log.Printf("athlete '%d' did not allow their activities to be read (granted '%s'), skipping update", athleteID, scopes)
+		stateSvc.UpdateState(ctx, athleteID, state.MissingActivityScope)
+		return strava.ErrorMissingScope
+	}
 
-	_, err := stravaSvc.Athlete.ImportNewActivities(ctx, accessToken)
-	if err != nil {
-		multierror.Append(errors, err)
-		log.Printf("error encountered importing new activities for athlete '%d': %+v", athleteID, err)
+	if !options.SkipListing {
+		log.Printf("importing new activities for athlete '%d'", athleteID)
+		stateSvc.UpdateState(ctx, athleteID, state.ImportingActivities)
+
+		summary, err := stravaSvc.Athlete.ImportNewActivities(ctx, accessToken)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			log.Printf("error encountered importing new activities for athlete '%d': %+v", athleteID, err)
+		}
+
+		// deleted activities, and activities hidden by the visibility policy, can
+		// only be erased from the map by a full rebuild
+		if summary.Deleted > 0 || summary.VisibilityChanged > 0 {
+			fullRebuild = true
+		}
 	}
 
 	log.Printf("importing new activity streams for athlete '%d'", athleteID)
@@ -36,18 +68,23 @@ func UpdateAthleteMap(
 
 	imported, err := stravaSvc.Athlete.ImportMissingActivityStreams(ctx, accessToken)
 	if err != nil {
-		multierror.Append(errors, err)
+		errors = multierror.Append(errors, err)
 		log.Printf("error encountered importing new activity streams for athlete '%d': %+v", athleteID, err)
 	}
 
-	if imported > 0 {
+	if imported > 0 || fullRebuild {
 		log.Printf("rebuilding map for athlete '%d'", athleteID)
 		stateSvc.UpdateState(ctx, athleteID, state.ComputingMapParams)
 
-		dataRefs, messageBatches, err := mapSvc.RebuildMapForAthlete(ctx, accessToken)
+		rebuild := mapSvc.UpdateMapForAthlete
+		if fullRebuild {
+			rebuild = mapSvc.RebuildMapForAthlete
+		}
+
+		dataRefs, messageBatches, err := rebuild(ctx, accessToken)
 		if err != nil {
 			log.Printf("error encountered rebuilding map for athlete '%d': %+v", athleteID, err)
-			multierror.Append(errors, err)
+			errors = multierror.Append(errors, err)
 		} else {
 			log.Printf("rebuilt map using '%d' data refs and '%d' queued messages for athlete '%d'", len(dataRefs), len(messageBatches), athleteID)
 		}
@@ -55,9 +92,35 @@ func UpdateAthleteMap(
 
 	stateSvc.UpdateState(ctx, athleteID, state.ProcessingMap)
 	if errors != nil && len(errors.Errors) > 0 {
-		stateSvc.UpdateState(ctx, athleteID, state.GetErrorState(errors.Errors))
+		// activities that could not be listed or downloaded are picked up by the
+		// next sync, so the athlete is told when that can happen rather than
+		// shown an error
+		if retryAt, limited := rateLimitedUntil(errors.Errors); limited {
+			log.Printf("sync of athlete '%d' was cut short by Strava rate limits until %s", athleteID, retryAt.Format(time.RFC3339))
+			stateSvc.UpdateState(ctx, athleteID, state.GetRateLimitedState(retryAt))
+		} else {
+			stateSvc.UpdateState(ctx, athleteID, state.GetErrorState(errors.Errors))
+		}
 		return errors
 	}
 
 	return nil
 }
+
+// rateLimitedUntil reports whether any of the errors is a request that Strava,
+// or the rate limit budget, put off, and the latest time at which the requests
+// can be made again. The time is zero if none of the errors says when
+func rateLimitedUntil(errs []error) (time.Time, bool) {
+	var latest time.Time
+	limited := false
+	for _, err := range errs {
+		if !errors.Is(err, sdk.ErrorTooManyRequests) && !errors.Is(err, sdk.ErrorServiceUnavailable) {
+			continue
+		}
+		limited = true
+		if retryAt, ok := sdk.RetryTime(err); ok && retryAt.After(latest) {
+			latest = retryAt
+		}
+	}
+	return latest, limited
+}
@@ -0,0 +1,46 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/state"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+func TestRateLimitedUntil(t *testing.T) {
+	window := time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)
+	day := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	limited := func(retryAt time.Time) error {
+		return fmt.Errorf("downloading activity: %w", &sdk.Error{StatusCode: http.StatusTooManyRequests, RetryAt: retryAt})
+	}
+
+	cases := []struct {
+		name    string
+		errs    []error
+		limited bool
+		state   state.State
+	}{
+		{"other errors", []error{sdk.ErrorNotFound, errors.New("failed")}, false, ""},
+		{"rate limited", []error{sdk.ErrorNotFound, limited(window)}, true, "RateLimited::2024-03-01T10:15:00Z"},
+		{"latest window", []error{limited(day), limited(window)}, true, "RateLimited::2024-03-02T00:00:00Z"},
+		{"unavailable", []error{&sdk.Error{StatusCode: http.StatusServiceUnavailable, RetryAt: window}}, true, "RateLimited::2024-03-01T10:15:00Z"},
+		// the budget gave up waiting without knowing when it refills
+		{"unknown reset", []error{sdk.ErrorTooManyRequests}, true, "RateLimited"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			retryAt, limited := rateLimitedUntil(c.errs)
+			if limited != c.limited {
+				t.Fatalf("rateLimitedUntil() = %s, %v, want %v", retryAt, limited, c.limited)
+			}
+			if s := state.GetRateLimitedState(retryAt); limited && s != c.state {
+				t.Errorf("state = %s, want %s", s, c.state)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/account"
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/state"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+// HandleWebhookEvent applies a push notification from Strava. Activity events
+// sync or remove that activity and update the map, while deauthorization
+// deletes the athlete
+func HandleWebhookEvent(
+	stravaSvc *strava.StravaService,
+	mapSvc *maps.MapService,
+	stateSvc state.StateService,
+	accountSvc *account.AccountService,
+	event sdk.WebhookEvent,
+	ctx context.Context) error {
+
+	if event.IsDeauthorization() {
+		// an athlete is only deleted once Strava confirms they left
+		revoked, err := stravaSvc.Auth.ConfirmDeauthorized(ctx, event.OwnerID)
+		if err != nil {
+			return fmt.Errorf("confirming deauthorization of athlete '%d': %w", event.OwnerID, err)
+		}
+		if !revoked {
+			log.Printf("ignoring deauthorization of athlete '%d', who is still authorized", event.OwnerID)
+			return nil
+		}
+
+		log.Printf("athlete '%d' deauthorized the application", event.OwnerID)
+		_, err = accountSvc.Delete(ctx, event.OwnerID, account.DeletionSourceWebhook)
+		return err
+	}
+
+	if event.ObjectType != sdk.WebhookObjectActivity {
+		return nil
+	}
+
+	ctx = sdk.WithAthlete(ctx, event.OwnerID)
+	accessToken, err := stravaSvc.Auth.GetAuthTokenForAthlete(ctx, event.OwnerID)
+	if err != nil {
+		return fmt.Errorf("no token for athlete '%d': %w", event.OwnerID, err)
+	}
+
+	options := UpdateOptions{SkipListing: true}
+	switch event.AspectType {
+	case sdk.WebhookAspectCreate, sdk.WebhookAspectUpdate:
+		log.Printf("syncing activity '%d' of athlete '%d' after %s event", event.ObjectID, event.OwnerID, event.AspectType)
+		var summary strava.ActivityImportSummary
+		summary, err = stravaSvc.Athlete.ImportActivity(ctx, accessToken, event.ObjectID)
+
+		// without the activity:read_all scope, activities that were made private
+		// can no longer be fetched and are forgotten instead
+		if errors.Is(err, sdk.ErrorNotFound) {
+			log.Printf("activity '%d' of athlete '%d' is no longer visible, removing it", event.ObjectID, event.OwnerID)
+			err = stravaSvc.Athlete.DeleteActivity(ctx, event.OwnerID, event.ObjectID)
+			summary.VisibilityChanged = 1
+		}
+
+		// activities that became less visible can only be erased from the map
+		// by a full rebuild
+		options.FullRebuild = summary.VisibilityChanged > 0
+	case sdk.WebhookAspectDelete:
+		// the activity is only forgotten once Strava no longer returns it
+		var exists bool
+		exists, err = stravaSvc.Athlete.ActivityExists(ctx, accessToken, event.ObjectID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			log.Printf("ignoring delete event of activity '%d' of athlete '%d', which still exists", event.ObjectID, event.OwnerID)
+			return nil
+		}
+
+		log.Printf("removing activity '%d' of athlete '%d'", event.ObjectID, event.OwnerID)
+		err = stravaSvc.Athlete.DeleteActivity(ctx, event.OwnerID, event.ObjectID)
+
+		// deleted activities can only be erased from the map by a full rebuild
+		options.FullRebuild = true
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return UpdateAthleteMap(stravaSvc, mapSvc, stateSvc, event.OwnerID, accessToken, options, ctx)
+}
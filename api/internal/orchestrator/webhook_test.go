@@ -0,0 +1,80 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+func TestWebhookEventParsing(t *testing.T) {
+	cases := []struct {
+		name            string
+		body            string
+		objectType      string
+		aspectType      string
+		deauthorization bool
+	}{
+		{
+			"activity created",
+			`{"aspect_type":"create","event_time":1549560669,"object_id":1360128428,"object_type":"activity","owner_id":134815,"subscription_id":120475,"updates":{}}`,
+			sdk.WebhookObjectActivity, sdk.WebhookAspectCreate, false,
+		},
+		{
+			"activity made private",
+			`{"aspect_type":"update","event_time":1516126040,"object_id":1360128428,"object_type":"activity","owner_id":134815,"subscription_id":120475,"updates":{"private":"true"}}`,
+			sdk.WebhookObjectActivity, sdk.WebhookAspectUpdate, false,
+		},
+		{
+			"athlete deauthorized",
+			`{"aspect_type":"update","event_time":1516126040,"object_id":134815,"object_type":"athlete","owner_id":134815,"subscription_id":120475,"updates":{"authorized":"false"}}`,
+			sdk.WebhookObjectAthlete, sdk.WebhookAspectUpdate, true,
+		},
+		{
+			"athlete updated",
+			`{"aspect_type":"update","event_time":1516126040,"object_id":134815,"object_type":"athlete","owner_id":134815,"subscription_id":120475,"updates":{"authorized":"true"}}`,
+			sdk.WebhookObjectAthlete, sdk.WebhookAspectUpdate, false,
+		},
+		{
+			// only athletes can deauthorize the application
+			"activity with an authorized update",
+			`{"aspect_type":"update","object_id":1,"object_type":"activity","owner_id":134815,"subscription_id":120475,"updates":{"authorized":"false"}}`,
+			sdk.WebhookObjectActivity, sdk.WebhookAspectUpdate, false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			event := sdk.WebhookEvent{}
+			if err := json.Unmarshal([]byte(c.body), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.ObjectType != c.objectType || event.AspectType != c.aspectType || event.OwnerID != 134815 || event.SubscriptionID != 120475 {
+				t.Errorf("parsed %+v", event)
+			}
+			if event.IsDeauthorization() != c.deauthorization {
+				t.Errorf("IsDeauthorization() = %v, want %v", event.IsDeauthorization(), c.deauthorization)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookEventIgnored(t *testing.T) {
+	// events that are ignored never touch any of the services
+	cases := []struct {
+		name  string
+		event sdk.WebhookEvent
+	}{
+		{"athlete updated", sdk.WebhookEvent{ObjectType: sdk.WebhookObjectAthlete, AspectType: sdk.WebhookAspectUpdate, OwnerID: 1}},
+		{"unknown object", sdk.WebhookEvent{ObjectType: "route", AspectType: sdk.WebhookAspectCreate, OwnerID: 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := HandleWebhookEvent(nil, nil, nil, nil, c.event, context.Background()); err != nil {
+				t.Errorf("HandleWebhookEvent() = %v", err)
+			}
+		})
+	}
+}
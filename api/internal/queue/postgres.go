@@ -0,0 +1,234 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+)
+
+var (
+	ErrorLeaseExpired = errors.New("message was claimed by another consumer after its visibility timeout expired")
+)
+
+// PostgresQueue is a work queue backed by the JobQueue table. Messages that
+// exceed the maximum number of attempts are moved to JobQueueDeadLetter.
+type PostgresQueue struct {
+	db                *database.DB
+	queueName         string
+	visibilityTimeout time.Duration
+	maxAttempts       int
+}
+
+func NewPostgresQueue(db *database.DB, queueName string, visibilityTimeout time.Duration, maxAttempts int) *PostgresQueue {
+	return &PostgresQueue{
+		db:                db,
+		queueName:         queueName,
+		visibilityTimeout: visibilityTimeout,
+		maxAttempts:       maxAttempts,
+	}
+}
+
+func (pq PostgresQueue) Enqueue(ctx context.Context, msgs ...interface{}) ([]string, error) {
+	messageIDs := []string{}
+	err := pq.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		for _, msg := range msgs {
+			bytes, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+
+			var id int64
+			if err := tx.QueryRow(ctx, enqueueSQL, pq.queueName, bytes).Scan(&id); err != nil {
+				return fmt.Errorf("enqueueing message: %w", err)
+			}
+
+			messageIDs = append(messageIDs, strconv.FormatInt(id, 10))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return []string{}, err
+	}
+	return messageIDs, nil
+}
+
+func (pq PostgresQueue) Dequeue(ctx context.Context, max int) ([]Message, error) {
+	msgs := []Message{}
+	err := pq.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		// messages that became visible again after exhausting their attempts
+		// belong to a consumer that died while processing them
+		if _, err := tx.Exec(ctx, deadLetterExpiredSQL, pq.queueName, pq.maxAttempts); err != nil {
+			return fmt.Errorf("dead lettering expired messages: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, dequeueSQL, pq.queueName, max, pq.visibilityTimeout.Seconds())
+		if err != nil {
+			return fmt.Errorf("dequeueing messages: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			msg := Message{}
+			if err := rows.Scan(&id, &msg.Body, &msg.Attempts, &msg.receipt); err != nil {
+				return err
+			}
+
+			msg.ID = strconv.FormatInt(id, 10)
+			msgs = append(msgs, msg)
+		}
+
+		return rows.Err()
+	})
+
+	return msgs, err
+}
+
+// Complete fails with ErrorLeaseExpired if the message was claimed by another
+// consumer, which completes or fails it instead
+func (pq PostgresQueue) Complete(ctx context.Context, msg Message) error {
+	return pq.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, completeSQL, msg.ID, msg.receipt)
+		if err != nil {
+			return fmt.Errorf("completing message '%s': %w", msg.ID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("completing message '%s': %w", msg.ID, ErrorLeaseExpired)
+		}
+		return nil
+	})
+}
+
+func (pq PostgresQueue) Fail(ctx context.Context, msg Message, cause error) error {
+	causeString := ""
+	if cause != nil {
+		causeString = cause.Error()
+	}
+
+	return pq.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		if msg.Attempts >= pq.maxAttempts {
+			tag, err := tx.Exec(ctx, deadLetterSQL, msg.ID, causeString, msg.receipt)
+			if err != nil {
+				return fmt.Errorf("dead lettering message '%s': %w", msg.ID, err)
+			}
+			if tag.RowsAffected() == 0 {
+				return fmt.Errorf("dead lettering message '%s': %w", msg.ID, ErrorLeaseExpired)
+			}
+			return nil
+		}
+
+		tag, err := tx.Exec(ctx, releaseSQL, msg.ID, msg.receipt, retryDelay(msg.Attempts, pq.visibilityTimeout).Seconds())
+		if err != nil {
+			return fmt.Errorf("releasing message '%s': %w", msg.ID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("releasing message '%s': %w", msg.ID, ErrorLeaseExpired)
+		}
+		return nil
+	})
+}
+
+var enqueueSQL = `
+INSERT INTO
+	JobQueue
+	(queue_name, payload)
+VALUES
+	($1, $2)
+RETURNING
+	id
+`
+
+// claims up to $2 visible messages and hides them for $3 seconds. Every claim
+// takes a new lease
+var dequeueSQL = `
+UPDATE
+	JobQueue
+SET
+	attempts = attempts + 1,
+	visible_at = NOW() + $3 * INTERVAL '1 second',
+	lease = uuid_generate_v4()::TEXT
+WHERE
+	id IN (
+		SELECT
+			id
+		FROM
+			JobQueue
+		WHERE
+			queue_name = $1 AND visible_at <= NOW()
+		ORDER BY
+			id
+		LIMIT
+			$2
+		FOR UPDATE SKIP LOCKED
+	)
+RETURNING
+	id, payload, attempts, lease
+`
+
+var completeSQL = `
+DELETE FROM
+	JobQueue
+WHERE
+	id = $1 AND lease = $2
+`
+
+// hides the message for $3 seconds before it is retried
+var releaseSQL = `
+UPDATE
+	JobQueue
+SET
+	visible_at = NOW() + $3 * INTERVAL '1 second'
+WHERE
+	id = $1 AND lease = $2
+`
+
+var deadLetterSQL = `
+WITH dead AS (
+	DELETE FROM
+		JobQueue
+	WHERE
+		id = $1 AND lease = $3
+	RETURNING
+		*
+)
+INSERT INTO
+	JobQueueDeadLetter
+	(id, queue_name, payload, attempts, last_error, created_at)
+SELECT
+	id, queue_name, payload, attempts, $2, created_at
+FROM
+	dead
+`
+
+var deadLetterExpiredSQL = `
+WITH dead AS (
+	DELETE FROM
+		JobQueue
+	WHERE
+		id IN (
+			SELECT
+				id
+			FROM
+				JobQueue
+			WHERE
+				queue_name = $1 AND visible_at <= NOW() AND attempts >= $2
+			FOR UPDATE SKIP LOCKED
+		)
+	RETURNING
+		*
+)
+INSERT INTO
+	JobQueueDeadLetter
+	(id, queue_name, payload, attempts, last_error, created_at)
+SELECT
+	id, queue_name, payload, attempts, 'visibility timeout expired', created_at
+FROM
+	dead
+`
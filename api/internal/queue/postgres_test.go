@@ -0,0 +1,267 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database/dbtest"
+)
+
+// newPostgresQueue connects to an empty queue. Every test uses a queue of its
+// own, so tests do not see each other's messages
+func newPostgresQueue(t *testing.T, maxAttempts int) (*PostgresQueue, *database.DB) {
+	t.Helper()
+	db := dbtest.New(t, "queue_test")
+	return NewPostgresQueue(db, t.Name(), 10*time.Minute, maxAttempts), db
+}
+
+// expire makes every message of a queue visible again, as if the consumer
+// holding it had died
+func expire(t *testing.T, db *database.DB, queueName string) {
+	t.Helper()
+	_, err := db.Pool.Exec(context.Background(), `UPDATE JobQueue SET visible_at = NOW() - INTERVAL '1 second' WHERE queue_name = $1`, queueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dequeueIDs(t *testing.T, pq *PostgresQueue, max int) []string {
+	t.Helper()
+	msgs, err := pq.Dequeue(context.Background(), max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func deadLetters(t *testing.T, db *database.DB, queueName string) map[string]string {
+	t.Helper()
+	rows, err := db.Pool.Query(context.Background(), `SELECT id::TEXT, last_error FROM JobQueueDeadLetter WHERE queue_name = $1`, queueName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	errs := map[string]string{}
+	for rows.Next() {
+		var id, lastError string
+		if err := rows.Scan(&id, &lastError); err != nil {
+			t.Fatal(err)
+		}
+		errs[id] = lastError
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return errs
+}
+
+func TestPostgresQueueDequeue(t *testing.T) {
+	pq, _ := newPostgresQueue(t, 5)
+	ctx := context.Background()
+
+	ids, err := pq.Enqueue(ctx, "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := pq.Dequeue(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != ids[0] || msgs[1].ID != ids[1] {
+		t.Fatalf("dequeued %+v, want messages %v", msgs, ids[:2])
+	}
+	if string(msgs[0].Body) != `"a"` || msgs[0].Attempts != 1 || msgs[0].receipt == "" || msgs[0].receipt == msgs[1].receipt {
+		t.Errorf("dequeued %+v", msgs[0])
+	}
+
+	// claimed messages stay hidden until their visibility timeout
+	if got := dequeueIDs(t, pq, 10); len(got) != 1 || got[0] != ids[2] {
+		t.Errorf("dequeued %v, want [%s]", got, ids[2])
+	}
+	if got := dequeueIDs(t, pq, 10); len(got) != 0 {
+		t.Errorf("dequeued hidden messages %v", got)
+	}
+
+	// other queues in the same table are left alone
+	other := NewPostgresQueue(pq.db, t.Name()+"-other", pq.visibilityTimeout, pq.maxAttempts)
+	if got := dequeueIDs(t, other, 10); len(got) != 0 {
+		t.Errorf("dequeued %v from another queue", got)
+	}
+}
+
+func TestPostgresQueueSkipLocked(t *testing.T) {
+	pq, db := newPostgresQueue(t, 5)
+	ctx := context.Background()
+
+	ids, err := pq.Enqueue(ctx, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another consumer is in the middle of claiming the first message
+	tx, err := db.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	var claimed int64
+	var body []byte
+	var attempts int
+	var lease string
+	if err := tx.QueryRow(ctx, dequeueSQL, pq.queueName, 1, pq.visibilityTimeout.Seconds()).Scan(&claimed, &body, &attempts, &lease); err != nil {
+		t.Fatal(err)
+	}
+
+	// rows locked by that consumer are skipped rather than waited for
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msgs, err := pq.Dequeue(timeoutCtx, 10)
+	if err != nil {
+		t.Fatalf("Dequeue() while a message is locked = %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != ids[1] {
+		t.Errorf("dequeued %+v, want [%s]", msgs, ids[1])
+	}
+
+	// the claim is undone with the transaction of the other consumer
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := dequeueIDs(t, pq, 10); len(got) != 1 || got[0] != ids[0] {
+		t.Errorf("dequeued %v after the claim was rolled back, want [%s]", got, ids[0])
+	}
+}
+
+func TestPostgresQueueLease(t *testing.T) {
+	pq, db := newPostgresQueue(t, 5)
+	ctx := context.Background()
+
+	if _, err := pq.Enqueue(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := pq.Dequeue(ctx, 1)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", first, err)
+	}
+
+	// the visibility timeout of the first consumer expires and another one
+	// claims the message
+	expire(t, db, pq.queueName)
+	second, err := pq.Dequeue(ctx, 1)
+	if err != nil || len(second) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", second, err)
+	}
+	if second[0].Attempts != 2 || second[0].receipt == first[0].receipt {
+		t.Errorf("second claim = %+v, want attempt 2 with a new lease", second[0])
+	}
+
+	// only the consumer holding the lease can act on the message
+	if err := pq.Complete(ctx, first[0]); !errors.Is(err, ErrorLeaseExpired) {
+		t.Errorf("Complete() with an expired lease = %v, want %v", err, ErrorLeaseExpired)
+	}
+	if err := pq.Fail(ctx, first[0], errors.New("slow")); !errors.Is(err, ErrorLeaseExpired) {
+		t.Errorf("Fail() with an expired lease = %v, want %v", err, ErrorLeaseExpired)
+	}
+	if err := pq.Complete(ctx, second[0]); err != nil {
+		t.Errorf("Complete() with the current lease = %v", err)
+	}
+
+	expire(t, db, pq.queueName)
+	if got := dequeueIDs(t, pq, 10); len(got) != 0 {
+		t.Errorf("dequeued %v after the message was completed", got)
+	}
+}
+
+func TestPostgresQueueFail(t *testing.T) {
+	pq, db := newPostgresQueue(t, 2)
+	ctx := context.Background()
+
+	ids, err := pq.Enqueue(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := pq.Dequeue(ctx, 1)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("Dequeue() = %v, %v", msgs, err)
+	}
+	if err := pq.Fail(ctx, msgs[0], errors.New("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed message is hidden for the retry delay, not the visibility timeout
+	var delay float64
+	err = db.Pool.QueryRow(ctx, `SELECT EXTRACT(EPOCH FROM visible_at - NOW()) FROM JobQueue WHERE id = $1`, msgs[0].ID).Scan(&delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := retryDelay(1, pq.visibilityTimeout).Seconds(); delay > want || delay < want-5 {
+		t.Errorf("failed message is hidden for %.0fs, want %.0fs", delay, want)
+	}
+	if got := dequeueIDs(t, pq, 10); len(got) != 0 {
+		t.Errorf("dequeued %v before the retry delay", got)
+	}
+
+	// the last attempt moves the message to the dead letter table
+	expire(t, db, pq.queueName)
+	msgs, err = pq.Dequeue(ctx, 1)
+	if err != nil || len(msgs) != 1 || msgs[0].Attempts != 2 {
+		t.Fatalf("Dequeue() = %+v, %v", msgs, err)
+	}
+	if err := pq.Fail(ctx, msgs[0], errors.New("last")); err != nil {
+		t.Fatal(err)
+	}
+
+	if dead := deadLetters(t, db, pq.queueName); len(dead) != 1 || dead[ids[0]] != "last" {
+		t.Errorf("dead letters = %v, want %s with error 'last'", dead, ids[0])
+	}
+	expire(t, db, pq.queueName)
+	if got := dequeueIDs(t, pq, 10); len(got) != 0 {
+		t.Errorf("dequeued %v after the message was dead lettered", got)
+	}
+}
+
+func TestPostgresQueueDeadLetterExpired(t *testing.T) {
+	pq, db := newPostgresQueue(t, 2)
+	ctx := context.Background()
+
+	ids, err := pq.Enqueue(ctx, "retried", "last attempt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second message was claimed once more, and its consumer died during
+	// its last attempt
+	if _, err := db.Pool.Exec(ctx, `UPDATE JobQueue SET attempts = 1 WHERE id = $1`, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Pool.Exec(ctx, `UPDATE JobQueue SET attempts = 2 WHERE id = $1`, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages out of attempts are dead lettered before anything is claimed
+	if got := dequeueIDs(t, pq, 10); len(got) != 1 || got[0] != ids[0] {
+		t.Errorf("dequeued %v, want [%s]", got, ids[0])
+	}
+	if dead := deadLetters(t, db, pq.queueName); len(dead) != 1 || dead[ids[1]] != "visibility timeout expired" {
+		t.Errorf("dead letters = %v, want %s", dead, ids[1])
+	}
+
+	// the first message is now on its last attempt, but it is still hidden and
+	// belongs to a consumer that may finish it
+	if got := dequeueIDs(t, pq, 10); len(got) != 0 {
+		t.Errorf("dequeued hidden messages %v", got)
+	}
+	if dead := deadLetters(t, db, pq.queueName); len(dead) != 1 {
+		t.Errorf("dead lettered a hidden message: %v", dead)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/Azure/azure-storage-queue-go/azqueue"
 )
@@ -14,11 +15,63 @@ type QueueService interface {
 	Enqueue(ctx context.Context, msgs ...interface{}) ([]string, error)
 }
 
+// Message is a message that has been received from a queue. It stays
+// invisible to other consumers until it is completed, failed, or the
+// visibility timeout of the queue elapses.
+type Message struct {
+	ID       string
+	Body     []byte
+	Attempts int
+
+	// backend specific handle needed to acknowledge the message, i.e., the pop
+	// receipt of an Azure message or the lease of a Postgres message
+	receipt string
+}
+
+// a failed message waits this long before its first retry
+const minRetryDelay = 30 * time.Second
+
+// retryDelay is how long a message that failed its attempt stays invisible.
+// The delay doubles with every attempt, up to the visibility timeout, so a
+// message that keeps failing does not hold up the rest of the queue
+func retryDelay(attempts int, visibilityTimeout time.Duration) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < attempts && delay < visibilityTimeout; i++ {
+		delay *= 2
+	}
+	if delay > visibilityTimeout {
+		return visibilityTimeout
+	}
+	return delay
+}
+
+// QueueConsumer receives messages that were sent through a QueueService
+type QueueConsumer interface {
+	Dequeue(ctx context.Context, max int) ([]Message, error)
+	// Complete removes a message from the queue after it has been processed
+	Complete(ctx context.Context, msg Message) error
+	// Fail makes a message available for another attempt, or moves it to the
+	// dead letter store if it has been attempted too many times
+	Fail(ctx context.Context, msg Message, cause error) error
+}
+
+// Queue can both send and receive messages
+type Queue interface {
+	QueueService
+	QueueConsumer
+}
+
 type AzureStorageQueue struct {
-	messagesURL *azqueue.MessagesURL
+	messagesURL       *azqueue.MessagesURL
+	poisonQueueURL    *azqueue.QueueURL
+	visibilityTimeout time.Duration
+	maxAttempts       int
 }
 
-func NewAzureStorageQueue(ctx context.Context, queueName, accountName, accountKey string) (*AzureStorageQueue, error) {
+// NewAzureStorageQueue creates a client for an Azure Storage Queue. Messages
+// that exceed the maximum number of attempts are moved to '<queueName>-poison',
+// which is the same convention used by Azure Functions queue triggers.
+func NewAzureStorageQueue(ctx context.Context, queueName, accountName, accountKey string, visibilityTimeout time.Duration, maxAttempts int) (*AzureStorageQueue, error) {
 	primaryURLRaw := fmt.Sprintf("https://%s.queue.core.windows.net", accountName)
 	primaryURL, err := url.Parse(primaryURLRaw)
 	if err != nil {
@@ -34,9 +87,13 @@ func NewAzureStorageQueue(ctx context.Context, queueName, accountName, accountKe
 	serviceURL := azqueue.NewServiceURL(*primaryURL, p)
 	queueURL := serviceURL.NewQueueURL(queueName)
 	messagesURL := queueURL.NewMessagesURL()
+	poisonQueueURL := serviceURL.NewQueueURL(queueName + "-poison")
 
 	return &AzureStorageQueue{
-		messagesURL: &messagesURL,
+		messagesURL:       &messagesURL,
+		poisonQueueURL:    &poisonQueueURL,
+		visibilityTimeout: visibilityTimeout,
+		maxAttempts:       maxAttempts,
 	}, nil
 }
 
@@ -59,3 +116,57 @@ func (as AzureStorageQueue) Enqueue(ctx context.Context, msgs ...interface{}) ([
 
 	return messageIDs, nil
 }
+
+func (as AzureStorageQueue) Dequeue(ctx context.Context, max int) ([]Message, error) {
+	// the service will not return more than 32 messages in a single request
+	if max > 32 {
+		max = 32
+	}
+
+	res, err := as.messagesURL.Dequeue(ctx, int32(max), as.visibilityTimeout)
+	if err != nil {
+		return []Message{}, err
+	}
+
+	msgs := []Message{}
+	for i := int32(0); i < res.NumMessages(); i++ {
+		dequeued := res.Message(i)
+		body, err := base64.StdEncoding.DecodeString(dequeued.Text)
+		if err != nil {
+			return msgs, fmt.Errorf("decoding message '%s': %w", dequeued.ID, err)
+		}
+
+		msgs = append(msgs, Message{
+			ID:       dequeued.ID.String(),
+			Body:     body,
+			Attempts: int(dequeued.DequeueCount),
+			receipt:  string(dequeued.PopReceipt),
+		})
+	}
+
+	return msgs, nil
+}
+
+func (as AzureStorageQueue) Complete(ctx context.Context, msg Message) error {
+	messageIDURL := as.messagesURL.NewMessageIDURL(azqueue.MessageID(msg.ID))
+	_, err := messageIDURL.Delete(ctx, azqueue.PopReceipt(msg.receipt))
+	return err
+}
+
+func (as AzureStorageQueue) Fail(ctx context.Context, msg Message, cause error) error {
+	asString := base64.StdEncoding.EncodeToString(msg.Body)
+
+	if msg.Attempts >= as.maxAttempts {
+		// creating a queue that already exists is a no-op
+		_, _ = as.poisonQueueURL.Create(ctx, azqueue.Metadata{})
+		if _, err := as.poisonQueueURL.NewMessagesURL().Enqueue(ctx, asString, 0, 0); err != nil {
+			return err
+		}
+		return as.Complete(ctx, msg)
+	}
+
+	// make the message visible again once it has backed off
+	messageIDURL := as.messagesURL.NewMessageIDURL(azqueue.MessageID(msg.ID))
+	_, err := messageIDURL.Update(ctx, azqueue.PopReceipt(msg.receipt), retryDelay(msg.Attempts, as.visibilityTimeout), asString)
+	return err
+}
@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts          int
+		visibilityTimeout time.Duration
+		want              time.Duration
+	}{
+		{1, 10 * time.Minute, 30 * time.Second},
+		{2, 10 * time.Minute, time.Minute},
+		{3, 10 * time.Minute, 2 * time.Minute},
+		{5, 10 * time.Minute, 8 * time.Minute},
+		{6, 10 * time.Minute, 10 * time.Minute},
+		{100, 10 * time.Minute, 10 * time.Minute},
+		{1, 10 * time.Second, 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := retryDelay(c.attempts, c.visibilityTimeout); got != c.want {
+			t.Errorf("retryDelay(%d, %v) = %v, want %v", c.attempts, c.visibilityTimeout, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+)
+
+var (
+	ErrorInvalidSession = errors.New("session is unknown or expired")
+)
+
+// Session is a login of an athlete. Only a hash of the token is stored, so the
+// token is only set on sessions that were just created
+type Session struct {
+	Token     string
+	AthleteID int
+	ExpiresAt time.Time
+}
+
+// SessionService keeps opaque login sessions, which are independent of the
+// Strava tokens of an athlete
+type SessionService struct {
+	db *database.DB
+	// how long a session lasts since it was last renewed
+	ttl time.Duration
+	// how long a session is used before its expiry is pushed back, which keeps
+	// most requests from writing to the database
+	renewAfter time.Duration
+}
+
+func NewSessionService(db *database.DB, ttl, renewAfter time.Duration) *SessionService {
+	return &SessionService{
+		db:         db,
+		ttl:        ttl,
+		renewAfter: renewAfter,
+	}
+}
+
+// TTL is how long a session lasts without being used
+func (s SessionService) TTL() time.Duration {
+	return s.ttl
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create starts a new session for an athlete
+func (s SessionService) Create(ctx context.Context, athleteID int) (*Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, fmt.Errorf("generating session token: %w", err)
+	}
+
+	now := time.Now().UTC()
+	session := &Session{
+		Token:     token,
+		AthleteID: athleteID,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	err = s.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, insertSessionSQL, hashToken(token), athleteID, now, session.ExpiresAt)
+		return err
+	})
+	return session, err
+}
+
+// Resolve returns the session of a token. Sessions that were used for longer
+// than the renewal interval are extended, which is reported so that the cookie
+// holding the token can be extended too
+func (s SessionService) Resolve(ctx context.Context, token string) (*Session, bool, error) {
+	if token == "" {
+		return nil, false, ErrorInvalidSession
+	}
+
+	session := &Session{}
+	renewed := false
+	err := s.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		now := time.Now().UTC()
+		renewedAt := time.Time{}
+		row := tx.QueryRow(ctx, getSessionSQL, hashToken(token), now)
+		if err := row.Scan(&session.AthleteID, &session.ExpiresAt, &renewedAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return ErrorInvalidSession
+			}
+			return fmt.Errorf("fetching session: %w", err)
+		}
+
+		if now.Sub(renewedAt) < s.renewAfter {
+			return nil
+		}
+
+		session.ExpiresAt = now.Add(s.ttl)
+		renewed = true
+		_, err := tx.Exec(ctx, renewSessionSQL, hashToken(token), now, session.ExpiresAt)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return session, renewed, nil
+}
+
+// Delete ends a session, i.e., when the athlete logs out
+func (s SessionService) Delete(ctx context.Context, token string) error {
+	return s.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, deleteSessionSQL, hashToken(token))
+		return err
+	})
+}
+
+// DeleteForAthlete ends every session of an athlete, which logs them out on
+// every device
+func (s SessionService) DeleteForAthlete(ctx context.Context, athleteID int) (int, error) {
+	deleted := 0
+	err := s.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, deleteSessionsForAthleteSQL, athleteID)
+		deleted = int(tag.RowsAffected())
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteExpired forgets sessions that can no longer be used
+func (s SessionService) DeleteExpired(ctx context.Context) (int, error) {
+	deleted := 0
+	err := s.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, deleteExpiredSessionsSQL, time.Now().UTC())
+		deleted = int(tag.RowsAffected())
+		return err
+	})
+	return deleted, err
+}
+
+var insertSessionSQL = `
+INSERT INTO
+	Session
+	(token_hash, athlete_id, renewed_at, expires_at)
+VALUES
+	($1, $2, $3, $4)
+`
+
+var getSessionSQL = `
+SELECT
+	athlete_id, expires_at, renewed_at
+FROM
+	Session
+WHERE
+	token_hash = $1
+	AND expires_at > $2
+`
+
+var renewSessionSQL = `
+UPDATE
+	Session
+SET
+	renewed_at = $2,
+	expires_at = $3
+WHERE
+	token_hash = $1
+`
+
+var deleteSessionSQL = `
+DELETE FROM
+	Session
+WHERE
+	token_hash = $1
+`
+
+var deleteSessionsForAthleteSQL = `
+DELETE FROM
+	Session
+WHERE
+	athlete_id = $1
+`
+
+var deleteExpiredSessionsSQL = `
+DELETE FROM
+	Session
+WHERE
+	expires_at <= $1
+`
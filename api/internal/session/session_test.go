@@ -0,0 +1,169 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database/dbtest"
+)
+
+func TestTokens(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, err := newToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 32 random bytes, base64 encoded without padding
+		if len(token) != 43 || seen[token] {
+			t.Fatalf("newToken() = %q", token)
+		}
+		seen[token] = true
+
+		if hash := hashToken(token); hash == token || len(hash) != 64 || hash != hashToken(token) {
+			t.Fatalf("hashToken(%q) = %q", token, hash)
+		}
+	}
+
+	// an empty token never reaches the database
+	if _, _, err := (SessionService{}).Resolve(context.Background(), ""); !errors.Is(err, ErrorInvalidSession) {
+		t.Errorf("Resolve() without a token = %v, want %v", err, ErrorInvalidSession)
+	}
+}
+
+func newSessionService(t *testing.T) (*SessionService, *database.DB) {
+	t.Helper()
+	db := dbtest.New(t, "session_test")
+	return NewSessionService(db, 30*24*time.Hour, time.Hour), db
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	s, db := newSessionService(t)
+	ctx := context.Background()
+
+	created, err := s.Create(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.AthleteID != 7 || time.Until(created.ExpiresAt) < s.TTL()-time.Minute {
+		t.Errorf("Create() = %+v", created)
+	}
+
+	// only the hash of the token is stored
+	var stored string
+	if err := db.Pool.QueryRow(ctx, `SELECT token_hash FROM Session WHERE athlete_id = 7`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != hashToken(created.Token) {
+		t.Errorf("stored %q, want the hash of the token", stored)
+	}
+
+	resolved, renewed, err := s.Resolve(ctx, created.Token)
+	if err != nil || resolved.AthleteID != 7 || renewed {
+		t.Errorf("Resolve() = %+v, %v, %v", resolved, renewed, err)
+	}
+	if _, _, err := s.Resolve(ctx, stored); !errors.Is(err, ErrorInvalidSession) {
+		t.Errorf("Resolve() with the stored hash = %v, want %v", err, ErrorInvalidSession)
+	}
+
+	if err := s.Delete(ctx, created.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Resolve(ctx, created.Token); !errors.Is(err, ErrorInvalidSession) {
+		t.Errorf("Resolve() after Delete() = %v, want %v", err, ErrorInvalidSession)
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	s, db := newSessionService(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		// time since the session was last renewed, and until it expires
+		renewedAgo, expiresIn time.Duration
+		valid, renewed        bool
+	}{
+		{"just renewed", time.Minute, 10 * 24 * time.Hour, true, false},
+		{"due for renewal", 2 * time.Hour, 10 * 24 * time.Hour, true, true},
+		{"about to expire", 2 * time.Hour, time.Minute, true, true},
+		{"expired", 2 * time.Hour, -time.Minute, false, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			created, err := s.Create(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			_, err = db.Pool.Exec(ctx, `UPDATE Session SET renewed_at = $2, expires_at = $3 WHERE token_hash = $1`,
+				hashToken(created.Token), now.Add(-c.renewedAgo), now.Add(c.expiresIn))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resolved, renewed, err := s.Resolve(ctx, created.Token)
+			if !c.valid {
+				if !errors.Is(err, ErrorInvalidSession) {
+					t.Errorf("Resolve() = %v, want %v", err, ErrorInvalidSession)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if renewed != c.renewed {
+				t.Errorf("renewed = %v, want %v", renewed, c.renewed)
+			}
+
+			// a renewed session lasts the whole TTL again
+			wantExpiry := now.Add(c.expiresIn)
+			if c.renewed {
+				wantExpiry = now.Add(s.TTL())
+			}
+			if d := resolved.ExpiresAt.Sub(wantExpiry); d < -time.Minute || d > time.Minute {
+				t.Errorf("session expires at %s, want %s", resolved.ExpiresAt, wantExpiry)
+			}
+			if _, renewed, err := s.Resolve(ctx, created.Token); err != nil || renewed {
+				t.Errorf("Resolve() again = %v, %v, want no renewal", renewed, err)
+			}
+		})
+	}
+}
+
+func TestSessionDeletion(t *testing.T) {
+	s, db := newSessionService(t)
+	ctx := context.Background()
+
+	tokens := map[string]int{}
+	for _, athleteID := range []int{1, 1, 2, 3} {
+		created, err := s.Create(ctx, athleteID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[created.Token] = athleteID
+	}
+	_, err := db.Pool.Exec(ctx, `UPDATE Session SET expires_at = $2 WHERE athlete_id = $1`, 3, time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// logging out everywhere ends every session of the athlete, and only theirs
+	if deleted, err := s.DeleteForAthlete(ctx, 1); err != nil || deleted != 2 {
+		t.Errorf("DeleteForAthlete() = %d, %v, want 2", deleted, err)
+	}
+	if deleted, err := s.DeleteExpired(ctx); err != nil || deleted != 1 {
+		t.Errorf("DeleteExpired() = %d, %v, want 1", deleted, err)
+	}
+
+	for token, athleteID := range tokens {
+		_, _, err := s.Resolve(ctx, token)
+		if valid := err == nil; valid != (athleteID == 2) {
+			t.Errorf("session of athlete %d resolves with %v", athleteID, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
@@ -16,8 +17,23 @@ const (
 	DownloadingActivities State = "DownloadingActivities"
 	ComputingMapParams    State = "ComputingMapParams"
 	ProcessingMap         State = "ProcessingMap"
+	// the athlete did not allow their activities to be read, and has to log in
+	// again
+	MissingActivityScope State = "MissingActivityScope"
+	// Strava refused requests until a rate limit window resets. The work that
+	// was put off is done by the first sync after that
+	RateLimited State = "RateLimited"
 )
 
+// GetRateLimitedState tells the athlete when the work that was put off by a
+// rate limit can be done. The time is left out if Strava did not report it
+func GetRateLimitedState(retryAt time.Time) State {
+	if retryAt.IsZero() {
+		return RateLimited
+	}
+	return State(fmt.Sprintf("%s::%s", RateLimited, retryAt.UTC().Format(time.RFC3339)))
+}
+
 func GetErrorState(errors []error) State {
 	errorStrings := make([]string, len(errors))
 	for i, err := range errors {
@@ -29,6 +45,7 @@ func GetErrorState(errors []error) State {
 type StateService interface {
 	UpdateState(ctx context.Context, athleteID int, state State) error
 	GetState(ctx context.Context, athleteID int) (*State, error)
+	DeleteState(ctx context.Context, athleteID int) error
 }
 
 type stateServiceImpl struct {
@@ -74,6 +91,13 @@ func (s stateServiceImpl) GetState(ctx context.Context, athleteID int) (*State,
 	return state, err
 }
 
+func (s stateServiceImpl) DeleteState(ctx context.Context, athleteID int) error {
+	return s.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM AthleteProcessingState WHERE athlete_id = $1", athleteID)
+		return err
+	})
+}
+
 var insertStateSQL = `
 INSERT INTO
 	AthleteProcessingState
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/encryption"
+)
+
+// EncryptedBlobstore encrypts objects before they are written to another
+// Blobstore, and decrypts them when they are read. Objects written before
+// encryption was enabled are read as they are
+type EncryptedBlobstore struct {
+	Blobstore
+	keyring *encryption.Keyring
+}
+
+func NewEncryptedBlobstore(store Blobstore, keyring *encryption.Keyring) *EncryptedBlobstore {
+	return &EncryptedBlobstore{
+		Blobstore: store,
+		keyring:   keyring,
+	}
+}
+
+// CreateObject encrypts an object with the primary key. The object is bound to
+// its name, so it cannot be read if it is moved to another name
+func (e *EncryptedBlobstore) CreateObject(ctx context.Context, name string, contents []byte) error {
+	encrypted, err := e.keyring.Encrypt(contents, []byte(name))
+	if err != nil {
+		return fmt.Errorf("encrypting '%s': %w", name, err)
+	}
+	return e.Blobstore.CreateObject(ctx, name, encrypted)
+}
+
+func (e *EncryptedBlobstore) GetObjectBytes(ctx context.Context, name string) ([]byte, error) {
+	contents, err := e.Blobstore.GetObjectBytes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := e.keyring.Decrypt(contents, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting '%s': %w", name, err)
+	}
+	return decrypted, nil
+}
+
+// CreateObjectFrom encrypts an object as it is uploaded, one chunk at a time
+func (e *EncryptedBlobstore) CreateObjectFrom(ctx context.Context, name string, contents io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		w, err := e.keyring.EncryptWriter(pw, []byte(name))
+		if err == nil {
+			_, err = io.Copy(w, contents)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		// the upload fails with the error, if there is one
+		pw.CloseWithError(err)
+		close(done)
+	}()
+
+	err := e.Blobstore.CreateObjectFrom(ctx, name, pr)
+	// stops the encryption if the upload failed before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return err
+}
+
+// GetObjectReader decrypts an object as it is downloaded
+func (e *EncryptedBlobstore) GetObjectReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	contents, err := e.Blobstore.GetObjectReader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := e.keyring.DecryptReader(contents, []byte(name))
+	if err != nil {
+		contents.Close()
+		return nil, fmt.Errorf("decrypting '%s': %w", name, err)
+	}
+	return decryptedObject{Reader: decrypted, Closer: contents}, nil
+}
+
+type decryptedObject struct {
+	io.Reader
+	io.Closer
+}
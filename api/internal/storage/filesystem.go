@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FilesystemBlobstore implements the Blobstore interface on top of a directory
+// on the local filesystem. Each container maps to a subdirectory of the root.
+type FilesystemBlobstore struct {
+	root string
+}
+
+// NewFilesystemBlobstore creates a storage client that reads and writes files
+// under rootDir/containerName, creating the directory if it does not exist.
+func NewFilesystemBlobstore(ctx context.Context, containerName string, rootDir string) (*FilesystemBlobstore, error) {
+	root, err := filepath.Abs(filepath.Join(rootDir, containerName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve storage root %v: %v", rootDir, err)
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage root %v: %v", root, err)
+	}
+
+	return &FilesystemBlobstore{
+		root: root,
+	}, nil
+}
+
+// Root returns the directory that objects are stored in
+func (s *FilesystemBlobstore) Root() string {
+	return s.root
+}
+
+// resolve an object name to a path on disk, disallowing escapes from the root
+func (s *FilesystemBlobstore) objectPath(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *FilesystemBlobstore) CreateObject(ctx context.Context, name string, contents []byte) error {
+	if err := s.writeObject(name, bytes.NewReader(contents)); err != nil {
+		return fmt.Errorf("storage.CreateObject: %w", err)
+	}
+	return nil
+}
+
+func (s *FilesystemBlobstore) CreateObjectFrom(ctx context.Context, name string, contents io.Reader) error {
+	if err := s.writeObject(name, contents); err != nil {
+		return fmt.Errorf("storage.CreateObjectFrom: %w", err)
+	}
+	return nil
+}
+
+func (s *FilesystemBlobstore) writeObject(name string, contents io.Reader) error {
+	objectPath := s.objectPath(name)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(objectPath), ".tmp-"+filepath.Base(objectPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), objectPath)
+}
+
+func (s *FilesystemBlobstore) GetObjectBytes(ctx context.Context, name string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(s.objectPath(name))
+	if err != nil {
+		return []byte{}, fmt.Errorf("storage.GetObjectBytes: %w", err)
+	}
+	return contents, nil
+}
+
+func (s *FilesystemBlobstore) GetObjectReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.objectPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("storage.GetObjectReader: %w", err)
+	}
+	return f, nil
+}
+
+func (s *FilesystemBlobstore) DeleteObject(ctx context.Context, name string) error {
+	err := os.Remove(s.objectPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("storage.DeleteObject: %w", err)
+	}
+	return nil
+}
+
+func (s *FilesystemBlobstore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+
+	// only the directory that the prefix points into is walked, the prefix may
+	// end in part of a name
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = s.objectPath(prefix[:i])
+	}
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// nothing was written under the prefix yet
+			if p == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return names, fmt.Errorf("storage.ListObjects: %w", err)
+	}
+
+	return names, nil
+}
+
+func (s *FilesystemBlobstore) ObjectExists(ctx context.Context, name string) (bool, error) {
+	info, err := os.Stat(s.objectPath(name))
+	if err == nil {
+		return !info.IsDir(), nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("storage.ObjectExists: %w", err)
+}
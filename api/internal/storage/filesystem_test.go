@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testBlobstore checks the behavior that every Blobstore shares
+func testBlobstore(t *testing.T, store Blobstore) {
+	ctx := context.Background()
+	objects := map[string]string{
+		"maps/1/a.png":  "a",
+		"maps/1/b.png":  "b",
+		"maps/12/c.png": "c",
+		"other.txt":     "other",
+	}
+	for name, contents := range objects {
+		var err error
+		if strings.HasSuffix(name, ".png") {
+			err = store.CreateObject(ctx, name, []byte(contents))
+		} else {
+			err = store.CreateObjectFrom(ctx, name, strings.NewReader(contents))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("read", func(t *testing.T) {
+		for name, contents := range objects {
+			data, err := store.GetObjectBytes(ctx, name)
+			if err != nil || string(data) != contents {
+				t.Errorf("GetObjectBytes(%q) = %q, %v, want %q", name, data, err, contents)
+			}
+
+			r, err := store.GetObjectReader(ctx, name)
+			if err != nil {
+				t.Fatalf("GetObjectReader(%q) = %v", name, err)
+			}
+			data, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || string(data) != contents {
+				t.Errorf("GetObjectReader(%q) read %q, %v, want %q", name, data, err, contents)
+			}
+		}
+
+		if _, err := store.GetObjectBytes(ctx, "maps/1/missing.png"); err == nil {
+			t.Error("GetObjectBytes() of a missing object did not fail")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		cases := []struct {
+			prefix string
+			want   []string
+		}{
+			{"", []string{"maps/1/a.png", "maps/1/b.png", "maps/12/c.png", "other.txt"}},
+			{"maps/1/", []string{"maps/1/a.png", "maps/1/b.png"}},
+			{"maps/1", []string{"maps/1/a.png", "maps/1/b.png", "maps/12/c.png"}},
+			{"maps/1/a", []string{"maps/1/a.png"}},
+			{"oth", []string{"other.txt"}},
+			{"maps/2/", []string{}},
+			{"missing/dir/", []string{}},
+		}
+
+		for _, c := range cases {
+			names, err := store.ListObjects(ctx, c.prefix)
+			if err != nil {
+				t.Fatalf("ListObjects(%q) = %v", c.prefix, err)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, c.want) {
+				t.Errorf("ListObjects(%q) = %v, want %v", c.prefix, names, c.want)
+			}
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := store.DeleteObject(ctx, "maps/1/a.png"); err != nil {
+			t.Fatal(err)
+		}
+		// deleting an object twice is not an error
+		if err := store.DeleteObject(ctx, "maps/1/a.png"); err != nil {
+			t.Errorf("DeleteObject() of a missing object = %v", err)
+		}
+
+		cases := []struct {
+			name   string
+			exists bool
+		}{
+			{"maps/1/a.png", false},
+			{"maps/1/b.png", true},
+			{"maps/1", false},
+			{"missing.txt", false},
+		}
+		for _, c := range cases {
+			if exists, err := store.ObjectExists(ctx, c.name); err != nil || exists != c.exists {
+				t.Errorf("ObjectExists(%q) = %v, %v, want %v", c.name, exists, err, c.exists)
+			}
+		}
+	})
+}
+
+func TestFilesystemBlobstore(t *testing.T) {
+	store, err := NewFilesystemBlobstore(context.Background(), "tiles", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobstore(t, store)
+}
+
+func TestFilesystemBlobstorePaths(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := NewFilesystemBlobstore(ctx, "tiles", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names cannot escape the root of the store
+	cases := []struct {
+		name string
+		path string
+	}{
+		{"a/b.png", "tiles/a/b.png"},
+		{"/a/b.png", "tiles/a/b.png"},
+		{"../b.png", "tiles/b.png"},
+		{"a/../../../b.png", "tiles/b.png"},
+	}
+	for _, c := range cases {
+		if err := store.CreateObject(ctx, c.name, []byte(c.name)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(c.path)))
+		if err != nil || !bytes.Equal(data, []byte(c.name)) {
+			t.Errorf("CreateObject(%q) wrote %q to %s, %v", c.name, data, c.path, err)
+		}
+	}
+
+	// files that are still being written are not listed
+	if err := ioutil.WriteFile(filepath.Join(store.Root(), "a", ".tmp-c.png123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := store.ListObjects(ctx, "a/")
+	if err != nil || !reflect.DeepEqual(names, []string{"a/b.png"}) {
+		t.Errorf("ListObjects() = %v, %v, want [a/b.png]", names, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "b.png")); !os.IsNotExist(err) {
+		t.Errorf("object was written outside of the root: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Options configures the connection to an S3 compatible endpoint
+type S3Options struct {
+	// Endpoint can be left empty to use AWS, or set to the URL of any S3
+	// compatible service (MinIO, Ceph, etc...)
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// UsePathStyle addresses buckets as <endpoint>/<bucket> rather than
+	// <bucket>.<endpoint>, which is what most self-hosted services expect
+	UsePathStyle bool
+}
+
+// S3Blobstore implements the Blobstore interface and provides the ability
+// write files to an S3 compatible object store.
+type S3Blobstore struct {
+	bucket string
+	client *s3.S3
+}
+
+// NewS3Blobstore creates a storage client for a single bucket
+func NewS3Blobstore(ctx context.Context, bucket string, options S3Options) (*S3Blobstore, error) {
+	awsConfig := aws.NewConfig().
+		WithRegion(options.Region).
+		WithS3ForcePathStyle(options.UsePathStyle)
+
+	if options.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(options.Endpoint)
+	}
+	if options.AccessKeyID != "" {
+		awsConfig = awsConfig.WithCredentials(
+			credentials.NewStaticCredentials(options.AccessKeyID, options.SecretAccessKey, ""))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 session: %v", err)
+	}
+
+	return &S3Blobstore{
+		bucket: bucket,
+		client: s3.New(sess),
+	}, nil
+}
+
+func (s *S3Blobstore) CreateObject(ctx context.Context, name string, contents []byte) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   bytes.NewReader(contents),
+	})
+	if err != nil {
+		return fmt.Errorf("storage.CreateObject: %w", err)
+	}
+	return nil
+}
+
+func (s *S3Blobstore) GetObjectBytes(ctx context.Context, name string) ([]byte, error) {
+	res, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return []byte{}, fmt.Errorf("storage.GetObjectBytes: %w", err)
+	}
+	defer res.Body.Close()
+
+	downloadedData := bytes.Buffer{}
+	if _, err = downloadedData.ReadFrom(res.Body); err != nil {
+		return []byte{}, fmt.Errorf("storage.GetObjectBytes: %w", err)
+	}
+
+	return downloadedData.Bytes(), nil
+}
+
+func (s *S3Blobstore) CreateObjectFrom(ctx context.Context, name string, contents io.Reader) error {
+	// the upload is split into parts, and aborted if any of them fails
+	uploader := s3manager.NewUploaderWithClient(s.client)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   contents,
+	})
+	if err != nil {
+		return fmt.Errorf("storage.CreateObjectFrom: %w", err)
+	}
+	return nil
+}
+
+func (s *S3Blobstore) GetObjectReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	res, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage.GetObjectReader: %w", err)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Blobstore) DeleteObject(ctx context.Context, name string) error {
+	// deleting a key that does not exist is not an error in S3
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return fmt.Errorf("storage.DeleteObject: %w", err)
+	}
+	return nil
+}
+
+func (s *S3Blobstore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return names, fmt.Errorf("storage.ListObjects: %w", err)
+	}
+
+	return names, nil
+}
+
+func (s *S3Blobstore) ObjectExists(ctx context.Context, name string) (bool, error) {
+	_, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return false, nil
+	}
+	return false, fmt.Errorf("storage.ObjectExists: %w", err)
+}
@@ -4,12 +4,30 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
-// AzureBlobstore implements the Blob interface and provides the ability
+// Blobstore is the set of object storage operations needed by the application.
+// Object names are '/' separated paths relative to the root of the store.
+type Blobstore interface {
+	CreateObject(ctx context.Context, name string, contents []byte) error
+	GetObjectBytes(ctx context.Context, name string) ([]byte, error)
+	// CreateObjectFrom writes an object as it is read, for objects too large
+	// to hold in memory
+	CreateObjectFrom(ctx context.Context, name string, contents io.Reader) error
+	// GetObjectReader opens an object to be read as it is downloaded. The
+	// reader must be closed
+	GetObjectReader(ctx context.Context, name string) (io.ReadCloser, error)
+	DeleteObject(ctx context.Context, name string) error
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+	ObjectExists(ctx context.Context, name string) (bool, error)
+}
+
+// AzureBlobstore implements the Blobstore interface and provides the ability
 // write files to Azure Blob Storage.
 type AzureBlobstore struct {
 	containerName string
@@ -73,3 +91,81 @@ func (s *AzureBlobstore) GetObjectBytes(ctx context.Context, name string) ([]byt
 
 	return downloadedData.Bytes(), nil
 }
+
+func (s *AzureBlobstore) CreateObjectFrom(ctx context.Context, name string, contents io.Reader) error {
+	blobURL := s.serviceURL.NewContainerURL(s.containerName).NewBlockBlobURL(name)
+
+	// the blocks are only committed once the whole stream was uploaded
+	if _, err := azblob.UploadStreamToBlockBlob(ctx, contents, blobURL, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 2,
+	}); err != nil {
+		return fmt.Errorf("storage.CreateObjectFrom: %w", err)
+	}
+	return nil
+}
+
+func (s *AzureBlobstore) GetObjectReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	blobURL := s.serviceURL.NewContainerURL(s.containerName).NewBlobURL(name)
+
+	downloadResponse, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, fmt.Errorf("storage.GetObjectReader: %w", err)
+	}
+
+	// NOTE: automatically retries are performed if the connection fails
+	return downloadResponse.Body(azblob.RetryReaderOptions{MaxRetryRequests: 5}), nil
+}
+
+func (s *AzureBlobstore) DeleteObject(ctx context.Context, name string) error {
+	blobURL := s.serviceURL.NewContainerURL(s.containerName).NewBlobURL(name)
+
+	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil && !isBlobNotFound(err) {
+		return fmt.Errorf("storage.DeleteObject: %w", err)
+	}
+	return nil
+}
+
+func (s *AzureBlobstore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	containerURL := s.serviceURL.NewContainerURL(s.containerName)
+	names := []string{}
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return names, fmt.Errorf("storage.ListObjects: %w", err)
+		}
+
+		for _, item := range res.Segment.BlobItems {
+			names = append(names, item.Name)
+		}
+		marker = res.NextMarker
+	}
+
+	return names, nil
+}
+
+func (s *AzureBlobstore) ObjectExists(ctx context.Context, name string) (bool, error) {
+	blobURL := s.serviceURL.NewContainerURL(s.containerName).NewBlobURL(name)
+
+	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err == nil {
+		return true, nil
+	}
+	if isBlobNotFound(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("storage.ObjectExists: %w", err)
+}
+
+func isBlobNotFound(err error) bool {
+	if stgErr, ok := err.(azblob.StorageError); ok {
+		if stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return true
+		}
+		// HEAD requests carry no body, so fall back to the status code
+		return stgErr.Response() != nil && stgErr.Response().StatusCode == http.StatusNotFound
+	}
+	return false
+}
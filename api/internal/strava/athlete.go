@@ -2,34 +2,52 @@ package strava
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"time"
 
 	"github.com/nmiodice/personal-strava-heatmap/internal/concurrency"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/encryption"
 	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+	"github.com/nmiodice/personal-strava-heatmap/internal/types"
+)
+
+const (
+	// activities can be uploaded some time after they start, so routine syncs
+	// also list activities that started a little before the newest one seen
+	syncCursorOverlap = 3 * 24 * time.Hour
 )
 
 type AthleteService struct {
 	concurrencyLimit int
+	fullSyncInterval time.Duration
 	stravaSDK        sdk.StravaSDK
 	athleteDB        athleteDB
 	oauthDB          oauthDB
-	storageClient    *storage.AzureBlobstore
+	storageClient    storage.Blobstore
+	keyring          *encryption.Keyring
 }
 
-func NewAthleteService(stravaSDK sdk.StravaSDK, db *database.DB, concurrencyLimit int, storageClient *storage.AzureBlobstore) *AthleteService {
+// NewAthleteService creates the service that syncs activities. Activity data
+// is written to storageClient, which is expected to encrypt it with keyring
+func NewAthleteService(stravaSDK sdk.StravaSDK, db *database.DB, concurrencyLimit int, fullSyncInterval time.Duration, storageClient storage.Blobstore, keyring *encryption.Keyring) *AthleteService {
 	return &AthleteService{
 		concurrencyLimit: concurrencyLimit,
+		fullSyncInterval: fullSyncInterval,
 		stravaSDK:        stravaSDK,
 		athleteDB: athleteDB{
 			db: db,
 		},
 		oauthDB: oauthDB{
-			db: db,
+			db:      db,
+			keyring: keyring,
 		},
 		storageClient: storageClient,
+		keyring:       keyring,
 	}
 }
 
@@ -45,18 +63,132 @@ func (as AthleteService) GetActivityDataRefs(ctx context.Context, token string)
 	return as.athleteDB.GetActivityDataRefs(ctx, athleteID)
 }
 
-func (as AthleteService) ImportNewActivities(ctx context.Context, token string) (int, error) {
-	activities, err := as.stravaSDK.ListAllActivities(ctx, token)
+func (as AthleteService) GetActivityRefsForAthlete(ctx context.Context, athleteID int) ([]ActivityRef, error) {
+	return as.athleteDB.GetActivityRefs(ctx, athleteID)
+}
+
+// ImportActivity records or updates a single activity, i.e., when Strava
+// reports that it was created or changed
+func (as AthleteService) ImportActivity(ctx context.Context, token string, activityID int64) (ActivityImportSummary, error) {
+	summary := ActivityImportSummary{}
+	activity, err := as.stravaSDK.GetActivity(ctx, token, activityID)
 	if err != nil {
-		return 0, err
+		return summary, err
 	}
 
-	newActivities, err := as.athleteDB.InsertActivities(ctx, activities)
+	changes, err := as.athleteDB.InsertActivities(ctx, []sdk.Activity{*activity})
 	if err != nil {
-		return 0, err
+		return summary, err
+	}
+	summary.New = len(changes.Inserted)
+	summary.Updated = len(changes.Updated)
+	summary.VisibilityChanged = len(changes.VisibilityChanged)
+	return summary, nil
+}
+
+// ActivityExists reports whether Strava still returns an activity to the
+// athlete the token belongs to
+func (as AthleteService) ActivityExists(ctx context.Context, token string, activityID int64) (bool, error) {
+	_, err := as.stravaSDK.GetActivity(ctx, token, activityID)
+	if errors.Is(err, sdk.ErrorNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteActivity forgets an activity. Its stored data is removed by
+// DeleteOrphanedActivityData
+func (as AthleteService) DeleteActivity(ctx context.Context, athleteID int, activityID int64) error {
+	return as.athleteDB.DeleteActivity(ctx, athleteID, activityID)
+}
+
+// RequestFullSync lists every activity of an athlete on their next sync, i.e.,
+// after they allowed private activities to be read
+func (as AthleteService) RequestFullSync(ctx context.Context, athleteID int) error {
+	return as.athleteDB.ResetFullSync(ctx, athleteID)
+}
+
+// DeleteAthleteData forgets the activities, sync cursor, settings and map of an
+// athlete
+func (as AthleteService) DeleteAthleteData(ctx context.Context, athleteID int) error {
+	return as.athleteDB.DeleteAthleteData(ctx, athleteID)
+}
+
+// ActivityImportSummary counts the activities changed by an import
+type ActivityImportSummary struct {
+	New     int
+	Updated int
+	Deleted int
+	// updated activities that became more or less visible
+	VisibilityChanged int
+}
+
+// ImportNewActivities lists the activities of an athlete that started after
+// the newest one seen before. Every so often all activities are listed instead,
+// which catches edits to older activities and removes deleted ones
+func (as AthleteService) ImportNewActivities(ctx context.Context, token string) (ActivityImportSummary, error) {
+	summary := ActivityImportSummary{}
+
+	athleteID, err := as.oauthDB.getAthleteForAuthToken(ctx, token)
+	if err != nil {
+		return summary, err
+	}
+
+	cursor, err := as.athleteDB.GetSyncCursor(ctx, athleteID)
+	if err != nil {
+		return summary, err
+	}
+
+	fullSync := cursor == nil || time.Since(cursor.FullSyncAt) >= as.fullSyncInterval
+	filter := sdk.ActivityFilter{}
+	latestStartDate := time.Time{}
+	if cursor != nil {
+		latestStartDate = cursor.LatestStartDate
+		if !fullSync && !latestStartDate.IsZero() {
+			filter.After = latestStartDate.Add(-syncCursorOverlap)
+		}
+	}
+
+	activities, err := as.stravaSDK.ListActivities(ctx, token, filter)
+	if err != nil {
+		return summary, err
+	}
+
+	changes, err := as.athleteDB.InsertActivities(ctx, activities)
+	if err != nil {
+		return summary, err
+	}
+	summary.New = len(changes.Inserted)
+	summary.Updated = len(changes.Updated)
+	summary.VisibilityChanged = len(changes.VisibilityChanged)
+
+	// a full listing is only trusted to find deletions if it completed. An empty
+	// listing is more likely a problem with the token than a wiped account
+	if fullSync && len(activities) > 0 {
+		listed := make([]int64, len(activities))
+		for i, activity := range activities {
+			listed[i] = activity.ID
+		}
+
+		deleted, err := as.athleteDB.DeleteActivitiesExcept(ctx, athleteID, listed)
+		if err != nil {
+			return summary, err
+		}
+		summary.Deleted = len(deleted)
 	}
 
-	return len(newActivities), nil
+	for _, activity := range activities {
+		if activity.StartDate.After(latestStartDate) {
+			latestStartDate = activity.StartDate
+		}
+	}
+
+	log.Printf(
+		"listed '%d' activities for athlete '%d' (full sync: %t): %d new, %d updated (%d visibility changes), %d deleted",
+		len(activities), athleteID, fullSync, summary.New, summary.Updated, summary.VisibilityChanged, summary.Deleted)
+
+	err = as.athleteDB.SetSyncCursor(ctx, athleteID, latestStartDate, fullSync)
+	return summary, err
 }
 
 type ActivitySyncSummary struct {
@@ -85,14 +217,14 @@ func (as AthleteService) ImportMissingActivityStreams(ctx context.Context, token
 		theActivity := activityID
 		funcs[i] = func() error {
 			err := as.syncSingleActivity(ctx, token, athleteID, theActivity)
-			if err != nil && err != sdk.ErrorNotFound {
+			if err != nil && !errors.Is(err, sdk.ErrorNotFound) {
 				return err
 			}
 
 			countSem.Acquire(1)
 			defer countSem.Release(1)
 
-			if err == sdk.ErrorNotFound {
+			if errors.Is(err, sdk.ErrorNotFound) {
 				notFoundCount++
 				log.Printf("activity '%d' for athlete '%d' was not found", activityID, athleteID)
 			} else {
@@ -114,13 +246,13 @@ func (as AthleteService) syncSingleActivity(ctx context.Context, token string, a
 		return err
 	}
 
-	fileName := fmt.Sprintf("%d/%d.json", athleteID, activityID)
+	fileName := activityDataRef(athleteID, activityID)
 	err = as.storageClient.CreateObject(ctx, fileName, activity)
 	if err != nil {
 		return err
 	}
 
-	err = as.athleteDB.UpdateActivityWithDataRef(ctx, athleteID, activityID, fileName)
+	err = as.athleteDB.UpdateActivityWithDataRef(ctx, athleteID, activityID, fileName, as.keyring.PrimaryKeyID())
 	if err != nil {
 		return err
 	}
@@ -128,6 +260,120 @@ func (as AthleteService) syncSingleActivity(ctx context.Context, token string, a
 	return nil
 }
 
+var activityDataRefRegex = regexp.MustCompile(`^\d+/\d+\.json$`)
+
+// activityDataRef is the name of the stored data of an activity
+func activityDataRef(athleteID int, activityID int64) string {
+	return fmt.Sprintf("%d/%d.json", athleteID, activityID)
+}
+
+// DeleteOrphanedActivityData removes stored activity data that does not
+// belong to any activity, for example because the activity was deleted
+func (as AthleteService) DeleteOrphanedActivityData(ctx context.Context) (int, error) {
+	// listing happens first. Activities are recorded before their data is
+	// downloaded, so data that is listed always has an activity if it is in use
+	names, err := as.storageClient.ListObjects(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	activities, err := as.athleteDB.GetAllActivities(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	known := types.NewSet()
+	for athleteID, activityIDs := range activities {
+		for _, activityID := range activityIDs {
+			known.Add(activityDataRef(athleteID, activityID))
+		}
+	}
+
+	deleted := 0
+	for _, name := range names {
+		// the container may hold other objects, which are left alone
+		if !activityDataRefRegex.MatchString(name) || known.Exists(name) {
+			continue
+		}
+		if err := as.storageClient.DeleteObject(ctx, name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	log.Printf("deleted '%d' orphaned activities", deleted)
+	return deleted, nil
+}
+
+// ReencryptActivityData encrypts stored activity data with the primary key,
+// i.e., after a key was rotated or encryption was enabled. Activities are
+// recorded one at a time, so a failure part way through keeps the ones that
+// were already done
+func (as AthleteService) ReencryptActivityData(ctx context.Context) (int, error) {
+	if !as.keyring.Enabled() {
+		return 0, nil
+	}
+
+	keyID := as.keyring.PrimaryKeyID()
+	stale, err := as.athleteDB.GetActivityDataWithStaleKey(ctx, keyID)
+	if err != nil {
+		return 0, err
+	}
+
+	reencrypted := 0
+	for _, data := range stale {
+		contents, err := as.storageClient.GetObjectBytes(ctx, data.DataRef)
+		if err != nil {
+			return reencrypted, err
+		}
+		if err := as.storageClient.CreateObject(ctx, data.DataRef, contents); err != nil {
+			return reencrypted, err
+		}
+		if err := as.athleteDB.SetActivityDataKeyID(ctx, data.AthleteID, data.ActivityID, keyID); err != nil {
+			return reencrypted, err
+		}
+		reencrypted++
+	}
+
+	log.Printf("encrypted data of '%d' activities with key '%s'", reencrypted, keyID)
+	return reencrypted, nil
+}
+
+// DeleteActivityDataForAthlete removes the stored data of an athlete that does
+// not belong to any of their activities. Once their activities are forgotten,
+// that is all of it
+func (as AthleteService) DeleteActivityDataForAthlete(ctx context.Context, athleteID int) (int, error) {
+	// listing happens first, like in DeleteOrphanedActivityData
+	names, err := as.storageClient.ListObjects(ctx, fmt.Sprintf("%d/", athleteID))
+	if err != nil {
+		return 0, err
+	}
+
+	activityIDs, err := as.athleteDB.GetActivityIDs(ctx, athleteID)
+	if err != nil {
+		return 0, err
+	}
+
+	known := types.NewSet()
+	for _, activityID := range activityIDs {
+		known.Add(activityDataRef(athleteID, activityID))
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if !activityDataRefRegex.MatchString(name) || known.Exists(name) {
+			continue
+		}
+		if err := as.storageClient.DeleteObject(ctx, name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	log.Printf("deleted data of '%d' activities of athlete '%d'", deleted, athleteID)
+	return deleted, nil
+}
+
 func (as AthleteService) GetOrCreateMapID(ctx context.Context, token string) (string, error) {
 	athleteID, err := as.oauthDB.getAthleteForAuthToken(ctx, token)
 	if err != nil {
@@ -137,6 +383,25 @@ func (as AthleteService) GetOrCreateMapID(ctx context.Context, token string) (st
 	return as.athleteDB.GetOrCreateMapID(ctx, athleteID)
 }
 
+// GetActivityMetadata returns every activity of an athlete, including those
+// that their visibility policy keeps off their map
+func (as AthleteService) GetActivityMetadata(ctx context.Context, athleteID int) ([]ActivityMetadata, error) {
+	return as.athleteDB.GetActivityMetadata(ctx, athleteID)
+}
+
+// GetMapIDForAthlete returns nil if the athlete has no map
+func (as AthleteService) GetMapIDForAthlete(ctx context.Context, athleteID int) (*string, error) {
+	return as.athleteDB.GetMapID(ctx, athleteID)
+}
+
+func (as AthleteService) GetOrCreateMapIDForAthlete(ctx context.Context, athleteID int) (string, error) {
+	return as.athleteDB.GetOrCreateMapID(ctx, athleteID)
+}
+
+func (as AthleteService) GetAthleteForMapID(ctx context.Context, mapID string) (int, error) {
+	return as.athleteDB.GetAthleteForMapID(ctx, mapID)
+}
+
 func (as AthleteService) SetMapSharable(ctx context.Context, mapID string) error {
 	return as.athleteDB.SetMapSharable(ctx, mapID)
 }
@@ -3,6 +3,8 @@ package strava
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
@@ -13,44 +15,267 @@ type athleteDB struct {
 	db *database.DB
 }
 
-func (ad athleteDB) InsertActivities(ctx context.Context, activities []sdk.Activity) ([]int64, error) {
-	inserted := []int64{}
-	queryArgs := []interface{}{}
-	idx := 1
-	queryFormat := ""
+// number of activities written per statement, which keeps the number of query
+// arguments under the Postgres limit
+const insertActivitiesBatchSize = 1000
+
+// ActivityChanges lists the IDs of activities changed by InsertActivities
+type ActivityChanges struct {
+	Inserted []int64
+	// activities whose metadata changed
+	Updated []int64
+	// subset of Updated whose visibility changed
+	VisibilityChanged []int64
+}
+
+// InsertActivities records new activities and updates the metadata of known ones
+func (ad athleteDB) InsertActivities(ctx context.Context, activities []sdk.Activity) (ActivityChanges, error) {
+	changes := ActivityChanges{
+		Inserted:          []int64{},
+		Updated:           []int64{},
+		VisibilityChanged: []int64{},
+	}
+
+	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		for start := 0; start < len(activities); start += insertActivitiesBatchSize {
+			end := start + insertActivitiesBatchSize
+			if end > len(activities) {
+				end = len(activities)
+			}
+
+			ids := []int64{}
+			visibility := map[int64]string{}
+			for _, activity := range activities[start:end] {
+				ids = append(ids, activity.ID)
+				visibility[activity.ID] = visibilityKey(activity.Visibility, activity.Private)
+			}
+
+			previousVisibility, err := getVisibility(ctx, tx, ids)
+			if err != nil {
+				return err
+			}
+
+			queryArgs := []interface{}{}
+			idx := 1
+			queryFormat := ""
+
+			for _, activity := range activities[start:end] {
+				if queryFormat != "" {
+					queryFormat += ", "
+				}
+				queryArgs = append(
+					queryArgs,
+					activity.Athlete.ID,
+					activity.ID,
+					nil,
+					activity.SportType,
+					activity.StartDate,
+					activity.Name,
+					activity.Distance,
+					activity.MovingTime,
+					activity.TotalElevationGain,
+					activity.Visibility,
+					activity.Private,
+					activity.GearID,
+					activity.Trainer,
+					activity.Manual,
+					activity.Map.SummaryPolyline,
+				)
+
+				placeholders := make([]string, insertActivitiesColumns)
+				for i := range placeholders {
+					placeholders[i] = fmt.Sprintf("$%d", idx+i)
+				}
+				queryFormat += "(" + strings.Join(placeholders, ", ") + ")"
+				idx += insertActivitiesColumns
+			}
+
+			rows, err := tx.Query(ctx, fmt.Sprintf(insertActivitiesSQL, queryFormat), queryArgs...)
+			if err != nil {
+				return err
+			}
+
+			for rows.Next() {
+				var id int64
+				var isInsert bool
+				if err = rows.Scan(&id, &isInsert); err != nil {
+					rows.Close()
+					return err
+				}
+
+				if isInsert {
+					changes.Inserted = append(changes.Inserted, id)
+					continue
+				}
+
+				changes.Updated = append(changes.Updated, id)
+				if previousVisibility[id] != visibility[id] {
+					changes.VisibilityChanged = append(changes.VisibilityChanged, id)
+				}
+			}
+			rows.Close()
 
-	for _, activity := range activities {
-		if queryFormat != "" {
-			queryFormat += ", "
+			if err = rows.Err(); err != nil {
+				return err
+			}
 		}
-		queryArgs = append(queryArgs, activity.Athlete.ID, activity.ID, nil)
-		queryFormat += fmt.Sprintf("($%d, $%d, $%d)", idx, idx+1, idx+2)
 
-		idx += 3
+		return nil
+	})
+	return changes, err
+}
+
+// visibilityKey combines the fields that decide who can see an activity
+func visibilityKey(visibility string, private bool) string {
+	return fmt.Sprintf("%s/%t", visibility, private)
+}
+
+func getVisibility(ctx context.Context, tx pgx.Tx, activityIDs []int64) (map[int64]string, error) {
+	rows, err := tx.Query(ctx, getVisibilitySQL, activityIDs)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	visibility := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var v *string
+		var private *bool
+		if err := rows.Scan(&id, &v, &private); err != nil {
+			return nil, err
+		}
 
-	query := fmt.Sprintf(insertActivitiesSQL, queryFormat)
+		key := visibilityKey("", false)
+		if v != nil && private != nil {
+			key = visibilityKey(*v, *private)
+		}
+		visibility[id] = key
+	}
+	return visibility, rows.Err()
+}
 
-	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
-		rows, err := tx.Query(ctx, query, queryArgs...)
+// DeleteActivitiesExcept removes every activity of an athlete that is not in
+// keep, returning the IDs of the removed activities
+func (ad athleteDB) DeleteActivitiesExcept(ctx context.Context, athleteID int, keep []int64) ([]int64, error) {
+	deleted := []int64{}
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, deleteActivitiesExceptSQL, athleteID, keep)
 		if err != nil {
 			return err
 		}
-
 		defer rows.Close()
+
 		for rows.Next() {
 			var id int64
-			err = rows.Scan(&id)
-			if err != nil {
+			if err := rows.Scan(&id); err != nil {
 				return err
 			}
+			deleted = append(deleted, id)
+		}
+		return rows.Err()
+	})
+	return deleted, err
+}
 
-			inserted = append(inserted, id)
+func (ad athleteDB) DeleteActivity(ctx context.Context, athleteID int, activityID int64) error {
+	return ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, deleteActivitySQL, athleteID, activityID)
+		return err
+	})
+}
+
+func (ad athleteDB) DeleteAthleteData(ctx context.Context, athleteID int) error {
+	return ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		for _, query := range deleteAthleteDataSQL {
+			if _, err := tx.Exec(ctx, query, athleteID); err != nil {
+				return fmt.Errorf("deleting athlete data: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// SyncCursor tracks how far the activity listing of an athlete has progressed
+type SyncCursor struct {
+	// start date of the newest activity seen
+	LatestStartDate time.Time
+	// when every activity of the athlete was last listed
+	FullSyncAt time.Time
+}
+
+// GetSyncCursor returns nil if the activities of the athlete were never listed
+func (ad athleteDB) GetSyncCursor(ctx context.Context, athleteID int) (*SyncCursor, error) {
+	var cursor *SyncCursor
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		var latestStartDate, fullSyncAt *time.Time
+		row := tx.QueryRow(ctx, getSyncCursorSQL, athleteID)
+		if err := row.Scan(&latestStartDate, &fullSyncAt); err != nil {
+			if err == pgx.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("fetching sync cursor: %w", err)
+		}
+
+		cursor = &SyncCursor{}
+		if latestStartDate != nil {
+			cursor.LatestStartDate = *latestStartDate
+		}
+		if fullSyncAt != nil {
+			cursor.FullSyncAt = *fullSyncAt
+		}
+		return nil
+	})
+	return cursor, err
+}
+
+// SetSyncCursor moves the cursor of an athlete forward. The full sync time is
+// only updated if fullSync is set
+func (ad athleteDB) SetSyncCursor(ctx context.Context, athleteID int, latestStartDate time.Time, fullSync bool) error {
+	var startDate *time.Time
+	if !latestStartDate.IsZero() {
+		startDate = &latestStartDate
+	}
+
+	return ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, upsertSyncCursorSQL, athleteID, startDate, fullSync)
+		return err
+	})
+}
+
+// ResetFullSync makes the next listing of an athlete a full one
+func (ad athleteDB) ResetFullSync(ctx context.Context, athleteID int) error {
+	return ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, resetFullSyncSQL, athleteID)
+		return err
+	})
+}
+
+// GetVisibilityPolicy returns the public policy for athletes that never chose one
+func (ad athleteDB) GetVisibilityPolicy(ctx context.Context, athleteID int) (string, error) {
+	policy := VisibilityPolicyPublic
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getVisibilityPolicySQL, athleteID)
+		if err := row.Scan(&policy); err != nil && err != pgx.ErrNoRows {
+			return fmt.Errorf("fetching visibility policy: %w", err)
 		}
+		return nil
+	})
+	return policy, err
+}
 
+// SetVisibilityPolicy returns true if the policy of the athlete changed
+func (ad athleteDB) SetVisibilityPolicy(ctx context.Context, athleteID int, policy string) (bool, error) {
+	changed := false
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, upsertVisibilityPolicySQL, athleteID, policy)
+		if err != nil {
+			return err
+		}
+		changed = tag.RowsAffected() > 0
 		return nil
 	})
-	return inserted, err
+	return changed, err
 }
 
 func (ad athleteDB) UnsyncedActivities(ctx context.Context, athleteID int) ([]int64, error) {
@@ -77,9 +302,11 @@ func (ad athleteDB) UnsyncedActivities(ctx context.Context, athleteID int) ([]in
 	return unprocessed, err
 }
 
-func (ad athleteDB) UpdateActivityWithDataRef(ctx context.Context, athleteID int, activityID int64, dataRef string) error {
+// UpdateActivityWithDataRef records where the data of an activity is stored,
+// and the ID of the key it was encrypted with, which is empty if it was not
+func (ad athleteDB) UpdateActivityWithDataRef(ctx context.Context, athleteID int, activityID int64, dataRef string, dataKeyID string) error {
 	return ad.db.InTx(ctx, pgx.RepeatableRead, func(tx pgx.Tx) error {
-		row := tx.QueryRow(ctx, updateActivityWithDataRefSQL, athleteID, activityID, dataRef)
+		row := tx.QueryRow(ctx, updateActivityWithDataRefSQL, athleteID, activityID, dataRef, dataKeyID)
 		var updatedActivityID int64
 		if err := row.Scan(&updatedActivityID); err != nil {
 			return fmt.Errorf("fetching activity_id for updated raw data: %w", err)
@@ -115,6 +342,222 @@ func (ad athleteDB) GetActivityDataRefs(ctx context.Context, athleteID int) ([]s
 	return dataRefs, err
 }
 
+// GetActivityDataWithStaleKey returns the stored data of activities that was
+// not encrypted with the key keyID
+func (ad athleteDB) GetActivityDataWithStaleKey(ctx context.Context, keyID string) ([]ActivityData, error) {
+	data := []ActivityData{}
+
+	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, staleKeyActivityDataSQL, keyID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			d := ActivityData{}
+			if err := rows.Scan(&d.AthleteID, &d.ActivityID, &d.DataRef); err != nil {
+				return err
+			}
+			data = append(data, d)
+		}
+
+		return nil
+	})
+
+	return data, err
+}
+
+// SetActivityDataKeyID records that the stored data of an activity was
+// encrypted again. Unlike UpdateActivityWithDataRef, the activity is not
+// considered synced again, because its data did not change
+func (ad athleteDB) SetActivityDataKeyID(ctx context.Context, athleteID int, activityID int64, dataKeyID string) error {
+	return ad.db.InTx(ctx, pgx.RepeatableRead, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, setActivityDataKeyIDSQL, athleteID, activityID, dataKeyID)
+		return err
+	})
+}
+
+// GetActivityIDs returns the IDs of the activities of an athlete
+func (ad athleteDB) GetActivityIDs(ctx context.Context, athleteID int) ([]int64, error) {
+	activityIDs := []int64{}
+
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, athleteActivitiesSQL, athleteID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var activityID int64
+			if err := rows.Scan(&activityID); err != nil {
+				return err
+			}
+			activityIDs = append(activityIDs, activityID)
+		}
+
+		return nil
+	})
+
+	return activityIDs, err
+}
+
+// GetActivityMetadata returns every activity of an athlete, regardless of their
+// visibility policy, oldest first
+func (ad athleteDB) GetActivityMetadata(ctx context.Context, athleteID int) ([]ActivityMetadata, error) {
+	activities := []ActivityMetadata{}
+
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, activityMetadataSQL, athleteID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			a := ActivityMetadata{}
+			err := rows.Scan(
+				&a.ActivityID, &a.Name, &a.SportType, &a.StartDate, &a.Distance, &a.MovingTime,
+				&a.TotalElevationGain, &a.Visibility, &a.Private, &a.GearID, &a.Trainer, &a.Manual,
+				&a.SummaryPolyline, &a.DataRef, &a.ImportedAt, &a.SyncedAt)
+			if err != nil {
+				return err
+			}
+			activities = append(activities, a)
+		}
+
+		return nil
+	})
+
+	return activities, err
+}
+
+// GetAllActivities returns the IDs of every activity, keyed by athlete
+func (ad athleteDB) GetAllActivities(ctx context.Context) (map[int][]int64, error) {
+	activities := map[int][]int64{}
+
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, allActivitiesSQL)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var athleteID int
+			var activityID int64
+			if err := rows.Scan(&athleteID, &activityID); err != nil {
+				return err
+			}
+
+			activities[athleteID] = append(activities[athleteID], activityID)
+		}
+
+		return nil
+	})
+
+	return activities, err
+}
+
+// ActivityRef points to the stored data of an activity, along with the
+// activity metadata that is useful when drawing it
+type ActivityRef struct {
+	ActivityID int64
+	DataRef    string
+	SportType  string
+	StartDate  time.Time
+	// when the activity data was downloaded
+	SyncedAt time.Time
+}
+
+// ActivityMetadata is everything recorded about an activity, as exported to
+// the athlete
+type ActivityMetadata struct {
+	ActivityID int64      `json:"activity_id"`
+	Name       string     `json:"name"`
+	SportType  string     `json:"sport_type"`
+	StartDate  *time.Time `json:"start_date"`
+	// meters
+	Distance float64 `json:"distance"`
+	// seconds
+	MovingTime int `json:"moving_time"`
+	// meters
+	TotalElevationGain float64 `json:"total_elevation_gain"`
+	Visibility         string  `json:"visibility"`
+	Private            bool    `json:"private"`
+	GearID             string  `json:"gear_id"`
+	Trainer            bool    `json:"trainer"`
+	Manual             bool    `json:"manual"`
+	SummaryPolyline    string  `json:"summary_polyline"`
+	// empty if the activity data was not downloaded yet
+	DataRef    string     `json:"-"`
+	ImportedAt time.Time  `json:"imported_at"`
+	SyncedAt   *time.Time `json:"synced_at"`
+}
+
+// ActivityData locates the stored data of an activity
+type ActivityData struct {
+	AthleteID  int
+	ActivityID int64
+	DataRef    string
+}
+
+func (ad athleteDB) GetActivityRefs(ctx context.Context, athleteID int) ([]ActivityRef, error) {
+	refs := []ActivityRef{}
+
+	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, syncedActivityRefSQL, athleteID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var ref ActivityRef
+			var sportType *string
+			var startDate, syncedAt *time.Time
+			err := rows.Scan(&ref.ActivityID, &ref.DataRef, &sportType, &startDate, &syncedAt)
+			if err != nil {
+				return err
+			}
+
+			if sportType != nil {
+				ref.SportType = *sportType
+			}
+			if startDate != nil {
+				ref.StartDate = *startDate
+			}
+			if syncedAt != nil {
+				ref.SyncedAt = *syncedAt
+			}
+			refs = append(refs, ref)
+		}
+
+		return nil
+	})
+
+	return refs, err
+}
+
+// GetMapID returns nil if the athlete has no map
+func (ad athleteDB) GetMapID(ctx context.Context, athleteID int) (*string, error) {
+	var mapID *string
+	err := ad.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getMapIDSQL, athleteID)
+		id := ""
+		if err := row.Scan(&id); err != nil {
+			if err == pgx.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("fetching map ID: %w", err)
+		}
+		mapID = &id
+		return nil
+	})
+	return mapID, err
+}
+
 func (ad athleteDB) GetOrCreateMapID(ctx context.Context, athleteID int) (string, error) {
 	mapID := ""
 	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
@@ -130,6 +573,21 @@ func (ad athleteDB) GetOrCreateMapID(ctx context.Context, athleteID int) (string
 	return mapID, err
 }
 
+func (ad athleteDB) GetAthleteForMapID(ctx context.Context, mapID string) (int, error) {
+	athleteID := 0
+	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getAthleteForMapIDSQL, mapID)
+
+		if err := row.Scan(&athleteID); err != nil {
+			return fmt.Errorf("fetching athlete for map ID: %w", err)
+		}
+
+		return nil
+	})
+
+	return athleteID, err
+}
+
 func (ad athleteDB) SetMapSharable(ctx context.Context, mapID string) error {
 	err := ad.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
 		row := tx.QueryRow(ctx, setMapSharableSQL, mapID)
@@ -159,19 +617,156 @@ func (ad athleteDB) GetMapSharable(ctx context.Context, mapID string) (bool, err
 	return sharable, err
 }
 
-// substitution is a series of escaped SQL values blocks
+// number of values for each activity in insertActivitiesSQL
+const insertActivitiesColumns = 15
+
+// substitution is a series of escaped SQL values blocks. Rows are only updated
+// when their metadata changed, and xmax is only 0 for rows that were inserted
 var insertActivitiesSQL = `
 INSERT INTO
 	StravaActivity
-	(athlete_id, activity_id, activity_data_ref)
+	(
+		athlete_id, activity_id, activity_data_ref, sport_type, start_date,
+		name, distance, moving_time, total_elevation_gain, visibility,
+		private, gear_id, trainer, manual, summary_polyline
+	)
 VALUES
 	%s
 ON CONFLICT (activity_id)
-	DO NOTHING
+	DO UPDATE SET
+		sport_type=EXCLUDED.sport_type,
+		start_date=EXCLUDED.start_date,
+		name=EXCLUDED.name,
+		distance=EXCLUDED.distance,
+		moving_time=EXCLUDED.moving_time,
+		total_elevation_gain=EXCLUDED.total_elevation_gain,
+		visibility=EXCLUDED.visibility,
+		private=EXCLUDED.private,
+		gear_id=EXCLUDED.gear_id,
+		trainer=EXCLUDED.trainer,
+		manual=EXCLUDED.manual,
+		summary_polyline=EXCLUDED.summary_polyline,
+		updated_at=NOW()
+	WHERE
+		(
+			StravaActivity.sport_type, StravaActivity.start_date, StravaActivity.name,
+			StravaActivity.distance, StravaActivity.moving_time, StravaActivity.total_elevation_gain,
+			StravaActivity.visibility, StravaActivity.private, StravaActivity.gear_id,
+			StravaActivity.trainer, StravaActivity.manual, StravaActivity.summary_polyline
+		) IS DISTINCT FROM (
+			EXCLUDED.sport_type, EXCLUDED.start_date, EXCLUDED.name,
+			EXCLUDED.distance, EXCLUDED.moving_time, EXCLUDED.total_elevation_gain,
+			EXCLUDED.visibility, EXCLUDED.private, EXCLUDED.gear_id,
+			EXCLUDED.trainer, EXCLUDED.manual, EXCLUDED.summary_polyline
+		)
+RETURNING
+	activity_id, (xmax = 0) AS inserted
+`
+
+var deleteActivitiesExceptSQL = `
+DELETE FROM
+	StravaActivity
+WHERE
+	athlete_id = $1
+		AND
+	NOT (activity_id = ANY($2::BIGINT[]))
 RETURNING
 	activity_id
 `
 
+var deleteActivitySQL = `
+DELETE FROM
+	StravaActivity
+WHERE
+	athlete_id = $1 AND activity_id = $2
+`
+
+var deleteAthleteDataSQL = []string{`
+DELETE FROM
+	StravaActivity
+WHERE
+	athlete_id = $1
+`, `
+DELETE FROM
+	AthleteSyncCursor
+WHERE
+	athlete_id = $1
+`, `
+DELETE FROM
+	AthleteSettings
+WHERE
+	athlete_id = $1
+`, `
+DELETE FROM
+	AthleteMap
+WHERE
+	athlete_id = $1
+`}
+
+var getSyncCursorSQL = `
+SELECT
+	latest_start_date, full_sync_at
+FROM
+	AthleteSyncCursor
+WHERE
+	athlete_id = $1
+`
+
+var upsertSyncCursorSQL = `
+INSERT INTO
+	AthleteSyncCursor
+	(athlete_id, latest_start_date, full_sync_at)
+VALUES
+	($1, $2, CASE WHEN $3::BOOLEAN THEN NOW() END)
+ON CONFLICT (athlete_id)
+	DO UPDATE SET
+		latest_start_date=GREATEST(AthleteSyncCursor.latest_start_date, EXCLUDED.latest_start_date),
+		full_sync_at=COALESCE(EXCLUDED.full_sync_at, AthleteSyncCursor.full_sync_at),
+		updated_at=NOW()
+`
+
+var resetFullSyncSQL = `
+UPDATE
+	AthleteSyncCursor
+SET
+	full_sync_at = NULL,
+	updated_at = NOW()
+WHERE
+	athlete_id = $1
+`
+
+var getVisibilityPolicySQL = `
+SELECT
+	visibility_policy
+FROM
+	AthleteSettings
+WHERE
+	athlete_id = $1
+`
+
+var upsertVisibilityPolicySQL = `
+INSERT INTO
+	AthleteSettings
+	(athlete_id, visibility_policy)
+VALUES
+	($1, $2)
+ON CONFLICT (athlete_id)
+	DO UPDATE SET
+		visibility_policy=EXCLUDED.visibility_policy,
+		updated_at=NOW()
+	WHERE
+		AthleteSettings.visibility_policy <> EXCLUDED.visibility_policy
+`
+
+var getVisibilitySQL = `
+SELECT
+	activity_id, visibility, private
+FROM
+	StravaActivity
+WHERE
+	activity_id = ANY($1::BIGINT[])
+`
+
 var unsyncedActivitiesSQL = `
 SELECT
 	activity_id
@@ -192,19 +787,110 @@ WHERE
 	athlete_id = $1
 		AND
 	(activity_data_ref IS NOT NULL AND activity_data_ref <> '')
+		AND
+	` + visibleActivitySQL + `
+`
+
+var allActivitiesSQL = `
+SELECT
+	athlete_id, activity_id
+FROM
+	StravaActivity
+`
+
+var activityMetadataSQL = `
+SELECT
+	activity_id, COALESCE(name, ''), COALESCE(sport_type, ''), start_date,
+	COALESCE(distance, 0), COALESCE(moving_time, 0), COALESCE(total_elevation_gain, 0),
+	COALESCE(visibility, ''), COALESCE(private, FALSE), COALESCE(gear_id, ''),
+	COALESCE(trainer, FALSE), COALESCE(manual, FALSE), COALESCE(summary_polyline, ''),
+	COALESCE(activity_data_ref, ''), imported_at, synced_at
+FROM
+	StravaActivity
+WHERE
+	athlete_id = $1
+ORDER BY
+	start_date, activity_id
+`
+
+var athleteActivitiesSQL = `
+SELECT
+	activity_id
+FROM
+	StravaActivity
+WHERE
+	athlete_id = $1
+`
+
+// visibleActivitySQL limits activities of athlete $1 to those allowed by the
+// visibility policy of the athlete. Activities whose visibility is not known
+// yet are only included when everything is allowed. The queue trigger function
+// applies the same filter in VISIBLE_ACTIVITY_REFS_SQL
+var visibleActivitySQL = `(
+	CASE
+		COALESCE((SELECT visibility_policy FROM AthleteSettings WHERE athlete_id = $1), '` + VisibilityPolicyPublic + `')
+	WHEN '` + VisibilityPolicyEverything + `' THEN
+		TRUE
+	WHEN '` + VisibilityPolicyFollowers + `' THEN
+		COALESCE(visibility IN ('everyone', 'followers_only') AND NOT private, FALSE)
+	ELSE
+		COALESCE(visibility = 'everyone' AND NOT private, FALSE)
+	END
+)`
+
+var syncedActivityRefSQL = `
+SELECT
+	activity_id, activity_data_ref, sport_type, start_date, synced_at
+FROM
+	StravaActivity
+WHERE
+	athlete_id = $1
+		AND
+	(activity_data_ref IS NOT NULL AND activity_data_ref <> '')
+		AND
+	` + visibleActivitySQL + `
 `
 
 var updateActivityWithDataRefSQL = `
 UPDATE
 	StravaActivity
 SET
-	activity_data_ref = $3
+	activity_data_ref = $3, data_key_id = NULLIF($4, ''), synced_at = NOW()
 WHERE
 	athlete_id = $1 AND activity_id = $2
 RETURNING
 	activity_id
 `
 
+var staleKeyActivityDataSQL = `
+SELECT
+	athlete_id, activity_id, activity_data_ref
+FROM
+	StravaActivity
+WHERE
+	(activity_data_ref IS NOT NULL AND activity_data_ref <> '')
+		AND
+	data_key_id IS DISTINCT FROM $1
+`
+
+var setActivityDataKeyIDSQL = `
+UPDATE
+	StravaActivity
+SET
+	data_key_id = NULLIF($3, '')
+WHERE
+	athlete_id = $1 AND activity_id = $2
+`
+
+var getMapIDSQL = `
+SELECT
+	id
+FROM
+	AthleteMap
+WHERE
+	athlete_id = $1
+`
+
 var insertOrGetMapIDSQL = `
 INSERT INTO
 	AthleteMap
@@ -217,6 +903,15 @@ RETURNING
 	id
 `
 
+var getAthleteForMapIDSQL = `
+SELECT
+	athlete_id
+FROM
+	AthleteMap
+WHERE
+	id = $1
+`
+
 var setMapSharableSQL = `
 UPDATE
 	AthleteMap
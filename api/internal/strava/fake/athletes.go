@@ -0,0 +1,219 @@
+package fake
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+const (
+	// seconds between recorded points
+	sampleInterval  = 5
+	metersPerDegree = 111320.0
+)
+
+// first activity of every athlete. Activities are spaced out from here so the
+// same seed always produces the same activities
+var firstStartDate = time.Date(2020, time.January, 1, 7, 0, 0, 0, time.UTC)
+
+// homes that synthetic athletes are spread across
+var homes = [][2]float64{
+	{47.6062, -122.3321},
+	{40.7128, -74.0060},
+	{51.5074, -0.1278},
+	{-33.8688, 151.2093},
+	{35.6762, 139.6503},
+}
+
+type athlete struct {
+	ID        int
+	Firstname string
+	Lastname  string
+	home      [2]float64
+	// athletes without a heart rate monitor record no heartrate stream
+	heartrate  bool
+	activities []sdk.Activity
+}
+
+type stream struct {
+	Type         string      `json:"type"`
+	Data         interface{} `json:"data"`
+	SeriesType   string      `json:"series_type"`
+	OriginalSize int         `json:"original_size"`
+	Resolution   string      `json:"resolution"`
+}
+
+// track is a generated recording of an activity, with one entry per point in
+// every stream
+type track struct {
+	latlng    [][2]float64
+	time      []int
+	distance  []float64
+	altitude  []float64
+	velocity  []float64
+	heartrate []int
+	moving    []bool
+}
+
+func newAthletes(seed int64, count, activityCount int) []*athlete {
+	rng := rand.New(rand.NewSource(seed))
+
+	athletes := make([]*athlete, count)
+	for i := range athletes {
+		a := &athlete{
+			ID:        1000 + i,
+			Firstname: "Sandbox",
+			Lastname:  fmt.Sprintf("Athlete %d", i+1),
+			home:      homes[i%len(homes)],
+			heartrate: i%3 != 2,
+		}
+
+		for j := 0; j < activityCount; j++ {
+			activityID := int64(a.ID)*100000 + int64(j)
+			a.activities = append(a.activities, newActivity(a, activityID, j, rng))
+		}
+		athletes[i] = a
+	}
+	return athletes
+}
+
+func newActivity(a *athlete, activityID int64, index int, rng *rand.Rand) sdk.Activity {
+	sportType := "Ride"
+	if rng.Intn(3) == 0 {
+		sportType = "Run"
+	}
+
+	visibility := "everyone"
+	switch rng.Intn(10) {
+	case 0:
+		visibility = "followers_only"
+	case 1:
+		visibility = "only_me"
+	}
+
+	activity := sdk.Activity{
+		ID:         activityID,
+		Name:       fmt.Sprintf("Sandbox %s #%d", sportType, index+1),
+		SportType:  sportType,
+		StartDate:  firstStartDate.Add(time.Duration(index) * 49 * time.Hour),
+		Visibility: visibility,
+		Private:    visibility == "only_me",
+	}
+	activity.Athlete.ID = a.ID
+
+	t := generateTrack(a, activity)
+	activity.Distance = t.distance[len(t.distance)-1]
+	activity.MovingTime = 0
+	for i := 1; i < len(t.moving); i++ {
+		if t.moving[i] {
+			activity.MovingTime += sampleInterval
+		}
+	}
+	for i := 1; i < len(t.altitude); i++ {
+		activity.TotalElevationGain += math.Max(0, t.altitude[i]-t.altitude[i-1])
+	}
+	activity.TotalElevationGain = round(activity.TotalElevationGain, 1)
+	return activity
+}
+
+// generateTrack walks a loop that starts and ends near the home of the
+// athlete. The track only depends on the activity, so it is generated again
+// whenever its streams are requested rather than kept in memory
+func generateTrack(a *athlete, activity sdk.Activity) track {
+	rng := rand.New(rand.NewSource(activity.ID))
+
+	speed := 7.0
+	if activity.SportType == "Run" {
+		speed = 3.0
+	}
+
+	points := 300 + rng.Intn(900)
+	lat := a.home[0] + (rng.Float64()-0.5)*0.05
+	lon := a.home[1] + (rng.Float64()-0.5)*0.05
+	startLat, startLon := lat, lon
+	heading := rng.Float64() * 2 * math.Pi
+	altitude := 50 + rng.Float64()*200
+	pauseLeft := 0
+
+	t := track{}
+	distance := 0.0
+	for i := 0; i < points; i++ {
+		moving := pauseLeft == 0
+		if moving && rng.Intn(200) == 0 {
+			// stop at a traffic light for a while
+			pauseLeft = 5 + rng.Intn(20)
+		}
+		if pauseLeft > 0 {
+			pauseLeft--
+		}
+
+		velocity := 0.0
+		if moving {
+			velocity = math.Max(0.5, speed+rng.NormFloat64())
+
+			// wander during the first half, then head back to the start
+			if i > points/2 {
+				target := math.Atan2(startLat-lat, (startLon-lon)*math.Cos(lat*math.Pi/180))
+				heading += 0.2 * math.Sin(target-heading)
+			}
+			heading += rng.NormFloat64() * 0.15
+
+			step := velocity * sampleInterval
+			lat += step * math.Sin(heading) / metersPerDegree
+			lon += step * math.Cos(heading) / (metersPerDegree * math.Cos(lat*math.Pi/180))
+			distance += step
+			altitude = math.Max(0, altitude+rng.NormFloat64())
+		}
+
+		t.latlng = append(t.latlng, [2]float64{round(lat, 6), round(lon, 6)})
+		t.time = append(t.time, i*sampleInterval)
+		t.distance = append(t.distance, round(distance, 1))
+		t.altitude = append(t.altitude, round(altitude, 1))
+		t.velocity = append(t.velocity, round(velocity, 1))
+		t.heartrate = append(t.heartrate, 100+int(velocity*8)+rng.Intn(10))
+		t.moving = append(t.moving, moving)
+	}
+	return t
+}
+
+// streams returns the requested streams of a track in the format used by
+// Strava. Like Strava, the distance stream is always included
+func (t track) streams(keys []string, heartrate bool) []stream {
+	data := map[string]interface{}{
+		sdk.StreamLatLng:         t.latlng,
+		sdk.StreamTime:           t.time,
+		sdk.StreamAltitude:       t.altitude,
+		sdk.StreamVelocitySmooth: t.velocity,
+		sdk.StreamMoving:         t.moving,
+		"distance":               t.distance,
+	}
+	if heartrate {
+		data[sdk.StreamHeartrate] = t.heartrate
+	}
+
+	streams := []stream{}
+	for _, key := range append(keys, "distance") {
+		values, ok := data[key]
+		if !ok {
+			continue
+		}
+		delete(data, key)
+
+		streams = append(streams, stream{
+			Type:         key,
+			Data:         values,
+			SeriesType:   "distance",
+			OriginalSize: len(t.time),
+			Resolution:   "high",
+		})
+	}
+	return streams
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
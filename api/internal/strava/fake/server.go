@@ -0,0 +1,429 @@
+// Package fake serves a fake Strava API for local development. It covers the
+// parts of the API used by this application: OAuth, activity listing, activity
+// streams and rate limits. Synthetic athletes and their activities are
+// generated from a seed, and tokens are stateless so that they keep working
+// across restarts of the server
+package fake
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+const (
+	// lifetime of access tokens. Strava uses 6 hours
+	tokenLifetime = 6 * time.Hour
+
+	defaultPerPage = 30
+	maxPerPage     = 200
+)
+
+type Config struct {
+	// credentials that token requests must present. Any are accepted if empty
+	ClientID     string
+	ClientSecret string
+
+	Seed       int64
+	Athletes   int
+	Activities int
+
+	// rate limits per 15 minutes and per day. The read limits only count GET
+	// requests
+	FifteenMinuteLimit     int
+	DailyLimit             int
+	ReadFifteenMinuteLimit int
+	ReadDailyLimit         int
+
+	// fraction of API requests that fail with the status code, regardless of
+	// the rate limit
+	ErrorRate429 float64
+	ErrorRate500 float64
+}
+
+// Server is a fake Strava API. Authorization and deauthorization are served
+// under /oauth/ and the API under /api/v3/
+type Server struct {
+	config   Config
+	athletes map[int]*athlete
+
+	mu                sync.Mutex
+	rng               *rand.Rand
+	window            time.Time
+	day               time.Time
+	fifteenMinute     int
+	daily             int
+	readFifteenMinute int
+	readDaily         int
+	// athletes who deauthorized the application. Their tokens are refused
+	// until they log in again
+	deauthorized map[int]bool
+}
+
+func NewServer(config Config) *Server {
+	if config.FifteenMinuteLimit == 0 {
+		config.FifteenMinuteLimit = 600
+	}
+	if config.DailyLimit == 0 {
+		config.DailyLimit = 30000
+	}
+	if config.ReadFifteenMinuteLimit == 0 {
+		config.ReadFifteenMinuteLimit = 300
+	}
+	if config.ReadDailyLimit == 0 {
+		config.ReadDailyLimit = 15000
+	}
+
+	athletes := map[int]*athlete{}
+	for _, a := range newAthletes(config.Seed, config.Athletes, config.Activities) {
+		athletes[a.ID] = a
+	}
+
+	return &Server{
+		config:       config,
+		athletes:     athletes,
+		rng:          rand.New(rand.NewSource(config.Seed)),
+		deauthorized: map[int]bool{},
+	}
+}
+
+// Handler routes requests to the fake API
+func (s *Server) Handler() http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	router.GET("/oauth/authorize", s.authorize)
+	router.POST("/oauth/deauthorize", s.limitRate, s.deauthorize)
+
+	api := router.Group("/api/v3", s.limitRate)
+	api.POST("/oauth/token", s.token)
+	api.GET("/activities", s.authenticate, s.listActivities)
+	api.GET("/activities/:id", s.authenticate, s.getActivity)
+	api.GET("/activities/:id/streams", s.authenticate, s.getStreams)
+
+	return router
+}
+
+// ListenAndServe serves the fake API until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("serving fake Strava API with '%d' athletes on %s", len(s.athletes), addr)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) sortedAthletes() []*athlete {
+	athletes := []*athlete{}
+	for _, a := range s.athletes {
+		athletes = append(athletes, a)
+	}
+	sort.Slice(athletes, func(i, j int) bool {
+		return athletes[i].ID < athletes[j].ID
+	})
+	return athletes
+}
+
+// authorize shows the athletes that can log in. Choosing one sends the browser
+// back to the application with an authorization code, like Strava does once an
+// athlete approves the application. Athletes can also log in while declining
+// access to their activities, like unchecking the boxes on the Strava page
+func (s *Server) authorize(c *gin.Context) {
+	redirectURI, err := url.Parse(c.Query("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		c.String(http.StatusBadRequest, "invalid redirect_uri")
+		return
+	}
+	scope := c.Query("scope")
+
+	redirect := func(a *athlete, scope string) string {
+		query := redirectURI.Query()
+		query.Set("code", encodeCredential("code", a.ID, 0, scope))
+		query.Set("scope", scope)
+		if state := c.Query("state"); state != "" {
+			query.Set("state", state)
+		}
+		target := *redirectURI
+		target.RawQuery = query.Encode()
+		return target.String()
+	}
+
+	page := strings.Builder{}
+	page.WriteString("<html><head><title>Fake Strava</title></head><body><h1>Log in as</h1><ul>")
+	for _, a := range s.sortedAthletes() {
+		fmt.Fprintf(&page, `<li><a href="%s">%s %s</a> (%d activities, <a href="%s">decline activity access</a>)</li>`,
+			html.EscapeString(redirect(a, scope)), html.EscapeString(a.Firstname), html.EscapeString(a.Lastname), len(a.activities),
+			html.EscapeString(redirect(a, sdk.ScopeRead)))
+	}
+	page.WriteString("</ul></body></html>")
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.String()))
+}
+
+func (s *Server) token(c *gin.Context) {
+	if s.config.ClientID != "" && (c.PostForm("client_id") != s.config.ClientID || c.PostForm("client_secret") != s.config.ClientSecret) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "invalid client"})
+		return
+	}
+
+	var credential string
+	var kind string
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		credential, kind = c.PostForm("code"), "code"
+	case "refresh_token":
+		credential, kind = c.PostForm("refresh_token"), "refresh"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid grant_type"})
+		return
+	}
+
+	athleteID, _, scope, err := decodeCredential(kind, credential)
+	a, ok := s.athletes[athleteID]
+	if err != nil || !ok || (kind == "refresh" && s.isDeauthorized(athleteID)) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "invalid " + kind})
+		return
+	}
+	if kind == "code" {
+		s.setDeauthorized(athleteID, false)
+	}
+
+	expiresAt := time.Now().Add(tokenLifetime).Unix()
+	response := sdk.AuthorizationCodeResponse{
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+		ExpiresIn:    int(tokenLifetime.Seconds()),
+		AccessToken:  encodeCredential("access", a.ID, expiresAt, scope),
+		RefreshToken: encodeCredential("refresh", a.ID, 0, scope),
+	}
+	response.Athlete.ID = a.ID
+	response.Athlete.Firstname = a.Firstname
+	response.Athlete.Lastname = a.Lastname
+	c.JSON(http.StatusOK, response)
+}
+
+// deauthorize revokes the tokens of an athlete. Tokens are stateless, so the
+// athlete is remembered instead, until they log in again
+func (s *Server) deauthorize(c *gin.Context) {
+	token := c.PostForm("access_token")
+	athleteID, expiresAt, _, err := decodeCredential("access", token)
+	if _, ok := s.athletes[athleteID]; err != nil || !ok || time.Now().Unix() >= expiresAt || s.isDeauthorized(athleteID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "Authorization Error"})
+		return
+	}
+
+	s.setDeauthorized(athleteID, true)
+	c.JSON(http.StatusOK, gin.H{"access_token": token})
+}
+
+func (s *Server) isDeauthorized(athleteID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deauthorized[athleteID]
+}
+
+func (s *Server) setDeauthorized(athleteID int, deauthorized bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if deauthorized {
+		s.deauthorized[athleteID] = true
+	} else {
+		delete(s.deauthorized, athleteID)
+	}
+}
+
+// authenticate checks the access token of a request and records the athlete
+// and scope it was issued for. Every route of the fake API reads activities,
+// which requires one of the activity scopes
+func (s *Server) authenticate(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	athleteID, expiresAt, scope, err := decodeCredential("access", token)
+	if _, ok := s.athletes[athleteID]; err != nil || !ok || time.Now().Unix() >= expiresAt || s.isDeauthorized(athleteID) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authorization Error"})
+		return
+	}
+
+	scopes := strings.Split(scope, ",")
+	if !hasScope(scopes, sdk.ScopeActivityRead) && !hasScope(scopes, sdk.ScopeActivityReadAll) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authorization Error", "errors": []gin.H{
+			{"resource": "AccessToken", "field": "activity:read_permission", "code": "missing"},
+		}})
+		return
+	}
+
+	c.Set("athlete", s.athletes[athleteID])
+	c.Set("readAll", hasScope(scopes, sdk.ScopeActivityReadAll))
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// visible returns the activities of the authenticated athlete that the token
+// may read. Private activities require the activity:read_all scope
+func visible(c *gin.Context) []sdk.Activity {
+	a := c.MustGet("athlete").(*athlete)
+	readAll := c.GetBool("readAll")
+
+	activities := []sdk.Activity{}
+	for _, activity := range a.activities {
+		if activity.Private && !readAll {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+	return activities
+}
+
+func (s *Server) listActivities(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	before, _ := strconv.ParseInt(c.Query("before"), 10, 64)
+	after, _ := strconv.ParseInt(c.Query("after"), 10, 64)
+
+	matching := []sdk.Activity{}
+	for _, activity := range visible(c) {
+		start := activity.StartDate.Unix()
+		if (before != 0 && start >= before) || (after != 0 && start <= after) {
+			continue
+		}
+		matching = append(matching, activity)
+	}
+
+	// newest first, like Strava
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].StartDate.After(matching[j].StartDate)
+	})
+
+	start := (page - 1) * perPage
+	if start > len(matching) {
+		start = len(matching)
+	}
+	end := start + perPage
+	if end > len(matching) {
+		end = len(matching)
+	}
+	c.JSON(http.StatusOK, matching[start:end])
+}
+
+func findActivity(c *gin.Context) (sdk.Activity, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return sdk.Activity{}, false
+	}
+
+	for _, activity := range visible(c) {
+		if activity.ID == id {
+			return activity, true
+		}
+	}
+	return sdk.Activity{}, false
+}
+
+func (s *Server) getActivity(c *gin.Context) {
+	activity, ok := findActivity(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Record Not Found"})
+		return
+	}
+	c.JSON(http.StatusOK, activity)
+}
+
+func (s *Server) getStreams(c *gin.Context) {
+	activity, ok := findActivity(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Record Not Found"})
+		return
+	}
+
+	a := c.MustGet("athlete").(*athlete)
+	keys := strings.Split(c.Query("keys"), ",")
+	c.JSON(http.StatusOK, generateTrack(a, activity).streams(keys, a.heartrate))
+}
+
+// limitRate counts API requests against the rate limits, reports usage in the
+// same headers as Strava, and injects errors
+func (s *Server) limitRate(c *gin.Context) {
+	s.mu.Lock()
+	now := time.Now().UTC()
+	if window := now.Truncate(15 * time.Minute); !window.Equal(s.window) {
+		s.window, s.fifteenMinute, s.readFifteenMinute = window, 0, 0
+	}
+	if day := now.Truncate(24 * time.Hour); !day.Equal(s.day) {
+		s.day, s.daily, s.readDaily = day, 0, 0
+	}
+	s.fifteenMinute++
+	s.daily++
+	if c.Request.Method == http.MethodGet {
+		s.readFifteenMinute++
+		s.readDaily++
+	}
+	fifteenMinute, daily := s.fifteenMinute, s.daily
+	readFifteenMinute, readDaily := s.readFifteenMinute, s.readDaily
+	roll := s.rng.Float64()
+	s.mu.Unlock()
+
+	c.Header("X-RateLimit-Limit", fmt.Sprintf("%d,%d", s.config.FifteenMinuteLimit, s.config.DailyLimit))
+	c.Header("X-RateLimit-Usage", fmt.Sprintf("%d,%d", fifteenMinute, daily))
+	c.Header("X-ReadRateLimit-Limit", fmt.Sprintf("%d,%d", s.config.ReadFifteenMinuteLimit, s.config.ReadDailyLimit))
+	c.Header("X-ReadRateLimit-Usage", fmt.Sprintf("%d,%d", readFifteenMinute, readDaily))
+
+	switch {
+	case fifteenMinute > s.config.FifteenMinuteLimit || daily > s.config.DailyLimit,
+		readFifteenMinute > s.config.ReadFifteenMinuteLimit || readDaily > s.config.ReadDailyLimit:
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "Rate Limit Exceeded"})
+	case roll < s.config.ErrorRate429:
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": "Rate Limit Exceeded"})
+	case roll < s.config.ErrorRate429+s.config.ErrorRate500:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Internal Server Error"})
+	}
+}
+
+// encodeCredential builds an authorization code, access token or refresh token.
+// Everything needed to check a credential is part of it
+func encodeCredential(kind string, athleteID int, expiresAt int64, scope string) string {
+	return fmt.Sprintf("sandbox-%s.%d.%d.%s", kind, athleteID, expiresAt, url.QueryEscape(scope))
+}
+
+func decodeCredential(kind string, credential string) (int, int64, string, error) {
+	parts := strings.SplitN(credential, ".", 4)
+	if len(parts) != 4 || parts[0] != "sandbox-"+kind {
+		return 0, 0, "", fmt.Errorf("not a %s", kind)
+	}
+
+	athleteID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, "", err
+	}
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	scope, err := url.QueryUnescape(parts[3])
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return athleteID, expiresAt, scope, nil
+}
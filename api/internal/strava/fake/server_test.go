@@ -0,0 +1,363 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+func newTestServer(t *testing.T, config Config) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(NewServer(config).Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call makes a request to the fake API and decodes the JSON response into out,
+// if set. It returns the response status
+func call(t *testing.T, method, target, accessToken string, form url.Values, out interface{}) (int, http.Header) {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if form != nil {
+		req, err = http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, target, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, res.Header
+}
+
+// logIn exchanges an authorization code for the athlete and scope
+func logIn(t *testing.T, server *httptest.Server, athleteID int, scope string) sdk.AuthorizationCodeResponse {
+	t.Helper()
+	tokens := sdk.AuthorizationCodeResponse{}
+	status, _ := call(t, http.MethodPost, server.URL+"/api/v3/oauth/token", "", url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {encodeCredential("code", athleteID, 0, scope)},
+	}, &tokens)
+	if status != http.StatusOK {
+		t.Fatalf("token exchange = %d", status)
+	}
+	return tokens
+}
+
+func TestAthletesAreGeneratedFromSeed(t *testing.T) {
+	first := NewServer(Config{Seed: 7, Athletes: 3, Activities: 5})
+	second := NewServer(Config{Seed: 7, Athletes: 3, Activities: 5})
+	other := NewServer(Config{Seed: 8, Athletes: 3, Activities: 5})
+
+	if len(first.athletes) != 3 {
+		t.Fatalf("generated %d athletes, want 3", len(first.athletes))
+	}
+	for id, a := range first.athletes {
+		if len(a.activities) != 5 {
+			t.Errorf("athlete %d has %d activities, want 5", id, len(a.activities))
+		}
+		if !reflect.DeepEqual(a.activities, second.athletes[id].activities) {
+			t.Errorf("activities of athlete %d differ for the same seed", id)
+		}
+		if reflect.DeepEqual(a.activities, other.athletes[id].activities) {
+			t.Errorf("activities of athlete %d are the same for another seed", id)
+		}
+
+		// streams are generated again on every request, and must not change
+		if !reflect.DeepEqual(generateTrack(a, a.activities[0]), generateTrack(a, a.activities[0])) {
+			t.Errorf("track of athlete %d changed between requests", id)
+		}
+	}
+}
+
+func TestAuthorizePage(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 2, Activities: 1})
+
+	res, err := http.Get(server.URL + "/oauth/authorize?" + url.Values{
+		"redirect_uri": {"http://localhost:8080/callback"},
+		"scope":        {"read,activity:read"},
+		"state":        {"abc"},
+	}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(body)
+
+	for _, want := range []string{
+		// the approved scope is sent back along with the state
+		"code=" + url.QueryEscape(encodeCredential("code", 1000, 0, "read,activity:read")),
+		"code=" + url.QueryEscape(encodeCredential("code", 1001, 0, "read,activity:read")),
+		"state=abc",
+		// and the scope without activity access
+		"code=" + url.QueryEscape(encodeCredential("code", 1000, 0, sdk.ScopeRead)),
+	} {
+		if !strings.Contains(html, strings.ReplaceAll(want, "&", "&amp;")) {
+			t.Errorf("page does not link to %s", want)
+		}
+	}
+
+	if status, _ := call(t, http.MethodGet, server.URL+"/oauth/authorize?redirect_uri=", "", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("authorize without a redirect = %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 1, Activities: 1, ClientID: "id", ClientSecret: "secret"})
+	tokenURL := server.URL + "/api/v3/oauth/token"
+	code := encodeCredential("code", 1000, 0, "read,activity:read")
+
+	cases := []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{"authorization code", url.Values{"grant_type": {"authorization_code"}, "code": {code}}, http.StatusOK},
+		{"refresh token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {encodeCredential("refresh", 1000, 0, "read")}}, http.StatusOK},
+		{"wrong secret", url.Values{"grant_type": {"authorization_code"}, "code": {code}, "client_secret": {"guess"}}, http.StatusUnauthorized},
+		{"unknown grant", url.Values{"grant_type": {"password"}}, http.StatusBadRequest},
+		{"refresh token as code", url.Values{"grant_type": {"authorization_code"}, "code": {encodeCredential("refresh", 1000, 0, "read")}}, http.StatusBadRequest},
+		{"unknown athlete", url.Values{"grant_type": {"authorization_code"}, "code": {encodeCredential("code", 1, 0, "read")}}, http.StatusBadRequest},
+		{"malformed code", url.Values{"grant_type": {"authorization_code"}, "code": {"code"}}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.form.Get("client_secret") == "" {
+				c.form.Set("client_secret", "secret")
+			}
+			c.form.Set("client_id", "id")
+
+			tokens := sdk.AuthorizationCodeResponse{}
+			status, _ := call(t, http.MethodPost, tokenURL, "", c.form, &tokens)
+			if status != c.status {
+				t.Fatalf("status = %d, want %d", status, c.status)
+			}
+			if status == http.StatusOK && (tokens.Athlete.ID != 1000 || tokens.ExpiresAt <= time.Now().Unix()) {
+				t.Errorf("tokens = %+v", tokens)
+			}
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 1, Activities: 40})
+	a := NewServer(Config{Seed: 1, Athletes: 1, Activities: 40}).athletes[1000]
+	private := 0
+	for _, activity := range a.activities {
+		if activity.Private {
+			private++
+		}
+	}
+	if private == 0 {
+		t.Fatal("no private activities were generated")
+	}
+
+	cases := []struct {
+		scope      string
+		status     int
+		activities int
+	}{
+		{sdk.ScopeRead, http.StatusUnauthorized, 0},
+		{sdk.ScopeRead + "," + sdk.ScopeActivityRead, http.StatusOK, 40 - private},
+		{sdk.ScopeRead + "," + sdk.ScopeActivityReadAll, http.StatusOK, 40},
+	}
+
+	for _, c := range cases {
+		t.Run(c.scope, func(t *testing.T) {
+			token := logIn(t, server, 1000, c.scope).AccessToken
+			activities := []sdk.Activity{}
+			status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities?per_page=200", token, nil, &activities)
+			if status != c.status || len(activities) != c.activities {
+				t.Errorf("listed %d activities with status %d, want %d with status %d", len(activities), status, c.activities, c.status)
+			}
+		})
+	}
+
+	if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities", "", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("listing without a token = %d, want %d", status, http.StatusUnauthorized)
+	}
+	expired := encodeCredential("access", 1000, time.Now().Add(-time.Minute).Unix(), sdk.ScopeActivityReadAll)
+	if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities", expired, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("listing with an expired token = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestDeauthorize(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 1, Activities: 1})
+	tokens := logIn(t, server, 1000, sdk.ScopeActivityRead)
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}
+
+	if status, _ := call(t, http.MethodPost, server.URL+"/oauth/deauthorize", "", url.Values{"access_token": {tokens.AccessToken}}, nil); status != http.StatusOK {
+		t.Fatalf("deauthorize = %d", status)
+	}
+
+	// every token is refused until the athlete logs in again
+	if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities", tokens.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("listing after deauthorizing = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := call(t, http.MethodPost, server.URL+"/api/v3/oauth/token", "", refresh, nil); status != http.StatusBadRequest {
+		t.Errorf("refreshing after deauthorizing = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, _ := call(t, http.MethodPost, server.URL+"/oauth/deauthorize", "", url.Values{"access_token": {tokens.AccessToken}}, nil); status != http.StatusUnauthorized {
+		t.Errorf("deauthorizing twice = %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	tokens = logIn(t, server, 1000, sdk.ScopeActivityRead)
+	if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities", tokens.AccessToken, nil, nil); status != http.StatusOK {
+		t.Errorf("listing after logging in again = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestListActivities(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 1, Activities: 10})
+	token := logIn(t, server, 1000, sdk.ScopeActivityReadAll).AccessToken
+
+	// activities are two days and an hour apart, starting at firstStartDate
+	startOf := func(index int) int64 {
+		return firstStartDate.Add(time.Duration(index) * 49 * time.Hour).Unix()
+	}
+	cases := []struct {
+		name  string
+		query string
+		// indexes of the activities, newest first
+		want []int
+	}{
+		{"all", "per_page=200", []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{"first page", "per_page=4", []int{9, 8, 7, 6}},
+		{"last page", "per_page=4&page=3", []int{1, 0}},
+		{"past the last page", "per_page=4&page=4", []int{}},
+		{"before", fmt.Sprintf("before=%d", startOf(2)), []int{1, 0}},
+		{"after", fmt.Sprintf("after=%d", startOf(7)), []int{9, 8}},
+		{"between", fmt.Sprintf("after=%d&before=%d", startOf(3), startOf(6)), []int{5, 4}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			activities := []sdk.Activity{}
+			if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities?"+c.query, token, nil, &activities); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+
+			got := []int{}
+			for _, activity := range activities {
+				got = append(got, int(activity.ID-100000000))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("listed activities %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStreams(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 3, Activities: 1})
+	keys := strings.Join([]string{sdk.StreamLatLng, sdk.StreamTime, sdk.StreamHeartrate}, ",")
+
+	cases := []struct {
+		athleteID int
+		want      []string
+	}{
+		{1000, []string{sdk.StreamLatLng, sdk.StreamTime, sdk.StreamHeartrate, "distance"}},
+		// the third athlete records without a heart rate monitor
+		{1002, []string{sdk.StreamLatLng, sdk.StreamTime, "distance"}},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.athleteID), func(t *testing.T) {
+			token := logIn(t, server, c.athleteID, sdk.ScopeActivityReadAll).AccessToken
+			target := fmt.Sprintf("%s/api/v3/activities/%d/streams?keys=%s", server.URL, int64(c.athleteID)*100000, keys)
+
+			streams := []struct {
+				Type string            `json:"type"`
+				Data []json.RawMessage `json:"data"`
+			}{}
+			if status, _ := call(t, http.MethodGet, target, token, nil, &streams); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+
+			types := []string{}
+			for _, s := range streams {
+				types = append(types, s.Type)
+				if len(s.Data) != len(streams[0].Data) {
+					t.Errorf("stream %s has %d points, want %d", s.Type, len(s.Data), len(streams[0].Data))
+				}
+			}
+			if !reflect.DeepEqual(types, c.want) {
+				t.Errorf("streams = %v, want %v", types, c.want)
+			}
+		})
+	}
+
+	token := logIn(t, server, 1000, sdk.ScopeActivityReadAll).AccessToken
+	// activities of other athletes are not found
+	if status, _ := call(t, http.MethodGet, server.URL+"/api/v3/activities/100100000/streams", token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("streams of another athlete = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	server := newTestServer(t, Config{Seed: 1, Athletes: 1, Activities: 1, FifteenMinuteLimit: 5, ReadFifteenMinuteLimit: 3})
+	tokens := logIn(t, server, 1000, sdk.ScopeActivityRead)
+
+	// the token exchange was the first request, and not a read
+	cases := []struct {
+		status             int
+		usage, readUsage   string
+		method, targetPath string
+	}{
+		{http.StatusOK, "2,2", "1,1", http.MethodGet, "/api/v3/activities"},
+		{http.StatusOK, "3,3", "2,2", http.MethodGet, "/api/v3/activities"},
+		{http.StatusOK, "4,4", "3,3", http.MethodGet, "/api/v3/activities"},
+		{http.StatusTooManyRequests, "5,5", "4,4", http.MethodGet, "/api/v3/activities"},
+		{http.StatusTooManyRequests, "6,6", "4,4", http.MethodPost, "/api/v3/oauth/token"},
+	}
+
+	for i, c := range cases {
+		form := url.Values(nil)
+		if c.method == http.MethodPost {
+			form = url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}}
+		}
+		status, header := call(t, c.method, server.URL+c.targetPath, tokens.AccessToken, form, nil)
+		if status != c.status {
+			t.Errorf("request %d = %d, want %d", i+1, status, c.status)
+		}
+		if header.Get("X-RateLimit-Usage") != c.usage || header.Get("X-ReadRateLimit-Usage") != c.readUsage {
+			t.Errorf("request %d used %s and %s, want %s and %s", i+1,
+				header.Get("X-RateLimit-Usage"), header.Get("X-ReadRateLimit-Usage"), c.usage, c.readUsage)
+		}
+		if header.Get("X-RateLimit-Limit") != "5,30000" || header.Get("X-ReadRateLimit-Limit") != "3,15000" {
+			t.Errorf("request %d has limits %s and %s", i+1, header.Get("X-RateLimit-Limit"), header.Get("X-ReadRateLimit-Limit"))
+		}
+	}
+}
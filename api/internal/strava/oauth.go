@@ -2,43 +2,85 @@ package strava
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/encryption"
 	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
 )
 
+// associated data of encrypted tokens, which keeps an access token from being
+// read as a refresh token or the other way around
+const (
+	accessTokenAD  = "StravaToken.access_token"
+	refreshTokenAD = "StravaToken.refresh_token"
+)
+
 type oauthDB struct {
-	db *database.DB
+	db      *database.DB
+	keyring *encryption.Keyring
 }
 
 type OAuthService struct {
 	stravaSDK sdk.StravaSDK
 	db        oauthDB
+	// signs login states
+	stateKey []byte
+	// the states that were consumed
+	states stateRecorder
 }
 
-func NewOAuthService(stravaSDK sdk.StravaSDK, db *database.DB) *OAuthService {
+// NewOAuthService creates the service that logs athletes in. Login states are
+// signed with stateSecret, which must be shared by every instance of the
+// backend. A random secret is used if it is empty. Tokens are encrypted with
+// keyring
+func NewOAuthService(stravaSDK sdk.StravaSDK, db *database.DB, stateSecret string, keyring *encryption.Keyring) (*OAuthService, error) {
+	stateKey := []byte(stateSecret)
+	if stateSecret == "" {
+		log.Printf("no login state secret configured, logins only work on this instance until it restarts")
+		stateKey = make([]byte, 32)
+		if _, err := rand.Read(stateKey); err != nil {
+			return nil, fmt.Errorf("generating login state secret: %w", err)
+		}
+	}
+
+	store := oauthDB{
+		db:      db,
+		keyring: keyring,
+	}
 	return &OAuthService{
 		stravaSDK: stravaSDK,
-		db: oauthDB{
-			db: db,
-		},
-	}
+		db:        store,
+		stateKey:  stateKey,
+		states:    store,
+	}, nil
 }
 
-func (o OAuthService) ExchangeAuthToken(ctx context.Context, request *sdk.TokenExchangeCode) (*sdk.AthleteToken, error) {
+// ExchangeAuthToken trades the code of a login for tokens, and records the
+// scopes that the athlete granted. It also returns true if the scopes differ
+// from the ones granted before
+func (o OAuthService) ExchangeAuthToken(ctx context.Context, request *sdk.TokenExchangeCode, scopes Scopes) (*sdk.AthleteToken, bool, error) {
 
-	authCodeResponse, err := o.stravaSDK.ExchangeAuthToken(request)
+	authCodeResponse, err := o.stravaSDK.ExchangeAuthToken(ctx, request)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	err = o.db.persistTokens(ctx, authCodeResponse.Athlete.ID, authCodeResponse.Tokens())
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	scopesChanged, err := o.db.persistScopes(ctx, authCodeResponse.Athlete.ID, scopes)
+	if err != nil {
+		return nil, false, err
 	}
 
 	response := &sdk.AthleteToken{
@@ -46,7 +88,7 @@ func (o OAuthService) ExchangeAuthToken(ctx context.Context, request *sdk.TokenE
 		Athlete:     authCodeResponse.Athlete.ID,
 	}
 
-	return response, nil
+	return response, scopesChanged, nil
 }
 
 func (o OAuthService) RefreshAuthToken(ctx context.Context, athleteID int) (*sdk.AthleteToken, error) {
@@ -55,7 +97,7 @@ func (o OAuthService) RefreshAuthToken(ctx context.Context, athleteID int) (*sdk
 		return nil, err
 	}
 
-	newTokens, err := o.stravaSDK.RefreshAuthToken(oldTokens.RefreshToken)
+	newTokens, err := o.stravaSDK.RefreshAuthToken(ctx, oldTokens.RefreshToken)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +116,92 @@ func (o OAuthService) RefreshAuthToken(ctx context.Context, athleteID int) (*sdk
 	return response, nil
 }
 
+// GetAuthTokenForAthlete returns the latest access token of an athlete
+func (o OAuthService) GetAuthTokenForAthlete(ctx context.Context, athleteID int) (string, error) {
+	tokens, err := o.db.getTokensForAthlete(ctx, athleteID)
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// RevokeTokensForAthlete deauthorizes the application at Strava on behalf of
+// an athlete. Tokens are kept, so that it can be retried. Athletes without
+// tokens, or whose tokens were already revoked, are skipped
+func (o OAuthService) RevokeTokensForAthlete(ctx context.Context, athleteID int) error {
+	tokens, err := o.db.getTokensForAthlete(ctx, athleteID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	accessToken := tokens.AccessToken
+	if time.Now().Unix() >= tokens.ExpiresAt {
+		refreshed, err := o.stravaSDK.RefreshAuthToken(ctx, tokens.RefreshToken)
+		if errors.Is(err, sdk.ErrorBadRequest) || errors.Is(err, sdk.ErrorUnauthorized) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		accessToken = refreshed.AccessToken
+	}
+
+	err = o.stravaSDK.Deauthorize(ctx, accessToken)
+	if errors.Is(err, sdk.ErrorUnauthorized) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("deauthorized the application for athlete '%d'", athleteID)
+	return nil
+}
+
+// ConfirmDeauthorized reports whether an athlete revoked access to the
+// application, which is the case once Strava refuses to refresh their tokens.
+// Athletes without tokens cannot be checked and are reported as authorized. A
+// refresh that succeeds is kept, since Strava may retire the old refresh token
+func (o OAuthService) ConfirmDeauthorized(ctx context.Context, athleteID int) (bool, error) {
+	tokens, err := o.db.getTokensForAthlete(ctx, athleteID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	refreshed, err := o.stravaSDK.RefreshAuthToken(ctx, tokens.RefreshToken)
+	if errors.Is(err, sdk.ErrorBadRequest) || errors.Is(err, sdk.ErrorUnauthorized) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, o.db.persistTokens(ctx, athleteID, refreshed)
+}
+
+// DeleteTokensForAthlete forgets every token of an athlete, and the scopes
+// they granted, which stops their activities from being synced
+func (o OAuthService) DeleteTokensForAthlete(ctx context.Context, athleteID int) error {
+	return o.db.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, deleteTokensForAthleteSQL, athleteID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, deleteScopesForAthleteSQL, athleteID)
+		return err
+	})
+}
+
+// ReencryptTokens encrypts stored tokens with the primary key, i.e., after a
+// key was rotated or encryption was enabled
+func (o OAuthService) ReencryptTokens(ctx context.Context) (int, error) {
+	return o.db.reencryptTokens(ctx)
+}
+
 func (o OAuthService) GetAllCurrentAthleteAuthTokens(ctx context.Context) (map[int]sdk.StravaTokens, error) {
 	return o.db.getAllCurrentAthleteAuthTokens(ctx)
 }
@@ -94,6 +222,9 @@ func (d oauthDB) getAllCurrentAthleteAuthTokens(ctx context.Context) (map[int]sd
 			if err := rows.Scan(&id, &tokens.AccessToken, &expiresAt, &tokens.RefreshToken); err != nil {
 				return err
 			}
+			if err := d.decryptTokens(&tokens); err != nil {
+				return fmt.Errorf("decrypting tokens for athlete: %w, %d", err, id)
+			}
 
 			tokens.ExpiresAt = expiresAt.UTC().Unix()
 			tokenMap[id] = tokens
@@ -105,15 +236,55 @@ func (d oauthDB) getAllCurrentAthleteAuthTokens(ctx context.Context) (map[int]sd
 	return tokenMap, err
 }
 
+// hashToken identifies an access token without storing it. Encrypted tokens
+// differ every time they are written, so they cannot be looked up directly
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (d oauthDB) encryptTokens(tokens *sdk.StravaTokens) (string, string, error) {
+	accessToken, err := d.keyring.EncryptString(tokens.AccessToken, accessTokenAD)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := d.keyring.EncryptString(tokens.RefreshToken, refreshTokenAD)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// decryptTokens decrypts tokens in place
+func (d oauthDB) decryptTokens(tokens *sdk.StravaTokens) error {
+	accessToken, err := d.keyring.DecryptString(tokens.AccessToken, accessTokenAD)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := d.keyring.DecryptString(tokens.RefreshToken, refreshTokenAD)
+	if err != nil {
+		return err
+	}
+	tokens.AccessToken = accessToken
+	tokens.RefreshToken = refreshToken
+	return nil
+}
+
 func (d oauthDB) persistTokens(ctx context.Context, athleteID int, tokens *sdk.StravaTokens) error {
+	accessToken, refreshToken, err := d.encryptTokens(tokens)
+	if err != nil {
+		return fmt.Errorf("encrypting tokens for athlete: %w, %d", err, athleteID)
+	}
+
 	return d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
 		row := tx.QueryRow(
 			ctx,
 			insertTokensSQL,
 			athleteID,
-			tokens.AccessToken,
+			accessToken,
 			time.Unix(tokens.ExpiresAt, 0),
-			tokens.RefreshToken)
+			refreshToken,
+			hashToken(tokens.AccessToken))
 
 		var athleteID int
 		if err := row.Scan(&athleteID); err != nil {
@@ -140,15 +311,76 @@ func (d oauthDB) getTokensForAthlete(ctx context.Context, athleteID int) (*sdk.S
 
 		return nil
 	})
+	if err != nil {
+		return &tokens, err
+	}
+	if err := d.decryptTokens(&tokens); err != nil {
+		return &tokens, fmt.Errorf("decrypting tokens for athlete: %w, %d", err, athleteID)
+	}
 	tokens.ExpiresAt = expiresAt.UTC().Unix()
-	return &tokens, err
+	return &tokens, nil
+}
+
+// reencryptTokens encrypts every token that is not encrypted with the primary
+// key again. Tokens are updated one at a time, so a failure part way through
+// keeps the tokens that were already done
+func (d oauthDB) reencryptTokens(ctx context.Context) (int, error) {
+	type storedTokens struct {
+		id     int
+		tokens sdk.StravaTokens
+	}
+
+	stale := []storedTokens{}
+	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, getAllTokensSQL)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			stored := storedTokens{}
+			if err := rows.Scan(&stored.id, &stored.tokens.AccessToken, &stored.tokens.RefreshToken); err != nil {
+				return err
+			}
+			if d.keyring.StringNeedsRotation(stored.tokens.AccessToken) || d.keyring.StringNeedsRotation(stored.tokens.RefreshToken) {
+				stale = append(stale, stored)
+			}
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	reencrypted := 0
+	for _, stored := range stale {
+		if err := d.decryptTokens(&stored.tokens); err != nil {
+			return reencrypted, fmt.Errorf("decrypting token: %w, %d", err, stored.id)
+		}
+		accessToken, refreshToken, err := d.encryptTokens(&stored.tokens)
+		if err != nil {
+			return reencrypted, err
+		}
+
+		err = d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, updateTokensSQL, stored.id, accessToken, refreshToken)
+			return err
+		})
+		if err != nil {
+			return reencrypted, err
+		}
+		reencrypted++
+	}
+	return reencrypted, nil
 }
 
 func (d oauthDB) getAthleteForAuthToken(ctx context.Context, authToken string) (int, error) {
 	var athleteID int
 
 	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
-		row := tx.QueryRow(ctx, getAthleteForTokenSQL, authToken)
+		row := tx.QueryRow(ctx, getAthleteForTokenSQL, hashToken(authToken))
 		if err := row.Scan(&athleteID); err != nil {
 			return fmt.Errorf("fetching athlete for authToken: %w", err)
 		}
@@ -158,13 +390,65 @@ func (d oauthDB) getAthleteForAuthToken(ctx context.Context, authToken string) (
 	return athleteID, err
 }
 
+// persistScopes returns true if the scopes were not recorded before
+func (d oauthDB) persistScopes(ctx context.Context, athleteID int, scopes Scopes) (bool, error) {
+	changed := false
+	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, upsertScopesSQL, athleteID, scopes.String())
+		changed = tag.RowsAffected() > 0
+		return err
+	})
+	return changed, err
+}
+
+// getScopesForAthlete returns nil if the athlete logged in before scopes were
+// recorded
+func (d oauthDB) getScopesForAthlete(ctx context.Context, athleteID int) (*string, error) {
+	var scope *string
+	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, getScopesSQL, athleteID)
+		s := ""
+		if err := row.Scan(&s); err != nil {
+			if err == pgx.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("fetching scopes for athlete: %w, %d", err, athleteID)
+		}
+		scope = &s
+		return nil
+	})
+	return scope, err
+}
+
+// useState records that a login state was consumed, returning false if it
+// already was
+func (d oauthDB) useState(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	used := false
+	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, insertUsedStateSQL, nonce, expiresAt)
+		used = tag.RowsAffected() == 1
+		return err
+	})
+	return used, err
+}
+
+func (d oauthDB) deleteExpiredStates(ctx context.Context) (int, error) {
+	deleted := 0
+	err := d.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, deleteExpiredStatesSQL, time.Now().UTC())
+		deleted = int(tag.RowsAffected())
+		return err
+	})
+	return deleted, err
+}
+
 var insertTokensSQL = `
 INSERT INTO
 	StravaToken
-	(athlete_id, access_token, access_token_expires_at, refresh_token)
+	(athlete_id, access_token, access_token_expires_at, refresh_token, access_token_hash)
 VALUES
-	($1, $2, $3, $4)
-ON CONFLICT (access_token) 
+	($1, $2, $3, $4, $5)
+ON CONFLICT (access_token_hash)
 	DO UPDATE
 		SET access_token = $2
 RETURNING
@@ -199,5 +483,76 @@ SELECT
 FROM
 	StravaToken
 WHERE
-	access_token = $1
+	access_token_hash = $1
+`
+
+var getAllTokensSQL = `
+SELECT
+	id, access_token, refresh_token
+FROM
+	StravaToken
+`
+
+var updateTokensSQL = `
+UPDATE
+	StravaToken
+SET
+	access_token = $2, refresh_token = $3
+WHERE
+	id = $1
+`
+
+var deleteTokensForAthleteSQL = `
+DELETE FROM
+	StravaToken
+WHERE
+	athlete_id = $1
+`
+
+var upsertScopesSQL = `
+INSERT INTO
+	AthleteScope
+	(athlete_id, scopes)
+VALUES
+	($1, $2)
+ON CONFLICT (athlete_id)
+	DO UPDATE SET
+		scopes=EXCLUDED.scopes,
+		updated_at=NOW()
+	WHERE
+		AthleteScope.scopes <> EXCLUDED.scopes
+`
+
+var getScopesSQL = `
+SELECT
+	scopes
+FROM
+	AthleteScope
+WHERE
+	athlete_id = $1
+`
+
+var deleteScopesForAthleteSQL = `
+DELETE FROM
+	AthleteScope
+WHERE
+	athlete_id = $1
+`
+
+var insertUsedStateSQL = `
+INSERT INTO
+	UsedOAuthState
+	(nonce, expires_at)
+VALUES
+	($1, $2)
+ON CONFLICT
+	(nonce)
+	DO NOTHING
+`
+
+var deleteExpiredStatesSQL = `
+DELETE FROM
+	UsedOAuthState
+WHERE
+	expires_at <= $1
 `
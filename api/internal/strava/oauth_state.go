@@ -0,0 +1,96 @@
+package strava
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OAuthStateTTL is how long a login can take between leaving for Strava and
+// being sent back
+const OAuthStateTTL = 10 * time.Minute
+
+var (
+	ErrorInvalidState = errors.New("login state is invalid or expired")
+	ErrorStateUsed    = errors.New("login state was already used")
+)
+
+// stateRecorder remembers consumed login states until they expire
+type stateRecorder interface {
+	// useState records that a login state was consumed, returning false if
+	// it already was
+	useState(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// NewState issues the value sent to Strava as the state of an authorization
+// request. Strava echoes it back on the redirect, where ConsumeState checks
+// it. States are signed, so they can be checked without storing them until they
+// are used
+func (o OAuthService) NewState() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating login state: %w", err)
+	}
+
+	payload := fmt.Sprintf(
+		"%s.%d",
+		base64.RawURLEncoding.EncodeToString(nonce),
+		time.Now().Add(OAuthStateTTL).Unix())
+	return payload + "." + o.signState(payload), nil
+}
+
+func (o OAuthService) signState(payload string) string {
+	mac := hmac.New(sha256.New, o.stateKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ConsumeState checks that a state was issued by NewState and has not expired.
+// A state can only be consumed once, so a redirect from Strava cannot be
+// replayed
+func (o OAuthService) ConsumeState(ctx context.Context, state string) error {
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return ErrorInvalidState
+	}
+
+	payload, signature := state[:i], state[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(o.signState(payload))) {
+		return ErrorInvalidState
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return ErrorInvalidState
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrorInvalidState
+	}
+	expiresAt := time.Unix(expires, 0).UTC()
+	if !time.Now().Before(expiresAt) {
+		return ErrorInvalidState
+	}
+
+	used, err := o.states.useState(ctx, parts[0], expiresAt)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrorStateUsed
+	}
+	return nil
+}
+
+// DeleteExpiredStates forgets used states that could no longer be consumed
+// anyway
+func (o OAuthService) DeleteExpiredStates(ctx context.Context) (int, error) {
+	return o.db.deleteExpiredStates(ctx)
+}
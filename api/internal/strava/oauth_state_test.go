@@ -0,0 +1,103 @@
+package strava
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryStates stands in for the UsedOAuthState table
+type memoryStates map[string]time.Time
+
+func (m memoryStates) useState(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	if _, ok := m[nonce]; ok {
+		return false, nil
+	}
+	m[nonce] = expiresAt
+	return true, nil
+}
+
+func newStateService(secret string) OAuthService {
+	return OAuthService{stateKey: []byte(secret), states: memoryStates{}}
+}
+
+func TestConsumeState(t *testing.T) {
+	o := newStateService("secret")
+	ctx := context.Background()
+
+	state, err := o.NewState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(payload string) string {
+		return payload + "." + o.signState(payload)
+	}
+	payload := state[:strings.LastIndex(state, ".")]
+	nonce := strings.Split(payload, ".")[0]
+	expired := signed(fmt.Sprintf("%s.%d", nonce, time.Now().Add(-time.Second).Unix()))
+	tampered := []byte(state)
+	tampered[0] ^= 0x01
+
+	cases := []struct {
+		name  string
+		state string
+		err   error
+	}{
+		{"empty", "", ErrorInvalidState},
+		{"no signature", payload, ErrorInvalidState},
+		{"tampered nonce", string(tampered), ErrorInvalidState},
+		{"tampered signature", payload + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 32)), ErrorInvalidState},
+		{"extended expiry", fmt.Sprintf("%s.%d.%s", nonce, time.Now().Add(time.Hour).Unix(), state[strings.LastIndex(state, ".")+1:]), ErrorInvalidState},
+		{"signed by another instance", payload + "." + newStateService("other").signState(payload), ErrorInvalidState},
+		{"expired", expired, ErrorInvalidState},
+		{"malformed expiry", signed(nonce + ".soon"), ErrorInvalidState},
+		{"missing expiry", signed(nonce), ErrorInvalidState},
+	}
+	for _, c := range cases {
+		if err := o.ConsumeState(ctx, c.state); !errors.Is(err, c.err) {
+			t.Errorf("%s: ConsumeState() = %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	// a state is valid once, so a redirect from Strava cannot be replayed
+	if err := o.ConsumeState(ctx, state); err != nil {
+		t.Fatalf("ConsumeState() = %v", err)
+	}
+	if err := o.ConsumeState(ctx, state); !errors.Is(err, ErrorStateUsed) {
+		t.Errorf("replayed ConsumeState() = %v, want %v", err, ErrorStateUsed)
+	}
+
+	// used states are remembered until they expire
+	expiresAt := o.states.(memoryStates)[nonce]
+	if remaining := time.Until(expiresAt); remaining <= 0 || remaining > OAuthStateTTL {
+		t.Errorf("state is remembered for %s, want at most %s", remaining, OAuthStateTTL)
+	}
+}
+
+func TestNewStateIsUnique(t *testing.T) {
+	o := newStateService("secret")
+	first, err := o.NewState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := o.NewState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("NewState() issued the same state twice")
+	}
+
+	// each state is consumed on its own
+	ctx := context.Background()
+	if err := o.ConsumeState(ctx, first); err != nil {
+		t.Errorf("ConsumeState(first) = %v", err)
+	}
+	if err := o.ConsumeState(ctx, second); err != nil {
+		t.Errorf("ConsumeState(second) = %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package strava
+
+import (
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+// RateLimitService reports how much of the Strava rate limits is used
+type RateLimitService struct {
+	stravaSDK sdk.StravaSDK
+}
+
+func NewRateLimitService(stravaSDK sdk.StravaSDK) *RateLimitService {
+	return &RateLimitService{
+		stravaSDK: stravaSDK,
+	}
+}
+
+// Usage returns the state of the rate limit budget of this instance of the
+// application, along with the requests made for an athlete
+func (rs RateLimitService) Usage(athleteID int) sdk.BudgetUsage {
+	return rs.stravaSDK.Usage(athleteID)
+}
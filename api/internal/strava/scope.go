@@ -0,0 +1,74 @@
+package strava
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+var (
+	ErrorMissingScope = errors.New("athlete did not allow their activities to be read")
+)
+
+// scopes requested when logging in. Private activities are only requested when
+// an athlete asks for them, i.e., to use the 'everything' visibility policy
+var (
+	LoginScopes        = Scopes{sdk.ScopeRead, sdk.ScopeActivityRead}
+	LoginScopesReadAll = Scopes{sdk.ScopeRead, sdk.ScopeActivityReadAll}
+)
+
+// Scopes are the OAuth scopes that an athlete granted the application
+type Scopes []string
+
+// ParseScopes reads the comma separated scopes that Strava reports after login
+func ParseScopes(scope string) Scopes {
+	scopes := Scopes{}
+	for _, s := range strings.Split(scope, ",") {
+		if s = strings.TrimSpace(s); s != "" && !scopes.Has(s) {
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func (s Scopes) Has(scope string) bool {
+	for _, granted := range s {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadActivities reports whether activities can be synced at all
+func (s Scopes) CanReadActivities() bool {
+	return s.Has(sdk.ScopeActivityRead) || s.Has(sdk.ScopeActivityReadAll)
+}
+
+// CanReadPrivateActivities reports whether activities that only the athlete
+// can see are listed
+func (s Scopes) CanReadPrivateActivities() bool {
+	return s.Has(sdk.ScopeActivityReadAll)
+}
+
+func (s Scopes) String() string {
+	return strings.Join(s, ",")
+}
+
+// GetScopesForAthlete returns the scopes an athlete granted when they last
+// logged in. Athletes who logged in before scopes were recorded are assumed to
+// have granted LoginScopes
+func (o OAuthService) GetScopesForAthlete(ctx context.Context, athleteID int) (Scopes, error) {
+	scope, err := o.db.getScopesForAthlete(ctx, athleteID)
+	if err != nil {
+		return nil, err
+	}
+	if scope == nil {
+		return LoginScopes, nil
+	}
+	return ParseScopes(*scope), nil
+}
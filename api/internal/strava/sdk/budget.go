@@ -0,0 +1,402 @@
+package sdk
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Priority decides which requests get the rate limit budget first when it runs low
+type Priority int
+
+const (
+	// scheduled work, i.e., hourly syncs and webhook events
+	PriorityBackground Priority = iota
+	// work that an athlete is waiting on, i.e., the first sync after logging in
+	PriorityInteractive
+)
+
+func (p Priority) String() string {
+	if p == PriorityInteractive {
+		return "interactive"
+	}
+	return "background"
+}
+
+const (
+	// longest time a request waits for budget before failing with
+	// ErrorTooManyRequests. Background work is retried by the next sync, so it
+	// gives up quickly rather than hold up the jobs that are running it
+	maxBackgroundBudgetWait  = time.Minute
+	maxInteractiveBudgetWait = 15 * time.Minute
+)
+
+type contextKey int
+
+const (
+	priorityContextKey contextKey = iota
+	athleteContextKey
+)
+
+// WithPriority sets the priority of the Strava requests made with a context.
+// Requests are background work by default
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey, priority)
+}
+
+// WithAthlete records the athlete that the Strava requests made with a context
+// are made for, which shares the budget fairly between athletes
+func WithAthlete(ctx context.Context, athleteID int) context.Context {
+	return context.WithValue(ctx, athleteContextKey, athleteID)
+}
+
+func priorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityContextKey).(Priority); ok {
+		return p
+	}
+	return PriorityBackground
+}
+
+func athleteFromContext(ctx context.Context) int {
+	athleteID, _ := ctx.Value(athleteContextKey).(int)
+	return athleteID
+}
+
+// RateLimits are the number of requests Strava allows per 15 minutes and per
+// day. The read limits only apply to GET requests, which also count towards
+// the overall limits
+type RateLimits struct {
+	FifteenMinute     int
+	Daily             int
+	ReadFifteenMinute int
+	ReadDaily         int
+}
+
+// DefaultRateLimits are the limits Strava gives new applications
+var DefaultRateLimits = RateLimits{
+	FifteenMinute:     200,
+	Daily:             2000,
+	ReadFifteenMinute: 100,
+	ReadDaily:         1000,
+}
+
+// bucket holds the tokens of one Strava rate limit window. Strava resets its
+// windows at fixed times, so a bucket is refilled completely at the end of its
+// window rather than at a steady rate
+type bucket struct {
+	name    string
+	length  time.Duration
+	read    bool
+	limit   int
+	used    int
+	resetAt time.Time
+}
+
+func (b *bucket) refill(now time.Time) {
+	if !now.Before(b.resetAt) {
+		b.used = 0
+		b.resetAt = now.Truncate(b.length).Add(b.length)
+	}
+}
+
+// available returns the number of tokens left to a priority. Background work
+// leaves a share of every bucket to interactive work
+func (b *bucket) available(priority Priority, reserve float64) int {
+	left := b.limit - b.used
+	if priority == PriorityBackground {
+		left -= int(math.Ceil(float64(b.limit) * reserve))
+	}
+	return left
+}
+
+type budgetWaiter struct {
+	priority  Priority
+	athleteID int
+	read      bool
+	seq       int64
+	granted   chan struct{}
+}
+
+// Budget schedules requests against the Strava rate limits. Every request takes
+// a token from the overall buckets, and GET requests also take one from the
+// read buckets. When tokens run out, requests wait and are granted in order of
+// priority, then to the athlete that used the least of the current 15 minute
+// window, so one athlete with a long history cannot starve the others
+type Budget struct {
+	mu      sync.Mutex
+	reserve float64
+	buckets []*bucket
+
+	// requests per athlete in the current 15 minute window
+	athleteUsage   map[int]int
+	athleteResetAt time.Time
+
+	waiters []*budgetWaiter
+	seq     int64
+	timer   *time.Timer
+}
+
+// NewBudget creates a budget from the initial rate limits. The limits are
+// updated from the headers of every response. interactiveReserve is the
+// fraction of every bucket that background work cannot use
+func NewBudget(limits RateLimits, interactiveReserve float64) *Budget {
+	return &Budget{
+		reserve: interactiveReserve,
+		buckets: []*bucket{
+			{name: "overall_15m", length: 15 * time.Minute, limit: limits.FifteenMinute},
+			{name: "overall_daily", length: 24 * time.Hour, limit: limits.Daily},
+			{name: "read_15m", length: 15 * time.Minute, read: true, limit: limits.ReadFifteenMinute},
+			{name: "read_daily", length: 24 * time.Hour, read: true, limit: limits.ReadDaily},
+		},
+		athleteUsage: map[int]int{},
+	}
+}
+
+func (b *Budget) refill(now time.Time) {
+	for _, bk := range b.buckets {
+		bk.refill(now)
+	}
+	if !now.Before(b.athleteResetAt) {
+		b.athleteUsage = map[int]int{}
+		b.athleteResetAt = now.Truncate(15 * time.Minute).Add(15 * time.Minute)
+	}
+}
+
+// check reports whether a request can take its tokens now. If it cannot, it
+// also returns the earliest time that enough tokens could be refilled
+func (b *Budget) check(priority Priority, read bool) (bool, time.Time) {
+	ok := true
+	retryAt := time.Time{}
+	for _, bk := range b.buckets {
+		if bk.read && !read {
+			continue
+		}
+		if bk.available(priority, b.reserve) <= 0 {
+			ok = false
+			if bk.resetAt.After(retryAt) {
+				retryAt = bk.resetAt
+			}
+		}
+	}
+	return ok, retryAt
+}
+
+func (b *Budget) take(athleteID int, read bool) {
+	for _, bk := range b.buckets {
+		if !bk.read || read {
+			bk.used++
+		}
+	}
+	b.athleteUsage[athleteID]++
+}
+
+// Acquire waits until a request can be made. The priority and athlete of the
+// request are read from the context. It fails with ErrorTooManyRequests if the
+// budget will not allow the request soon enough
+func (b *Budget) Acquire(ctx context.Context, read bool) error {
+	priority := priorityFromContext(ctx)
+	athleteID := athleteFromContext(ctx)
+	maxWait := maxBackgroundBudgetWait
+	if priority == PriorityInteractive {
+		maxWait = maxInteractiveBudgetWait
+	}
+
+	b.mu.Lock()
+	now := time.Now().UTC()
+	b.refill(now)
+
+	ok, retryAt := b.check(priority, read)
+	if ok && len(b.waiters) == 0 {
+		b.take(athleteID, read)
+		b.mu.Unlock()
+		return nil
+	}
+	if !ok && retryAt.Sub(now) > maxWait {
+		b.mu.Unlock()
+		return tooManyRequestsUntil(retryAt)
+	}
+
+	b.seq++
+	w := &budgetWaiter{
+		priority:  priority,
+		athleteID: athleteID,
+		read:      read,
+		seq:       b.seq,
+		granted:   make(chan struct{}),
+	}
+	b.waiters = append(b.waiters, w)
+	b.dispatch()
+	b.mu.Unlock()
+
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+		if b.cancel(w) {
+			return ctx.Err()
+		}
+		return nil
+	case <-timeout.C:
+		if b.cancel(w) {
+			return tooManyRequestsUntil(retryAt)
+		}
+		return nil
+	}
+}
+
+// cancel stops a waiter, returning false if it was granted in the meantime
+func (b *Budget) cancel(w *budgetWaiter) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, other := range b.waiters {
+		if other == w {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch grants tokens to waiting requests, in order of priority and then
+// athlete usage. It must be called with the lock held
+func (b *Budget) dispatch() {
+	b.refill(time.Now().UTC())
+
+	sort.SliceStable(b.waiters, func(i, j int) bool {
+		wi, wj := b.waiters[i], b.waiters[j]
+		if wi.priority != wj.priority {
+			return wi.priority > wj.priority
+		}
+		if ui, uj := b.athleteUsage[wi.athleteID], b.athleteUsage[wj.athleteID]; ui != uj {
+			return ui < uj
+		}
+		return wi.seq < wj.seq
+	})
+
+	remaining := []*budgetWaiter{}
+	retryAt := time.Time{}
+	for _, w := range b.waiters {
+		ok, at := b.check(w.priority, w.read)
+		if !ok {
+			remaining = append(remaining, w)
+			if retryAt.IsZero() || at.Before(retryAt) {
+				retryAt = at
+			}
+			continue
+		}
+
+		b.take(w.athleteID, w.read)
+		close(w.granted)
+	}
+	b.waiters = remaining
+
+	// try again once the next bucket is refilled
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.waiters) > 0 && !retryAt.IsZero() {
+		b.timer = time.AfterFunc(time.Until(retryAt), func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.dispatch()
+		})
+	}
+}
+
+// Observe updates the budget with the limits and usage that Strava reported
+// in a response. Strava is trusted over local counts unless requests that it
+// has not seen yet are still in flight
+func (b *Budget) Observe(limits, usage *rateLimit, readLimits, readUsage *rateLimit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now().UTC())
+	for _, bk := range b.buckets {
+		l, u := limits, usage
+		if bk.read {
+			l, u = readLimits, readUsage
+		}
+		if l == nil || u == nil {
+			continue
+		}
+
+		limit, used := l.fifteenMinute, u.fifteenMinute
+		if bk.length == 24*time.Hour {
+			limit, used = l.daily, u.daily
+		}
+		bk.limit = limit
+		if used > bk.used {
+			bk.used = used
+		}
+	}
+	b.dispatch()
+}
+
+// Exhaust marks the 15 minute windows as used up, i.e., after Strava rejected
+// a request that the budget allowed
+func (b *Budget) Exhaust() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now().UTC())
+	for _, bk := range b.buckets {
+		if bk.length == 15*time.Minute {
+			bk.used = bk.limit
+		}
+	}
+}
+
+// WindowUsage is the state of one rate limit window
+type WindowUsage struct {
+	Name     string    `json:"name"`
+	Limit    int       `json:"limit"`
+	Used     int       `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// BudgetUsage is a snapshot of the rate limit budget
+type BudgetUsage struct {
+	Windows []WindowUsage `json:"windows"`
+	// fraction of every window kept for interactive work
+	InteractiveReserve float64 `json:"interactive_reserve"`
+	// requests waiting for budget, by priority
+	Waiting map[string]int `json:"waiting"`
+	// requests made for the athlete in the current 15 minute window
+	AthleteUsed int `json:"athlete_used"`
+}
+
+// Usage returns the state of the budget. Usage of other athletes is not shared
+func (b *Budget) Usage(athleteID int) BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now().UTC())
+	usage := BudgetUsage{
+		Windows:            []WindowUsage{},
+		InteractiveReserve: b.reserve,
+		Waiting: map[string]int{
+			PriorityBackground.String():  0,
+			PriorityInteractive.String(): 0,
+		},
+		AthleteUsed: b.athleteUsage[athleteID],
+	}
+	for _, bk := range b.buckets {
+		usage.Windows = append(usage.Windows, WindowUsage{
+			Name:     bk.name,
+			Limit:    bk.limit,
+			Used:     bk.used,
+			ResetsAt: bk.resetAt,
+		})
+	}
+	for _, w := range b.waiters {
+		usage.Waiting[w.priority.String()]++
+	}
+	return usage
+}
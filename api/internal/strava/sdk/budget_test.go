@@ -0,0 +1,222 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// limits that leave the other buckets out of the way of the one under test
+var testLimits = RateLimits{
+	FifteenMinute:     10,
+	Daily:             1000,
+	ReadFifteenMinute: 1000,
+	ReadDaily:         1000,
+}
+
+// acquire does not wait for budget, so the tests do not depend on how close the
+// next window is
+func acquire(b *Budget, priority Priority, athleteID int, read bool) error {
+	ctx := WithAthlete(WithPriority(context.Background(), priority), athleteID)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	return b.Acquire(ctx, read)
+}
+
+func refused(err error) bool {
+	return errors.Is(err, ErrorTooManyRequests) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func TestBudgetInteractiveReserve(t *testing.T) {
+	cases := []struct {
+		name                    string
+		reserve                 float64
+		background, interactive int
+	}{
+		{"no reserve", 0, 10, 0},
+		{"fifth reserved", 0.2, 8, 2},
+		{"reserve rounds up", 0.15, 8, 2},
+		{"all reserved", 1, 0, 10},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := NewBudget(testLimits, c.reserve)
+
+			for i := 0; i < c.background; i++ {
+				if err := acquire(b, PriorityBackground, 1, false); err != nil {
+					t.Fatalf("background request %d = %v", i+1, err)
+				}
+			}
+			if err := acquire(b, PriorityBackground, 1, false); !refused(err) {
+				t.Fatalf("background request past the reserve = %v, want it refused", err)
+			}
+
+			// the reserve is left to interactive work
+			for i := 0; i < c.interactive; i++ {
+				if err := acquire(b, PriorityInteractive, 2, false); err != nil {
+					t.Fatalf("interactive request %d = %v", i+1, err)
+				}
+			}
+			if err := acquire(b, PriorityInteractive, 2, false); !refused(err) {
+				t.Fatalf("interactive request past the limit = %v, want it refused", err)
+			}
+
+			usage := b.Usage(2)
+			if usage.Windows[0].Used != testLimits.FifteenMinute {
+				t.Errorf("used %d of the 15 minute window, want %d", usage.Windows[0].Used, testLimits.FifteenMinute)
+			}
+			if usage.AthleteUsed != c.interactive {
+				t.Errorf("athlete used %d requests, want %d", usage.AthleteUsed, c.interactive)
+			}
+			if usage.Waiting[PriorityBackground.String()] != 0 || usage.Waiting[PriorityInteractive.String()] != 0 {
+				t.Errorf("refused requests are still waiting: %v", usage.Waiting)
+			}
+		})
+	}
+}
+
+func TestBudgetReadBuckets(t *testing.T) {
+	b := NewBudget(RateLimits{FifteenMinute: 10, Daily: 1000, ReadFifteenMinute: 3, ReadDaily: 1000}, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := acquire(b, PriorityBackground, 1, true); err != nil {
+			t.Fatalf("read %d = %v", i+1, err)
+		}
+	}
+	if err := acquire(b, PriorityBackground, 1, true); !refused(err) {
+		t.Fatalf("read past the read limit = %v, want it refused", err)
+	}
+
+	// other requests only count towards the overall limits
+	if err := acquire(b, PriorityBackground, 1, false); err != nil {
+		t.Fatalf("write after the read limit = %v", err)
+	}
+
+	used := map[string]int{}
+	for _, w := range b.Usage(1).Windows {
+		used[w.Name] = w.Used
+	}
+	want := map[string]int{"overall_15m": 4, "overall_daily": 4, "read_15m": 3, "read_daily": 3}
+	for name, n := range want {
+		if used[name] != n {
+			t.Errorf("window %s used %d, want %d", name, used[name], n)
+		}
+	}
+}
+
+func TestBudgetWindowReset(t *testing.T) {
+	b := NewBudget(testLimits, 0)
+	now := time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC)
+	b.refill(now)
+
+	for _, bk := range b.buckets {
+		bk.used = bk.limit
+	}
+	b.athleteUsage[1] = 5
+
+	cases := []struct {
+		name string
+		at   time.Time
+		// used count of the 15 minute and daily windows after the refill
+		fifteenMinute, daily int
+		athleteUsage         int
+		fifteenMinuteReset   time.Time
+	}{
+		{"same window", now.Add(7 * time.Minute), 10, 1000, 5, time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)},
+		{"next 15 minutes", now.Add(8 * time.Minute), 0, 1000, 0, time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{"next day", time.Date(2024, 3, 2, 0, 0, 1, 0, time.UTC), 0, 0, 0, time.Date(2024, 3, 2, 0, 15, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		b.refill(c.at)
+		if b.buckets[0].used != c.fifteenMinute || b.buckets[1].used != c.daily {
+			t.Errorf("%s: used %d and %d, want %d and %d", c.name, b.buckets[0].used, b.buckets[1].used, c.fifteenMinute, c.daily)
+		}
+		if b.athleteUsage[1] != c.athleteUsage {
+			t.Errorf("%s: athlete used %d, want %d", c.name, b.athleteUsage[1], c.athleteUsage)
+		}
+		if !b.buckets[0].resetAt.Equal(c.fifteenMinuteReset) {
+			t.Errorf("%s: 15 minute window resets at %s, want %s", c.name, b.buckets[0].resetAt, c.fifteenMinuteReset)
+		}
+	}
+}
+
+func TestBudgetObserve(t *testing.T) {
+	b := NewBudget(testLimits, 0)
+	for i := 0; i < 4; i++ {
+		if err := acquire(b, PriorityBackground, 1, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Strava is trusted when it saw more requests, i.e., from other instances
+	b.Observe(&rateLimit{20, 2000}, &rateLimit{6, 2}, &rateLimit{15, 1500}, &rateLimit{1, 1})
+	want := []struct {
+		limit, used int
+	}{
+		{20, 6}, {2000, 4}, {15, 4}, {1500, 4},
+	}
+	for i, w := range b.Usage(1).Windows {
+		if w.Limit != want[i].limit || w.Used != want[i].used {
+			t.Errorf("window %s = %d of %d, want %d of %d", w.Name, w.Used, w.Limit, want[i].used, want[i].limit)
+		}
+	}
+
+	// missing headers leave the buckets as they are
+	b.Observe(nil, nil, nil, nil)
+	if w := b.Usage(1).Windows[0]; w.Limit != 20 || w.Used != 6 {
+		t.Errorf("window %s = %d of %d after a response without limits", w.Name, w.Used, w.Limit)
+	}
+
+	b.Exhaust()
+	for _, w := range b.Usage(1).Windows {
+		exhausted := w.Used == w.Limit
+		if fifteenMinute := w.Name == "overall_15m" || w.Name == "read_15m"; exhausted != fifteenMinute {
+			t.Errorf("window %s = %d of %d after Exhaust", w.Name, w.Used, w.Limit)
+		}
+	}
+}
+
+func TestBudgetDispatchOrder(t *testing.T) {
+	b := NewBudget(testLimits, 0)
+	b.mu.Lock()
+	b.refill(time.Now().UTC())
+	b.buckets[0].used = b.buckets[0].limit - 2
+	b.athleteUsage = map[int]int{1: 5, 2: 1, 3: 0}
+
+	waiter := func(priority Priority, athleteID int) *budgetWaiter {
+		b.seq++
+		w := &budgetWaiter{priority: priority, athleteID: athleteID, seq: b.seq, granted: make(chan struct{})}
+		b.waiters = append(b.waiters, w)
+		return w
+	}
+	heavyBackground := waiter(PriorityBackground, 1)
+	lightBackground := waiter(PriorityBackground, 3)
+	interactive := waiter(PriorityInteractive, 2)
+
+	// two tokens are left, for the interactive request and then the athlete
+	// that used the least of the window
+	b.dispatch()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.mu.Unlock()
+
+	granted := func(w *budgetWaiter) bool {
+		select {
+		case <-w.granted:
+			return true
+		default:
+			return false
+		}
+	}
+	if !granted(interactive) || !granted(lightBackground) || granted(heavyBackground) {
+		t.Errorf("granted interactive = %v, light background = %v, heavy background = %v, want true, true, false",
+			granted(interactive), granted(lightBackground), granted(heavyBackground))
+	}
+	if !b.cancel(heavyBackground) {
+		t.Error("request that was not granted is not waiting")
+	}
+}
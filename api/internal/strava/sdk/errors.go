@@ -0,0 +1,103 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Error is a request that Strava, or the rate limit budget, refused. Errors
+// with the same status code match each other with errors.Is, so callers can
+// compare against the common errors below
+type Error struct {
+	StatusCode int
+	// message in the response body, if any
+	Message string
+	// when the request may succeed if it is made again. Zero if unknown
+	RetryAt time.Time
+}
+
+func makeHTTPError(code int) *Error {
+	return &Error{StatusCode: code}
+}
+
+// tooManyRequestsUntil is a request that was not made because a rate limit is
+// used up until retryAt
+func tooManyRequestsUntil(retryAt time.Time) *Error {
+	return &Error{StatusCode: http.StatusTooManyRequests, RetryAt: retryAt}
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("HTTP status = %d", e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if !e.RetryAt.IsZero() {
+		msg += fmt.Sprintf(" (retry at %s)", e.RetryAt.Format(time.RFC3339))
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.StatusCode == e.StatusCode
+}
+
+// Transient reports whether the request may succeed if it is made again later,
+// without any change on our side
+func (e *Error) Transient() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusRequestTimeout:
+		return true
+	default:
+		return e.StatusCode >= 500
+	}
+}
+
+// Common error codes for HTTP responses
+var (
+	ErrorBadRequest          = makeHTTPError(http.StatusBadRequest)
+	ErrorUnauthorized        = makeHTTPError(http.StatusUnauthorized)
+	ErrorForbidden           = makeHTTPError(http.StatusForbidden)
+	ErrorNotFound            = makeHTTPError(http.StatusNotFound)
+	ErrorTooManyRequests     = makeHTTPError(http.StatusTooManyRequests)
+	ErrorInternalServerError = makeHTTPError(http.StatusInternalServerError)
+	ErrorServiceUnavailable  = makeHTTPError(http.StatusServiceUnavailable)
+)
+
+// IsTransient reports whether a failed request may succeed if it is made again
+// later, i.e., after a rate limit window or an outage. Other errors, such as a
+// revoked token or a missing activity, will keep failing. Cancellation is not
+// transient because the caller asked for it
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var sdkErr *Error
+	if errors.As(err, &sdkErr) {
+		return sdkErr.Transient()
+	}
+
+	// the request may not have reached Strava at all
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// RetryTime reports when a request that was refused because of a rate limit or
+// an outage may be made again. The SDK only waits for windows that reset
+// within a minute, so callers get these errors for work that has to be
+// scheduled again after the window, or that the athlete has to be told about
+func RetryTime(err error) (time.Time, bool) {
+	var sdkErr *Error
+	if !errors.As(err, &sdkErr) || sdkErr.RetryAt.IsZero() {
+		return time.Time{}, false
+	}
+	return sdkErr.RetryAt, true
+}
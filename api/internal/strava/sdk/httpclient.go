@@ -1,7 +1,9 @@
 package sdk
 
 import (
+	"encoding/json"
 	"log"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,51 +14,140 @@ import (
 )
 
 const (
-	rateLimitHeader      = "X-Ratelimit-Limit"
-	rateLimitUsageHeader = "X-Ratelimit-Usage"
+	// requests are attempted up to this many more times. Waits double from the
+	// minimum, except after a 429 or 503, which wait until Strava allows
+	// requests again
+	maxRetries       = 5
+	minRetryWaitTime = 500 * time.Millisecond
+	// a 429 or 503 is only retried if Strava allows requests again this soon.
+	// Otherwise the request fails with an error that says when the window
+	// resets (see RetryTime), so the caller can schedule the work again or tell
+	// the athlete it was put off, and the budget holds back the requests that
+	// follow it until then. This keeps a request from holding up the job that
+	// made it for more than a few minutes
+	maxRateLimitWait = time.Minute
+	// spreads out retries that wait for the same rate limit window
+	maxRetryJitter   = 10 * time.Second
+	maxRetryWaitTime = maxRateLimitWait + maxRetryJitter
+
+	rateLimitHeader          = "X-Ratelimit-Limit"
+	rateLimitUsageHeader     = "X-Ratelimit-Usage"
+	readRateLimitHeader      = "X-Readratelimit-Limit"
+	readRateLimitUsageHeader = "X-Readratelimit-Usage"
 )
 
-// determine whether or not to retry a request
+// token requests do not count towards the rate limits
+func countsTowardsRateLimit(r *resty.Request) bool {
+	return !strings.HasSuffix(r.URL, "oauth/token")
+}
+
+// determine whether or not to retry a request. Requests that were never sent,
+// i.e., because the rate limit budget ran out, are not retried
 func retryConditionFunc(r *resty.Response, err error) bool {
-	switch err {
-	case ErrorInternalServerError:
-		log.Printf("Recieved %+v (%s), will retry", err, r.Status())
+	if r == nil || err == nil || r.Request.Context().Err() != nil {
+		return false
+	}
+
+	// the request did not get a response, i.e., the connection failed
+	if r.RawResponse == nil {
+		log.Printf("Request failed: %+v, will retry", err)
 		return true
-	default:
+	}
+
+	sdkErr, ok := err.(*Error)
+	if !ok || !sdkErr.Transient() {
 		return false
 	}
+
+	if sdkErr.StatusCode == http.StatusTooManyRequests || sdkErr.StatusCode == http.StatusServiceUnavailable {
+		if isDailyLimitReached(r) || time.Until(sdkErr.RetryAt) > maxRateLimitWait {
+			log.Printf("Recieved %+v (%s), will not retry before the window resets", err, r.Status())
+			return false
+		}
+		log.Printf("Recieved %+v (%s), will retry at %s", err, r.Status(), sdkErr.RetryAt.Format(time.RFC3339))
+	} else {
+		log.Printf("Recieved %+v (%s), will retry", err, r.Status())
+	}
+	return true
 }
 
-// convert non 200 status code responses into error
-func afterResponseConvertNon200ToError(c *resty.Client, r *resty.Response) error {
+// retryAfter waits until the next rate limit window, or until the time Strava
+// asks for, after a 429 or 503. Other errors use exponential backoff with jitter
+func retryAfter(c *resty.Client, r *resty.Response) (time.Duration, error) {
 	switch r.StatusCode() {
-	case http.StatusBadRequest:
-		return ErrorBadRequest
-	case http.StatusUnauthorized:
-		return ErrorUnauthorized
-	case http.StatusNotFound:
-		return ErrorNotFound
-	case http.StatusTooManyRequests:
-		return ErrorTooManyRequests
-	case http.StatusInternalServerError:
-		return ErrorInternalServerError
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		jitter := time.Duration(rand.Int63n(int64(maxRetryJitter)))
+		return time.Until(retryTime(r)) + jitter, nil
 	default:
-		if r.StatusCode() >= 300 {
-			return makeHTTPError(r.StatusCode())
+		return 0, nil
+	}
+}
+
+// retryTime is when a request refused by Strava may be made again. Without a
+// Retry-After header, that is the start of the next rate limit window
+func retryTime(r *resty.Response) time.Time {
+	if h := r.Header().Get("Retry-After"); h != "" {
+		if seconds, err := strconv.Atoi(h); err == nil {
+			return time.Now().UTC().Add(time.Duration(seconds) * time.Second)
 		}
+		if t, err := http.ParseTime(h); err == nil {
+			return t.UTC()
+		}
+	}
+
+	if isDailyLimitReached(r) {
+		return getDelayTime(time.Hour * 24)
+	}
+	return getDelayTime(time.Minute * 15)
+}
+
+func isDailyLimitReached(r *resty.Response) bool {
+	for _, headers := range [][2]string{
+		{rateLimitHeader, rateLimitUsageHeader},
+		{readRateLimitHeader, readRateLimitUsageHeader},
+	} {
+		limits := parseRateLimitHeader(r, headers[0])
+		used := parseRateLimitHeader(r, headers[1])
+		if limits != nil && used != nil && used.daily >= limits.daily {
+			return true
+		}
+	}
+	return false
+}
+
+// convert non 200 status code responses into error
+func afterResponseConvertNon200ToError(c *resty.Client, r *resty.Response) error {
+	if r.StatusCode() < 300 {
 		return nil
 	}
+
+	sdkErr := makeHTTPError(r.StatusCode())
+	body := struct {
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(r.Body(), &body) == nil {
+		sdkErr.Message = body.Message
+	}
+	if r.StatusCode() == http.StatusTooManyRequests || r.StatusCode() == http.StatusServiceUnavailable {
+		sdkErr.RetryAt = retryTime(r)
+	}
+	return sdkErr
 }
 
-// fail request in rate limit exceeded condition
-func makeAPILimitRequestMiddleware(db *rateLimitDB) resty.RequestMiddleware {
+// fail request in rate limit exceeded condition, which may have been reached
+// by another instance of the application. Otherwise wait for budget
+func makeAPILimitRequestMiddleware(db *rateLimitDB, budget *Budget) resty.RequestMiddleware {
 	return func(c *resty.Client, r *resty.Request) error {
+		if !countsTowardsRateLimit(r) {
+			return nil
+		}
+
 		limitedUntil := db.GetLimittedUntilTime(r.Context())
 		if time.Now().UTC().Before(limitedUntil) {
 			log.Printf("artificially rate limiting until %+v based on rate limit table metadata", limitedUntil)
-			return ErrorTooManyRequests
+			return tooManyRequestsUntil(limitedUntil)
 		}
-		return nil
+		return budget.Acquire(r.Context(), r.Method == http.MethodGet)
 	}
 }
 
@@ -90,14 +181,23 @@ func getDelayTime(bucket time.Duration) time.Time {
 }
 
 // persist consumed rate limit
-func makeAPILimitResponseMiddleware(db *rateLimitDB) resty.ResponseMiddleware {
+func makeAPILimitResponseMiddleware(db *rateLimitDB, budget *Budget) resty.ResponseMiddleware {
 	return func(c *resty.Client, r *resty.Response) error {
+		if r.StatusCode() == http.StatusTooManyRequests {
+			budget.Exhaust()
+		}
+
 		limits := parseRateLimitHeader(r, rateLimitHeader)
 		used := parseRateLimitHeader(r, rateLimitUsageHeader)
+		readLimits := parseRateLimitHeader(r, readRateLimitHeader)
+		readUsed := parseRateLimitHeader(r, readRateLimitUsageHeader)
+		budget.Observe(limits, used, readLimits, readUsed)
 		if limits == nil || used == nil {
 			return nil
 		}
 
+		// only the overall limits stop every request. Requests that are not
+		// reads can still be made once the read limits are reached
 		var limitUntil time.Time
 		if used.daily >= limits.daily {
 			limitUntil = getDelayTime(time.Hour * 24)
@@ -114,15 +214,17 @@ func makeAPILimitResponseMiddleware(db *rateLimitDB) resty.ResponseMiddleware {
 	}
 }
 
-func newHTTPClient(timeout time.Duration, db *database.DB) *resty.Client {
+func newHTTPClient(timeout time.Duration, db *database.DB, budget *Budget) *resty.Client {
 	http := &http.Client{Timeout: timeout}
 	rlDB := &rateLimitDB{db}
 	return resty.
 		NewWithClient(http).
-		SetRetryCount(5).
-		SetRetryWaitTime(500 * time.Millisecond).
+		SetRetryCount(maxRetries).
+		SetRetryWaitTime(minRetryWaitTime).
+		SetRetryMaxWaitTime(maxRetryWaitTime).
+		SetRetryAfter(retryAfter).
 		AddRetryCondition(retryConditionFunc).
-		OnBeforeRequest(makeAPILimitRequestMiddleware(rlDB)).
-		OnAfterResponse(makeAPILimitResponseMiddleware(rlDB)).
+		OnBeforeRequest(makeAPILimitRequestMiddleware(rlDB, budget)).
+		OnAfterResponse(makeAPILimitResponseMiddleware(rlDB, budget)).
 		OnAfterResponse(afterResponseConvertNon200ToError)
 }
@@ -0,0 +1,98 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+func newResponse(status int, header http.Header) (*resty.Response, error) {
+	r := &resty.Response{
+		Request:     resty.New().R(),
+		RawResponse: &http.Response{StatusCode: status, Header: header},
+	}
+	return r, afterResponseConvertNon200ToError(nil, r)
+}
+
+func TestRetryCondition(t *testing.T) {
+	retryIn := func(d time.Duration) http.Header {
+		return http.Header{"Retry-After": []string{strconv.Itoa(int(d.Seconds()))}}
+	}
+
+	cases := []struct {
+		name   string
+		status int
+		header http.Header
+		retry  bool
+	}{
+		{"server error", http.StatusInternalServerError, http.Header{}, true},
+		{"not found", http.StatusNotFound, http.Header{}, false},
+		{"rate limited briefly", http.StatusTooManyRequests, retryIn(30 * time.Second), true},
+		{"unavailable briefly", http.StatusServiceUnavailable, retryIn(maxRateLimitWait), true},
+		// waiting for the next window would hold up the job for too long
+		{"rate limited for a window", http.StatusTooManyRequests, retryIn(15 * time.Minute), false},
+		{"daily limit", http.StatusTooManyRequests, http.Header{
+			rateLimitHeader:      []string{"200,2000"},
+			rateLimitUsageHeader: []string{"10,2000"},
+		}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := newResponse(c.status, c.header)
+			if retry := retryConditionFunc(r, err); retry != c.retry {
+				t.Errorf("retryConditionFunc() = %v, want %v", retry, c.retry)
+			}
+		})
+	}
+}
+
+func TestRetryWaitIsBounded(t *testing.T) {
+	// the longest a request can wait across all of its retries
+	if total := maxRetries * maxRetryWaitTime; total > 10*time.Minute {
+		t.Errorf("retries can wait %s", total)
+	}
+
+	r, _ := newResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"30"}})
+	wait, err := retryAfter(nil, r)
+	if err != nil || wait < 29*time.Second || wait > 30*time.Second+maxRetryJitter || wait > maxRetryWaitTime {
+		t.Errorf("retryAfter() = %s, %v", wait, err)
+	}
+}
+
+func TestRetryTime(t *testing.T) {
+	// a 429 that is not retried says when the work can be done instead
+	r, err := newResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"900"}})
+	if retryConditionFunc(r, err) {
+		t.Fatal("retried a request for the next window")
+	}
+	retryAt, ok := RetryTime(fmt.Errorf("listing activities: %w", err))
+	if want := time.Now().Add(15 * time.Minute); !ok || retryAt.Before(want.Add(-time.Minute)) || retryAt.After(want) {
+		t.Errorf("RetryTime() = %s, %v, want %s", retryAt, ok, want)
+	}
+
+	// so does a request the budget did not allow
+	b := NewBudget(testLimits, 0)
+	b.refill(time.Now().UTC())
+	for _, bk := range b.buckets {
+		bk.used = bk.limit
+	}
+	err = acquire(b, PriorityBackground, 1, true)
+	if !errors.Is(err, ErrorTooManyRequests) {
+		t.Fatalf("Acquire() without budget = %v, want %v", err, ErrorTooManyRequests)
+	}
+	if retryAt, ok := RetryTime(err); !ok || !retryAt.Equal(b.buckets[1].resetAt) {
+		t.Errorf("RetryTime() = %s, %v, want the reset of the daily window at %s", retryAt, ok, b.buckets[1].resetAt)
+	}
+
+	for _, err := range []error{nil, ErrorNotFound, ErrorTooManyRequests, errors.New("failed")} {
+		if retryAt, ok := RetryTime(err); ok {
+			t.Errorf("RetryTime(%v) = %s, want no time", err, retryAt)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	resty "github.com/go-resty/resty/v2"
 )
@@ -13,23 +14,28 @@ type sdkImpl struct {
 	client       *resty.Client
 	clientID     string
 	clientSecret string
+	apiRootURL   string
+	oauthRootURL string
+	budget       *Budget
 }
 
 const (
 	// according to https://developers.strava.com/docs/
 	maxPaginatedResults = 200
-	apiRootURL          = "https://www.strava.com/api/v3/"
+	DefaultAPIRootURL   = "https://www.strava.com/api/v3/"
+	DefaultOAuthRootURL = "https://www.strava.com/oauth/"
 )
 
-func (sdk sdkImpl) ExchangeAuthToken(request *TokenExchangeCode) (*AuthorizationCodeResponse, error) {
+func (sdk sdkImpl) ExchangeAuthToken(ctx context.Context, request *TokenExchangeCode) (*AuthorizationCodeResponse, error) {
 	res, err := sdk.client.R().
+		SetContext(ctx).
 		SetFormData(map[string]string{
 			"client_id":     sdk.clientID,
 			"client_secret": sdk.clientSecret,
 			"grant_type":    "authorization_code",
 			"code":          request.Code,
 		}).
-		Post(apiRootURL + "oauth/token")
+		Post(sdk.apiRootURL + "oauth/token")
 
 	if err != nil {
 		return nil, err
@@ -40,15 +46,16 @@ func (sdk sdkImpl) ExchangeAuthToken(request *TokenExchangeCode) (*Authorization
 	return authCodeResponse, err
 }
 
-func (sdk sdkImpl) RefreshAuthToken(refreshToken string) (*StravaTokens, error) {
+func (sdk sdkImpl) RefreshAuthToken(ctx context.Context, refreshToken string) (*StravaTokens, error) {
 	res, err := sdk.client.R().
+		SetContext(ctx).
 		SetFormData(map[string]string{
 			"client_id":     sdk.clientID,
 			"client_secret": sdk.clientSecret,
 			"grant_type":    "refresh_token",
 			"refresh_token": refreshToken,
 		}).
-		Post(apiRootURL + "oauth/token")
+		Post(sdk.apiRootURL + "oauth/token")
 
 	if err != nil {
 		return nil, err
@@ -59,11 +66,29 @@ func (sdk sdkImpl) RefreshAuthToken(refreshToken string) (*StravaTokens, error)
 	return tokens, err
 }
 
+// Deauthorize revokes every token of the athlete that an access token belongs
+// to, as if they removed the application from their Strava settings
+func (sdk sdkImpl) Deauthorize(ctx context.Context, accessToken string) error {
+	_, err := sdk.client.R().
+		SetContext(ctx).
+		SetFormData(map[string]string{
+			"access_token": accessToken,
+		}).
+		Post(sdk.oauthRootURL + "deauthorize")
+
+	return err
+}
+
 func (sdk sdkImpl) ListAllActivities(ctx context.Context, token string) ([]Activity, error) {
+	return sdk.ListActivities(ctx, token, ActivityFilter{})
+}
+
+// ListActivities pages through every activity that matches a filter
+func (sdk sdkImpl) ListActivities(ctx context.Context, token string, filter ActivityFilter) ([]Activity, error) {
 	page := 1
 	activities := []Activity{}
 	for {
-		pageActivities, err := sdk.GetActivitiesByPage(ctx, token, page, maxPaginatedResults)
+		pageActivities, err := sdk.GetActivitiesByPage(ctx, token, page, maxPaginatedResults, filter)
 		if err != nil {
 			return activities, err
 		}
@@ -78,16 +103,25 @@ func (sdk sdkImpl) ListAllActivities(ctx context.Context, token string) ([]Activ
 }
 
 // GetActivitiesByPage return the activities on a particular page
-func (sdk sdkImpl) GetActivitiesByPage(ctx context.Context, token string, page int, perPage int) ([]Activity, error) {
+func (sdk sdkImpl) GetActivitiesByPage(ctx context.Context, token string, page int, perPage int, filter ActivityFilter) ([]Activity, error) {
 	activities := []Activity{}
 
+	params := map[string]string{
+		"page":     strconv.Itoa(page),
+		"per_page": strconv.Itoa(perPage),
+	}
+	if !filter.Before.IsZero() {
+		params["before"] = strconv.FormatInt(filter.Before.Unix(), 10)
+	}
+	if !filter.After.IsZero() {
+		params["after"] = strconv.FormatInt(filter.After.Unix(), 10)
+	}
+
 	res, err := sdk.client.R().
+		SetContext(ctx).
 		SetHeader("Authorization", "Bearer "+token).
-		SetQueryParams(map[string]string{
-			"page":     strconv.Itoa(page),
-			"per_page": strconv.Itoa(perPage),
-		}).
-		Get(apiRootURL + "activities")
+		SetQueryParams(params).
+		Get(sdk.apiRootURL + "activities")
 
 	if err != nil {
 		return activities, err
@@ -100,10 +134,28 @@ func (sdk sdkImpl) GetActivitiesByPage(ctx context.Context, token string, page i
 	return activities, nil
 }
 
-// GetActivityBytes return raw representation of activities
+// GetActivity returns the summary of a single activity
+func (sdk sdkImpl) GetActivity(ctx context.Context, token string, activityID int64) (*Activity, error) {
+	res, err := sdk.client.R().
+		SetContext(ctx).
+		SetHeader("Authorization", "Bearer "+token).
+		Get(fmt.Sprintf(sdk.apiRootURL+"activities/%d", activityID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	activity := &Activity{}
+	err = json.Unmarshal(res.Body(), activity)
+	return activity, err
+}
+
+// GetActivityBytes return raw representation of the streams of an activity,
+// listed in ActivityStreams. Streams that were not recorded are left out
 func (sdk sdkImpl) GetActivityBytes(ctx context.Context, token string, activityID int64) ([]byte, error) {
-	url := fmt.Sprintf(apiRootURL+"activities/%d/streams?keys=latlng", activityID)
+	url := fmt.Sprintf(sdk.apiRootURL+"activities/%d/streams?keys=%s", activityID, strings.Join(ActivityStreams, ","))
 	res, err := sdk.client.R().
+		SetContext(ctx).
 		SetHeader("Authorization", "Bearer "+token).
 		Get(url)
 
@@ -112,3 +164,62 @@ func (sdk sdkImpl) GetActivityBytes(ctx context.Context, token string, activityI
 	}
 	return res.Body(), nil
 }
+
+// CreatePushSubscription subscribes the application to webhook events. Strava
+// validates the callback URL before responding, so it must already be served
+func (sdk sdkImpl) CreatePushSubscription(ctx context.Context, callbackURL string, verifyToken string) (*PushSubscription, error) {
+	res, err := sdk.client.R().
+		SetContext(ctx).
+		SetFormData(map[string]string{
+			"client_id":     sdk.clientID,
+			"client_secret": sdk.clientSecret,
+			"callback_url":  callbackURL,
+			"verify_token":  verifyToken,
+		}).
+		Post(sdk.apiRootURL + "push_subscriptions")
+
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &PushSubscription{}
+	err = json.Unmarshal(res.Body(), subscription)
+	return subscription, err
+}
+
+// ListPushSubscriptions returns the webhook subscriptions of the application
+func (sdk sdkImpl) ListPushSubscriptions(ctx context.Context) ([]PushSubscription, error) {
+	res, err := sdk.client.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"client_id":     sdk.clientID,
+			"client_secret": sdk.clientSecret,
+		}).
+		Get(sdk.apiRootURL + "push_subscriptions")
+
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := []PushSubscription{}
+	err = json.Unmarshal(res.Body(), &subscriptions)
+	return subscriptions, err
+}
+
+// DeletePushSubscription stops webhook events from being sent
+func (sdk sdkImpl) DeletePushSubscription(ctx context.Context, subscriptionID int) error {
+	_, err := sdk.client.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"client_id":     sdk.clientID,
+			"client_secret": sdk.clientSecret,
+		}).
+		Delete(fmt.Sprintf(sdk.apiRootURL+"push_subscriptions/%d", subscriptionID))
+
+	return err
+}
+
+// Usage returns the state of the rate limit budget
+func (sdk sdkImpl) Usage(athleteID int) BudgetUsage {
+	return sdk.budget.Usage(athleteID)
+}
@@ -1,6 +1,9 @@
 package sdk
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type AuthorizationCodeResponse struct {
 	TokenType    string `json:"token_type"`
@@ -44,6 +47,16 @@ type StravaTokens struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// OAuth scopes that an athlete can grant the application. Strava reports the
+// granted scopes as a comma separated list when redirecting after login
+const (
+	ScopeRead = "read"
+	// activities visible to everyone or to followers
+	ScopeActivityRead = "activity:read"
+	// every activity, including private ones
+	ScopeActivityReadAll = "activity:read_all"
+)
+
 type TokenExchangeCode struct {
 	Code string
 }
@@ -53,6 +66,13 @@ type AthleteToken struct {
 	Athlete     int
 }
 
+// ActivityFilter limits a listing to activities that started within a time
+// range. Zero times are not applied
+type ActivityFilter struct {
+	Before time.Time
+	After  time.Time
+}
+
 type Activities struct {
 	Collection []Activity
 }
@@ -61,5 +81,81 @@ type Activity struct {
 	Athlete struct {
 		ID int `json:"id"`
 	} `json:"athlete"`
-	ID int64 `json:"id"`
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	SportType string    `json:"sport_type"`
+	StartDate time.Time `json:"start_date"`
+	// meters
+	Distance float64 `json:"distance"`
+	// seconds
+	MovingTime int `json:"moving_time"`
+	// meters
+	TotalElevationGain float64 `json:"total_elevation_gain"`
+	// one of: everyone, followers_only, only_me
+	Visibility string `json:"visibility"`
+	Private    bool   `json:"private"`
+	GearID     string `json:"gear_id"`
+	Trainer    bool   `json:"trainer"`
+	Manual     bool   `json:"manual"`
+	Map        struct {
+		SummaryPolyline string `json:"summary_polyline"`
+	} `json:"map"`
+}
+
+// PushSubscription is a webhook subscription of the application. Strava allows
+// a single subscription per application
+type PushSubscription struct {
+	ID            int       `json:"id"`
+	ApplicationID int       `json:"application_id"`
+	CallbackURL   string    `json:"callback_url"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Activity stream types. Strava returns every stream requested with the same
+// number of points, so values at the same index were recorded together
+const (
+	StreamLatLng         = "latlng"
+	StreamTime           = "time"
+	StreamAltitude       = "altitude"
+	StreamVelocitySmooth = "velocity_smooth"
+	StreamHeartrate      = "heartrate"
+	StreamMoving         = "moving"
+)
+
+// ActivityStreams are the streams downloaded for every activity
+var ActivityStreams = []string{
+	StreamLatLng,
+	StreamTime,
+	StreamAltitude,
+	StreamVelocitySmooth,
+	StreamHeartrate,
+	StreamMoving,
+}
+
+// Webhook event object and aspect types
+const (
+	WebhookObjectActivity = "activity"
+	WebhookObjectAthlete  = "athlete"
+	WebhookAspectCreate   = "create"
+	WebhookAspectUpdate   = "update"
+	WebhookAspectDelete   = "delete"
+)
+
+// WebhookEvent is a push notification sent by Strava
+type WebhookEvent struct {
+	ObjectType string `json:"object_type"`
+	// activity or athlete ID, depending on the object type
+	ObjectID   int64  `json:"object_id"`
+	AspectType string `json:"aspect_type"`
+	// changed fields, i.e., {"title": "Messy"} or {"authorized": "false"}
+	Updates        map[string]interface{} `json:"updates"`
+	OwnerID        int                    `json:"owner_id"`
+	SubscriptionID int                    `json:"subscription_id"`
+	EventTime      int64                  `json:"event_time"`
+}
+
+// IsDeauthorization reports whether the athlete revoked access to the application
+func (e WebhookEvent) IsDeauthorization() bool {
+	return e.ObjectType == WebhookObjectAthlete && fmt.Sprint(e.Updates["authorized"]) == "false"
 }
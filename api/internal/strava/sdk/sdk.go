@@ -2,50 +2,77 @@ package sdk
 
 import (
 	"context"
-	"fmt"
-	"net/http"
+	"strings"
 	"time"
 
 	"github.com/nmiodice/personal-strava-heatmap/internal/database"
 )
 
-func makeHTTPError(code int) error {
-	return fmt.Errorf("HTTP status = %d", code)
-}
-
-// Common error codes for HTTP responses
-var (
-	ErrorBadRequest          = makeHTTPError(http.StatusBadRequest)
-	ErrorUnauthorized        = makeHTTPError(http.StatusUnauthorized)
-	ErrorNotFound            = makeHTTPError(http.StatusNotFound)
-	ErrorTooManyRequests     = makeHTTPError(http.StatusTooManyRequests)
-	ErrorInternalServerError = makeHTTPError(http.StatusInternalServerError)
-)
-
-// StravaSDK wraps API calls to Strava
+// StravaSDK wraps API calls to Strava. Every call stops when its context is
+// done. Failed requests return an *Error, and IsTransient tells whether they
+// are worth making again later
 type StravaSDK interface {
 	// authentication APIs
-	ExchangeAuthToken(request *TokenExchangeCode) (*AuthorizationCodeResponse, error)
-	RefreshAuthToken(refreshToken string) (*StravaTokens, error)
+	ExchangeAuthToken(ctx context.Context, request *TokenExchangeCode) (*AuthorizationCodeResponse, error)
+	RefreshAuthToken(ctx context.Context, refreshToken string) (*StravaTokens, error)
+	Deauthorize(ctx context.Context, accessToken string) error
 
 	// athlete APIs
 	ListAllActivities(ctx context.Context, token string) ([]Activity, error)
-	GetActivitiesByPage(ctx context.Context, token string, page int, perPage int) ([]Activity, error)
+	ListActivities(ctx context.Context, token string, filter ActivityFilter) ([]Activity, error)
+	GetActivitiesByPage(ctx context.Context, token string, page int, perPage int, filter ActivityFilter) ([]Activity, error)
+	GetActivity(ctx context.Context, token string, activityID int64) (*Activity, error)
 	GetActivityBytes(ctx context.Context, token string, activityID int64) ([]byte, error)
+
+	// push subscription APIs
+	CreatePushSubscription(ctx context.Context, callbackURL string, verifyToken string) (*PushSubscription, error)
+	ListPushSubscriptions(ctx context.Context) ([]PushSubscription, error)
+	DeletePushSubscription(ctx context.Context, subscriptionID int) error
+
+	// Usage returns the state of the rate limit budget, along with the requests
+	// made for an athlete
+	Usage(athleteID int) BudgetUsage
 }
 
 type StravaSDKConfig struct {
 	Timeout      time.Duration
 	ClientID     string
 	ClientSecret string
-	DB           *database.DB
+	// defaults to DefaultAPIRootURL. Useful to point the SDK at a fake API
+	APIRootURL string
+	// defaults to DefaultOAuthRootURL. Deauthorization is served there rather
+	// than under the API root
+	OAuthRootURL string
+	// initial rate limits, which are updated from every response
+	RateLimits RateLimits
+	// fraction of the rate limits that only interactive work can use
+	InteractiveReserve float64
+	DB                 *database.DB
 }
 
 // NewStravaSDK create a new SDK
 func NewStravaSDK(config StravaSDKConfig) StravaSDK {
+	apiRootURL := config.APIRootURL
+	if apiRootURL == "" {
+		apiRootURL = DefaultAPIRootURL
+	}
+	oauthRootURL := config.OAuthRootURL
+	if oauthRootURL == "" {
+		oauthRootURL = DefaultOAuthRootURL
+	}
+
+	rateLimits := config.RateLimits
+	if rateLimits == (RateLimits{}) {
+		rateLimits = DefaultRateLimits
+	}
+
+	budget := NewBudget(rateLimits, config.InteractiveReserve)
 	return sdkImpl{
-		client:       newHTTPClient(config.Timeout, config.DB),
+		client:       newHTTPClient(config.Timeout, config.DB, budget),
+		budget:       budget,
 		clientID:     config.ClientID,
 		clientSecret: config.ClientSecret,
+		apiRootURL:   strings.TrimRight(apiRootURL, "/") + "/",
+		oauthRootURL: strings.TrimRight(oauthRootURL, "/") + "/",
 	}
 }
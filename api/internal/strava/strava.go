@@ -1,6 +1,8 @@
 package strava
 
 type StravaService struct {
-	Athlete *AthleteService
-	Auth    *OAuthService
+	Athlete      *AthleteService
+	Auth         *OAuthService
+	Subscription *SubscriptionService
+	RateLimit    *RateLimitService
 }
@@ -0,0 +1,126 @@
+package strava
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava/sdk"
+)
+
+var (
+	ErrorUnknownSubscription = errors.New("subscription is not one of the application")
+)
+
+// SubscriptionService manages the webhook subscription of the application. The
+// ID of the subscription is recorded, because events carry it and nothing else
+// shows that they came from Strava
+type SubscriptionService struct {
+	stravaSDK   sdk.StravaSDK
+	db          *database.DB
+	verifyToken string
+}
+
+func NewSubscriptionService(stravaSDK sdk.StravaSDK, db *database.DB, verifyToken string) *SubscriptionService {
+	return &SubscriptionService{
+		stravaSDK:   stravaSDK,
+		db:          db,
+		verifyToken: verifyToken,
+	}
+}
+
+// VerifyToken is the token that Strava echoes back when validating a callback
+func (ss SubscriptionService) VerifyToken() string {
+	return ss.verifyToken
+}
+
+func (ss SubscriptionService) Create(ctx context.Context, callbackURL string) (*sdk.PushSubscription, error) {
+	subscription, err := ss.stravaSDK.CreatePushSubscription(ctx, callbackURL, ss.verifyToken)
+	if err != nil {
+		return nil, err
+	}
+	return subscription, ss.record(ctx, subscription)
+}
+
+// Record trusts events of a subscription that was created before subscriptions
+// were recorded. The subscription must be one Strava lists for the application
+func (ss SubscriptionService) Record(ctx context.Context, subscriptionID int) error {
+	subscriptions, err := ss.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if subscription.ID == subscriptionID {
+			return ss.record(ctx, &subscription)
+		}
+	}
+	return fmt.Errorf("%w: %d", ErrorUnknownSubscription, subscriptionID)
+}
+
+func (ss SubscriptionService) record(ctx context.Context, subscription *sdk.PushSubscription) error {
+	err := ss.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, insertSubscriptionSQL, subscription.ID, subscription.CallbackURL)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("recording subscription: %w, %d", err, subscription.ID)
+	}
+	return nil
+}
+
+// IsKnown reports whether events of a subscription are trusted
+func (ss SubscriptionService) IsKnown(ctx context.Context, subscriptionID int) (bool, error) {
+	known := false
+	err := ss.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, subscriptionExistsSQL, subscriptionID).Scan(&known)
+	})
+	if err != nil {
+		return false, fmt.Errorf("fetching subscription: %w, %d", err, subscriptionID)
+	}
+	return known, nil
+}
+
+func (ss SubscriptionService) List(ctx context.Context) ([]sdk.PushSubscription, error) {
+	return ss.stravaSDK.ListPushSubscriptions(ctx)
+}
+
+func (ss SubscriptionService) Delete(ctx context.Context, subscriptionID int) error {
+	if err := ss.stravaSDK.DeletePushSubscription(ctx, subscriptionID); err != nil {
+		return err
+	}
+	return ss.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, deleteSubscriptionSQL, subscriptionID)
+		return err
+	})
+}
+
+var insertSubscriptionSQL = `
+INSERT INTO
+	WebhookSubscription
+	(id, callback_url)
+VALUES
+	($1, $2)
+ON CONFLICT (id)
+	DO UPDATE
+		SET callback_url = $2
+`
+
+var subscriptionExistsSQL = `
+SELECT EXISTS (
+	SELECT
+		1
+	FROM
+		WebhookSubscription
+	WHERE
+		id = $1
+)
+`
+
+var deleteSubscriptionSQL = `
+DELETE FROM
+	WebhookSubscription
+WHERE
+	id = $1
+`
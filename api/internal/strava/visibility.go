@@ -0,0 +1,40 @@
+package strava
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// only activities that everyone can see are drawn
+	VisibilityPolicyPublic = "public"
+	// activities that followers can see are drawn as well
+	VisibilityPolicyFollowers = "followers"
+	// every activity is drawn, including private ones. Strava only lists
+	// private activities to applications granted the activity:read_all scope
+	VisibilityPolicyEverything = "everything"
+)
+
+// ValidateVisibilityPolicy checks that a visibility policy is one that is supported
+func ValidateVisibilityPolicy(policy string) error {
+	switch policy {
+	case VisibilityPolicyPublic, VisibilityPolicyFollowers, VisibilityPolicyEverything:
+		return nil
+	}
+	return fmt.Errorf("unknown visibility policy '%s'", policy)
+}
+
+// GetVisibilityPolicy returns the policy that decides which activities of an
+// athlete are drawn on their map
+func (as AthleteService) GetVisibilityPolicy(ctx context.Context, athleteID int) (string, error) {
+	return as.athleteDB.GetVisibilityPolicy(ctx, athleteID)
+}
+
+// SetVisibilityPolicy returns true if the policy changed, in which case the map
+// of the athlete needs a full rebuild
+func (as AthleteService) SetVisibilityPolicy(ctx context.Context, athleteID int, policy string) (bool, error) {
+	if err := ValidateVisibilityPolicy(policy); err != nil {
+		return false, err
+	}
+	return as.athleteDB.SetVisibilityPolicy(ctx, athleteID, policy)
+}
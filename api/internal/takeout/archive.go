@@ -0,0 +1,244 @@
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+var readme = `This archive holds the data Personal Heatmap keeps about you.
+
+activities.csv, activities.json
+	Every activity imported from Strava, including those your visibility
+	policy keeps off your map.
+streams/<activity ID>.json
+	The streams of each activity, as they were downloaded from Strava.
+	Activities whose streams were not downloaded yet have no file.
+activities.geojson
+	The track of every activity with streams, as GeoJSON line strings.
+map_builds.json
+	How your map was built, and the state of the last sync of your
+	activities.
+`
+
+var csvHeader = []string{
+	"activity_id", "name", "sport_type", "start_date", "distance", "moving_time",
+	"total_elevation_gain", "visibility", "private", "gear_id", "trainer", "manual",
+	"summary_polyline", "imported_at", "synced_at",
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONLineString      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type string `json:"type"`
+	// longitude, latitude pairs
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+// mapBuilds is the record of how the map of an athlete was built
+type mapBuilds struct {
+	// state of the last sync of the athlete
+	State *string `json:"sync_state"`
+	// nil if the athlete has no map
+	Map *maps.BuildRecord `json:"map"`
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeArchive writes the archive of an athlete to w as it is assembled, so
+// only one file of it is held in memory at a time. It returns the size of the
+// archive
+func (t TakeoutService) writeArchive(ctx context.Context, athleteID int, w io.Writer) (int64, error) {
+	activities, err := t.stravaSvc.Athlete.GetActivityMetadata(ctx, athleteID)
+	if err != nil {
+		return 0, err
+	}
+	builds, err := t.mapBuilds(ctx, athleteID)
+	if err != nil {
+		return 0, err
+	}
+	return assembleArchive(ctx, t.storage, activities, builds, w)
+}
+
+// assembleArchive writes the files of an archive to w. The streams of each
+// activity are read from the store one at a time
+func assembleArchive(ctx context.Context, store storage.Blobstore, activities []strava.ActivityMetadata, builds *mapBuilds, w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	archive := zip.NewWriter(counter)
+
+	if err := writeFile(archive, "README.txt", []byte(readme)); err != nil {
+		return 0, err
+	}
+	if err := writeActivitiesCSV(archive, activities); err != nil {
+		return 0, err
+	}
+	if err := writeJSON(archive, "activities.json", activities); err != nil {
+		return 0, err
+	}
+
+	tracks := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, activity := range activities {
+		if activity.DataRef == "" {
+			continue
+		}
+
+		data, err := store.GetObjectBytes(ctx, activity.DataRef)
+		if err != nil {
+			return 0, fmt.Errorf("reading streams of activity: %w, %d", err, activity.ActivityID)
+		}
+		if err := writeFile(archive, fmt.Sprintf("streams/%d.json", activity.ActivityID), data); err != nil {
+			return 0, err
+		}
+
+		if feature, ok := trackFeature(activity, data); ok {
+			tracks.Features = append(tracks.Features, feature)
+		}
+	}
+	if err := writeJSON(archive, "activities.geojson", tracks); err != nil {
+		return 0, err
+	}
+	if err := writeJSON(archive, "map_builds.json", builds); err != nil {
+		return 0, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, fmt.Errorf("writing export: %w", err)
+	}
+	return counter.n, nil
+}
+
+func (t TakeoutService) mapBuilds(ctx context.Context, athleteID int) (*mapBuilds, error) {
+	builds := &mapBuilds{}
+
+	athleteState, err := t.stateSvc.GetState(ctx, athleteID)
+	if err != nil {
+		return nil, err
+	}
+	if athleteState != nil && *athleteState != "" {
+		s := string(*athleteState)
+		builds.State = &s
+	}
+
+	mapID, err := t.stravaSvc.Athlete.GetMapIDForAthlete(ctx, athleteID)
+	if err != nil {
+		return nil, err
+	}
+	if mapID != nil {
+		if builds.Map, err = t.mapSvc.GetBuildRecord(ctx, *mapID); err != nil {
+			return nil, err
+		}
+	}
+	return builds, nil
+}
+
+// trackFeature returns false if the activity has too few points for a line
+func trackFeature(activity strava.ActivityMetadata, data []byte) (geoJSONFeature, bool) {
+	latLons := maps.TrackLatLons(data)
+	if len(latLons) < 2 {
+		return geoJSONFeature{}, false
+	}
+
+	coordinates := make([][]float64, len(latLons))
+	for i, latLon := range latLons {
+		coordinates[i] = []float64{latLon[1], latLon[0]}
+	}
+
+	return geoJSONFeature{
+		Type: "Feature",
+		Geometry: geoJSONLineString{
+			Type:        "LineString",
+			Coordinates: coordinates,
+		},
+		Properties: map[string]interface{}{
+			"activity_id": activity.ActivityID,
+			"name":        activity.Name,
+			"sport_type":  activity.SportType,
+			"start_date":  activity.StartDate,
+		},
+	}, true
+}
+
+func writeFile(archive *zip.Writer, name string, contents []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("adding '%s' to export: %w", name, err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		return fmt.Errorf("adding '%s' to export: %w", name, err)
+	}
+	return nil
+}
+
+func writeJSON(archive *zip.Writer, name string, value interface{}) error {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding '%s': %w", name, err)
+	}
+	return writeFile(archive, name, contents)
+}
+
+func writeActivitiesCSV(archive *zip.Writer, activities []strava.ActivityMetadata) error {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write(csvHeader)
+	for _, a := range activities {
+		w.Write([]string{
+			strconv.FormatInt(a.ActivityID, 10),
+			a.Name,
+			a.SportType,
+			formatTime(a.StartDate),
+			strconv.FormatFloat(a.Distance, 'f', -1, 64),
+			strconv.Itoa(a.MovingTime),
+			strconv.FormatFloat(a.TotalElevationGain, 'f', -1, 64),
+			a.Visibility,
+			strconv.FormatBool(a.Private),
+			a.GearID,
+			strconv.FormatBool(a.Trainer),
+			strconv.FormatBool(a.Manual),
+			a.SummaryPolyline,
+			formatTime(&a.ImportedAt),
+			formatTime(a.SyncedAt),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("encoding 'activities.csv': %w", err)
+	}
+	return writeFile(archive, "activities.csv", buf.Bytes())
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
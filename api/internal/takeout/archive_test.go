@@ -0,0 +1,186 @@
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+func readArchive(t *testing.T, data []byte) ([]string, map[string][]byte) {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	files := map[string][]byte{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, f.Name)
+		files[f.Name] = contents
+	}
+	return names, files
+}
+
+func TestAssembleArchive(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewFilesystemBlobstore(ctx, "activities", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := map[string]string{
+		"1/101.json": `[{"type":"latlng","data":[[37.1,-122.1],[37.2,-122.2]]},{"type":"time","data":[0,5]}]`,
+		// a single point is not a line
+		"1/102.json": `[{"type":"latlng","data":[[37.1,-122.1]]}]`,
+	}
+	for name, contents := range streams {
+		if err := store.CreateObject(ctx, name, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	activities := []strava.ActivityMetadata{
+		{ActivityID: 101, Name: "Morning, \"Ride\"", SportType: "Ride", StartDate: &start, Distance: 1234.5, Visibility: "everyone", DataRef: "1/101.json", ImportedAt: start},
+		{ActivityID: 102, Name: "Treadmill", SportType: "Run", Trainer: true, Private: true, Visibility: "only_me", DataRef: "1/102.json", ImportedAt: start},
+		// the streams of this activity were not downloaded yet
+		{ActivityID: 103, Name: "Swim", SportType: "Swim", ImportedAt: start},
+	}
+	syncState := "Done"
+	builds := &mapBuilds{State: &syncState, Map: &maps.BuildRecord{MapID: "map", Tiles: 12}}
+
+	buf := &bytes.Buffer{}
+	size, err := assembleArchive(ctx, store, activities, builds, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(buf.Len()) {
+		t.Errorf("assembleArchive() = %d bytes, wrote %d", size, buf.Len())
+	}
+
+	names, files := readArchive(t, buf.Bytes())
+	wantNames := []string{
+		"README.txt", "activities.csv", "activities.json",
+		"streams/101.json", "streams/102.json",
+		"activities.geojson", "map_builds.json",
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("archive holds %v, want %v", names, wantNames)
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		rows, err := csv.NewReader(bytes.NewReader(files["activities.csv"])).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 4 || !reflect.DeepEqual(rows[0], csvHeader) {
+			t.Fatalf("csv has %d rows, header %v", len(rows), rows[0])
+		}
+		// every activity is listed, whatever its visibility
+		first := rows[1]
+		if first[0] != "101" || first[1] != `Morning, "Ride"` || first[3] != "2024-03-01T10:00:00Z" || first[4] != "1234.5" || first[14] != "" {
+			t.Errorf("first row = %v", first)
+		}
+		if rows[2][0] != "102" || rows[2][8] != "true" || rows[2][10] != "true" || rows[3][0] != "103" {
+			t.Errorf("rows = %v", rows[2:])
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		listed := []strava.ActivityMetadata{}
+		if err := json.Unmarshal(files["activities.json"], &listed); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 3 || listed[0].ActivityID != 101 || listed[0].DataRef != "" {
+			t.Errorf("activities.json = %+v", listed)
+		}
+		// where the data is stored is not part of the export
+		if bytes.Contains(files["activities.json"], []byte("1/101.json")) {
+			t.Error("activities.json holds the storage location of the streams")
+		}
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		for id, name := range map[string]string{"101": "1/101.json", "102": "1/102.json"} {
+			if string(files["streams/"+id+".json"]) != streams[name] {
+				t.Errorf("streams/%s.json = %s, want %s", id, files["streams/"+id+".json"], streams[name])
+			}
+		}
+	})
+
+	t.Run("geojson", func(t *testing.T) {
+		tracks := geoJSONFeatureCollection{}
+		if err := json.Unmarshal(files["activities.geojson"], &tracks); err != nil {
+			t.Fatal(err)
+		}
+		if tracks.Type != "FeatureCollection" || len(tracks.Features) != 1 {
+			t.Fatalf("activities.geojson = %+v, want a single track", tracks)
+		}
+		feature := tracks.Features[0]
+		// GeoJSON positions are longitude first
+		want := [][]float64{{-122.1, 37.1}, {-122.2, 37.2}}
+		if feature.Geometry.Type != "LineString" || !reflect.DeepEqual(feature.Geometry.Coordinates, want) {
+			t.Errorf("geometry = %+v, want %v", feature.Geometry, want)
+		}
+		if feature.Properties["activity_id"] != float64(101) || feature.Properties["sport_type"] != "Ride" {
+			t.Errorf("properties = %v", feature.Properties)
+		}
+	})
+
+	t.Run("map builds", func(t *testing.T) {
+		got := mapBuilds{}
+		if err := json.Unmarshal(files["map_builds.json"], &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.State == nil || *got.State != "Done" || got.Map == nil || got.Map.MapID != "map" || got.Map.Tiles != 12 {
+			t.Errorf("map_builds.json = %s", files["map_builds.json"])
+		}
+	})
+}
+
+func TestAssembleArchiveEmpty(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewFilesystemBlobstore(ctx, "activities", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an athlete without activities or a map still gets every file
+	buf := &bytes.Buffer{}
+	if _, err := assembleArchive(ctx, store, []strava.ActivityMetadata{}, &mapBuilds{}, buf); err != nil {
+		t.Fatal(err)
+	}
+	names, files := readArchive(t, buf.Bytes())
+	if want := []string{"README.txt", "activities.csv", "activities.json", "activities.geojson", "map_builds.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("archive holds %v, want %v", names, want)
+	}
+	if string(files["map_builds.json"]) != "{\n  \"sync_state\": null,\n  \"map\": null\n}" {
+		t.Errorf("map_builds.json = %s", files["map_builds.json"])
+	}
+
+	// streams that cannot be read fail the export rather than leave a gap
+	missing := []strava.ActivityMetadata{{ActivityID: 1, DataRef: "1/1.json"}}
+	if _, err := assembleArchive(ctx, store, missing, &mapBuilds{}, &bytes.Buffer{}); err == nil {
+		t.Error("assembleArchive() with missing streams did not fail")
+	}
+}
@@ -0,0 +1,52 @@
+package takeout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadLink returns the value that identifies an export in its download
+// link. It is signed and expires with the export, so the archive can be
+// fetched without a session, i.e., by a download manager
+func (t TakeoutService) DownloadLink(export *Export) (string, error) {
+	if export.Status != StatusReady || export.ExpiresAt == nil {
+		return "", ErrorExportNotFound
+	}
+
+	payload := fmt.Sprintf("%s.%d", export.ID, export.ExpiresAt.Unix())
+	return payload + "." + t.signLink(payload), nil
+}
+
+func (t TakeoutService) signLink(payload string) string {
+	mac := hmac.New(sha256.New, t.linkKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkLink returns the ID of the export behind a download link
+func (t TakeoutService) checkLink(link string) (string, error) {
+	i := strings.LastIndex(link, ".")
+	if i < 0 {
+		return "", ErrorExportNotFound
+	}
+
+	payload, signature := link[:i], link[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(t.signLink(payload))) {
+		return "", ErrorExportNotFound
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return "", ErrorExportNotFound
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !time.Now().Before(time.Unix(expires, 0)) {
+		return "", ErrorExportNotFound
+	}
+	return parts[0], nil
+}
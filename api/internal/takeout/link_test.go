@@ -0,0 +1,86 @@
+package takeout
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLink(t *testing.T) {
+	svc := TakeoutService{linkKey: []byte("secret")}
+	other := TakeoutService{linkKey: []byte("another secret")}
+
+	link := func(svc TakeoutService, id string, expiresIn time.Duration) string {
+		t.Helper()
+		expiresAt := time.Now().Add(expiresIn)
+		l, err := svc.DownloadLink(&Export{ID: id, Status: StatusReady, ExpiresAt: &expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	valid := link(svc, "0b6e4f1c", time.Hour)
+	parts := strings.Split(valid, ".")
+	if len(parts) != 3 {
+		t.Fatalf("DownloadLink() = %q, want an ID, expiry and signature", valid)
+	}
+	signature := parts[2]
+	tampered := "A"
+	if strings.HasSuffix(valid, tampered) {
+		tampered = "B"
+	}
+	later := time.Now().Add(48 * time.Hour).Unix()
+
+	cases := []struct {
+		name string
+		link string
+		id   string
+	}{
+		{"valid", valid, "0b6e4f1c"},
+		{"expired", link(svc, "0b6e4f1c", -time.Second), ""},
+		{"extended", fmt.Sprintf("%s.%d.%s", parts[0], later, signature), ""},
+		{"another export", fmt.Sprintf("%s.%s.%s", "0b6e4f1d", parts[1], signature), ""},
+		{"tampered signature", valid[:len(valid)-1] + tampered, ""},
+		{"signed with another secret", link(other, "0b6e4f1c", time.Hour), ""},
+		{"no signature", parts[0] + "." + parts[1], ""},
+		{"extra field", "x." + valid, ""},
+		{"empty", "", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			id, err := svc.checkLink(c.link)
+			if c.id == "" {
+				if !errors.Is(err, ErrorExportNotFound) {
+					t.Errorf("checkLink() = %q, %v, want %v", id, err, ErrorExportNotFound)
+				}
+				return
+			}
+			if err != nil || id != c.id {
+				t.Errorf("checkLink() = %q, %v, want %q", id, err, c.id)
+			}
+		})
+	}
+}
+
+func TestDownloadLinkOfUnfinishedExport(t *testing.T) {
+	svc := TakeoutService{linkKey: []byte("secret")}
+	expiresAt := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		name   string
+		export Export
+	}{
+		{"pending", Export{ID: "a", Status: StatusPending}},
+		{"failed", Export{ID: "a", Status: StatusFailed, ExpiresAt: &expiresAt}},
+		{"ready without expiry", Export{ID: "a", Status: StatusReady}},
+	}
+
+	for _, c := range cases {
+		if link, err := svc.DownloadLink(&c.export); !errors.Is(err, ErrorExportNotFound) {
+			t.Errorf("%s: DownloadLink() = %q, %v, want %v", c.name, link, err, ErrorExportNotFound)
+		}
+	}
+}
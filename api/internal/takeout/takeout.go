@@ -0,0 +1,414 @@
+// Package takeout exports the data kept about an athlete, so they can download
+// it. Exports are built in the background and kept in storage until they
+// expire
+package takeout
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/jackc/pgx/v4"
+	"github.com/nmiodice/personal-strava-heatmap/internal/database"
+	"github.com/nmiodice/personal-strava-heatmap/internal/maps"
+	"github.com/nmiodice/personal-strava-heatmap/internal/state"
+	"github.com/nmiodice/personal-strava-heatmap/internal/storage"
+	"github.com/nmiodice/personal-strava-heatmap/internal/strava"
+)
+
+// exports that are still pending after this long were abandoned, i.e., because
+// the instance building them restarted
+const staleAfter = time.Hour
+
+// Status is how far an export got
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusReady   Status = "ready"
+	StatusFailed  Status = "failed"
+)
+
+var (
+	ErrorExportNotFound = errors.New("export is unknown or expired")
+)
+
+// Export is a request of an athlete for their data
+type Export struct {
+	ID          string
+	AthleteID   int
+	Status      Status
+	SizeBytes   int64
+	RequestedAt time.Time
+	CompletedAt *time.Time
+	// set once the export is ready. The archive is deleted after this
+	ExpiresAt *time.Time
+	Error     *string
+}
+
+func (e Export) objectName() string {
+	return fmt.Sprintf("%s%s.zip", athletePrefix(e.AthleteID), e.ID)
+}
+
+func athletePrefix(athleteID int) string {
+	return fmt.Sprintf("takeout/%d/", athleteID)
+}
+
+type TakeoutService struct {
+	db        *database.DB
+	stravaSvc *strava.StravaService
+	mapSvc    *maps.MapService
+	stateSvc  state.StateService
+	// the activity storage, whose objects are encrypted. Archives are kept
+	// there too, since they hold the same data
+	storage storage.Blobstore
+	// how long an archive can be downloaded after it is built
+	ttl     time.Duration
+	linkKey []byte
+}
+
+// NewTakeoutService creates the service that exports the data of athletes.
+// Download links are signed with the link secret, which must be the same on
+// every instance
+func NewTakeoutService(db *database.DB, stravaSvc *strava.StravaService, mapSvc *maps.MapService, stateSvc state.StateService, storageClient storage.Blobstore, ttl time.Duration, linkSecret string) (*TakeoutService, error) {
+	linkKey := []byte(linkSecret)
+	if linkSecret == "" {
+		log.Printf("no takeout link secret configured, download links only work on this instance until it restarts")
+		linkKey = make([]byte, 32)
+		if _, err := rand.Read(linkKey); err != nil {
+			return nil, fmt.Errorf("generating takeout link secret: %w", err)
+		}
+	}
+
+	return &TakeoutService{
+		db:        db,
+		stravaSvc: stravaSvc,
+		mapSvc:    mapSvc,
+		stateSvc:  stateSvc,
+		storage:   storageClient,
+		ttl:       ttl,
+		linkKey:   linkKey,
+	}, nil
+}
+
+// Request records an export for an athlete, or returns the one that is being
+// built. It also returns true if the export is new, in which case it must be
+// built by the caller
+func (t TakeoutService) Request(ctx context.Context, athleteID int) (*Export, bool, error) {
+	var export *Export
+	created := false
+	err := t.db.InTx(ctx, pgx.Serializable, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, insertExportSQL, athleteID)
+		if err != nil {
+			return err
+		}
+		created = tag.RowsAffected() == 1
+
+		export, err = scanExport(tx.QueryRow(ctx, getPendingExportSQL, athleteID))
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("recording export for athlete: %w, %d", err, athleteID)
+	}
+	return export, created, nil
+}
+
+// Build assembles the archive of an export and stores it. The archive is
+// uploaded as it is assembled, so it is never held in memory. A failed export
+// is recorded, so the athlete can see it failed and ask again
+func (t TakeoutService) Build(ctx context.Context, export *Export) error {
+	size, err := t.storeArchive(ctx, export)
+	if err != nil {
+		failure := err.Error()
+		if recordErr := t.markFailed(ctx, export.ID, failure); recordErr != nil {
+			log.Printf("error recording failed export for athlete '%d': %+v", export.AthleteID, recordErr)
+		}
+		export.Status = StatusFailed
+		export.Error = &failure
+		return fmt.Errorf("building export for athlete '%d': %w", export.AthleteID, err)
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(t.ttl)
+	err = t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, markReadySQL, export.ID, size, now, expiresAt)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("recording export for athlete: %w, %d", err, export.AthleteID)
+	}
+
+	export.Status = StatusReady
+	export.SizeBytes = size
+	export.CompletedAt = &now
+	export.ExpiresAt = &expiresAt
+	log.Printf("built export of '%d' bytes for athlete '%d'", size, export.AthleteID)
+	return nil
+}
+
+// storeArchive writes the archive of an export to storage and returns its size
+func (t TakeoutService) storeArchive(ctx context.Context, export *Export) (int64, error) {
+	pr, pw := io.Pipe()
+	var size int64
+	var archiveErr error
+	done := make(chan struct{})
+	go func() {
+		size, archiveErr = t.writeArchive(ctx, export.AthleteID, pw)
+		pw.CloseWithError(archiveErr)
+		close(done)
+	}()
+
+	err := t.storage.CreateObjectFrom(ctx, export.objectName(), pr)
+	// stops the archive if the upload failed before reading all of it
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+
+	if archiveErr != nil && !errors.Is(archiveErr, io.ErrClosedPipe) {
+		return 0, archiveErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (t TakeoutService) markFailed(ctx context.Context, id string, failure string) error {
+	return t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, markFailedSQL, id, failure)
+		return err
+	})
+}
+
+// Latest returns the newest export of an athlete that has not expired, or nil
+// if there is none
+func (t TakeoutService) Latest(ctx context.Context, athleteID int) (*Export, error) {
+	var export *Export
+	err := t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		var err error
+		export, err = scanExport(tx.QueryRow(ctx, getLatestExportSQL, athleteID, time.Now().UTC()))
+		if err == pgx.ErrNoRows {
+			export = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching export for athlete: %w, %d", err, athleteID)
+	}
+	return export, nil
+}
+
+// Open returns the archive behind a download link, which is read as it is
+// downloaded. The archive must be closed
+func (t TakeoutService) Open(ctx context.Context, link string) (*Export, io.ReadCloser, error) {
+	id, err := t.checkLink(link)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var export *Export
+	err = t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		var err error
+		export, err = scanExport(tx.QueryRow(ctx, getReadyExportSQL, id, time.Now().UTC()))
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrorExportNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching export: %w, %s", err, id)
+	}
+
+	archive, err := t.storage.GetObjectReader(ctx, export.objectName())
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading export: %w, %s", err, id)
+	}
+	return export, archive, nil
+}
+
+// DeleteExpired removes exports that can no longer be downloaded, and gives up
+// on exports that were abandoned while being built
+func (t TakeoutService) DeleteExpired(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	err := t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, markAbandonedSQL, now.Add(-staleAfter))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("marking abandoned exports: %w", err)
+	}
+
+	expired := []*Export{}
+	err = t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, getExpiredExportsSQL, now, now.Add(-t.ttl))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			export, err := scanExport(rows)
+			if err != nil {
+				return err
+			}
+			expired = append(expired, export)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("fetching expired exports: %w", err)
+	}
+
+	var errors *multierror.Error
+	deleted := 0
+	for _, export := range expired {
+		if export.Status == StatusReady {
+			if err := t.storage.DeleteObject(ctx, export.objectName()); err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+		}
+		if err := t.deleteExport(ctx, export.ID); err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, errors.ErrorOrNil()
+}
+
+func (t TakeoutService) deleteExport(ctx context.Context, id string) error {
+	return t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, deleteExportSQL, id)
+		return err
+	})
+}
+
+// DeleteForAthlete removes every export of an athlete, and returns how many
+// archives were deleted
+func (t TakeoutService) DeleteForAthlete(ctx context.Context, athleteID int) (int, error) {
+	names, err := t.storage.ListObjects(ctx, athletePrefix(athleteID))
+	if err != nil {
+		return 0, fmt.Errorf("listing exports of athlete: %w, %d", err, athleteID)
+	}
+
+	deleted := 0
+	for _, name := range names {
+		if err := t.storage.DeleteObject(ctx, name); err != nil {
+			return deleted, fmt.Errorf("deleting export of athlete: %w, %d", err, athleteID)
+		}
+		deleted++
+	}
+
+	err = t.db.InTx(ctx, pgx.ReadCommitted, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, deleteExportsForAthleteSQL, athleteID)
+		return err
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("deleting exports of athlete: %w, %d", err, athleteID)
+	}
+	return deleted, nil
+}
+
+func scanExport(row pgx.Row) (*Export, error) {
+	export := &Export{}
+	status := ""
+	err := row.Scan(
+		&export.ID, &export.AthleteID, &status, &export.SizeBytes,
+		&export.RequestedAt, &export.CompletedAt, &export.ExpiresAt, &export.Error)
+	export.Status = Status(status)
+	return export, err
+}
+
+var insertExportSQL = `
+INSERT INTO
+	TakeoutExport
+	(athlete_id)
+VALUES
+	($1)
+ON CONFLICT
+	(athlete_id) WHERE status = 'pending'
+	DO NOTHING
+`
+
+var exportColumnsSQL = `
+	id::TEXT, athlete_id, status, size_bytes,
+	requested_at, completed_at, expires_at, error
+`
+
+var getPendingExportSQL = `
+SELECT` + exportColumnsSQL + `FROM
+	TakeoutExport
+WHERE
+	athlete_id = $1 AND status = 'pending'
+`
+
+var getLatestExportSQL = `
+SELECT` + exportColumnsSQL + `FROM
+	TakeoutExport
+WHERE
+	athlete_id = $1 AND (expires_at IS NULL OR expires_at > $2)
+ORDER BY
+	requested_at DESC
+LIMIT 1
+`
+
+var getReadyExportSQL = `
+SELECT` + exportColumnsSQL + `FROM
+	TakeoutExport
+WHERE
+	id::TEXT = $1 AND status = 'ready' AND expires_at > $2
+`
+
+var getExpiredExportsSQL = `
+SELECT` + exportColumnsSQL + `FROM
+	TakeoutExport
+WHERE
+	(status = 'ready' AND expires_at <= $1) OR (status = 'failed' AND requested_at <= $2)
+`
+
+var markReadySQL = `
+UPDATE
+	TakeoutExport
+SET
+	status = 'ready', size_bytes = $2, completed_at = $3, expires_at = $4
+WHERE
+	id = $1
+`
+
+var markFailedSQL = `
+UPDATE
+	TakeoutExport
+SET
+	status = 'failed', completed_at = NOW(), error = $2
+WHERE
+	id = $1
+`
+
+var markAbandonedSQL = `
+UPDATE
+	TakeoutExport
+SET
+	status = 'failed', completed_at = NOW(), error = 'export was abandoned'
+WHERE
+	status = 'pending' AND requested_at <= $1
+`
+
+var deleteExportSQL = `
+DELETE FROM
+	TakeoutExport
+WHERE
+	id = $1
+`
+
+var deleteExportsForAthleteSQL = `
+DELETE FROM
+	TakeoutExport
+WHERE
+	athlete_id = $1
+`
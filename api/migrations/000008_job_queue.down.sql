@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE JobQueueDeadLetter;
+DROP TABLE JobQueue;
+
+END;
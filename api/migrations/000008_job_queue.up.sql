@@ -0,0 +1,28 @@
+BEGIN;
+
+CREATE TABLE JobQueue (
+	id         BIGSERIAL PRIMARY KEY,
+	queue_name VARCHAR(100) NOT NULL,
+	payload    JSONB NOT NULL,
+	attempts   INT NOT NULL DEFAULT 0,
+	visible_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	-- set when a message is dequeued. Only the consumer holding the lease can
+	-- complete or release the message, so a consumer whose visibility timeout
+	-- expired cannot act on a message another consumer has claimed since
+	lease      TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX job_queue_visible_idx ON JobQueue (queue_name, visible_at);
+
+CREATE TABLE JobQueueDeadLetter (
+	id         BIGINT PRIMARY KEY,
+	queue_name VARCHAR(100) NOT NULL,
+	payload    JSONB NOT NULL,
+	attempts   INT NOT NULL,
+	last_error TEXT,
+	created_at TIMESTAMP NOT NULL,
+	failed_at  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+END;
@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE
+    StravaActivity
+DROP COLUMN
+    sport_type,
+DROP COLUMN
+    start_date;
+
+END;
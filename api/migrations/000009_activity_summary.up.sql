@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE
+    StravaActivity
+ADD COLUMN
+    sport_type TEXT,
+ADD COLUMN
+    start_date TIMESTAMP;
+
+END;
@@ -0,0 +1,11 @@
+BEGIN;
+
+CREATE TABLE MapZoomVisits (
+	map_id     uuid NOT NULL,
+	zoom       INT NOT NULL,
+	max_visits INT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (map_id, zoom)
+);
+
+END;
@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE TABLE MapPyramidLevel (
+	map_id     uuid NOT NULL,
+	zoom       INT NOT NULL,
+	batches    JSONB NOT NULL,
+	enqueued   BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (map_id, zoom)
+);
+
+END;
@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE
+    AthleteMap
+DROP COLUMN
+    built_through;
+
+ALTER TABLE
+    StravaActivity
+DROP COLUMN
+    synced_at;
+
+END;
@@ -0,0 +1,20 @@
+BEGIN;
+
+ALTER TABLE
+    StravaActivity
+ADD COLUMN
+    synced_at TIMESTAMP;
+
+UPDATE
+    StravaActivity
+SET
+    synced_at = NOW()
+WHERE
+    activity_data_ref IS NOT NULL AND activity_data_ref <> '';
+
+ALTER TABLE
+    AthleteMap
+ADD COLUMN
+    built_through TIMESTAMP;
+
+END;
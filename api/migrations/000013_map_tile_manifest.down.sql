@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP TABLE
+  MapTile
+;
+
+END;
@@ -0,0 +1,18 @@
+BEGIN;
+
+CREATE TABLE MapTile (
+	map_id uuid NOT NULL,
+	z      INT NOT NULL,
+	x      INT NOT NULL,
+	y      INT NOT NULL,
+	PRIMARY KEY (map_id, z, x, y)
+);
+
+-- existing maps are rebuilt in full on their next update, which records their
+-- tile manifest
+UPDATE
+    AthleteMap
+SET
+    built_through = NULL;
+
+END;
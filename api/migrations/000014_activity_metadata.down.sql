@@ -0,0 +1,28 @@
+BEGIN;
+
+ALTER TABLE
+    StravaActivity
+DROP COLUMN
+    name,
+DROP COLUMN
+    distance,
+DROP COLUMN
+    moving_time,
+DROP COLUMN
+    total_elevation_gain,
+DROP COLUMN
+    visibility,
+DROP COLUMN
+    private,
+DROP COLUMN
+    gear_id,
+DROP COLUMN
+    trainer,
+DROP COLUMN
+    manual,
+DROP COLUMN
+    summary_polyline,
+DROP COLUMN
+    updated_at;
+
+END;
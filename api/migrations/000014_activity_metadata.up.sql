@@ -0,0 +1,28 @@
+BEGIN;
+
+ALTER TABLE
+    StravaActivity
+ADD COLUMN
+    name TEXT,
+ADD COLUMN
+    distance DOUBLE PRECISION,
+ADD COLUMN
+    moving_time INT,
+ADD COLUMN
+    total_elevation_gain DOUBLE PRECISION,
+ADD COLUMN
+    visibility TEXT,
+ADD COLUMN
+    private BOOLEAN,
+ADD COLUMN
+    gear_id TEXT,
+ADD COLUMN
+    trainer BOOLEAN,
+ADD COLUMN
+    manual BOOLEAN,
+ADD COLUMN
+    summary_polyline TEXT,
+ADD COLUMN
+    updated_at TIMESTAMP;
+
+END;
@@ -0,0 +1,10 @@
+BEGIN;
+
+CREATE TABLE AthleteSyncCursor (
+	athlete_id        int PRIMARY KEY,
+	latest_start_date TIMESTAMP,
+	full_sync_at      TIMESTAMP,
+	updated_at        TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+END;
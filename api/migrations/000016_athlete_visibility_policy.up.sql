@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE AthleteSettings (
+	athlete_id        int PRIMARY KEY,
+	visibility_policy TEXT NOT NULL DEFAULT 'public',
+	updated_at        TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- existing maps were built from every activity and are rebuilt in full on
+-- their next update, which applies the visibility policy
+UPDATE
+    AthleteMap
+SET
+    built_through = NULL;
+
+END;
@@ -0,0 +1,16 @@
+BEGIN;
+
+-- sessions are looked up by a hash of their token, so the table cannot be used
+-- to log in as an athlete
+CREATE TABLE Session (
+	token_hash TEXT PRIMARY KEY,
+	athlete_id INT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	renewed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX session_athlete_id_idx ON Session (athlete_id);
+CREATE INDEX session_expires_at_idx ON Session (expires_at);
+
+END;
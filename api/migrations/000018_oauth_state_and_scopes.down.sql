@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE
+  AthleteScope
+;
+
+DROP TABLE
+  UsedOAuthState
+;
+
+END;
@@ -0,0 +1,17 @@
+BEGIN;
+
+-- login states are signed rather than stored when issued. They are recorded
+-- here once used, so that they cannot be used again before they expire
+CREATE TABLE UsedOAuthState (
+	nonce      TEXT PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);
+
+-- scopes granted by an athlete the last time they logged in
+CREATE TABLE AthleteScope (
+	athlete_id int PRIMARY KEY,
+	scopes     TEXT NOT NULL,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+END;
@@ -0,0 +1,26 @@
+BEGIN;
+
+-- the columns cannot go back to VARCHAR(500) while they hold encrypted values,
+-- which the code before this migration cannot read
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM StravaToken WHERE access_token LIKE 'enc:%' OR refresh_token LIKE 'enc:%') THEN
+		RAISE EXCEPTION 'StravaToken holds encrypted tokens, which cannot be rolled back';
+	END IF;
+	IF EXISTS (SELECT 1 FROM StravaActivity WHERE data_key_id IS NOT NULL) THEN
+		RAISE EXCEPTION 'StravaActivity references encrypted activity data, which cannot be rolled back';
+	END IF;
+END
+$$;
+
+ALTER TABLE StravaActivity
+	DROP COLUMN data_key_id;
+
+ALTER TABLE StravaToken
+	DROP CONSTRAINT stravatoken_access_token_hash_key,
+	DROP COLUMN access_token_hash,
+	ADD CONSTRAINT stravatoken_access_token_key UNIQUE (access_token),
+	ALTER COLUMN access_token TYPE VARCHAR(500),
+	ALTER COLUMN refresh_token TYPE VARCHAR(500);
+
+END;
@@ -0,0 +1,25 @@
+BEGIN;
+
+-- encrypted tokens differ on every write, so tokens are looked up by a hash of
+-- the access token instead
+ALTER TABLE StravaToken
+	ALTER COLUMN access_token TYPE TEXT,
+	ALTER COLUMN refresh_token TYPE TEXT,
+	ADD COLUMN access_token_hash TEXT;
+
+UPDATE
+	StravaToken
+SET
+	access_token_hash = encode(sha256(convert_to(access_token, 'UTF8')), 'hex');
+
+ALTER TABLE StravaToken
+	ALTER COLUMN access_token_hash SET NOT NULL,
+	DROP CONSTRAINT stravatoken_access_token_key,
+	ADD CONSTRAINT stravatoken_access_token_hash_key UNIQUE (access_token_hash);
+
+-- key that the stored data of an activity was encrypted with, NULL if it is not
+-- encrypted
+ALTER TABLE StravaActivity
+	ADD COLUMN data_key_id TEXT;
+
+END;
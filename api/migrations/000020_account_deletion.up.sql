@@ -0,0 +1,24 @@
+BEGIN;
+
+-- a request to delete the data of an athlete. Each step records when it
+-- finished, so a deletion that failed part way through resumes where it
+-- stopped. Finished deletions are kept as an audit trail
+CREATE TABLE AccountDeletion (
+	id                SERIAL PRIMARY KEY,
+	athlete_id        INT NOT NULL,
+	map_id            uuid,
+	source            TEXT NOT NULL,
+	requested_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+	revoked_at        TIMESTAMP,
+	data_deleted_at   TIMESTAMP,
+	completed_at      TIMESTAMP,
+	activities_purged INT NOT NULL DEFAULT 0,
+	tiles_purged      INT NOT NULL DEFAULT 0,
+	failures          INT NOT NULL DEFAULT 0,
+	last_error        TEXT
+);
+
+-- an athlete has at most one deletion in progress
+CREATE UNIQUE INDEX accountdeletion_pending_idx ON AccountDeletion (athlete_id) WHERE completed_at IS NULL;
+
+END;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- an export of the data of an athlete. The archive is kept in storage until the
+-- export expires
+CREATE TABLE TakeoutExport (
+	id           uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+	athlete_id   INT NOT NULL,
+	status       TEXT NOT NULL DEFAULT 'pending',
+	size_bytes   BIGINT NOT NULL DEFAULT 0,
+	requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	completed_at TIMESTAMP,
+	expires_at   TIMESTAMP,
+	error        TEXT
+);
+
+-- an athlete has at most one export being built
+CREATE UNIQUE INDEX takeoutexport_pending_idx ON TakeoutExport (athlete_id) WHERE status = 'pending';
+
+END;
@@ -0,0 +1,11 @@
+BEGIN;
+
+-- webhook subscriptions created by this application. Events that name another
+-- subscription did not come from Strava and are dropped
+CREATE TABLE WebhookSubscription (
+	id           INT PRIMARY KEY,
+	callback_url TEXT NOT NULL,
+	created_at   TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+END;
@@ -6,13 +6,10 @@ $( document ).ready(function() {
 
 
 function refreshStatus() {
-    // token = localStorage.getItem('api-token')
-    params = new URLSearchParams(window.location.search);
-    token = params.get('token')
-    
+    // the session cookie identifies the athlete
     $.ajax({
         type: "GET",  
-        url: "processingstate?token=" + token,
+        url: "processingstate",
         success: function(data){  
             getStateHandlerFunc(data.athlete_state)(data.athlete_state, data.map_state)
         },
@@ -23,6 +20,11 @@ function refreshStatus() {
 }
 
 function getStateHandlerFunc(athlete_state) {
+    // the state may carry the time the rate limit resets
+    if (athlete_state.state.startsWith('RateLimited')) {
+        return handleRateLimitedState
+    }
+
     switch (athlete_state.state) {
         case 'ImportingActivities':
             return handleImportingActivitiesState
@@ -32,6 +34,8 @@ function getStateHandlerFunc(athlete_state) {
             return handleComputingMapParamsState
         case 'ProcessingMap':
             return handleProcessingMapState
+        case 'MissingActivityScope':
+            return handleMissingActivityScopeState
         default:
             return handleAllOtherStates
     }
@@ -73,6 +77,23 @@ function handleProcessingMapState(athlete_state, map_state) {
     $('#status_text').html('Rebuilding - ' + completePercent + '% complete. May be slow at first but will speed up. Move around or refresh to see updates.')
 }
 
+function handleMissingActivityScopeState(athlete_state, map_state) {
+    clearInterval(window.refreshTimer)
+    $('#status_icon').attr('src', '/static/icons/refresh_black_48dp.png')
+    $('#status_text').html('Your activities could not be read. <a href="/?reauthorize=activity" style="color:#FC4C02;">Allow access</a> to draw your map.')
+}
+
+function handleRateLimitedState(athlete_state, map_state) {
+    clearInterval(window.refreshTimer)
+    parts = athlete_state.state.split('::')
+    resumes = 'once Strava allows it'
+    if (parts.length > 1) {
+        resumes = 'after ' + new Date(parts[1]).toLocaleTimeString()
+    }
+    $('#status_icon').attr('src', '/static/icons/queue_black_48dp.png')
+    $('#status_text').html('Strava is limiting requests, so some of your activities were put off. They will be synced by the first hourly sync ' + resumes + '.')
+}
+
 function handleAllOtherStates(athlete_state, map_state) {
     $('#athlete_status').html('Something may have gone wrong: ' + athlete_state.state)
 }
\ No newline at end of file
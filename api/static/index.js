@@ -9,11 +9,14 @@ function loginCallbackURL() {
     return location.protocol + '//' + location.host + '/tokenexchange'
 }
 
+// the scope, prompt and state are chosen by the backend, which checks the state
+// when Strava redirects back
 function stravaLogin() {
-    window.location = "https://www.strava.com/oauth/authorize" + 
-        "?scope=" + encodeURIComponent('activity:read') +
+    window.location = ($( '#strava_authorize_url' )[0].value || "https://www.strava.com/oauth/authorize") +
+        "?scope=" + encodeURIComponent($( '#strava_scope' )[0].value) +
         "&client_id=" + encodeURIComponent($( '#strava_client_id' )[0].value) +
         "&redirect_uri=" + encodeURIComponent(loginCallbackURL()) +
         "&response_type=" + encodeURIComponent('code') +
-        "&approval_prompt=" + encodeURIComponent('auto')
+        "&approval_prompt=" + encodeURIComponent($( '#approval_prompt' )[0].value) +
+        "&state=" + encodeURIComponent($( '#oauth_state' )[0].value)
 }
@@ -9,21 +9,49 @@ function resetWindowParams() {
 class CoordMapType {
   constructor(tileSize) {
     this.tileSize = tileSize;
+    this.densitySuffix = tileDensitySuffix()
+    this.lazyZoom = Number($('#lazy_tile_zoom').val())
   }
   getTile(coord, zoom, ownerDocument) {
     const img = ownerDocument.createElement("img");
     const endpoint = $('#tile_endpoint')[0].value
     const map_id = $('#map_id')[0].value
-    const tile_name = '-' + coord.x + '-' + coord.y + '-' + zoom + '.png'
+    const tile_name = '-' + coord.x + '-' + coord.y + '-' + zoom + this.densitySuffix + '.png'
 
     img.onerror = "this.style.display='none';"
     img.alt = ""
-    img.src = endpoint + map_id + tile_name
+    img.width = this.tileSize.width
+    img.height = this.tileSize.height
+    if (this.lazyZoom > 0 && zoom >= this.lazyZoom) {
+      // rendered by the backend the first time it is requested
+      img.src = '/tiles/' + map_id + '/' + zoom + '/' + coord.x + '/' + coord.y + this.densitySuffix + '.png'
+    } else {
+      img.src = endpoint + map_id + tile_name
+    }
     return img
   }
   releaseTile(tile) { }
 }
 
+/**
+ * Picks the smallest available tile density that covers the screen's pixel
+ * ratio, or the largest one if none do. Returns the tile name suffix for it
+ */
+function tileDensitySuffix() {
+  const available = $('#tile_densities').val().split(',').map(Number).sort(function (a, b) { return a - b })
+  const wanted = window.devicePixelRatio || 1
+
+  let density = available[available.length - 1]
+  for (const d of available) {
+    if (d >= wanted) {
+      density = d
+      break
+    }
+  }
+
+  return density > 1 ? '@' + density + 'x' : ''
+}
+
 /**
 * Initialize map
 */
@@ -34,6 +62,7 @@ function initMap() {
   configureLocationButtonListener()
   configureShareButtonVisibility()
   configureShareButtonListener()
+  configureTakeoutButtonListener()
   applyMapOverlay()
   triggerGPSEnablement()
 }
@@ -61,6 +90,42 @@ function configureShareButtonListener() {
   })
 }
 
+// the export is built in the background, so its status is polled until it can
+// be downloaded
+function configureTakeoutButtonListener() {
+  $('#takeout_button').click(function () {
+    $('#takeout_button').prop('disabled', true)
+    $.post("/takeout", function () {
+      showToast("Preparing your data, the download will start when it is ready")
+      pollTakeoutStatus()
+    })
+      .fail(function () {
+        $('#takeout_button').prop('disabled', false)
+        showToast("Unable to export your data ¯\\_(ツ)_/¯")
+      })
+  })
+}
+
+function pollTakeoutStatus() {
+  $.get("/takeout", function (response) {
+    if (response.status == "pending") {
+      setTimeout(pollTakeoutStatus, 3000)
+      return
+    }
+
+    $('#takeout_button').prop('disabled', false)
+    if (response.status == "ready") {
+      window.location.href = response.download_url
+    } else {
+      showToast("Unable to export your data ¯\\_(ツ)_/¯")
+    }
+  })
+    .fail(function () {
+      $('#takeout_button').prop('disabled', false)
+      showToast("Unable to export your data ¯\\_(ツ)_/¯")
+    })
+}
+
 function toHref(url) {
   return "<a href=\"" + url + "\" style=\"color:#FC4C02;\" target=\"_blank\">" + url + "</a>"
 }
@@ -8,7 +8,7 @@ from typing import List, Optional
 import azure.functions as func
 
 from .main import (Args, BoundingBox, DBConfig, ProcessingParam, StorageConfig,
-                   Tile, get_db_conn, run)
+                   Tile, get_db_conn, load_encryption_keys, run)
 
 
 def get_params_from_message(message: dict) -> List[ProcessingParam]:
@@ -56,7 +56,10 @@ def get_args(athlete_id: int, params: List[ProcessingParam]) -> Args:
             upload_container_name=os.environ['UPLOAD_STORAGE_CONTAINER_NAME'],
             account_name=os.environ['STORAGE_ACCOUNT_NAME'],
             account_key=os.environ['STORAGE_ACCOUNT_KEY'],
-            max_workers=int(os.environ['STORAGE_MAX_WORKERS'])
+            max_workers=int(os.environ['STORAGE_MAX_WORKERS']),
+            encryption_keys=load_encryption_keys(
+                os.environ.get('ENCRYPTION_KEYS', ''),
+                os.environ.get('ENCRYPTION_KEY_FILE', ''))
         )
     )
 
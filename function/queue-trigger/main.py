@@ -1,3 +1,4 @@
+import base64
 import concurrent
 import io
 import json
@@ -15,6 +16,7 @@ import numpy as np
 import PIL
 import psycopg2
 from azure.storage.blob import BlobServiceClient, ContentSettings
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
 from PIL import Image, ImageFilter
 from scipy.ndimage.filters import gaussian_filter
 
@@ -59,6 +61,8 @@ class StorageConfig:
     account_name: str
     account_key: str
     max_workers: int
+    # keys that activity data may be encrypted with, by ID
+    encryption_keys: Dict[str, bytes]
 
 
 @dataclass
@@ -145,11 +149,57 @@ def get_args() -> Args:
             upload_container_name=os.environ['UPLOAD_STORAGE_CONTAINER_NAME'],
             account_name=os.environ['STORAGE_ACCOUNT_NAME'],
             account_key=os.environ['STORAGE_ACCOUNT_KEY'],
-            max_workers=int(os.environ['STORAGE_MAX_WORKERS'])
+            max_workers=int(os.environ['STORAGE_MAX_WORKERS']),
+            encryption_keys=load_encryption_keys(
+                os.environ.get('ENCRYPTION_KEYS', ''),
+                os.environ.get('ENCRYPTION_KEY_FILE', ''))
         )
     )
 
 
+# layout of data encrypted by the backend, see api/internal/encryption
+ENVELOPE_MAGIC = b'HMENC1'
+NONCE_SIZE = 12
+WRAPPED_KEY_SIZE = NONCE_SIZE + 32 + 16
+
+
+def load_encryption_keys(keys: str, key_file: str) -> Dict[str, bytes]:
+    """Reads keys in the format of ENCRYPTION_KEYS and ENCRYPTION_KEY_FILE."""
+    pairs = keys.split(',')
+    if key_file:
+        with open(key_file) as f:
+            pairs.extend(line for line in f.read().splitlines()
+                         if not line.strip().startswith('#'))
+
+    parsed = {}
+    for pair in pairs:
+        pair = pair.strip()
+        if not pair:
+            continue
+        key_id, secret = pair.split(':', 1)
+        parsed[key_id] = base64.b64decode(secret)
+    return parsed
+
+
+def decrypt_activity(data: bytes, name: str, keys: Dict[str, bytes]) -> bytes:
+    """Decrypts activity data stored under name. Data that is not encrypted is
+    returned as it is."""
+    if not data.startswith(ENVELOPE_MAGIC):
+        return data
+
+    rest = data[len(ENVELOPE_MAGIC):]
+    key_id_size = rest[0]
+    key_id = rest[1:1 + key_id_size].decode('utf-8')
+    rest = rest[1 + key_id_size:]
+    if key_id not in keys:
+        raise ValueError('{} was encrypted with unknown key {}'.format(name, key_id))
+
+    data_key = AESGCM(keys[key_id]).decrypt(
+        rest[:NONCE_SIZE], rest[NONCE_SIZE:WRAPPED_KEY_SIZE], key_id.encode('utf-8'))
+    sealed = rest[WRAPPED_KEY_SIZE:]
+    return AESGCM(data_key).decrypt(sealed[:NONCE_SIZE], sealed[NONCE_SIZE:], name.encode('utf-8'))
+
+
 def get_db_conn(config: DBConfig) -> Any:
     return psycopg2.connect(
         host=config.host,
@@ -158,14 +208,39 @@ def get_db_conn(config: DBConfig) -> Any:
         password=config.password)
 
 
+# the activities of an athlete that their visibility policy allows on their map.
+# Keep in sync with visibleActivitySQL in api/internal/strava/athlete_db.go
+VISIBLE_ACTIVITY_REFS_SQL = """
+SELECT
+    activity_data_ref
+FROM
+    StravaActivity
+WHERE
+    athlete_id = %(athlete_id)s
+        AND
+    (activity_data_ref IS NOT NULL AND activity_data_ref <> '')
+        AND
+    (
+        CASE
+            COALESCE((SELECT visibility_policy FROM AthleteSettings WHERE athlete_id = %(athlete_id)s), 'public')
+        WHEN 'everything' THEN
+            TRUE
+        WHEN 'followers' THEN
+            COALESCE(visibility IN ('everyone', 'followers_only') AND NOT private, FALSE)
+        ELSE
+            COALESCE(visibility = 'everyone' AND NOT private, FALSE)
+        END
+    )
+"""
+
+
 def get_activity_refs(athlete_id: int, config: DBConfig) -> List[ActivityRef]:
     refs = []
     conn = None
     try:
         conn = get_db_conn(config)
         cur = conn.cursor()
-        cur.execute(
-            'SELECT activity_data_ref FROM stravaactivity WHERE athlete_id = %s AND activity_data_ref IS NOT NULL', (athlete_id,))
+        cur.execute(VISIBLE_ACTIVITY_REFS_SQL, {'athlete_id': athlete_id})
         row = cur.fetchone()
 
         while row is not None and len(row) == 1:
@@ -194,15 +269,16 @@ def download_activities(refs: List[ActivityRef],
             blob_client = service_client.get_blob_client(
                 config.download_container_name, ref.data_ref)
 
-            def __dl_func(client):
-                js_string = client.download_blob().readall()
+            def __dl_func(client, name):
+                js_string = decrypt_activity(
+                    client.download_blob().readall(), name, config.encryption_keys)
                 json_docs.append(json.loads(js_string))
                 downloaded = len(json_docs)
                 if downloaded % 20 == 0:
                     logging.info(
                         'downloaded {}/{} activities'.format(len(json_docs), len(refs)))
 
-            jobs.append(executor.submit(__dl_func, blob_client))
+            jobs.append(executor.submit(__dl_func, blob_client, ref.data_ref))
 
     concurrent.futures.as_completed(jobs)
     logging.info(